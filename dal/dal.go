@@ -1,12 +1,19 @@
 package dal
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"fmt"
 	"log"
 )
 
 var DB *sql.DB
 
+// FTS5 reports whether items can be searched through the items_fts full-text index.
+// go-sqlite3 only includes FTS5 when built with the sqlite_fts5 tag.
+var FTS5 bool
+
 func InitDB() {
 	var err error
 	DB, err = sql.Open("sqlite3", "./app.db")
@@ -52,6 +59,9 @@ func InitDB() {
 		('read_item', 'Ability to view items'),
 		('update_item', 'Ability to edit existing items'),
 		('delete_item', 'Ability to delete items'),
+		('share_item', 'Ability to share items with other users and roles'),
+		('comment_item', 'Ability to comment on items'),
+		('moderate_comments', 'Ability to delete comments written by other users'),
 		('manage_roles', 'Ability to manage roles and permissions');`
 
 	_, err = DB.Exec(createPermissionsTableSQL)
@@ -117,7 +127,7 @@ func InitDB() {
 	SELECT 
     	(SELECT id FROM roles WHERE name = 'user'),
     	id
-	FROM permissions WHERE name IN ('read_item', 'create_item', 'update_item', 'delete_item');`
+	FROM permissions WHERE name IN ('read_item', 'create_item', 'update_item', 'delete_item', 'share_item', 'comment_item');`
 
 	_, err = DB.Exec(createUsersTableSQL)
 	if err != nil {
@@ -139,14 +149,661 @@ func InitDB() {
 	CREATE INDEX IF NOT EXISTS idx_items_user_id ON items(user_id);
 	CREATE INDEX IF NOT EXISTS idx_items_name ON items(name);
 
-	CREATE TRIGGER IF NOT EXISTS update_items_timestamp 
+	-- Bump updated_at on every update that does not set it explicitly. The WHEN guard
+	-- keeps explicit values (and stops recursion when recursive triggers are enabled).
+	DROP TRIGGER IF EXISTS update_items_timestamp;
+	CREATE TRIGGER update_items_timestamp
 	AFTER UPDATE ON items
+	WHEN NEW.updated_at IS OLD.updated_at
 	BEGIN
 		UPDATE items SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
-	END;`
+	END;
+
+	-- Fill in timestamps inserted as NULL, which bypasses the column defaults
+	CREATE TRIGGER IF NOT EXISTS insert_items_timestamps
+	AFTER INSERT ON items
+	WHEN NEW.created_at IS NULL OR NEW.updated_at IS NULL
+	BEGIN
+		UPDATE items SET
+			created_at = COALESCE(NEW.created_at, CURRENT_TIMESTAMP),
+			updated_at = COALESCE(NEW.updated_at, NEW.created_at, CURRENT_TIMESTAMP)
+		WHERE id = NEW.id;
+	END;
+
+	UPDATE items SET created_at = COALESCE(created_at, updated_at, CURRENT_TIMESTAMP),
+		updated_at = COALESCE(updated_at, created_at, CURRENT_TIMESTAMP)
+	WHERE created_at IS NULL OR updated_at IS NULL;`
 
 	_, err = DB.Exec(createItemsTableSQL)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// Create item_shares table for per-item access grants
+	createItemSharesTableSQL := `CREATE TABLE IF NOT EXISTS item_shares (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		item_id INTEGER NOT NULL,
+		user_id INTEGER,
+		role_id INTEGER,
+		access_level VARCHAR(16) NOT NULL,
+		created_by INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (item_id) REFERENCES items(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE,
+		FOREIGN KEY (created_by) REFERENCES users(id),
+		CHECK (access_level IN ('viewer', 'editor', 'owner')),
+		CHECK ((user_id IS NULL) <> (role_id IS NULL))
+	);
+
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_item_shares_item_user ON item_shares(item_id, user_id);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_item_shares_item_role ON item_shares(item_id, role_id);
+	CREATE INDEX IF NOT EXISTS idx_item_shares_user_id ON item_shares(user_id);
+	CREATE INDEX IF NOT EXISTS idx_item_shares_role_id ON item_shares(role_id);`
+
+	_, err = DB.Exec(createItemSharesTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create organization tables for multi-tenancy
+	createOrganizationsTableSQL := `CREATE TABLE IF NOT EXISTS organizations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name VARCHAR(255) NOT NULL,
+		personal_user_id INTEGER UNIQUE,
+		created_by INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (personal_user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (created_by) REFERENCES users(id),
+		CHECK (LENGTH(name) > 0)
+	);
+
+	CREATE TRIGGER IF NOT EXISTS update_organizations_timestamp 
+	AFTER UPDATE ON organizations
+	BEGIN
+		UPDATE organizations SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+	END;
+
+	CREATE TABLE IF NOT EXISTS organization_members (
+		organization_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		role VARCHAR(16) NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (organization_id, user_id),
+		FOREIGN KEY (organization_id) REFERENCES organizations(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		CHECK (role IN ('owner', 'admin', 'member', 'viewer'))
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_organization_members_user_id ON organization_members(user_id);
+
+	CREATE TABLE IF NOT EXISTS organization_invitations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		organization_id INTEGER NOT NULL,
+		email VARCHAR(255) NOT NULL,
+		role VARCHAR(16) NOT NULL,
+		token_hash VARCHAR(64) NOT NULL UNIQUE,
+		invited_by INTEGER NOT NULL,
+		expires_at DATETIME NOT NULL,
+		accepted_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (organization_id) REFERENCES organizations(id) ON DELETE CASCADE,
+		FOREIGN KEY (invited_by) REFERENCES users(id),
+		CHECK (role IN ('admin', 'member', 'viewer'))
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_organization_invitations_org ON organization_invitations(organization_id);
+	CREATE INDEX IF NOT EXISTS idx_organization_invitations_email ON organization_invitations(email);`
+
+	_, err = DB.Exec(createOrganizationsTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = hashInvitationTokens(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Create tags tables; tags belong to an organization and are matched case-insensitively
+	createTagsTableSQL := `CREATE TABLE IF NOT EXISTS tags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		organization_id INTEGER NOT NULL,
+		name VARCHAR(50) NOT NULL COLLATE NOCASE,
+		created_by INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (organization_id) REFERENCES organizations(id) ON DELETE CASCADE,
+		FOREIGN KEY (created_by) REFERENCES users(id),
+		CHECK (LENGTH(name) > 0)
+	);
+
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_tags_organization_name ON tags(organization_id, name);
+
+	CREATE TABLE IF NOT EXISTS item_tags (
+		item_id INTEGER NOT NULL,
+		tag_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (item_id, tag_id),
+		FOREIGN KEY (item_id) REFERENCES items(id) ON DELETE CASCADE,
+		FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_item_tags_tag_id ON item_tags(tag_id);`
+
+	_, err = DB.Exec(createTagsTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Items belong to an organization
+	if err = addColumnIfMissing("items", "organization_id", "INTEGER REFERENCES organizations(id)"); err != nil {
+		log.Fatal(err)
+	}
+
+	// Items carry a version for optimistic concurrency control
+	if err = addColumnIfMissing("items", "version", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		log.Fatal(err)
+	}
+
+	// Deleted items stay in the trash until they are restored or purged
+	if err = addColumnIfMissing("items", "deleted_at", "DATETIME"); err != nil {
+		log.Fatal(err)
+	}
+	if err = addColumnIfMissing("items", "deleted_by", "INTEGER REFERENCES users(id)"); err != nil {
+		log.Fatal(err)
+	}
+	_, err = DB.Exec("CREATE INDEX IF NOT EXISTS idx_items_deleted_at ON items(deleted_at)")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Custom attributes of items as a JSON object, described by the organization's item_fields
+	if err = addColumnIfMissing("items", "attributes", "TEXT NOT NULL DEFAULT '{}'"); err != nil {
+		log.Fatal(err)
+	}
+
+	// Create item_fields table for the custom fields an organization defines for its items
+	createItemFieldsTableSQL := `CREATE TABLE IF NOT EXISTS item_fields (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		organization_id INTEGER NOT NULL,
+		name VARCHAR(50) NOT NULL,
+		type VARCHAR(20) NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		required BOOLEAN NOT NULL DEFAULT 0,
+		enum TEXT,
+		min REAL,
+		max REAL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (organization_id) REFERENCES organizations(id) ON DELETE CASCADE
+	);
+
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_item_fields_organization_name ON item_fields(organization_id, name);`
+
+	_, err = DB.Exec(createItemFieldsTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create attachments table for files uploaded to items. The content lives in blob
+	// storage, once per distinct SHA-256, so identical uploads share a blob.
+	createAttachmentsTableSQL := `CREATE TABLE IF NOT EXISTS blobs (
+		sha256 CHAR(64) PRIMARY KEY,
+		size INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS attachments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		item_id INTEGER NOT NULL,
+		filename VARCHAR(255) NOT NULL,
+		content_type VARCHAR(255) NOT NULL,
+		size INTEGER NOT NULL,
+		sha256 CHAR(64) NOT NULL,
+		uploaded_by INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (item_id) REFERENCES items(id) ON DELETE CASCADE,
+		FOREIGN KEY (sha256) REFERENCES blobs(sha256),
+		FOREIGN KEY (uploaded_by) REFERENCES users(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_attachments_item_id ON attachments(item_id);
+	CREATE INDEX IF NOT EXISTS idx_attachments_sha256 ON attachments(sha256);`
+
+	_, err = DB.Exec(createAttachmentsTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create comments table for discussions on items. Replies point to the comment that
+	// starts their thread; body_html is the rendered body with mentions resolved.
+	createCommentsTableSQL := `CREATE TABLE IF NOT EXISTS comments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		item_id INTEGER NOT NULL,
+		parent_id INTEGER,
+		user_id INTEGER,
+		body TEXT NOT NULL,
+		body_html TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		edited_at DATETIME,
+		deleted_at DATETIME,
+		FOREIGN KEY (item_id) REFERENCES items(id) ON DELETE CASCADE,
+		FOREIGN KEY (parent_id) REFERENCES comments(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_comments_item_id ON comments(item_id, parent_id);
+	CREATE INDEX IF NOT EXISTS idx_comments_parent_id ON comments(parent_id);
+
+	CREATE TABLE IF NOT EXISTS comment_mentions (
+		comment_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		PRIMARY KEY (comment_id, user_id),
+		FOREIGN KEY (comment_id) REFERENCES comments(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_comment_mentions_user_id ON comment_mentions(user_id);`
+
+	_, err = DB.Exec(createCommentsTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Items move through the states of their organization's workflow. Organizations
+	// without one use the built-in workflow, which starts in "open".
+	if err = addColumnIfMissing("items", "status", "VARCHAR(50) NOT NULL DEFAULT 'open'"); err != nil {
+		log.Fatal(err)
+	}
+
+	// Create workflows table for the state machines organizations configure, and
+	// item_transitions for the history of item statuses
+	createWorkflowsTableSQL := `CREATE TABLE IF NOT EXISTS workflows (
+		organization_id INTEGER PRIMARY KEY,
+		definition TEXT NOT NULL,
+		updated_by INTEGER,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (organization_id) REFERENCES organizations(id) ON DELETE CASCADE,
+		FOREIGN KEY (updated_by) REFERENCES users(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS item_transitions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		item_id INTEGER NOT NULL,
+		transition VARCHAR(50),
+		from_status VARCHAR(50) NOT NULL,
+		to_status VARCHAR(50) NOT NULL,
+		comment TEXT NOT NULL DEFAULT '',
+		user_id INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (item_id) REFERENCES items(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_item_transitions_item_id ON item_transitions(item_id);
+	CREATE INDEX IF NOT EXISTS idx_items_status ON items(organization_id, status);`
+
+	_, err = DB.Exec(createWorkflowsTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Optional deadlines of items and when to remind their owners of them
+	if err = addColumnIfMissing("items", "due_at", "DATETIME"); err != nil {
+		log.Fatal(err)
+	}
+	if err = addColumnIfMissing("items", "remind_at", "DATETIME"); err != nil {
+		log.Fatal(err)
+	}
+
+	// Create item_reminders table for the reminders that fired, which the scheduler
+	// claims before delivering them so each fires once and sets delivered_at on once
+	// they were sent, and notifications for the messages users read in the app
+	createRemindersTableSQL := `CREATE TABLE IF NOT EXISTS item_reminders (
+		item_id INTEGER NOT NULL,
+		remind_at DATETIME NOT NULL,
+		fired_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		delivered_at DATETIME,
+		PRIMARY KEY (item_id, remind_at),
+		FOREIGN KEY (item_id) REFERENCES items(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS notifications (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		kind VARCHAR(50) NOT NULL,
+		item_id INTEGER,
+		subject TEXT NOT NULL,
+		body TEXT NOT NULL DEFAULT '',
+		read_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (item_id) REFERENCES items(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_items_remind_at ON items(remind_at);
+	CREATE INDEX IF NOT EXISTS idx_items_due_at ON items(organization_id, due_at);
+	CREATE INDEX IF NOT EXISTS idx_notifications_user_id ON notifications(user_id, read_at);
+	CREATE INDEX IF NOT EXISTS idx_notifications_item_id ON notifications(item_id);`
+
+	_, err = DB.Exec(createRemindersTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Reminders claimed by older versions were delivered, or given up on, when claimed
+	tracked, err := columnExists("item_reminders", "delivered_at")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !tracked {
+		_, err = DB.Exec(`ALTER TABLE item_reminders ADD COLUMN delivered_at DATETIME;
+		UPDATE item_reminders SET delivered_at = fired_at;`)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Create item_links table for typed relations between items: "parent" links lead
+	// from a parent to its child, "blocks" from the blocking item to the blocked one and
+	// "relates" from the lower item ID to the higher one
+	createItemLinksTableSQL := `CREATE TABLE IF NOT EXISTS item_links (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		type VARCHAR(20) NOT NULL,
+		source_id INTEGER NOT NULL,
+		target_id INTEGER NOT NULL,
+		created_by INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (source_id) REFERENCES items(id) ON DELETE CASCADE,
+		FOREIGN KEY (target_id) REFERENCES items(id) ON DELETE CASCADE,
+		FOREIGN KEY (created_by) REFERENCES users(id),
+		UNIQUE (type, source_id, target_id),
+		CHECK (type IN ('parent', 'blocks', 'relates')),
+		CHECK (source_id != target_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_item_links_source_id ON item_links(source_id, type);
+	CREATE INDEX IF NOT EXISTS idx_item_links_target_id ON item_links(target_id, type);`
+
+	_, err = DB.Exec(createItemLinksTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create share_links table for the public read-only links to items, which store a
+	// hash of their token, and share_link_views for the log of every use of a link
+	createShareLinksTableSQL := `CREATE TABLE IF NOT EXISTS share_links (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		item_id INTEGER NOT NULL,
+		token_hash VARCHAR(64) NOT NULL UNIQUE,
+		password_hash TEXT,
+		expires_at DATETIME,
+		max_views INTEGER,
+		view_count INTEGER NOT NULL DEFAULT 0,
+		created_by INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		revoked_at DATETIME,
+		FOREIGN KEY (item_id) REFERENCES items(id) ON DELETE CASCADE,
+		FOREIGN KEY (created_by) REFERENCES users(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS share_link_views (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		share_link_id INTEGER NOT NULL,
+		outcome VARCHAR(20) NOT NULL,
+		ip VARCHAR(64) NOT NULL DEFAULT '',
+		user_agent VARCHAR(255) NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (share_link_id) REFERENCES share_links(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_share_links_item_id ON share_links(item_id);
+	CREATE INDEX IF NOT EXISTS idx_share_link_views_link ON share_link_views(share_link_id, created_at);`
+
+	_, err = DB.Exec(createShareLinksTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create item_templates table for the blueprints new items can be made from; tags
+	// and attributes are stored as JSON
+	createItemTemplatesTableSQL := `CREATE TABLE IF NOT EXISTS item_templates (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		organization_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		shared BOOLEAN NOT NULL DEFAULT 0,
+		item_name VARCHAR(255) NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		tags TEXT NOT NULL DEFAULT '[]',
+		attributes TEXT NOT NULL DEFAULT '{}',
+		due_in VARCHAR(20) NOT NULL DEFAULT '',
+		remind_in VARCHAR(20) NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (organization_id) REFERENCES organizations(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_item_templates_organization ON item_templates(organization_id, name);`
+
+	_, err = DB.Exec(createItemTemplatesTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create item_preferences table for the pins, favorites and manual order each user
+	// keeps for themselves; positions are fractional keys compared as strings
+	createItemPreferencesTableSQL := `CREATE TABLE IF NOT EXISTS item_preferences (
+		user_id INTEGER NOT NULL,
+		item_id INTEGER NOT NULL,
+		pinned BOOLEAN NOT NULL DEFAULT 0,
+		favorite BOOLEAN NOT NULL DEFAULT 0,
+		position VARCHAR(255),
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, item_id),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (item_id) REFERENCES items(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_item_preferences_position ON item_preferences(user_id, position);
+	CREATE INDEX IF NOT EXISTS idx_item_preferences_item_id ON item_preferences(item_id);`
+
+	_, err = DB.Exec(createItemPreferencesTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create item_revisions table for the history of item contents
+	createItemRevisionsTableSQL := `CREATE TABLE IF NOT EXISTS item_revisions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		item_id INTEGER NOT NULL,
+		revision INTEGER NOT NULL,
+		action VARCHAR(20) NOT NULL,
+		snapshot TEXT NOT NULL,
+		restored_from INTEGER,
+		user_id INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		CHECK (action IN ('create', 'update', 'delete', 'restore'))
+	);
+
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_item_revisions_item_revision ON item_revisions(item_id, revision);
+
+	-- Items that existed before revisions were recorded start with their current contents
+	INSERT INTO item_revisions (item_id, revision, action, snapshot, user_id, created_at)
+	SELECT id, version, 'create', json_object('name', name, 'description', COALESCE(description, '')), user_id, updated_at
+	FROM items
+	WHERE NOT EXISTS (SELECT 1 FROM item_revisions r WHERE r.item_id = items.id);`
+
+	_, err = DB.Exec(createItemRevisionsTableSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Give every user a personal organization and move their unscoped items into it
+	backfillOrganizationsSQL := `CREATE INDEX IF NOT EXISTS idx_items_organization_id ON items(organization_id);
+
+	INSERT INTO organizations (name, personal_user_id, created_by)
+	SELECT email, id, id FROM users
+	WHERE id NOT IN (SELECT personal_user_id FROM organizations WHERE personal_user_id IS NOT NULL);
+
+	INSERT OR IGNORE INTO organization_members (organization_id, user_id, role)
+	SELECT id, personal_user_id, 'owner' FROM organizations WHERE personal_user_id IS NOT NULL;
+
+	UPDATE items SET organization_id = (
+		SELECT id FROM organizations WHERE personal_user_id = items.user_id
+	) WHERE organization_id IS NULL;`
+
+	_, err = DB.Exec(backfillOrganizationsSQL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err = initItemSearch(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// initItemSearch creates the items_fts index and the triggers keeping it in sync with
+// items. Without FTS5 the triggers are dropped so that writes to items keep working
+// when a database indexed by an FTS5 build is opened by one without it.
+func initItemSearch() error {
+	dropTriggersSQL := `DROP TRIGGER IF EXISTS items_fts_insert;
+	DROP TRIGGER IF EXISTS items_fts_delete;
+	DROP TRIGGER IF EXISTS items_fts_update;`
+
+	err := DB.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&FTS5)
+	if err != nil {
+		return err
+	}
+	if !FTS5 {
+		log.Println("FTS5 is not available, item search falls back to LIKE (build with -tags sqlite_fts5 to enable it)")
+		_, err = DB.Exec(dropTriggersSQL)
+		return err
+	}
+
+	_, err = DB.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS items_fts USING fts5(
+		name,
+		description,
+		content = 'items',
+		content_rowid = 'id'
+	)`)
+	if err != nil {
+		return err
+	}
+
+	// The index is stale if items changed while the triggers were missing
+	var triggers int
+	err = DB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'items_fts_%'").Scan(&triggers)
+	if err != nil {
+		return err
+	}
+
+	createTriggersSQL := `CREATE TRIGGER IF NOT EXISTS items_fts_insert AFTER INSERT ON items
+	BEGIN
+		INSERT INTO items_fts (rowid, name, description) VALUES (NEW.id, NEW.name, NEW.description);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS items_fts_delete AFTER DELETE ON items
+	BEGIN
+		INSERT INTO items_fts (items_fts, rowid, name, description) VALUES ('delete', OLD.id, OLD.name, OLD.description);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS items_fts_update AFTER UPDATE OF name, description ON items
+	BEGIN
+		INSERT INTO items_fts (items_fts, rowid, name, description) VALUES ('delete', OLD.id, OLD.name, OLD.description);
+		INSERT INTO items_fts (rowid, name, description) VALUES (NEW.id, NEW.name, NEW.description);
+	END;`
+
+	if _, err = DB.Exec(createTriggersSQL); err != nil {
+		return err
+	}
+	if triggers < 3 {
+		_, err = DB.Exec("INSERT INTO items_fts (items_fts) VALUES ('rebuild')")
+	}
+	return err
+}
+
+// hashInvitationTokens replaces the invitation tokens older versions stored in the
+// clear by their SHA-256, under which invitations are now looked up
+func hashInvitationTokens() error {
+	clear, err := columnExists("organization_invitations", "token")
+	if err != nil || !clear {
+		return err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("ALTER TABLE organization_invitations RENAME COLUMN token TO token_hash"); err != nil {
+		return err
+	}
+	rows, err := tx.Query("SELECT id, token_hash FROM organization_invitations")
+	if err != nil {
+		return err
+	}
+	tokens := map[int]string{}
+	for rows.Next() {
+		var (
+			id    int
+			token string
+		)
+		if err := rows.Scan(&id, &token); err != nil {
+			rows.Close()
+			return err
+		}
+		tokens[id] = token
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, token := range tokens {
+		sum := sha256.Sum256([]byte(token))
+		if _, err := tx.Exec("UPDATE organization_invitations SET token_hash = ? WHERE id = ?",
+			hex.EncodeToString(sum[:]), id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// addColumnIfMissing adds a column to an existing table. CREATE TABLE IF NOT EXISTS
+// leaves tables created by older versions untouched, so new columns are added here.
+func addColumnIfMissing(table, column, definition string) error {
+	exists, err := columnExists(table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = DB.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// columnExists tells whether a table has a column
+func columnExists(table, column string) (bool, error) {
+	rows, err := DB.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    bool
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crudracula/models"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestItemCursorsWithConcurrentInserts pages through a listing with next and prev cursors
+// while other items are being created between its rows, and checks that every item that
+// existed beforehand is returned exactly once and in order in both directions
+func TestItemCursorsWithConcurrentInserts(t *testing.T) {
+	token := signupUser(t, uniqueEmail(t, "pager"))
+	seeded := make(map[string]bool)
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("item %02d", i*2)
+		createTestItem(t, token, nil, name)
+		seeded[name] = true
+	}
+
+	// Insert items that sort between the seeded ones for as long as the pages are read
+	stop := make(chan struct{})
+	started, inserted := make(chan struct{}), make(chan error, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				inserted <- nil
+				return
+			default:
+			}
+			body := fmt.Sprintf(`{"name": "item %02d %d"}`, (i%29)*2+1, i)
+			req := httptest.NewRequest(http.MethodPost, "/api/items", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := testApp.Test(req, -1)
+			if err == nil && resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("creating an item: status %d", resp.StatusCode)
+			}
+			if err != nil {
+				inserted <- err
+				return
+			}
+			if i == 0 {
+				close(started)
+			}
+		}
+	}()
+	select {
+	case <-started:
+	case err := <-inserted:
+		t.Fatal(err)
+	}
+
+	// page reads one listing page and fails on rows out of order or seen twice
+	page := func(cursor string, seen map[string]bool, last *string, descending bool) models.PaginatedResponse {
+		t.Helper()
+		path := "/api/items?sort=name&per_page=4&count=false"
+		if cursor != "" {
+			path += "&cursor=" + url.QueryEscape(cursor)
+		}
+		var response models.PaginatedResponse
+		mustRequest(t, http.MethodGet, path, token, nil, "", &response)
+
+		items := response.Items
+		if descending {
+			items = make([]models.Item, len(response.Items))
+			for i, item := range response.Items {
+				items[len(items)-1-i] = item
+			}
+		}
+		for _, item := range items {
+			if seen[item.Name] {
+				t.Errorf("%q returned twice", item.Name)
+			}
+			if *last != "" && (item.Name > *last) == descending {
+				t.Errorf("%q returned after %q", item.Name, *last)
+			}
+			seen[item.Name] = true
+			*last = item.Name
+		}
+		return response
+	}
+
+	forward, last := make(map[string]bool), ""
+	response := page("", forward, &last, false)
+	for pages := 1; response.NextCursor != ""; pages++ {
+		if pages > 100 {
+			t.Fatal("paging forward does not end")
+		}
+		response = page(response.NextCursor, forward, &last, false)
+	}
+
+	backward := make(map[string]bool)
+	last = ""
+	for _, item := range response.Items {
+		backward[item.Name] = true
+	}
+	for pages := 1; response.PrevCursor != ""; pages++ {
+		if pages > 100 {
+			t.Fatal("paging backward does not end")
+		}
+		if last == "" {
+			last = response.Items[0].Name
+		}
+		response = page(response.PrevCursor, backward, &last, true)
+	}
+
+	close(stop)
+	wg.Wait()
+	if err := <-inserted; err != nil {
+		t.Fatal(err)
+	}
+
+	for name := range seeded {
+		if !forward[name] {
+			t.Errorf("%q skipped when paging forward", name)
+		}
+		if !backward[name] {
+			t.Errorf("%q skipped when paging backward", name)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+// Package jsonpatch applies JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902)
+// documents to decoded JSON values: map[string]interface{}, []interface{}, string,
+// float64, bool and nil.
+package jsonpatch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ErrTestFailed is returned when a "test" operation does not hold
+var ErrTestFailed = errors.New("test operation failed")
+
+// Operation is one step of a JSON Patch document. Value is kept encoded so that a
+// missing value can be told apart from null.
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// value decodes the value of an operation
+func (op Operation) value() (interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal(op.Value, &value); err != nil {
+		return nil, fmt.Errorf("invalid value: %v", err)
+	}
+	return value, nil
+}
+
+// OperationError reports which operation of a patch could not be applied
+type OperationError struct {
+	Index int
+	Op    Operation
+	Err   error
+}
+
+func (e *OperationError) Error() string {
+	return fmt.Sprintf("operation %d (%s %s): %v", e.Index, e.Op.Op, e.Op.Path, e.Err)
+}
+
+func (e *OperationError) Unwrap() error {
+	return e.Err
+}
+
+// MergePatch applies a merge patch to a target. Objects are merged recursively, null
+// removes a member and any other value replaces the target.
+func MergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	} else {
+		targetObject = copyObject(targetObject)
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = MergePatch(targetObject[key], value)
+	}
+	return targetObject
+}
+
+// Validate checks that every operation is well formed without applying any
+func Validate(ops []Operation) error {
+	for i, op := range ops {
+		var err error
+		switch op.Op {
+		case "add", "replace", "test":
+			if _, err = parsePointer(op.Path); err == nil {
+				if len(op.Value) == 0 {
+					err = errors.New("missing value")
+				} else {
+					_, err = op.value()
+				}
+			}
+		case "remove":
+			_, err = parsePointer(op.Path)
+		case "move", "copy":
+			if _, err = parsePointer(op.Path); err == nil {
+				_, err = parsePointer(op.From)
+			}
+			if err == nil && op.Op == "move" && strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+				err = errors.New("cannot move a value into one of its children")
+			}
+		default:
+			err = fmt.Errorf("unknown operation %q", op.Op)
+		}
+		if err != nil {
+			return &OperationError{Index: i, Op: op, Err: err}
+		}
+	}
+	return nil
+}
+
+// Apply applies a JSON Patch to a document. The document is not modified; either all
+// operations apply and the patched copy is returned, or none do and an error is.
+func Apply(doc interface{}, ops []Operation) (interface{}, error) {
+	if err := Validate(ops); err != nil {
+		return nil, err
+	}
+
+	doc = deepCopy(doc)
+	for i, op := range ops {
+		var err error
+		switch op.Op {
+		case "add":
+			var value interface{}
+			if value, err = op.value(); err == nil {
+				doc, err = add(doc, op.Path, value)
+			}
+		case "remove":
+			doc, _, err = remove(doc, op.Path)
+		case "replace":
+			var value interface{}
+			if value, err = op.value(); err == nil {
+				if doc, _, err = remove(doc, op.Path); err == nil {
+					doc, err = add(doc, op.Path, value)
+				}
+			}
+		case "move":
+			var value interface{}
+			if doc, value, err = remove(doc, op.From); err == nil {
+				doc, err = add(doc, op.Path, value)
+			}
+		case "copy":
+			var value interface{}
+			if value, err = get(doc, op.From); err == nil {
+				doc, err = add(doc, op.Path, deepCopy(value))
+			}
+		case "test":
+			var value, expected interface{}
+			if expected, err = op.value(); err == nil {
+				if value, err = get(doc, op.Path); err == nil && !reflect.DeepEqual(value, expected) {
+					err = ErrTestFailed
+				}
+			}
+		}
+		if err != nil {
+			return nil, &OperationError{Index: i, Op: op, Err: err}
+		}
+	}
+	return doc, nil
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index token; "-" means one past the end when allowed
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return length, nil
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	limit := length - 1
+	if allowEnd {
+		limit = length
+	}
+	if index > limit {
+		return 0, fmt.Errorf("array index %d out of bounds", index)
+	}
+	return index, nil
+}
+
+// get returns the value a pointer refers to
+func get(doc interface{}, pointer string) (interface{}, error) {
+	tokens, _ := parsePointer(pointer)
+	current := doc
+	for _, token := range tokens {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("path %q does not exist", pointer)
+			}
+			current = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			current = node[index]
+		default:
+			return nil, fmt.Errorf("path %q does not exist", pointer)
+		}
+	}
+	return current, nil
+}
+
+// add inserts a value at a pointer and returns the resulting document
+func add(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+	tokens, _ := parsePointer(pointer)
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := get(doc, parentPointer)
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return doc, nil
+	case []interface{}:
+		index, err := arrayIndex(last, len(node), true)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node, nil)
+		copy(node[index+1:], node[index:])
+		node[index] = value
+		return replaceAt(doc, parentPointer, node)
+	default:
+		return nil, fmt.Errorf("path %q does not exist", parentPointer)
+	}
+}
+
+// remove deletes the value at a pointer, returning the resulting document and the value
+func remove(doc interface{}, pointer string) (interface{}, interface{}, error) {
+	tokens, _ := parsePointer(pointer)
+	if len(tokens) == 0 {
+		return nil, doc, nil
+	}
+
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := get(doc, parentPointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	last := tokens[len(tokens)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, ok := node[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("path %q does not exist", pointer)
+		}
+		delete(node, last)
+		return doc, value, nil
+	case []interface{}:
+		index, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := node[index]
+		node = append(node[:index:index], node[index+1:]...)
+		doc, err = replaceAt(doc, parentPointer, node)
+		return doc, value, err
+	default:
+		return nil, nil, fmt.Errorf("path %q does not exist", pointer)
+	}
+}
+
+// replaceAt stores a new value for an existing location, needed when an array grows or
+// shrinks and its slice header changes
+func replaceAt(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+	tokens, _ := parsePointer(pointer)
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	parent, err := get(doc, pointer[:strings.LastIndex(pointer, "/")])
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+	case []interface{}:
+		index, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		node[index] = value
+	}
+	return doc, nil
+}
+
+func copyObject(object map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(object))
+	for k, v := range object {
+		copied[k] = v
+	}
+	return copied
+}
+
+// deepCopy copies decoded JSON so that patching never changes the caller's values
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			copied[k] = deepCopy(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = deepCopy(item)
+		}
+		return copied
+	default:
+		return v
+	}
+}
@@ -0,0 +1,207 @@
+// Package jsonschema validates decoded JSON values (map[string]interface{}, []interface{},
+// string, float64, bool and nil) against the subset of JSON Schema (draft 2020-12) used
+// to describe item attributes: type, enum, minimum, maximum, minLength, maxLength,
+// format, properties, required and additionalProperties.
+package jsonschema
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Draft is the $schema URI of the supported dialect
+const Draft = "https://json-schema.org/draft/2020-12/schema"
+
+// Schema is a JSON Schema document or subschema
+type Schema struct {
+	Schema      string        `json:"$schema,omitempty"`
+	Title       string        `json:"title,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Type        string        `json:"type,omitempty"`
+	Format      string        `json:"format,omitempty"`
+	Enum        []interface{} `json:"enum,omitempty"`
+	Minimum     *float64      `json:"minimum,omitempty"`
+	Maximum     *float64      `json:"maximum,omitempty"`
+	MinLength   *int          `json:"minLength,omitempty"`
+	MaxLength   *int          `json:"maxLength,omitempty"`
+
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+}
+
+// ValidationError is one way a value does not match a schema. Path is a JSON Pointer
+// to the offending value, "" for the value itself.
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// Validate returns every violation of the schema by value, in a stable order
+func (s *Schema) Validate(value interface{}) []ValidationError {
+	var errs []ValidationError
+	s.validate("", value, &errs)
+	return errs
+}
+
+func (s *Schema) validate(path string, value interface{}, errs *[]ValidationError) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if s.Type != "" && !hasType(value, s.Type) {
+		fail("must be %s", article(s.Type))
+		return
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, allowed := range s.Enum {
+			if equal(value, allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of %s", formatEnum(s.Enum))
+		}
+	}
+
+	switch v := value.(type) {
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			fail("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			fail("must be at most %v", *s.Maximum)
+		}
+
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			fail("must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			fail("must be at most %d characters", *s.MaxLength)
+		}
+		if s.Format != "" && !hasFormat(v, s.Format) {
+			fail("must be a valid %s", s.Format)
+		}
+
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, present := v[name]; !present {
+				*errs = append(*errs, ValidationError{Path: path + "/" + escape(name), Message: "is required"})
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if property, defined := s.Properties[name]; defined {
+				property.validate(path+"/"+escape(name), v[name], errs)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				*errs = append(*errs, ValidationError{Path: path + "/" + escape(name), Message: "is not allowed"})
+			}
+		}
+	}
+}
+
+// hasType reports whether a decoded JSON value is of a JSON Schema type
+func hasType(value interface{}, typ string) bool {
+	switch v := value.(type) {
+	case nil:
+		return typ == "null"
+	case bool:
+		return typ == "boolean"
+	case float64:
+		return typ == "number" || typ == "integer" && v == math.Trunc(v) && !math.IsInf(v, 0)
+	case string:
+		return typ == "string"
+	case []interface{}:
+		return typ == "array"
+	case map[string]interface{}:
+		return typ == "object"
+	}
+	return false
+}
+
+// hasFormat checks the formats the package knows; unknown formats are annotations only
+func hasFormat(value, format string) bool {
+	switch format {
+	case "date":
+		_, err := time.Parse("2006-01-02", value)
+		return err == nil
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, value)
+		return err == nil
+	case "uri":
+		u, err := url.Parse(value)
+		return err == nil && u.Scheme != "" && (u.Host != "" || u.Opaque != "")
+	}
+	return true
+}
+
+// equal compares decoded JSON values; numbers are all float64
+func equal(a, b interface{}) bool {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// toFloat also accepts the integer types a schema built in Go may use in enum
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func formatEnum(values []interface{}) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			parts[i] = fmt.Sprintf("%q", s)
+		} else {
+			parts[i] = fmt.Sprint(value)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func article(typ string) string {
+	switch typ {
+	case "integer", "object", "array":
+		return "an " + typ
+	case "null":
+		return "null"
+	}
+	return "a " + typ
+}
+
+// escape encodes a property name as a JSON Pointer reference token
+func escape(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
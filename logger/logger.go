@@ -73,7 +73,8 @@ func LogRequest(method, path string, duration time.Duration, status int, ctx con
 
 // LogError now includes request ID from context
 func LogError(ctx context.Context, err error, msg string, fields map[string]interface{}) {
-	requestID := ctx.Value(RequestIDKey).(string)
+	// Errors the server raises before any middleware ran have no request ID
+	requestID, _ := ctx.Value(RequestIDKey).(string)
 
 	event := log.Error().
 		Str("requestId", requestID).
@@ -102,7 +102,7 @@ func Signup(c *fiber.Ctx) error {
 	}
 
 	// Insert new user with the role ID
-	_, err = tx.Exec(
+	result, err := tx.Exec(
 		"INSERT INTO users (email, password, role_id) VALUES (?, ?, ?)",
 		req.Email, hashedPassword, roleID)
 	if err != nil {
@@ -110,6 +110,18 @@ func Signup(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusInternalServerError, "Failed to create user")
 	}
 
+	userID, err := result.LastInsertId()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get user ID")
+		return fiber.NewError(fiber.StatusInternalServerError, "Database error")
+	}
+
+	// Every user gets a personal organization as their default workspace
+	if err = createPersonalOrganization(tx, int(userID), req.Email); err != nil {
+		log.Error().Err(err).Msg("Failed to create personal organization")
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to create user")
+	}
+
 	// Commit transaction
 	if err = tx.Commit(); err != nil {
 		log.Error().Err(err).Msg("Failed to commit transaction")
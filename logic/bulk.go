@@ -0,0 +1,368 @@
+package logic
+
+import (
+	"crudracula/dal"
+	"crudracula/models"
+	"crudracula/policy"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Bulk modes: atomic commits only when every operation succeeds, best_effort commits
+// the operations that succeeded
+const (
+	BulkAtomic     = "atomic"
+	BulkBestEffort = "best_effort"
+)
+
+// maxBulkOperations bounds the size of a single bulk request
+const maxBulkOperations = 1000
+
+// bulkOperationPermissions maps each bulk operation to the permission it requires
+var bulkOperationPermissions = map[string]string{
+	"create": "create_item",
+	"update": "update_item",
+	"delete": "delete_item",
+}
+
+// validateBulkOperation checks the shape of an operation before anything is looked up
+func validateBulkOperation(op models.BulkItemOperation) error {
+	if _, known := bulkOperationPermissions[op.Op]; !known {
+		return fiber.NewError(fiber.StatusBadRequest, "op must be one of create, update or delete")
+	}
+	if op.Op != "create" && op.ID <= 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "id is required")
+	}
+	if op.Op == "create" && op.Name == nil {
+		return fiber.NewError(fiber.StatusBadRequest, "name is required")
+	}
+	if op.Op == "update" && op.Name == nil && op.Description == nil && op.Attributes == nil {
+		return fiber.NewError(fiber.StatusBadRequest, "an update needs a name, a description or attributes")
+	}
+	if op.Name != nil && *op.Name == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "name must not be empty")
+	}
+	if op.Name != nil && len(*op.Name) > maxItemNameLength {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("name must be at most %d characters", maxItemNameLength))
+	}
+	if op.Version < 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "version must be positive")
+	}
+	if op.Op != "create" && op.Version == 0 && ifMatchRequired() {
+		return fiber.NewError(fiber.StatusPreconditionRequired, "version is required")
+	}
+	return nil
+}
+
+// checkBulkOperation runs the checks a single request for the operation would go through:
+// the role permission RequirePermission enforces, the organization role, the policy
+// engine and the item access level. Role checks are cached across the batch.
+func checkBulkOperation(c *fiber.Ctx, userID int, org activeOrganization, op models.BulkItemOperation,
+	roleChecks map[string]RolePermissionCheck) error {
+	if err := validateBulkOperation(op); err != nil {
+		return err
+	}
+
+	permission := bulkOperationPermissions[op.Op]
+	check, cached := roleChecks[permission]
+	if !cached {
+		var err error
+		if check, err = CheckRolePermission(userID, permission); err != nil {
+			log.Error().Err(err).Int("userId", userID).Str("permission", permission).Msg("Failed to check permission")
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to check user permissions")
+		}
+		roleChecks[permission] = check
+	}
+	if check.NoRole {
+		return fiber.NewError(fiber.StatusForbidden, "No role assigned to user")
+	}
+	if !check.Allowed {
+		return fiber.NewError(fiber.StatusForbidden, "Permission denied")
+	}
+
+	if op.Op == "create" {
+		if orgRoleRank[org.Role] < orgRoleRank[OrgRoleMember] {
+			return fiber.NewError(fiber.StatusForbidden, "Organization viewers cannot create items")
+		}
+		return authorize(c, userID, permission, policy.Attributes{"type": "item", "organization_id": org.ID, "name": *op.Name})
+	}
+
+	if err := authorizeItem(c, userID, org, op.ID, permission); err != nil {
+		return err
+	}
+
+	required := AccessEditor
+	if op.Op == "delete" {
+		required = AccessOwner
+	}
+	level, err := itemAccessLevel(userID, org, op.ID)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", op.ID).Msg("Failed to resolve item access level")
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal server error: failed to check item access")
+	}
+	if level == "" {
+		return fiber.NewError(fiber.StatusNotFound, "Item not found")
+	}
+	if accessLevelRank[level] < accessLevelRank[required] {
+		return fiber.NewError(fiber.StatusForbidden, "Insufficient access to item")
+	}
+	return nil
+}
+
+// bulkWriteRejected explains, within the batch's transaction, why a write changed no rows
+func bulkWriteRejected(tx *sql.Tx, id, version int) error {
+	var current int
+	err := tx.QueryRow("SELECT version FROM items WHERE id = ? AND "+itemLiveCondition, id).Scan(&current)
+	if err == sql.ErrNoRows {
+		return fiber.NewError(fiber.StatusNotFound, "Item not found")
+	} else if err != nil {
+		return err
+	}
+	if version != 0 && current != version {
+		return fiber.NewError(fiber.StatusPreconditionFailed, "Item has been modified, reload it and try again")
+	}
+	return fiber.NewError(fiber.StatusForbidden, "Insufficient access to item")
+}
+
+// bulkAttributes validates the attributes an operation writes, reporting invalid ones
+// like any other failed operation
+func bulkAttributes(tx *sql.Tx, org activeOrganization, attributes map[string]interface{}) (string, error) {
+	encoded, err := checkedAttributes(tx, org, attributes)
+	var invalid *invalidAttributesError
+	if errors.As(err, &invalid) {
+		return "", fiber.NewError(fiber.StatusUnprocessableEntity, invalid.Error())
+	}
+	return encoded, err
+}
+
+// executeBulkOperation applies a checked operation in the batch's transaction and returns
+// the resulting item and the status of the operation
+func executeBulkOperation(tx *sql.Tx, userID int, org activeOrganization, op models.BulkItemOperation) (models.Item, int, error) {
+	var (
+		id     = op.ID
+		status = fiber.StatusOK
+		action string
+		result sql.Result
+		err    error
+	)
+
+	switch op.Op {
+	case "create":
+		description := ""
+		if op.Description != nil {
+			description = *op.Description
+		}
+		attributes, err := bulkAttributes(tx, org, op.Attributes)
+		if err != nil {
+			return models.Item{}, 0, err
+		}
+		initial, err := initialItemStatus(tx, org.ID)
+		if err != nil {
+			return models.Item{}, 0, err
+		}
+		result, err = tx.Exec("INSERT INTO items (name, description, attributes, status, user_id, organization_id) VALUES (?, ?, ?, ?, ?, ?)",
+			*op.Name, description, attributes, initial, userID, org.ID)
+		if err != nil {
+			return models.Item{}, 0, err
+		}
+		lastID, _ := result.LastInsertId()
+		id, status, action = int(lastID), fiber.StatusCreated, RevisionCreate
+
+	case "update":
+		var (
+			set  []string
+			args []interface{}
+		)
+		if op.Name != nil {
+			set, args = append(set, "name = ?"), append(args, *op.Name)
+		}
+		if op.Description != nil {
+			set, args = append(set, "description = ?"), append(args, *op.Description)
+		}
+		if op.Attributes != nil {
+			attributes, err := bulkAttributes(tx, org, op.Attributes)
+			if err != nil {
+				return models.Item{}, 0, err
+			}
+			set, args = append(set, "attributes = ?"), append(args, attributes)
+		}
+		accessClause, accessArgs := itemAccessClause(userID, org, AccessEditor)
+		result, err = tx.Exec("UPDATE items SET "+strings.Join(set, ", ")+", version = version + 1"+
+			" WHERE items.id = ? AND (? = 0 OR items.version = ?) AND "+accessClause,
+			append(append(args, id, op.Version, op.Version), accessArgs...)...)
+		action = RevisionUpdate
+
+	case "delete":
+		accessClause, accessArgs := itemAccessClause(userID, org, AccessOwner)
+		result, err = tx.Exec(`UPDATE items
+			SET deleted_at = CURRENT_TIMESTAMP, deleted_by = ?, version = version + 1
+			WHERE items.id = ? AND (? = 0 OR items.version = ?) AND `+accessClause,
+			append([]interface{}{userID, id, op.Version, op.Version}, accessArgs...)...)
+		status, action = fiber.StatusNoContent, RevisionDelete
+	}
+	if err != nil {
+		return models.Item{}, 0, err
+	}
+
+	if op.Op != "create" {
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			return models.Item{}, 0, bulkWriteRejected(tx, id, op.Version)
+		}
+	}
+
+	item, err := queryItem(tx, id)
+	if err == nil {
+		err = recordItemRevision(tx, userID, item, action, nil)
+	}
+	return item, status, err
+}
+
+// BulkItems runs a batch of create, update and delete operations in one transaction.
+// Every operation is checked as if it were sent on its own and gets its own result.
+func BulkItems(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		log.Debug().Err(err).Int("userId", userID).Msg("No active organization")
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
+	var req models.BulkItemRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+	}
+	if req.Mode == "" {
+		req.Mode = BulkAtomic
+	}
+	if req.Mode != BulkAtomic && req.Mode != BulkBestEffort {
+		return c.Status(400).JSON(fiber.Map{"error": "mode must be atomic or best_effort"})
+	}
+	if len(req.Operations) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "operations must not be empty"})
+	}
+	if len(req.Operations) > maxBulkOperations {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("At most %d operations are allowed", maxBulkOperations)})
+	}
+
+	response := models.BulkItemResponse{
+		Mode:    req.Mode,
+		Errors:  []int{},
+		Results: make([]models.BulkItemResult, len(req.Operations)),
+	}
+	fail := func(i int, err error) {
+		status, message := fiber.StatusInternalServerError, "Internal server error: failed to apply operation"
+		var fiberErr *fiber.Error
+		if errors.As(err, &fiberErr) {
+			status, message = fiberErr.Code, fiberErr.Message
+		} else {
+			log.Error().Err(err).Int("userId", userID).Int("index", i).Msg("Bulk item operation failed")
+		}
+		response.Results[i].Status, response.Results[i].Error = status, message
+		response.Results[i].Item = nil
+		response.Errors = append(response.Errors, i)
+	}
+
+	// Check everything before the transaction starts, so the checks read committed
+	// state and do not hold the write lock
+	roleChecks := map[string]RolePermissionCheck{}
+	checked := make([]bool, len(req.Operations))
+	for i, op := range req.Operations {
+		response.Results[i] = models.BulkItemResult{Index: i, Op: op.Op, ID: op.ID}
+		if err := checkBulkOperation(c, userID, org, op, roleChecks); err != nil {
+			fail(i, err)
+			continue
+		}
+		checked[i] = true
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to apply operations"})
+	}
+	defer tx.Rollback()
+
+	// Each operation runs in a savepoint so a failure undoes only that operation
+	if req.Mode == BulkBestEffort || len(response.Errors) == 0 {
+		for i, op := range req.Operations {
+			if !checked[i] {
+				continue
+			}
+			if _, err := tx.Exec("SAVEPOINT bulk_operation"); err != nil {
+				fail(i, err)
+				continue
+			}
+			item, status, err := executeBulkOperation(tx, userID, org, op)
+			if err != nil {
+				fail(i, err)
+				if _, err := tx.Exec("ROLLBACK TO bulk_operation"); err != nil {
+					log.Error().Err(err).Msg("Failed to roll back bulk operation")
+					return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to apply operations"})
+				}
+			} else {
+				response.Results[i].Status, response.Results[i].ID = status, item.ID
+				if status != fiber.StatusNoContent {
+					response.Results[i].Item = &item
+				}
+			}
+			if _, err := tx.Exec("RELEASE bulk_operation"); err != nil {
+				log.Error().Err(err).Msg("Failed to release bulk operation")
+				return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to apply operations"})
+			}
+		}
+	}
+
+	if req.Mode == BulkAtomic && len(response.Errors) > 0 {
+		// Nothing is kept; operations that did not fail themselves report why
+		tx.Rollback()
+		failed := map[int]bool{}
+		for _, i := range response.Errors {
+			failed[i] = true
+		}
+		for i := range response.Results {
+			if !failed[i] {
+				response.Results[i] = models.BulkItemResult{
+					Index:  i,
+					Op:     req.Operations[i].Op,
+					ID:     req.Operations[i].ID,
+					Status: fiber.StatusFailedDependency,
+					Error:  "Not applied because another operation failed",
+				}
+			}
+		}
+	} else {
+		if err := tx.Commit(); err != nil {
+			log.Error().Err(err).Msg("Failed to commit transaction")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to apply operations"})
+		}
+		response.Committed = true
+		response.Succeeded = len(response.Results) - len(response.Errors)
+	}
+	response.Failed = len(response.Errors)
+	sort.Ints(response.Errors)
+
+	log.Info().
+		Int("userId", userID).
+		Str("mode", req.Mode).
+		Int("operations", len(req.Operations)).
+		Int("succeeded", response.Succeeded).
+		Int("failed", response.Failed).
+		Bool("committed", response.Committed).
+		Msg("Bulk item operations applied")
+
+	if len(response.Errors) > 0 {
+		return c.Status(fiber.StatusMultiStatus).JSON(response)
+	}
+	return c.JSON(response)
+}
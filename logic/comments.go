@@ -0,0 +1,564 @@
+package logic
+
+import (
+	"crudracula/dal"
+	"crudracula/markdown"
+	"crudracula/models"
+	"crudracula/policy"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// defaultCommentEditWindow applies when COMMENT_EDIT_WINDOW is not set
+	defaultCommentEditWindow = "15m"
+
+	// maxCommentLength bounds comment bodies, in characters
+	maxCommentLength = 10000
+
+	defaultCommentsPerPage = 20
+	maxCommentsPerPage     = 100
+)
+
+const commentColumns = `c.id, c.item_id, c.parent_id, c.user_id, author.email, c.body, c.body_html,
+	(SELECT COUNT(*) FROM comments r WHERE r.parent_id = c.id), c.created_at, c.edited_at, c.deleted_at
+	FROM comments c
+	LEFT JOIN users author ON author.id = c.user_id`
+
+// commentEditWindow returns how long after posting authors may edit a comment, as set
+// by COMMENT_EDIT_WINDOW ("15m", "1h", ...). Zero means comments cannot be edited.
+func commentEditWindow() (string, time.Duration) {
+	raw := os.Getenv("COMMENT_EDIT_WINDOW")
+	if raw == "" {
+		raw = defaultCommentEditWindow
+	}
+	if raw == "0" {
+		return raw, 0
+	}
+	window, err := policy.ParseDuration(raw)
+	if err != nil || window < 0 {
+		log.Warn().Str("value", raw).Msg("Invalid COMMENT_EDIT_WINDOW, using the default")
+		raw = defaultCommentEditWindow
+		window, _ = policy.ParseDuration(raw)
+	}
+	return raw, window
+}
+
+func scanComment(row interface{ Scan(...interface{}) error }, comment *models.Comment) error {
+	var (
+		parentID    sql.NullInt64
+		authorID    sql.NullInt64
+		authorEmail sql.NullString
+		editedAt    sql.NullTime
+		deletedAt   sql.NullTime
+	)
+	err := row.Scan(&comment.ID, &comment.ItemID, &parentID, &authorID, &authorEmail, &comment.Body,
+		&comment.HTML, &comment.ReplyCount, &comment.CreatedAt, &editedAt, &deletedAt)
+	if err != nil {
+		return err
+	}
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		comment.ParentID = &id
+	}
+	if authorID.Valid && authorEmail.Valid {
+		comment.Author = &models.ItemOwner{ID: int(authorID.Int64), Email: authorEmail.String}
+	}
+	if editedAt.Valid {
+		at := editedAt.Time.UTC()
+		comment.EditedAt = &at
+	}
+	if deletedAt.Valid {
+		comment.Deleted = true
+		comment.Author = nil
+	}
+	comment.Mentions = []models.ItemOwner{}
+	return nil
+}
+
+// loadCommentMentions fills in the users mentioned by each comment
+func loadCommentMentions(comments []models.Comment) error {
+	if len(comments) == 0 {
+		return nil
+	}
+	index := make(map[int]*models.Comment, len(comments))
+	args := make([]interface{}, len(comments))
+	for i := range comments {
+		index[comments[i].ID] = &comments[i]
+		args[i] = comments[i].ID
+	}
+
+	rows, err := dal.DB.Query(`
+		SELECT m.comment_id, u.id, u.email
+		FROM comment_mentions m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.comment_id IN (`+placeholders(len(args))+`)
+		ORDER BY u.email`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var commentID int
+		var user models.ItemOwner
+		if err := rows.Scan(&commentID, &user.ID, &user.Email); err != nil {
+			return err
+		}
+		comment := index[commentID]
+		comment.Mentions = append(comment.Mentions, user)
+	}
+	return rows.Err()
+}
+
+// loadComment reads a comment on an item with its mentions
+func loadComment(itemID, commentID int) (models.Comment, error) {
+	var comment models.Comment
+	err := scanComment(dal.DB.QueryRow("SELECT "+commentColumns+
+		" WHERE c.id = ? AND c.item_id = ?", commentID, itemID), &comment)
+	if err != nil {
+		return comment, err
+	}
+	comments := []models.Comment{comment}
+	if err := loadCommentMentions(comments); err != nil {
+		return comment, err
+	}
+	return comments[0], nil
+}
+
+// commentParam loads the comment named by the :commentId parameter
+func commentParam(c *fiber.Ctx, itemID int) (models.Comment, error) {
+	commentID, err := c.ParamsInt("commentId")
+	if err != nil {
+		return models.Comment{}, fiber.NewError(fiber.StatusBadRequest, "Invalid comment ID")
+	}
+	comment, err := loadComment(itemID, commentID)
+	if err == sql.ErrNoRows {
+		return comment, fiber.NewError(fiber.StatusNotFound, "Comment not found")
+	} else if err != nil {
+		log.Error().Err(err).Int("itemId", itemID).Int("commentId", commentID).Msg("Failed to fetch comment")
+		return comment, fiber.NewError(fiber.StatusInternalServerError, "Internal server error: failed to fetch comment")
+	}
+	return comment, nil
+}
+
+// visibleItem authenticates a request about an item the caller can see, leaving the
+// policy check for the action to the caller
+func visibleItem(c *fiber.Ctx) (int, activeOrganization, int, error) {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return 0, activeOrganization{}, 0, fiber.NewError(fiber.StatusUnauthorized, "Unauthorized")
+	}
+
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return 0, org, 0, fiber.NewError(fiber.StatusForbidden, "No active organization")
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return 0, org, 0, fiber.NewError(fiber.StatusBadRequest, "Invalid ID")
+	}
+
+	visible, err := hasItemAccess(userID, org, id, AccessViewer)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to check item access")
+		return 0, org, 0, fiber.NewError(fiber.StatusInternalServerError, "Internal server error: failed to check item access")
+	}
+	if !visible {
+		return 0, org, 0, fiber.NewError(fiber.StatusNotFound, "Item not found")
+	}
+	return userID, org, id, nil
+}
+
+// parseCommentBody checks the body of a comment request
+func parseCommentBody(c *fiber.Ctx) (models.CommentRequest, error) {
+	var req models.CommentRequest
+	if err := c.BodyParser(&req); err != nil {
+		return req, fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+	}
+	req.Body = strings.TrimSpace(req.Body)
+	switch {
+	case req.Body == "":
+		return req, fiber.NewError(fiber.StatusBadRequest, "Comment body is required")
+	case utf8.RuneCountInString(req.Body) > maxCommentLength:
+		return req, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Comments must not be longer than %d characters", maxCommentLength))
+	}
+	return req, nil
+}
+
+// renderComment renders a comment body and resolves its @mentions to members of the
+// organization, returning the IDs of the mentioned users
+func renderComment(q queryer, orgID int, body string) (string, []int, error) {
+	var (
+		mentioned []int
+		seen      = map[int]bool{}
+		lookupErr error
+	)
+	rendered := markdown.Render(body, func(email string) (int, bool) {
+		if lookupErr != nil {
+			return 0, false
+		}
+		rows, err := q.Query(`
+			SELECT u.id FROM users u
+			JOIN organization_members m ON m.user_id = u.id AND m.organization_id = ?
+			WHERE u.email = ? COLLATE NOCASE`, orgID, email)
+		if err != nil {
+			lookupErr = err
+			return 0, false
+		}
+		defer rows.Close()
+		if !rows.Next() {
+			lookupErr = rows.Err()
+			return 0, false
+		}
+		var userID int
+		if lookupErr = rows.Scan(&userID); lookupErr != nil {
+			return 0, false
+		}
+		if !seen[userID] {
+			seen[userID] = true
+			mentioned = append(mentioned, userID)
+		}
+		return userID, true
+	})
+	return rendered, mentioned, lookupErr
+}
+
+// saveCommentMentions replaces the users recorded as mentioned by a comment
+func saveCommentMentions(tx *sql.Tx, commentID int, userIDs []int) error {
+	if _, err := tx.Exec("DELETE FROM comment_mentions WHERE comment_id = ?", commentID); err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		if _, err := tx.Exec("INSERT INTO comment_mentions (comment_id, user_id) VALUES (?, ?)", commentID, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pageComments reads the page and per_page query parameters
+func pageComments(c *fiber.Ctx) (int, int, error) {
+	page := 1
+	if p, err := strconv.Atoi(c.Query("page", "1")); err == nil && p > 1 {
+		page = p
+	}
+	perPage := defaultCommentsPerPage
+	if raw := c.Query("per_page"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return 0, 0, fiber.NewError(fiber.StatusBadRequest, "per_page must be a positive number")
+		}
+		perPage = min(n, maxCommentsPerPage)
+	}
+	return page, perPage, nil
+}
+
+// listComments responds with a page of the comments matching a condition on c
+func listComments(c *fiber.Ctx, itemID int, where string, args ...interface{}) error {
+	page, perPage, err := pageComments(c)
+	if err != nil {
+		return err
+	}
+
+	var total int
+	if err := dal.DB.QueryRow("SELECT COUNT(*) FROM comments c WHERE "+where, args...).Scan(&total); err != nil {
+		log.Error().Err(err).Int("itemId", itemID).Msg("Failed to count comments")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to count comments"})
+	}
+
+	rows, err := dal.DB.Query("SELECT "+commentColumns+" WHERE "+where+
+		" ORDER BY c.created_at, c.id LIMIT ? OFFSET ?", append(args, perPage, (page-1)*perPage)...)
+	if err != nil {
+		log.Error().Err(err).Int("itemId", itemID).Msg("Failed to fetch comments")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch comments"})
+	}
+	defer rows.Close()
+
+	comments := []models.Comment{}
+	for rows.Next() {
+		var comment models.Comment
+		if err := scanComment(rows, &comment); err != nil {
+			log.Error().Err(err).Int("itemId", itemID).Msg("Failed to scan comment")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch comments"})
+		}
+		comments = append(comments, comment)
+	}
+	if err := rows.Err(); err != nil {
+		log.Error().Err(err).Int("itemId", itemID).Msg("Failed to iterate comments")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch comments"})
+	}
+	rows.Close()
+
+	if err := loadCommentMentions(comments); err != nil {
+		log.Error().Err(err).Int("itemId", itemID).Msg("Failed to fetch comment mentions")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch comments"})
+	}
+
+	return c.JSON(models.CommentsResponse{
+		Comments:      comments,
+		TotalComments: total,
+		TotalPages:    (total + perPage - 1) / perPage,
+		CurrentPage:   page,
+		PerPage:       perPage,
+	})
+}
+
+// GetItemComments lists the comments that start threads on an item, oldest first, with
+// the number of replies to each
+func GetItemComments(c *fiber.Ctx) error {
+	_, id, err := readableItem(c)
+	if err != nil {
+		return err
+	}
+	return listComments(c, id, "c.item_id = ? AND c.parent_id IS NULL", id)
+}
+
+// GetCommentReplies lists the replies in a comment's thread, oldest first
+func GetCommentReplies(c *fiber.Ctx) error {
+	_, id, err := readableItem(c)
+	if err != nil {
+		return err
+	}
+	comment, err := commentParam(c, id)
+	if err != nil {
+		return err
+	}
+	return listComments(c, id, "c.parent_id = ?", comment.ID)
+}
+
+func GetItemComment(c *fiber.Ctx) error {
+	_, id, err := readableItem(c)
+	if err != nil {
+		return err
+	}
+	comment, err := commentParam(c, id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(comment)
+}
+
+// CreateItemComment adds a comment to an item, or a reply when parent_id names a
+// comment on it. Replies to replies join the thread of the comment they answer.
+func CreateItemComment(c *fiber.Ctx) error {
+	userID, org, id, err := visibleItem(c)
+	if err != nil {
+		return err
+	}
+	if err := authorizeItem(c, userID, org, id, "comment_item"); err != nil {
+		return err
+	}
+
+	req, err := parseCommentBody(c)
+	if err != nil {
+		return err
+	}
+
+	var parentID interface{}
+	if req.ParentID != nil {
+		parent, err := loadComment(id, *req.ParentID)
+		if err == sql.ErrNoRows {
+			return c.Status(400).JSON(fiber.Map{"error": "parent_id must be a comment on this item"})
+		} else if err != nil {
+			log.Error().Err(err).Int("itemId", id).Int("commentId", *req.ParentID).Msg("Failed to fetch parent comment")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create comment"})
+		}
+		parentID = parent.ID
+		if parent.ParentID != nil {
+			parentID = *parent.ParentID
+		}
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create comment"})
+	}
+	defer tx.Rollback()
+
+	rendered, mentioned, err := renderComment(tx, org.ID, req.Body)
+	if err != nil {
+		log.Error().Err(err).Int("itemId", id).Msg("Failed to resolve comment mentions")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create comment"})
+	}
+
+	result, err := tx.Exec("INSERT INTO comments (item_id, parent_id, user_id, body, body_html) VALUES (?, ?, ?, ?, ?)",
+		id, parentID, userID, req.Body, rendered)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to create comment")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create comment"})
+	}
+	commentID, _ := result.LastInsertId()
+
+	if err = saveCommentMentions(tx, int(commentID), mentioned); err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to save comment")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create comment"})
+	}
+
+	comment, err := loadComment(id, int(commentID))
+	if err != nil {
+		log.Error().Err(err).Int("commentId", int(commentID)).Msg("Failed to fetch created comment")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch comment"})
+	}
+
+	log.Info().Int("userId", userID).Int("itemId", id).Int("commentId", comment.ID).
+		Ints("mentions", mentioned).Msg("Comment created")
+	return c.Status(201).JSON(comment)
+}
+
+// UpdateItemComment lets the author change a comment within COMMENT_EDIT_WINDOW of
+// posting it
+func UpdateItemComment(c *fiber.Ctx) error {
+	userID, org, id, err := visibleItem(c)
+	if err != nil {
+		return err
+	}
+	if err := authorizeItem(c, userID, org, id, "comment_item"); err != nil {
+		return err
+	}
+
+	comment, err := commentParam(c, id)
+	if err != nil {
+		return err
+	}
+	if comment.Deleted {
+		return c.Status(404).JSON(fiber.Map{"error": "Comment not found"})
+	}
+	if comment.Author == nil || comment.Author.ID != userID {
+		return c.Status(403).JSON(fiber.Map{"error": "Only the author can edit a comment"})
+	}
+	raw, window := commentEditWindow()
+	if window == 0 {
+		return c.Status(403).JSON(fiber.Map{"error": "Comments cannot be edited"})
+	}
+	if time.Since(comment.CreatedAt) > window {
+		return c.Status(403).JSON(fiber.Map{"error": fmt.Sprintf("Comments can only be edited within %s of posting", raw)})
+	}
+
+	req, err := parseCommentBody(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update comment"})
+	}
+	defer tx.Rollback()
+
+	rendered, mentioned, err := renderComment(tx, org.ID, req.Body)
+	if err != nil {
+		log.Error().Err(err).Int("commentId", comment.ID).Msg("Failed to resolve comment mentions")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update comment"})
+	}
+
+	_, err = tx.Exec(`UPDATE comments SET body = ?, body_html = ?, edited_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND deleted_at IS NULL`, req.Body, rendered, comment.ID)
+	if err == nil {
+		err = saveCommentMentions(tx, comment.ID, mentioned)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("commentId", comment.ID).Msg("Failed to update comment")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update comment"})
+	}
+
+	comment, err = loadComment(id, comment.ID)
+	if err != nil {
+		log.Error().Err(err).Int("commentId", comment.ID).Msg("Failed to fetch updated comment")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch comment"})
+	}
+
+	log.Info().Int("userId", userID).Int("commentId", comment.ID).Msg("Comment updated")
+	return c.JSON(comment)
+}
+
+// DeleteItemComment removes a comment. Authors can delete their own comments; deleting
+// anyone else's takes moderate_comments. A comment with replies keeps its place in the
+// thread without its content until the last reply is gone.
+func DeleteItemComment(c *fiber.Ctx) error {
+	userID, org, id, err := visibleItem(c)
+	if err != nil {
+		return err
+	}
+
+	comment, err := commentParam(c, id)
+	if err != nil {
+		return err
+	}
+	if comment.Deleted {
+		return c.Status(404).JSON(fiber.Map{"error": "Comment not found"})
+	}
+
+	action := "moderate_comments"
+	if comment.Author != nil && comment.Author.ID == userID {
+		action = "comment_item"
+	}
+	if err := authorizeItem(c, userID, org, id, action); err != nil {
+		return err
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to delete comment"})
+	}
+	defer tx.Rollback()
+
+	if err = removeComment(tx, comment.ID); err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("commentId", comment.ID).Msg("Failed to delete comment")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to delete comment"})
+	}
+
+	log.Info().Int("userId", userID).Int("itemId", id).Int("commentId", comment.ID).Msg("Comment deleted")
+	return c.SendStatus(204)
+}
+
+// removeComment deletes a comment, or blanks it while replies remain. Removing the last
+// reply of a blanked comment removes that comment too.
+func removeComment(tx *sql.Tx, commentID int) error {
+	var (
+		parentID sql.NullInt64
+		replies  int
+	)
+	err := tx.QueryRow("SELECT parent_id, (SELECT COUNT(*) FROM comments r WHERE r.parent_id = c.id) FROM comments c WHERE id = ?",
+		commentID).Scan(&parentID, &replies)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM comment_mentions WHERE comment_id = ?", commentID); err != nil {
+		return err
+	}
+
+	if replies > 0 {
+		_, err = tx.Exec("UPDATE comments SET body = '', body_html = '', deleted_at = CURRENT_TIMESTAMP WHERE id = ?", commentID)
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM comments WHERE id = ?", commentID); err != nil {
+		return err
+	}
+	if parentID.Valid {
+		_, err = tx.Exec(`DELETE FROM comments WHERE id = ? AND deleted_at IS NOT NULL
+			AND NOT EXISTS (SELECT 1 FROM comments r WHERE r.parent_id = comments.id)`, parentID.Int64)
+	}
+	return err
+}
@@ -57,6 +57,15 @@ func GetUserIDFromToken(c *fiber.Ctx) (int, error) {
 
 // VerifyToken validates a JWT token and returns the user ID
 func VerifyToken(tokenString string) (int, error) {
+	claims, err := ParseToken(tokenString)
+	if err != nil {
+		return 0, err
+	}
+	return claims.UserID, nil
+}
+
+// ParseToken validates a JWT token and returns all of its claims
+func ParseToken(tokenString string) (*models.Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &models.Claims{}, func(token *jwt.Token) (interface{}, error) {
 		// Validate the signing method
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -66,21 +75,27 @@ func VerifyToken(tokenString string) (int, error) {
 	})
 
 	if err != nil {
-		return 0, fmt.Errorf("failed to parse token: %w", err)
+		return nil, fmt.Errorf("failed to parse token: %w", err)
 	}
 
 	if claims, ok := token.Claims.(*models.Claims); ok && token.Valid {
-		return claims.UserID, nil
+		return claims, nil
 	}
 
-	return 0, errors.New("invalid token")
+	return nil, errors.New("invalid token")
 }
 
 // GenerateToken creates a new JWT token for a user
 func GenerateToken(userID int) (string, error) {
+	return GenerateOrganizationToken(userID, 0)
+}
+
+// GenerateOrganizationToken creates a new JWT token for a user with an active organization claim
+func GenerateOrganizationToken(userID, organizationID int) (string, error) {
 	// Create the Claims
 	claims := &models.Claims{
-		UserID: userID,
+		UserID:         userID,
+		OrganizationID: organizationID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -0,0 +1,102 @@
+package logic
+
+import (
+	"crudracula/encoders"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	cursorNext = "next"
+	cursorPrev = "prev"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// itemCursor marks a position in an items listing by the sort key values of the row
+// at the edge of a page. Cursors are signed so clients cannot forge key values, and
+// bound to the query they came from.
+type itemCursor struct {
+	Direction string        `json:"d"`
+	Query     string        `json:"q"`
+	Keys      []interface{} `json:"k"`
+}
+
+// queryFingerprint identifies the user, organization and options a cursor was issued for.
+// The page size may change between requests; everything else must stay the same.
+func queryFingerprint(userID int, org activeOrganization, params itemListParams) string {
+	var filters []string
+	for _, filter := range params.Filters {
+		filters = append(filters, filter.Param+"="+filter.Value.Format(sqliteTimeLayout))
+	}
+	if len(params.Statuses) > 0 {
+		filters = append(filters, "status="+strings.Join(params.Statuses, ","))
+	}
+	if params.Due != "" {
+		filters = append(filters, "due="+params.Due, "tz="+params.TZ)
+	}
+	if len(params.Tags) > 0 {
+		filters = append(filters, "tags="+strings.Join(params.Tags, ","), "tags_match="+params.TagMatch)
+	}
+	if params.Pinned != nil {
+		filters = append(filters, fmt.Sprintf("pinned=%t", *params.Pinned))
+	}
+	if params.Favorite != nil {
+		filters = append(filters, fmt.Sprintf("favorite=%t", *params.Favorite))
+	}
+	for _, filter := range params.Attributes {
+		filters = append(filters, attributePrefix+filter.Param+"="+strings.Join(filter.Raw, "|"))
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d|%d|%s|%s|%s|%s|%s", userID, org.ID, params.Scope,
+		params.SearchMode, params.Search, params.sortString(), strings.Join(filters, "&"))))
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+func cursorSignature(payload []byte) []byte {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// encodeCursor serializes and signs a cursor
+func encodeCursor(cursor itemCursor) (string, error) {
+	payload, err := encoders.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(cursorSignature(payload)), nil
+}
+
+// decodeCursor verifies a cursor and checks that it belongs to the given query
+func decodeCursor(raw, fingerprint string, keyCount int) (itemCursor, error) {
+	var cursor itemCursor
+
+	encodedPayload, encodedSignature, ok := strings.Cut(raw, ".")
+	if !ok {
+		return cursor, errInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return cursor, errInvalidCursor
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil || !hmac.Equal(signature, cursorSignature(payload)) {
+		return cursor, errInvalidCursor
+	}
+
+	if err := encoders.Unmarshal(payload, &cursor); err != nil {
+		return cursor, errInvalidCursor
+	}
+	if cursor.Query != fingerprint {
+		return cursor, errors.New("cursor does not match the query, the listing options must not change between pages")
+	}
+	if cursor.Direction != cursorNext && cursor.Direction != cursorPrev || len(cursor.Keys) != keyCount {
+		return cursor, errInvalidCursor
+	}
+	return cursor, nil
+}
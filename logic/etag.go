@@ -0,0 +1,108 @@
+package logic
+
+import (
+	"crudracula/models"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// itemETag identifies one version of an item
+func itemETag(id, version int) string {
+	return fmt.Sprintf(`"%d-%d"`, id, version)
+}
+
+// ifMatchRequired reports whether item writes must carry If-Match. It is read on each
+// request so that values from .env, loaded in init, are seen.
+func ifMatchRequired() bool {
+	required, _ := strconv.ParseBool(os.Getenv("REQUIRE_IF_MATCH"))
+	return required
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header lists the ETag.
+// Weak validators are compared by their opaque value.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// errPreconditionFailed carries the current representation of an item whose ETag did
+// not match If-Match
+type errPreconditionFailed struct {
+	Current models.Item
+}
+
+func (e *errPreconditionFailed) Error() string {
+	return "item has been modified"
+}
+
+// checkItemIfMatch evaluates If-Match for a write to an item the caller may access.
+// It returns the version the write must still find, or 0 when there is no precondition.
+func checkItemIfMatch(c *fiber.Ctx, id int) (int, error) {
+	header := c.Get(fiber.HeaderIfMatch)
+	if header == "" {
+		if ifMatchRequired() {
+			return 0, fiber.NewError(fiber.StatusPreconditionRequired, "If-Match header is required")
+		}
+		return 0, nil
+	}
+
+	current, err := loadItem(id)
+	if err == sql.ErrNoRows {
+		return 0, fiber.NewError(fiber.StatusNotFound, "Item not found")
+	} else if err != nil {
+		log.Error().Err(err).Int("itemId", id).Msg("Failed to load item for If-Match")
+		return 0, fiber.NewError(fiber.StatusInternalServerError, "Internal server error: failed to check item version")
+	}
+	if !etagMatches(header, current.ETag) {
+		return 0, &errPreconditionFailed{Current: current}
+	}
+	return current.Version, nil
+}
+
+// respondItemError renders a precondition failure with the item's current
+// representation and invalid attributes field by field, and returns any other error
+// for the error handler
+func respondItemError(c *fiber.Ctx, err error) error {
+	var failed *errPreconditionFailed
+	if errors.As(err, &failed) {
+		c.Set(fiber.HeaderETag, failed.Current.ETag)
+		return c.Status(fiber.StatusPreconditionFailed).JSON(fiber.Map{
+			"error":   "Item has been modified, reload it and try again",
+			"current": failed.Current,
+		})
+	}
+	var invalid *invalidAttributesError
+	if errors.As(err, &invalid) {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error":  "Invalid attributes",
+			"fields": invalid.Fields,
+		})
+	}
+	return err
+}
+
+// itemWriteRejected explains why a conditional write to an item changed no rows:
+// the item moved past the expected version, or the user cannot access it
+func itemWriteRejected(c *fiber.Ctx, userID int, org activeOrganization, id, version int) error {
+	if version != 0 {
+		current, err := loadItem(id)
+		if err == nil && current.Version != version {
+			if visible, err := hasItemAccess(userID, org, id, AccessViewer); err == nil && visible {
+				return respondItemError(c, &errPreconditionFailed{Current: current})
+			}
+		}
+	}
+	return itemAccessDenied(c, userID, org, id)
+}
@@ -0,0 +1,257 @@
+package logic
+
+import (
+	"crudracula/dal"
+	"crudracula/models"
+	"database/sql"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// positionDigits are the digits of item positions, in the order SQLite compares them
+const positionDigits = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// positionBetween returns a position that sorts strictly between a and b, where "" stands
+// for the start and the end. Positions are the digits of a fraction and never end in
+// "0", so there is always room for another one and moving an item rewrites only its row.
+func positionBetween(a, b string) string {
+	if b != "" {
+		n := 0
+		for n < len(b) && positionDigit(a, n) == b[n] {
+			n++
+		}
+		if n > 0 {
+			return b[:n] + positionBetween(a[min(n, len(a)):], b[n:])
+		}
+	}
+
+	low, high := 0, len(positionDigits)
+	if a != "" {
+		low = strings.IndexByte(positionDigits, a[0])
+	}
+	if b != "" {
+		high = strings.IndexByte(positionDigits, b[0])
+	}
+	if high-low > 1 {
+		return string(positionDigits[(low+high+1)/2])
+	}
+	if len(b) > 1 {
+		return b[:1]
+	}
+	return string(positionDigits[low]) + positionBetween(a[min(1, len(a)):], "")
+}
+
+// positionDigit is the digit of a position at index i, padded with zeros
+func positionDigit(position string, i int) byte {
+	if i < len(position) {
+		return position[i]
+	}
+	return '0'
+}
+
+// loadItemPreferences returns the preferences of a user for an item
+func loadItemPreferences(q rowQuerier, userID, itemID int) (models.ItemPreferences, error) {
+	var (
+		preferences models.ItemPreferences
+		position    sql.NullString
+	)
+	err := q.QueryRow("SELECT pinned, favorite, position FROM item_preferences WHERE user_id = ? AND item_id = ?",
+		userID, itemID).Scan(&preferences.Pinned, &preferences.Favorite, &position)
+	if err == sql.ErrNoRows {
+		return preferences, nil
+	}
+	if position.Valid {
+		preferences.Position = &position.String
+	}
+	return preferences, err
+}
+
+// setItemPreference changes one preference column of a user for an item. Rows left
+// without any preference are removed.
+func setItemPreference(tx *sql.Tx, userID, itemID int, column string, value interface{}) error {
+	_, err := tx.Exec(`
+		INSERT INTO item_preferences (user_id, item_id, `+column+`) VALUES (?, ?, ?)
+		ON CONFLICT (user_id, item_id) DO UPDATE SET `+column+` = excluded.`+column+`, updated_at = CURRENT_TIMESTAMP`,
+		userID, itemID, value)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM item_preferences
+		WHERE user_id = ? AND item_id = ? AND NOT pinned AND NOT favorite AND position IS NULL`, userID, itemID)
+	return err
+}
+
+// changeItemPreference sets a preference of the current user for a visible item and
+// responds with all their preferences for it
+func changeItemPreference(c *fiber.Ctx, column string, value interface{}) error {
+	userID, _, id, err := visibleItem(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update preferences"})
+	}
+	defer tx.Rollback()
+
+	err = setItemPreference(tx, userID, id, column, value)
+	var preferences models.ItemPreferences
+	if err == nil {
+		preferences, err = loadItemPreferences(tx, userID, id)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Str("preference", column).Msg("Failed to update item preference")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update preferences"})
+	}
+
+	log.Debug().Int("userId", userID).Int("itemId", id).Str("preference", column).Interface("value", value).Msg("Item preference changed")
+	return c.JSON(preferences)
+}
+
+// GetItemPreferences returns the current user's pin, favorite and position of an item
+func GetItemPreferences(c *fiber.Ctx) error {
+	userID, _, id, err := visibleItem(c)
+	if err != nil {
+		return err
+	}
+	preferences, err := loadItemPreferences(dal.DB, userID, id)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to fetch item preferences")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch preferences"})
+	}
+	return c.JSON(preferences)
+}
+
+// PinItem pins an item for the current user
+func PinItem(c *fiber.Ctx) error {
+	return changeItemPreference(c, "pinned", true)
+}
+
+// UnpinItem unpins an item for the current user
+func UnpinItem(c *fiber.Ctx) error {
+	return changeItemPreference(c, "pinned", false)
+}
+
+// FavoriteItem marks an item as a favorite of the current user
+func FavoriteItem(c *fiber.Ctx) error {
+	return changeItemPreference(c, "favorite", true)
+}
+
+// UnfavoriteItem removes an item from the favorites of the current user
+func UnfavoriteItem(c *fiber.Ctx) error {
+	return changeItemPreference(c, "favorite", false)
+}
+
+// ClearItemPosition takes an item out of the current user's manual order
+func ClearItemPosition(c *fiber.Ctx) error {
+	return changeItemPreference(c, "position", nil)
+}
+
+// MoveItem places an item in the current user's manual order, right before or after
+// another item of the organization, or first. Only the moved item gets a new position.
+// An item placed next to one that was never placed puts that one after all placed items
+// first.
+func MoveItem(c *fiber.Ctx) error {
+	userID, org, id, err := visibleItem(c)
+	if err != nil {
+		return err
+	}
+
+	var req models.ItemPositionRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+	}
+	neighbor := max(req.BeforeID, req.AfterID)
+	switch {
+	case req.BeforeID != 0 && req.AfterID != 0:
+		return c.Status(400).JSON(fiber.Map{"error": "Give either before_id or after_id, not both"})
+	case req.BeforeID < 0 || req.AfterID < 0:
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid item ID"})
+	case neighbor == id:
+		return c.Status(400).JSON(fiber.Map{"error": "An item cannot be placed next to itself"})
+	}
+	if neighbor != 0 {
+		visible, err := hasItemAccess(userID, org, neighbor, AccessViewer)
+		if err != nil {
+			log.Error().Err(err).Int("userId", userID).Int("itemId", neighbor).Msg("Failed to check item access")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to check item access"})
+		}
+		if !visible {
+			return c.Status(404).JSON(fiber.Map{"error": "Neighboring item not found"})
+		}
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to move item"})
+	}
+	defer tx.Rollback()
+
+	// adjacent finds the closest position of the user's other items in the organization
+	// on one side of a position
+	adjacent := func(aggregate, op, position string) (string, error) {
+		var found sql.NullString
+		err := tx.QueryRow(`
+			SELECT `+aggregate+`(p.position) FROM item_preferences p JOIN items ON items.id = p.item_id
+			WHERE p.user_id = ? AND items.organization_id = ? AND p.item_id <> ? AND p.position `+op+` ?`,
+			userID, org.ID, id, position).Scan(&found)
+		return found.String, err
+	}
+
+	var position string
+	if neighbor == 0 {
+		var first string
+		if first, err = adjacent("MIN", ">", ""); err == nil {
+			position = positionBetween("", first)
+		}
+	} else {
+		var preferences models.ItemPreferences
+		if preferences, err = loadItemPreferences(tx, userID, neighbor); err == nil && preferences.Position == nil {
+			var last string
+			if last, err = adjacent("MAX", ">", ""); err == nil {
+				placed := positionBetween(last, "")
+				preferences.Position = &placed
+				err = setItemPreference(tx, userID, neighbor, "position", placed)
+			}
+		}
+		if err == nil && req.AfterID != 0 {
+			var next string
+			if next, err = adjacent("MIN", ">", *preferences.Position); err == nil {
+				position = positionBetween(*preferences.Position, next)
+			}
+		} else if err == nil {
+			var prev string
+			if prev, err = adjacent("MAX", "<", *preferences.Position); err == nil {
+				position = positionBetween(prev, *preferences.Position)
+			}
+		}
+	}
+
+	var preferences models.ItemPreferences
+	if err == nil {
+		err = setItemPreference(tx, userID, id, "position", position)
+	}
+	if err == nil {
+		preferences, err = loadItemPreferences(tx, userID, id)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Int("neighborId", neighbor).Msg("Failed to move item")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to move item"})
+	}
+
+	log.Debug().Int("userId", userID).Int("itemId", id).Str("position", position).Msg("Item moved")
+	return c.JSON(preferences)
+}
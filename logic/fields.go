@@ -0,0 +1,486 @@
+package logic
+
+import (
+	"crudracula/dal"
+	"crudracula/encoders"
+	"crudracula/jsonschema"
+	"crudracula/models"
+	"database/sql"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Types of custom item fields
+const (
+	FieldString  = "string"
+	FieldNumber  = "number"
+	FieldInteger = "integer"
+	FieldBoolean = "boolean"
+	FieldDate    = "date"
+	FieldURL     = "url"
+)
+
+var fieldTypes = map[string]bool{
+	FieldString: true, FieldNumber: true, FieldInteger: true,
+	FieldBoolean: true, FieldDate: true, FieldURL: true,
+}
+
+// fieldNamePattern keeps field names usable as JSON paths and query parameters as is
+var fieldNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+// queryer is implemented by *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+const itemFieldColumns = "id, name, type, description, required, enum, min, max, created_at, updated_at"
+
+func scanItemField(row rowScanner, field *models.ItemField) error {
+	var (
+		enum     sql.NullString
+		min, max sql.NullFloat64
+	)
+	err := row.Scan(&field.ID, &field.Name, &field.Type, &field.Description, &field.Required,
+		&enum, &min, &max, &field.CreatedAt, &field.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	field.Enum, field.Min, field.Max = nil, nil, nil
+	if enum.Valid {
+		if err := encoders.Unmarshal([]byte(enum.String), &field.Enum); err != nil {
+			return err
+		}
+	}
+	if min.Valid {
+		field.Min = &min.Float64
+	}
+	if max.Valid {
+		field.Max = &max.Float64
+	}
+	field.CreatedAt, field.UpdatedAt = field.CreatedAt.UTC(), field.UpdatedAt.UTC()
+	return nil
+}
+
+// loadItemFields lists the custom fields of an organization by name
+func loadItemFields(q queryer, orgID int) ([]models.ItemField, error) {
+	rows, err := q.Query("SELECT "+itemFieldColumns+" FROM item_fields WHERE organization_id = ? ORDER BY name", orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fields := []models.ItemField{}
+	for rows.Next() {
+		var field models.ItemField
+		if err := scanItemField(rows, &field); err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	return fields, rows.Err()
+}
+
+// loadItemField reads one custom field of an organization
+func loadItemField(orgID, id int) (models.ItemField, error) {
+	var field models.ItemField
+	err := scanItemField(dal.DB.QueryRow("SELECT "+itemFieldColumns+" FROM item_fields WHERE id = ? AND organization_id = ?",
+		id, orgID), &field)
+	return field, err
+}
+
+// fieldSchema is the JSON Schema of the values of a field. For string-like fields Min
+// and Max bound the length.
+func fieldSchema(field models.ItemField) *jsonschema.Schema {
+	schema := &jsonschema.Schema{Description: field.Description, Enum: field.Enum}
+	switch field.Type {
+	case FieldNumber, FieldInteger:
+		schema.Type, schema.Minimum, schema.Maximum = field.Type, field.Min, field.Max
+	case FieldBoolean:
+		schema.Type = "boolean"
+	case FieldDate:
+		schema.Type, schema.Format = "string", "date"
+	case FieldString, FieldURL:
+		schema.Type = "string"
+		if field.Type == FieldURL {
+			schema.Format = "uri"
+		}
+		if field.Min != nil {
+			length := int(*field.Min)
+			schema.MinLength = &length
+		}
+		if field.Max != nil {
+			length := int(*field.Max)
+			schema.MaxLength = &length
+		}
+	}
+	return schema
+}
+
+// attributesSchema is the JSON Schema of the attributes of items with the given fields.
+// Attributes without a field are not allowed.
+func attributesSchema(fields []models.ItemField) *jsonschema.Schema {
+	closed := false
+	schema := &jsonschema.Schema{
+		Schema:               jsonschema.Draft,
+		Title:                "Item attributes",
+		Type:                 "object",
+		Properties:           map[string]*jsonschema.Schema{},
+		Required:             []string{},
+		AdditionalProperties: &closed,
+	}
+	for _, field := range fields {
+		schema.Properties[field.Name] = fieldSchema(field)
+		if field.Required {
+			schema.Required = append(schema.Required, field.Name)
+		}
+	}
+	return schema
+}
+
+// invalidAttributesError lists the attributes of an item that do not match the fields
+// of its organization
+type invalidAttributesError struct {
+	Fields []models.FieldError
+}
+
+func (e *invalidAttributesError) Error() string {
+	parts := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		parts[i] = field.Field + " " + field.Error
+	}
+	return "Invalid attributes: " + strings.Join(parts, "; ")
+}
+
+// validateItemAttributes checks attributes about to be written against the custom
+// fields of the organization
+func validateItemAttributes(q queryer, org activeOrganization, attributes map[string]interface{}) error {
+	fields, err := loadItemFields(q, org.ID)
+	if err != nil {
+		log.Error().Err(err).Int("organizationId", org.ID).Msg("Failed to load item fields")
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal server error: failed to check attributes")
+	}
+	if attributes == nil {
+		attributes = map[string]interface{}{}
+	}
+
+	var invalid []models.FieldError
+	for _, violation := range attributesSchema(fields).Validate(attributes) {
+		message := violation.Message
+		if message == "is not allowed" {
+			message = "is not a field of this organization"
+		}
+		invalid = append(invalid, models.FieldError{Field: strings.TrimPrefix(violation.Path, "/"), Error: message})
+	}
+	if len(invalid) > 0 {
+		return &invalidAttributesError{Fields: invalid}
+	}
+	return nil
+}
+
+// checkedAttributes validates attributes about to be written and serializes them for
+// the items.attributes column
+func checkedAttributes(q queryer, org activeOrganization, attributes map[string]interface{}) (string, error) {
+	if err := validateItemAttributes(q, org, attributes); err != nil {
+		return "", err
+	}
+	if attributes == nil {
+		return "{}", nil
+	}
+	encoded, err := encoders.Marshal(attributes)
+	return string(encoded), err
+}
+
+// validateItemField checks a field definition and returns it normalized
+func validateItemField(req models.ItemFieldRequest) (models.ItemField, error) {
+	field := models.ItemField{
+		Name:        strings.TrimSpace(req.Name),
+		Type:        req.Type,
+		Description: strings.TrimSpace(req.Description),
+		Required:    req.Required,
+		Enum:        req.Enum,
+		Min:         req.Min,
+		Max:         req.Max,
+	}
+	if len(field.Enum) == 0 {
+		field.Enum = nil
+	}
+
+	if !fieldNamePattern.MatchString(field.Name) {
+		return field, fiber.NewError(fiber.StatusBadRequest,
+			"name must start with a lowercase letter and contain only lowercase letters, digits and underscores, at most 50 characters")
+	}
+	if !fieldTypes[field.Type] {
+		return field, fiber.NewError(fiber.StatusBadRequest, "type must be one of string, number, integer, boolean, date or url")
+	}
+
+	if field.Min != nil || field.Max != nil {
+		switch field.Type {
+		case FieldBoolean, FieldDate:
+			return field, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("%s fields cannot have min or max", field.Type))
+		case FieldString, FieldURL:
+			for _, bound := range []*float64{field.Min, field.Max} {
+				if bound != nil && (*bound < 0 || *bound != math.Trunc(*bound)) {
+					return field, fiber.NewError(fiber.StatusBadRequest,
+						"min and max of string fields are lengths and must be whole numbers of at least 0")
+				}
+			}
+		}
+		if field.Min != nil && field.Max != nil && *field.Min > *field.Max {
+			return field, fiber.NewError(fiber.StatusBadRequest, "min must not be greater than max")
+		}
+	}
+
+	if field.Enum != nil {
+		switch field.Type {
+		case FieldString, FieldNumber, FieldInteger:
+		default:
+			return field, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("%s fields cannot have enum", field.Type))
+		}
+		// Every allowed value must itself be valid for the field
+		unrestricted := field
+		unrestricted.Enum = nil
+		schema := fieldSchema(unrestricted)
+		for _, value := range field.Enum {
+			if violations := schema.Validate(value); len(violations) > 0 {
+				return field, fiber.NewError(fiber.StatusBadRequest,
+					fmt.Sprintf("enum value %v %s", value, violations[0].Message))
+			}
+		}
+	}
+	return field, nil
+}
+
+// fieldAdmin resolves the caller of an endpoint that changes the organization's fields,
+// which is reserved to its admins
+func fieldAdmin(c *fiber.Ctx) (int, activeOrganization, error) {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return 0, activeOrganization{}, fiber.NewError(fiber.StatusUnauthorized, "Unauthorized")
+	}
+
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return 0, org, fiber.NewError(fiber.StatusForbidden, "No active organization")
+	}
+	if orgRoleRank[org.Role] < orgRoleRank[OrgRoleAdmin] {
+		return 0, org, fiber.NewError(fiber.StatusForbidden, "Only organization admins can manage item fields")
+	}
+	return userID, org, nil
+}
+
+// fieldEnumColumn serializes an enum for the item_fields.enum column
+func fieldEnumColumn(enum []interface{}) (interface{}, error) {
+	if enum == nil {
+		return nil, nil
+	}
+	encoded, err := encoders.Marshal(enum)
+	return string(encoded), err
+}
+
+// GetItemFields lists the custom fields of the active organization
+func GetItemFields(c *fiber.Ctx) error {
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
+	fields, err := loadItemFields(dal.DB, org.ID)
+	if err != nil {
+		log.Error().Err(err).Int("organizationId", org.ID).Msg("Failed to fetch item fields")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch item fields"})
+	}
+	return c.JSON(fields)
+}
+
+// GetItemFieldSchema returns the JSON Schema item attributes of the active organization
+// are validated against
+func GetItemFieldSchema(c *fiber.Ctx) error {
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
+	fields, err := loadItemFields(dal.DB, org.ID)
+	if err != nil {
+		log.Error().Err(err).Int("organizationId", org.ID).Msg("Failed to fetch item fields")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch item fields"})
+	}
+	return c.JSON(attributesSchema(fields), "application/schema+json")
+}
+
+// CreateItemField defines a new custom field. Existing items are not checked against it.
+func CreateItemField(c *fiber.Ctx) error {
+	userID, org, err := fieldAdmin(c)
+	if err != nil {
+		return err
+	}
+
+	var req models.ItemFieldRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+	}
+	field, err := validateItemField(req)
+	if err != nil {
+		return err
+	}
+
+	var exists bool
+	err = dal.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM item_fields WHERE organization_id = ? AND name = ?)",
+		org.ID, field.Name).Scan(&exists)
+	if err != nil {
+		log.Error().Err(err).Str("name", field.Name).Msg("Failed to check item field name")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create item field"})
+	}
+	if exists {
+		return c.Status(409).JSON(fiber.Map{"error": fmt.Sprintf("A field named %q already exists", field.Name)})
+	}
+
+	enum, err := fieldEnumColumn(field.Enum)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create item field"})
+	}
+	result, err := dal.DB.Exec(`
+		INSERT INTO item_fields (organization_id, name, type, description, required, enum, min, max)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		org.ID, field.Name, field.Type, field.Description, field.Required, enum, field.Min, field.Max)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Str("name", field.Name).Msg("Failed to create item field")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create item field"})
+	}
+
+	id, _ := result.LastInsertId()
+	created, err := loadItemField(org.ID, int(id))
+	if err != nil {
+		log.Error().Err(err).Int64("fieldId", id).Msg("Failed to load created item field")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create item field"})
+	}
+
+	log.Info().Int("userId", userID).Int("organizationId", org.ID).Str("name", created.Name).Msg("Item field created")
+	return c.Status(201).JSON(created)
+}
+
+// UpdateItemField redefines a custom field. Values items already have are kept as they
+// are and checked against the new definition the next time their attributes change.
+func UpdateItemField(c *fiber.Ctx) error {
+	userID, org, err := fieldAdmin(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid field ID"})
+	}
+	current, err := loadItemField(org.ID, id)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Field not found"})
+	} else if err != nil {
+		log.Error().Err(err).Int("fieldId", id).Msg("Failed to load item field")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update item field"})
+	}
+
+	var req models.ItemFieldRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+	}
+	if req.Name != "" && req.Name != current.Name {
+		return c.Status(400).JSON(fiber.Map{"error": "Field names cannot be changed"})
+	}
+	req.Name = current.Name
+	field, err := validateItemField(req)
+	if err != nil {
+		return err
+	}
+
+	enum, err := fieldEnumColumn(field.Enum)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update item field"})
+	}
+	_, err = dal.DB.Exec(`
+		UPDATE item_fields
+		SET type = ?, description = ?, required = ?, enum = ?, min = ?, max = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?`,
+		field.Type, field.Description, field.Required, enum, field.Min, field.Max, id)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("fieldId", id).Msg("Failed to update item field")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update item field"})
+	}
+
+	updated, err := loadItemField(org.ID, id)
+	if err != nil {
+		log.Error().Err(err).Int("fieldId", id).Msg("Failed to load updated item field")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update item field"})
+	}
+
+	log.Info().Int("userId", userID).Int("fieldId", id).Str("name", updated.Name).Msg("Item field updated")
+	return c.JSON(updated)
+}
+
+// DeleteItemField removes a custom field and its value from every item of the
+// organization; live items that had one get a new version
+func DeleteItemField(c *fiber.Ctx) error {
+	userID, org, err := fieldAdmin(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid field ID"})
+	}
+	field, err := loadItemField(org.ID, id)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Field not found"})
+	} else if err != nil {
+		log.Error().Err(err).Int("fieldId", id).Msg("Failed to load item field")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to delete item field"})
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to delete item field"})
+	}
+	defer tx.Rollback()
+
+	path := "$." + field.Name
+	var itemIDs []int
+	rows, err := tx.Query("SELECT id FROM items WHERE organization_id = ? AND json_type(attributes, ?) IS NOT NULL",
+		org.ID, path)
+	if err == nil {
+		for rows.Next() {
+			var itemID int
+			if err = rows.Scan(&itemID); err != nil {
+				break
+			}
+			itemIDs = append(itemIDs, itemID)
+		}
+		rows.Close()
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE items SET attributes = json_remove(attributes, ?) WHERE organization_id = ? AND json_type(attributes, ?) IS NOT NULL",
+			path, org.ID, path)
+	}
+	if err == nil {
+		err = touchItems(tx, userID, itemIDs)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM item_fields WHERE id = ?", id)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("fieldId", id).Msg("Failed to delete item field")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to delete item field"})
+	}
+
+	log.Info().Int("userId", userID).Int("fieldId", id).Str("name", field.Name).Int("items", len(itemIDs)).Msg("Item field deleted")
+	return c.SendStatus(204)
+}
@@ -0,0 +1,272 @@
+package logic
+
+import (
+	"crudracula/dal"
+	"crudracula/encoders"
+	"crudracula/jsonpatch"
+	"crudracula/models"
+	"database/sql"
+	"errors"
+	"fmt"
+	"mime"
+	"reflect"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+// maxItemNameLength matches the VARCHAR(255) of items.name
+const maxItemNameLength = 255
+
+// itemEditableFields are the members of an item a patch may change
+var itemEditableFields = map[string]bool{
+	"name": true, "description": true, "attributes": true, "due_at": true, "remind_at": true,
+}
+
+// patchItemDocument applies a patch to the JSON representation of an item
+func patchItemDocument(contentType string, body []byte, current models.Item) (interface{}, error) {
+	encoded, err := encoders.Marshal(current)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err := encoders.Unmarshal(encoded, &doc); err != nil {
+		return nil, err
+	}
+
+	if contentType == mergePatchContentType {
+		var patch interface{}
+		if err := encoders.Unmarshal(body, &patch); err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid merge patch document")
+		}
+		return jsonpatch.MergePatch(doc, patch), nil
+	}
+
+	var ops []jsonpatch.Operation
+	if err := encoders.Unmarshal(body, &ops); err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid JSON Patch document")
+	}
+	if err := jsonpatch.Validate(ops); err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	patched, err := jsonpatch.Apply(doc, ops)
+	if errors.Is(err, jsonpatch.ErrTestFailed) {
+		return nil, fiber.NewError(fiber.StatusConflict, err.Error())
+	} else if err != nil {
+		return nil, fiber.NewError(fiber.StatusUnprocessableEntity, err.Error())
+	}
+	return patched, nil
+}
+
+// validatePatchedItem checks a patched document against the item schema and returns
+// the new name, description, attributes and due dates. Read-only members must keep
+// their current values; attributes are checked against the custom fields by the caller.
+func validatePatchedItem(patched interface{}, current models.Item) (models.Item, error) {
+	var item models.Item
+	doc, ok := patched.(map[string]interface{})
+	if !ok {
+		return item, fiber.NewError(fiber.StatusUnprocessableEntity, "An item must be a JSON object")
+	}
+
+	encoded, err := encoders.Marshal(current)
+	if err != nil {
+		return item, err
+	}
+	var original map[string]interface{}
+	if err := encoders.Unmarshal(encoded, &original); err != nil {
+		return item, err
+	}
+
+	for field, value := range doc {
+		if itemEditableFields[field] {
+			continue
+		}
+		if originalValue, known := original[field]; !known {
+			return item, fiber.NewError(fiber.StatusUnprocessableEntity, fmt.Sprintf("Unknown field %q", field))
+		} else if !reflect.DeepEqual(value, originalValue) {
+			return item, fiber.NewError(fiber.StatusUnprocessableEntity, fmt.Sprintf("Field %q is read-only", field))
+		}
+	}
+	for field := range original {
+		if _, kept := doc[field]; !kept && !itemEditableFields[field] {
+			return item, fiber.NewError(fiber.StatusUnprocessableEntity, fmt.Sprintf("Field %q is read-only", field))
+		}
+	}
+
+	name, ok := doc["name"].(string)
+	if !ok || name == "" {
+		return item, fiber.NewError(fiber.StatusUnprocessableEntity, "name must be a non-empty string")
+	}
+	if len(name) > maxItemNameLength {
+		return item, fiber.NewError(fiber.StatusUnprocessableEntity,
+			fmt.Sprintf("name must be at most %d characters", maxItemNameLength))
+	}
+
+	// A removed or null description is stored as an empty one
+	var description string
+	switch value := doc["description"].(type) {
+	case nil:
+	case string:
+		description = value
+	default:
+		return item, fiber.NewError(fiber.StatusUnprocessableEntity, "description must be a string")
+	}
+
+	// Removing the attributes clears them
+	var attributes map[string]interface{}
+	switch value := doc["attributes"].(type) {
+	case nil:
+		attributes = map[string]interface{}{}
+	case map[string]interface{}:
+		attributes = value
+	default:
+		return item, fiber.NewError(fiber.StatusUnprocessableEntity, "attributes must be an object")
+	}
+
+	// Removed or null due dates are cleared
+	for field, target := range map[string]**time.Time{"due_at": &item.DueAt, "remind_at": &item.RemindAt} {
+		switch value := doc[field].(type) {
+		case nil:
+		case string:
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return item, fiber.NewError(fiber.StatusUnprocessableEntity, field+" must be an RFC 3339 timestamp or null")
+			}
+			*target = &t
+		default:
+			return item, fiber.NewError(fiber.StatusUnprocessableEntity, field+" must be an RFC 3339 timestamp or null")
+		}
+	}
+
+	item.Name, item.Description, item.Attributes = name, description, attributes
+	return item, nil
+}
+
+// PatchItem partially updates an item with a JSON Merge Patch (RFC 7396) or a JSON
+// Patch (RFC 6902), selected by Content-Type
+func PatchItem(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		log.Debug().Err(err).Int("userId", userID).Msg("No active organization")
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid ID"})
+	}
+
+	contentType, _, _ := mime.ParseMediaType(c.Get(fiber.HeaderContentType))
+	if contentType != mergePatchContentType && contentType != jsonPatchContentType {
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+			"error": "Content-Type must be " + mergePatchContentType + " or " + jsonPatchContentType,
+		})
+	}
+
+	if err := authorizeItem(c, userID, org, id, "update_item"); err != nil {
+		return err
+	}
+
+	version, err := checkItemIfMatch(c, id)
+	if err != nil {
+		return respondItemError(c, err)
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update item"})
+	}
+	defer tx.Rollback()
+
+	current, err := queryItem(tx, id)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Item not found"})
+	} else if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to load item for patch")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update item"})
+	}
+	// The item may have changed since the If-Match check, and the patch must not apply to
+	// a version the client has not seen
+	if version != 0 && current.Version != version {
+		return respondItemError(c, &errPreconditionFailed{Current: current})
+	}
+
+	patched, err := patchItemDocument(contentType, c.Body(), current)
+	if err != nil {
+		return err
+	}
+	item, err := validatePatchedItem(patched, current)
+	if err != nil {
+		return err
+	}
+
+	// Attributes are checked against the custom fields only when the patch changes them
+	var encodedAttributes interface{}
+	if !reflect.DeepEqual(item.Attributes, current.Attributes) {
+		if encodedAttributes, err = checkedAttributes(tx, org, item.Attributes); err != nil {
+			return respondItemError(c, err)
+		}
+	}
+
+	log.Debug().
+		Int("userId", userID).
+		Int("id", id).
+		Str("contentType", contentType).
+		Str("name", item.Name).
+		Msg("Patching item")
+
+	// The patch was computed from this version, so it only applies if it is still current
+	accessClause, accessArgs := itemAccessClause(userID, org, AccessEditor)
+	result, err := tx.Exec(`
+        UPDATE items
+        SET name = ?, description = ?, attributes = COALESCE(?, attributes), due_at = ?, remind_at = ?,
+            version = version + 1
+        WHERE items.id = ? AND items.version = ? AND `+accessClause,
+		append([]interface{}{item.Name, item.Description, encodedAttributes, sqliteTime(item.DueAt), sqliteTime(item.RemindAt),
+			id, current.Version}, accessArgs...)...)
+	if err != nil {
+		log.Error().Err(err).
+			Int("userId", userID).
+			Int("itemId", id).
+			Str("method", c.Method()).
+			Str("path", c.Path()).
+			Msg("Database query failed while patching item")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update item"})
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		tx.Rollback()
+		return itemWriteRejected(c, userID, org, id, current.Version)
+	}
+
+	updated, err := queryItem(tx, id)
+	if err == nil {
+		err = recordItemRevision(tx, userID, updated, RevisionUpdate, nil)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("id", id).Msg("Failed to record patched item")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update item"})
+	}
+
+	log.Info().Int("userId", userID).Int("id", id).Int("version", updated.Version).Msg("Item patched successfully")
+
+	c.Set(fiber.HeaderETag, updated.ETag)
+	return c.JSON(updated)
+}
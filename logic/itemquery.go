@@ -0,0 +1,788 @@
+package logic
+
+import (
+	"crudracula/dal"
+	"crudracula/encoders"
+	"crudracula/models"
+	"database/sql"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultItemsPerPage = 3
+	maxItemsPerPage     = 100
+)
+
+// itemColumns are the columns read by scanItem, from items joined by itemOwnerJoin.
+// Tags come as a JSON array, sorted by name, and attributes as a JSON object.
+const itemColumns = `items.id, items.name, COALESCE(items.description, ''),
+	items.user_id, owner.email, items.created_at, items.updated_at, items.version,
+	(SELECT json_group_array(name) FROM (
+		SELECT tags.name FROM item_tags JOIN tags ON tags.id = item_tags.tag_id
+		WHERE item_tags.item_id = items.id ORDER BY tags.name)),
+	items.attributes, items.status, items.due_at, items.remind_at`
+
+// itemOwnerJoin joins the creator of each item for its owner summary
+const itemOwnerJoin = "LEFT JOIN users owner ON owner.id = items.user_id"
+
+// itemPreferenceJoin joins the preferences of the user given as its argument
+const itemPreferenceJoin = "LEFT JOIN item_preferences pref ON pref.item_id = items.id AND pref.user_id = ?"
+
+// itemPreferenceColumns are the columns read by scanItemPreferences
+const itemPreferenceColumns = "IFNULL(pref.pinned, 0), IFNULL(pref.favorite, 0), pref.position"
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanItem reads itemColumns, followed by any extra columns, into an item
+func scanItem(row rowScanner, item *models.Item, extra ...interface{}) error {
+	var (
+		ownerID    int
+		ownerEmail sql.NullString
+		tags       string
+		attributes string
+		dueAt      sql.NullTime
+		remindAt   sql.NullTime
+	)
+	dest := []interface{}{&item.ID, &item.Name, &item.Description, &ownerID, &ownerEmail,
+		&item.CreatedAt, &item.UpdatedAt, &item.Version, &tags, &attributes, &item.Status, &dueAt, &remindAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return err
+	}
+	item.Tags = []string{}
+	if err := encoders.Unmarshal([]byte(tags), &item.Tags); err != nil {
+		return err
+	}
+	item.Attributes = map[string]interface{}{}
+	if err := encoders.Unmarshal([]byte(attributes), &item.Attributes); err != nil {
+		return err
+	}
+	item.ETag = itemETag(item.ID, item.Version)
+	item.CreatedAt, item.UpdatedAt = item.CreatedAt.UTC(), item.UpdatedAt.UTC()
+	item.DueAt, item.RemindAt = nullTimeUTC(dueAt), nullTimeUTC(remindAt)
+	item.Owner = nil
+	if ownerEmail.Valid {
+		item.Owner = &models.ItemOwner{ID: ownerID, Email: ownerEmail.String}
+	}
+	return nil
+}
+
+// rowQuerier is implemented by *sql.DB and *sql.Tx
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// loadItem reads an item by ID without any access check; callers must have checked it
+func loadItem(id int) (models.Item, error) {
+	return queryItem(dal.DB, id)
+}
+
+// queryItem reads an item by ID within a transaction or directly from the database
+func queryItem(q rowQuerier, id int) (models.Item, error) {
+	var item models.Item
+	err := scanItem(q.QueryRow("SELECT "+itemColumns+" FROM items "+itemOwnerJoin+" WHERE items.id = ?", id), &item)
+	return item, err
+}
+
+// sqliteTimeLayout is how CURRENT_TIMESTAMP values are stored, so filters on
+// created_at and updated_at must compare against strings in this layout
+const sqliteTimeLayout = "2006-01-02 15:04:05"
+
+// sqliteTime formats an optional time for storage next to CURRENT_TIMESTAMP values
+func sqliteTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+func nullTimeUTC(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	utc := t.Time.UTC()
+	return &utc
+}
+
+// sortRelevance orders search results by FTS5 rank
+const sortRelevance = "relevance"
+
+// itemSortColumns are the fields items can be sorted by, with the SQL they sort on.
+// Items the user never placed sort after placed ones, as "~" follows every position.
+var itemSortColumns = map[string]string{
+	"id":         "items.id",
+	"name":       "items.name COLLATE NOCASE",
+	"created_at": "items.created_at",
+	"updated_at": "items.updated_at",
+	"pinned":     "IFNULL(pref.pinned, 0)",
+	"favorite":   "IFNULL(pref.favorite, 0)",
+	"position":   "IFNULL(pref.position, '~')",
+}
+
+// itemKeyColumns select the raw value of each sort field for cursors. Timestamps are
+// cast so the driver returns the stored text rather than a parsed time.
+var itemKeyColumns = map[string]string{
+	"id":         "items.id",
+	"name":       "items.name",
+	"created_at": "CAST(items.created_at AS TEXT)",
+	"updated_at": "CAST(items.updated_at AS TEXT)",
+	"pinned":     "IFNULL(pref.pinned, 0)",
+	"favorite":   "IFNULL(pref.favorite, 0)",
+	"position":   "IFNULL(pref.position, '~')",
+}
+
+// itemSortKey is one key of a sort=name,-created_at parameter
+type itemSortKey struct {
+	Field string
+	Desc  bool
+}
+
+func (k itemSortKey) String() string {
+	if k.Desc {
+		return "-" + k.Field
+	}
+	return k.Field
+}
+
+// attributePrefix marks custom fields in sort keys and filter parameters, e.g.
+// sort=-attr.priority or attr.status=open
+const attributePrefix = "attr."
+
+// attributeColumn extracts the value of a custom field from items. Only names of
+// defined fields, which match fieldNamePattern, may be passed.
+func attributeColumn(name string) string {
+	return "json_extract(items.attributes, '$." + name + "')"
+}
+
+// column is the SQL the key sorts on. Items without a value for a custom field sort as
+// an empty string, after numbers and before any other text, so cursors can seek past them.
+func (k itemSortKey) column() string {
+	if name, ok := strings.CutPrefix(k.Field, attributePrefix); ok {
+		return "IFNULL(" + attributeColumn(name) + ", '')"
+	}
+	return itemSortColumns[k.Field]
+}
+
+// keyColumn selects the raw value of the key for cursors
+func (k itemSortKey) keyColumn() string {
+	if strings.HasPrefix(k.Field, attributePrefix) {
+		return k.column()
+	}
+	return itemKeyColumns[k.Field]
+}
+
+// itemDateFilter restricts a timestamp column to one side of a point in time
+type itemDateFilter struct {
+	Param  string // Query parameter, e.g. created_after
+	Column string
+	Op     string
+	Value  time.Time
+}
+
+// itemDateFilters lists the supported date filter parameters
+var itemDateFilters = []itemDateFilter{
+	{Param: "created_after", Column: "items.created_at", Op: ">"},
+	{Param: "created_before", Column: "items.created_at", Op: "<"},
+	{Param: "updated_after", Column: "items.updated_at", Op: ">"},
+	{Param: "updated_before", Column: "items.updated_at", Op: "<"},
+}
+
+// itemAttributeFilter restricts a custom field to a set of values, or to one side of a
+// bound with the .min and .max suffixes
+type itemAttributeFilter struct {
+	Param  string // Query parameter without the prefix, e.g. status or estimate.min
+	Name   string
+	Op     string // IN, >= or <=
+	Raw    []string
+	Values []interface{}
+}
+
+// itemListParams are the options of GET /api/items after validation
+type itemListParams struct {
+	Page       int
+	PerPage    int
+	Scope      string
+	Search     string
+	SearchMode string
+	Sort       []itemSortKey
+	Filters    []itemDateFilter
+	Attributes []itemAttributeFilter
+	Tags       []string
+	TagMatch   string // TagMatchAny or TagMatchAll
+	Statuses   []string
+	Due        string    // DueOverdue, DueToday or DueWeek
+	TZ         string    // Time zone of the days of the due filter
+	DueAfter   time.Time // Bounds of the due filter; zero when open
+	DueBefore  time.Time
+	Pinned     *bool // Only items the user pinned, or did not pin
+	Favorite   *bool
+	Cursor     string // Opaque cursor from a previous response, replaces page
+	Count      bool   // Whether to count all matching items
+}
+
+// parseItemListParams reads and validates the listing options of a request
+func parseItemListParams(c *fiber.Ctx) (itemListParams, error) {
+	params := itemListParams{
+		Page:       1,
+		PerPage:    defaultItemsPerPage,
+		Scope:      c.Query("scope", "all"),
+		Search:     strings.TrimSpace(c.Query("search", "")),
+		SearchMode: c.Query("search_mode", SearchSimple),
+		TagMatch:   c.Query("tags_match", TagMatchAny),
+		Cursor:     c.Query("cursor"),
+		Count:      c.QueryBool("count", true),
+	}
+
+	// An unparsable page falls back to the first one, as it always has
+	if page, err := strconv.Atoi(c.Query("page", "1")); err == nil && page > 1 {
+		params.Page = page
+	}
+
+	if raw := c.Query("per_page"); raw != "" {
+		perPage, err := strconv.Atoi(raw)
+		if err != nil || perPage < 1 {
+			return params, fiber.NewError(fiber.StatusBadRequest, "per_page must be a positive number")
+		}
+		params.PerPage = min(perPage, maxItemsPerPage)
+	}
+
+	switch params.Scope {
+	case "all", "owned", "shared":
+	default:
+		return params, fiber.NewError(fiber.StatusBadRequest, "scope must be one of all, owned or shared")
+	}
+
+	if params.SearchMode != SearchSimple && params.SearchMode != SearchAdvanced {
+		return params, fiber.NewError(fiber.StatusBadRequest, "search_mode must be simple or advanced")
+	}
+
+	// Custom fields are only looked up when the options refer to them
+	var fields map[string]models.ItemField
+	attributeParams := attributeQueryParams(c)
+	if len(attributeParams) > 0 || strings.Contains(c.Query("sort"), attributePrefix) {
+		var err error
+		if fields, err = activeItemFields(c); err != nil {
+			return params, err
+		}
+	}
+
+	sort, err := parseItemSort(c.Query("sort"), params.rankable(), fields)
+	if err != nil {
+		return params, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	params.Sort = sort
+	if params.Cursor != "" && !params.seekable() {
+		return params, fiber.NewError(fiber.StatusBadRequest, "cursor cannot be used when sorting by relevance")
+	}
+
+	for _, filter := range itemDateFilters {
+		raw := c.Query(filter.Param)
+		if raw == "" {
+			continue
+		}
+		value, err := parseFilterTime(raw)
+		if err != nil {
+			return params, fiber.NewError(fiber.StatusBadRequest,
+				fmt.Sprintf("%s must be an RFC 3339 timestamp or a YYYY-MM-DD date", filter.Param))
+		}
+		filter.Value = value
+		params.Filters = append(params.Filters, filter)
+	}
+
+	if raw := c.Query("tags"); raw != "" {
+		tags, err := normalizeTagNames(strings.Split(raw, ","))
+		if err != nil {
+			return params, err
+		}
+		params.Tags = tags
+	}
+	if params.TagMatch != TagMatchAny && params.TagMatch != TagMatchAll {
+		return params, fiber.NewError(fiber.StatusBadRequest, "tags_match must be any or all")
+	}
+
+	// Statuses are not checked against the workflow, so items left in old states stay findable
+	if raw := c.Query("status"); raw != "" {
+		seen := map[string]bool{}
+		for _, status := range strings.Split(raw, ",") {
+			status = strings.TrimSpace(status)
+			if !workflowNamePattern.MatchString(status) {
+				return params, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Invalid status %q", status))
+			}
+			if !seen[status] {
+				seen[status] = true
+				params.Statuses = append(params.Statuses, status)
+			}
+		}
+		slices.Sort(params.Statuses)
+	}
+
+	// Due windows start from now or from the start of today in tz, UTC by default
+	if params.Due = c.Query("due"); params.Due != "" {
+		location := time.UTC
+		if params.TZ = c.Query("tz"); params.TZ != "" {
+			if location, err = time.LoadLocation(params.TZ); err != nil {
+				return params, fiber.NewError(fiber.StatusBadRequest, "tz must be an IANA time zone name")
+			}
+		}
+		now := time.Now().In(location)
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+		switch params.Due {
+		case DueOverdue:
+			params.DueBefore = now
+		case DueToday:
+			params.DueAfter, params.DueBefore = today, today.AddDate(0, 0, 1)
+		case DueWeek:
+			params.DueAfter, params.DueBefore = today, today.AddDate(0, 0, 7)
+		default:
+			return params, fiber.NewError(fiber.StatusBadRequest, "due must be overdue, today or week")
+		}
+	}
+
+	for _, filter := range []struct {
+		param string
+		value **bool
+	}{{"pinned", &params.Pinned}, {"favorite", &params.Favorite}} {
+		if raw := c.Query(filter.param); raw != "" {
+			value, err := strconv.ParseBool(raw)
+			if err != nil {
+				return params, fiber.NewError(fiber.StatusBadRequest, filter.param+" must be true or false")
+			}
+			*filter.value = &value
+		}
+	}
+
+	if params.Attributes, err = parseAttributeFilters(attributeParams, fields); err != nil {
+		return params, err
+	}
+
+	return params, nil
+}
+
+// rankable reports whether results can be ordered by relevance
+func (p itemListParams) rankable() bool {
+	return p.Search != "" && dal.FTS5
+}
+
+// seekable reports whether the sort allows keyset pagination. Relevance scores are not
+// stored, so there is no key to continue from.
+func (p itemListParams) seekable() bool {
+	for _, key := range p.Sort {
+		if key.Field == sortRelevance {
+			return false
+		}
+	}
+	return true
+}
+
+// parseItemSort parses a comma-separated list of sort fields, each optionally prefixed
+// with "-" for descending order. Custom fields are given as attr.<name>. The default is
+// relevance when searching with FTS5, otherwise newest first. Unless sorted by id, ties
+// are broken by id so the order is stable across pages.
+func parseItemSort(raw string, rankable bool, fields map[string]models.ItemField) ([]itemSortKey, error) {
+	var keys []itemSortKey
+	seen := map[string]bool{}
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key := itemSortKey{Field: strings.TrimPrefix(part, "-"), Desc: strings.HasPrefix(part, "-")}
+		if key.Field == sortRelevance {
+			if !rankable {
+				return nil, fmt.Errorf("sort by relevance requires a full-text search")
+			}
+			key.Desc = false
+		} else if name, ok := strings.CutPrefix(key.Field, attributePrefix); ok {
+			if _, defined := fields[name]; !defined {
+				return nil, fmt.Errorf("cannot sort by %q, %q is not a custom field", key.Field, name)
+			}
+		} else if _, ok := itemSortColumns[key.Field]; !ok {
+			return nil, fmt.Errorf("cannot sort by %q, allowed fields are id, name, created_at, updated_at, pinned, favorite, position and attr.<field>", key.Field)
+		}
+		if seen[key.Field] {
+			return nil, fmt.Errorf("sort field %q is given more than once", key.Field)
+		}
+		seen[key.Field] = true
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 && rankable {
+		keys = append(keys, itemSortKey{Field: sortRelevance})
+	}
+	if !seen["id"] {
+		keys = append(keys, itemSortKey{Field: "id", Desc: true})
+	}
+	return keys, nil
+}
+
+// attributeQueryParam is a query parameter naming a custom field, with all its values
+type attributeQueryParam struct {
+	Key    string // Without the prefix
+	Values []string
+}
+
+// attributeQueryParams collects the attr.* query parameters, sorted by name
+func attributeQueryParams(c *fiber.Ctx) []attributeQueryParam {
+	values := map[string][]string{}
+	c.Context().QueryArgs().VisitAll(func(key, value []byte) {
+		if name, ok := strings.CutPrefix(string(key), attributePrefix); ok {
+			values[name] = append(values[name], string(value))
+		}
+	})
+
+	params := make([]attributeQueryParam, 0, len(values))
+	for key, value := range values {
+		params = append(params, attributeQueryParam{Key: key, Values: value})
+	}
+	sort.Slice(params, func(i, j int) bool { return params[i].Key < params[j].Key })
+	return params
+}
+
+// activeItemFields loads the custom fields of the active organization by name
+func activeItemFields(c *fiber.Ctx) (map[string]models.ItemField, error) {
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusForbidden, "No active organization")
+	}
+	fields, err := loadItemFields(dal.DB, org.ID)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Internal server error: failed to fetch item fields")
+	}
+	byName := make(map[string]models.ItemField, len(fields))
+	for _, field := range fields {
+		byName[field.Name] = field
+	}
+	return byName, nil
+}
+
+// parseAttributeFilters turns attr.<name>=value parameters into filters. Repeating a
+// parameter matches any of its values; attr.<name>.min and attr.<name>.max are
+// inclusive bounds.
+func parseAttributeFilters(params []attributeQueryParam, fields map[string]models.ItemField) ([]itemAttributeFilter, error) {
+	var filters []itemAttributeFilter
+	for _, param := range params {
+		filter := itemAttributeFilter{Param: param.Key, Name: param.Key, Op: "IN", Raw: param.Values}
+		if name, ok := strings.CutSuffix(param.Key, ".min"); ok {
+			filter.Name, filter.Op = name, ">="
+		} else if name, ok := strings.CutSuffix(param.Key, ".max"); ok {
+			filter.Name, filter.Op = name, "<="
+		}
+
+		field, defined := fields[filter.Name]
+		if !defined {
+			return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("%q is not a custom field", filter.Name))
+		}
+		if filter.Op != "IN" {
+			if field.Type == FieldBoolean {
+				return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("%s%s cannot have a range", attributePrefix, field.Name))
+			}
+			if len(param.Values) > 1 {
+				return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("%s%s can only be given once", attributePrefix, param.Key))
+			}
+		}
+
+		for _, raw := range param.Values {
+			value, err := attributeFilterValue(field, raw)
+			if err != nil {
+				return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("%s%s %s", attributePrefix, param.Key, err.Error()))
+			}
+			filter.Values = append(filter.Values, value)
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// attributeFilterValue converts a filter value to what json_extract returns for the field
+func attributeFilterValue(field models.ItemField, raw string) (interface{}, error) {
+	switch field.Type {
+	case FieldNumber, FieldInteger:
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("must be a number")
+		}
+		return value, nil
+	case FieldBoolean:
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("must be true or false")
+		}
+		if value {
+			return 1, nil
+		}
+		return 0, nil
+	case FieldDate:
+		if _, err := time.Parse("2006-01-02", raw); err != nil {
+			return nil, fmt.Errorf("must be a YYYY-MM-DD date")
+		}
+	}
+	return raw, nil
+}
+
+// parseFilterTime accepts an RFC 3339 timestamp or a plain date, read as midnight UTC
+func parseFilterTime(raw string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse("2006-01-02", raw)
+}
+
+// sortString formats the effective sort the way the sort parameter accepts it
+func (p itemListParams) sortString() string {
+	parts := make([]string, len(p.Sort))
+	for i, key := range p.Sort {
+		parts[i] = key.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// filters returns the effective date, status, due, tag, preference and custom field filters
+// for the response
+func (p itemListParams) filters() *models.ItemFilters {
+	if len(p.Filters) == 0 && len(p.Statuses) == 0 && p.Due == "" && len(p.Tags) == 0 && len(p.Attributes) == 0 &&
+		p.Pinned == nil && p.Favorite == nil {
+		return nil
+	}
+	filters := &models.ItemFilters{Status: p.Statuses, Due: p.Due, TZ: p.TZ, Pinned: p.Pinned, Favorite: p.Favorite}
+	if len(p.Tags) > 0 {
+		filters.Tags = p.Tags
+		filters.TagMatch = p.TagMatch
+	}
+	if len(p.Attributes) > 0 {
+		filters.Attributes = map[string][]string{}
+		for _, filter := range p.Attributes {
+			filters.Attributes[filter.Param] = filter.Raw
+		}
+	}
+	for _, filter := range p.Filters {
+		value := filter.Value.Format(time.RFC3339)
+		switch filter.Param {
+		case "created_after":
+			filters.CreatedAfter = value
+		case "created_before":
+			filters.CreatedBefore = value
+		case "updated_after":
+			filters.UpdatedAfter = value
+		case "updated_before":
+			filters.UpdatedBefore = value
+		}
+	}
+	return filters
+}
+
+// itemQuery accumulates the clauses of a SELECT over the items a user can see
+type itemQuery struct {
+	from    string
+	columns []string
+	where   []string
+	args    []interface{}
+	sort    []itemSortKey
+	keyed   bool // Rows end with the value of every sort key
+	search  itemSearch
+
+	// Keyset pagination: the page starts after (or, going backward, before) seekArgs
+	seekWhere string
+	seekArgs  []interface{}
+	backward  bool
+}
+
+// newItemQuery builds the query listing items of the active organization for the
+// given options
+func newItemQuery(userID int, org activeOrganization, params itemListParams) *itemQuery {
+	q := &itemQuery{
+		from:    "items " + itemOwnerJoin + " " + itemPreferenceJoin,
+		columns: []string{itemColumns, itemPreferenceColumns},
+		args:    []interface{}{userID},
+	}
+
+	// Restrict the listing to items the user can see
+	switch params.Scope {
+	case "all":
+		clause, args := itemAccessClause(userID, org, AccessViewer)
+		q.addWhere(clause, args...)
+	case "owned":
+		q.addWhere("items.organization_id = ? AND items.user_id = ? AND "+itemLiveCondition, org.ID, userID)
+	case "shared":
+		clause, args := itemSharedWithClause(userID, org)
+		q.addWhere(clause, args...)
+	}
+
+	if params.Search != "" {
+		q.search = newItemSearch(params.Search, params.SearchMode)
+		q.addWhere(q.search.Where, q.search.Args...)
+		if q.search.Join != "" {
+			q.from += " " + q.search.Join
+		}
+		if q.search.Columns != "" {
+			q.columns = append(q.columns, q.search.Columns)
+		}
+	}
+
+	for _, filter := range params.Filters {
+		q.addWhere(filter.Column+" "+filter.Op+" ?", filter.Value.UTC().Format(sqliteTimeLayout))
+	}
+
+	for _, filter := range params.Attributes {
+		if filter.Op == "IN" {
+			q.addWhere(attributeColumn(filter.Name)+" IN ("+placeholders(len(filter.Values))+")", filter.Values...)
+		} else {
+			q.addWhere(attributeColumn(filter.Name)+" "+filter.Op+" ?", filter.Values...)
+		}
+	}
+
+	if len(params.Statuses) > 0 {
+		args := make([]interface{}, len(params.Statuses))
+		for i, status := range params.Statuses {
+			args[i] = status
+		}
+		q.addWhere("items.status IN ("+placeholders(len(params.Statuses))+")", args...)
+	}
+	if !params.DueAfter.IsZero() {
+		q.addWhere("items.due_at >= ?", params.DueAfter.UTC().Format(sqliteTimeLayout))
+	}
+	if !params.DueBefore.IsZero() {
+		q.addWhere("items.due_at < ?", params.DueBefore.UTC().Format(sqliteTimeLayout))
+	}
+
+	if params.Pinned != nil {
+		q.addWhere("IFNULL(pref.pinned, 0) = ?", *params.Pinned)
+	}
+	if params.Favorite != nil {
+		q.addWhere("IFNULL(pref.favorite, 0) = ?", *params.Favorite)
+	}
+
+	// Tag names are unique per organization, so counting matches tells any from all
+	if len(params.Tags) > 0 {
+		matched := `(
+			SELECT COUNT(*) FROM item_tags JOIN tags ON tags.id = item_tags.tag_id
+			WHERE item_tags.item_id = items.id AND tags.name IN (` + placeholders(len(params.Tags)) + `))`
+		args := make([]interface{}, len(params.Tags))
+		for i, tag := range params.Tags {
+			args[i] = tag
+		}
+		if params.TagMatch == TagMatchAll {
+			q.addWhere(matched+" = ?", append(args, len(params.Tags))...)
+		} else {
+			q.addWhere(matched+" > 0", args...)
+		}
+	}
+
+	q.sort = params.Sort
+	q.keyed = params.seekable()
+	if q.keyed {
+		for _, key := range q.sort {
+			q.columns = append(q.columns, key.keyColumn())
+		}
+	}
+
+	return q
+}
+
+// seek restricts the page to items after the given sort key values, or before them
+// when going backward. Rows are then fetched in reverse order; the caller restores it.
+func (q *itemQuery) seek(values []interface{}, backward bool) {
+	var (
+		alternatives []string
+		args         []interface{}
+	)
+	for i, key := range q.sort {
+		var terms []string
+		for _, prev := range q.sort[:i] {
+			terms = append(terms, prev.column()+" = ?")
+		}
+		op := ">"
+		if key.Desc != backward {
+			op = "<"
+		}
+		terms = append(terms, key.column()+" "+op+" ?")
+		alternatives = append(alternatives, "("+strings.Join(terms, " AND ")+")")
+		args = append(args, values[:i+1]...)
+	}
+
+	q.seekWhere = "(" + strings.Join(alternatives, " OR ") + ")"
+	q.seekArgs = args
+	q.backward = backward
+}
+
+// scanItemPreferences reads itemPreferenceColumns into an item
+func scanItemPreferences(item *models.Item, pinned, favorite bool, position sql.NullString) {
+	item.Preferences = &models.ItemPreferences{Pinned: pinned, Favorite: favorite}
+	if position.Valid {
+		item.Preferences.Position = &position.String
+	}
+}
+
+// keyCount is the number of sort key columns selected after the item columns
+func (q *itemQuery) keyCount() int {
+	if !q.keyed {
+		return 0
+	}
+	return len(q.sort)
+}
+
+func (q *itemQuery) addWhere(clause string, args ...interface{}) {
+	q.where = append(q.where, clause)
+	q.args = append(q.args, args...)
+}
+
+// highlighted reports whether rows carry highlight and snippet columns
+func (q *itemQuery) highlighted() bool {
+	return q.search.Columns != ""
+}
+
+func (q *itemQuery) whereSQL() string {
+	return strings.Join(q.where, " AND ")
+}
+
+// countSQL counts all matching items
+func (q *itemQuery) countSQL() string {
+	return "SELECT COUNT(*) FROM " + q.from + " WHERE " + q.whereSQL()
+}
+
+func (q *itemQuery) orderSQL() string {
+	order := make([]string, len(q.sort))
+	for i, key := range q.sort {
+		if key.Field == sortRelevance {
+			order[i] = q.search.OrderBy
+			continue
+		}
+		order[i] = key.column()
+		if key.Desc != q.backward {
+			order[i] += " DESC"
+		}
+	}
+	return strings.Join(order, ", ")
+}
+
+// listSQL selects every matching item in order; its arguments are q.args and q.seekArgs
+func (q *itemQuery) listSQL() string {
+	where := q.whereSQL()
+	if q.seekWhere != "" {
+		where += " AND " + q.seekWhere
+	}
+	return "SELECT " + strings.Join(q.columns, ", ") +
+		" FROM " + q.from +
+		" WHERE " + where +
+		" ORDER BY " + q.orderSQL()
+}
+
+// pageSQL selects one page of matching items
+func (q *itemQuery) pageSQL() string {
+	return q.listSQL() + " LIMIT ? OFFSET ?"
+}
+
+// pageArgs are the arguments of pageSQL
+func (q *itemQuery) pageArgs(limit, offset int) []interface{} {
+	args := append([]interface{}{}, q.args...)
+	args = append(args, q.seekArgs...)
+	return append(args, limit, offset)
+}
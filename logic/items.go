@@ -3,10 +3,11 @@ package logic
 import (
 	"crudracula/dal"
 	"crudracula/models"
+	"crudracula/policy"
 	"database/sql"
 	"errors"
 	"fmt"
-	"strconv"
+	"slices"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
@@ -70,82 +71,78 @@ func GetItems(c *fiber.Ctx) error {
 		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
 	}
 
-	page, err := strconv.Atoi(c.Query("page", "1"))
+	org, err := getActiveOrganization(c)
 	if err != nil {
-		log.Error().Err(err).
-			Int("userId", userID).
-			Str("rawPage", c.Query("page")).
-			Str("default", "1").
-			Str("method", c.Method()).
-			Str("path", c.Path()).
-			Msg("Failed to parse page parameter")
-		page = 1 // Fallback to default
-	}
-	if page < 1 {
-		page = 1
+		log.Debug().Err(err).Int("userId", userID).Msg("No active organization")
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
 	}
 
-	perPage := 3
+	params, err := parseItemListParams(c)
+	if err != nil {
+		return err
+	}
+	page, perPage, search := params.Page, params.PerPage, params.Search
 	offset := (page - 1) * perPage
-	search := c.Query("search", "")
 
 	log.Debug().
 		Int("userId", userID).
 		Int("page", page).
 		Int("perPage", perPage).
 		Str("search", search).
+		Str("sort", params.sortString()).
 		Msg("Fetching items")
 
-	var totalItems int
-	var rows *sql.Rows
+	if err := authorize(c, userID, "read_item", policy.Attributes{"type": "item", "organization_id": org.ID}); err != nil {
+		return err
+	}
+
+	query := newItemQuery(userID, org, params)
+	fingerprint := queryFingerprint(userID, org, params)
 
-	if search != "" {
-		err = dal.DB.QueryRow(`
-            SELECT COUNT(*) FROM items 
-            WHERE (name LIKE ? OR description LIKE ?) AND user_id = ?`,
-			"%"+search+"%", "%"+search+"%", userID).Scan(&totalItems)
+	var cursor *itemCursor
+	if params.Cursor != "" {
+		decoded, err := decodeCursor(params.Cursor, fingerprint, query.keyCount())
 		if err != nil {
-			fmt.Println(err)
-			log.Error().Err(err).
-				Int("userId", userID).
-				Str("search", search).
-				Str("query", "SELECT COUNT(*) FROM items WHERE (name LIKE ? OR description LIKE ?) AND user_id = ?").
-				Str("method", c.Method()).
-				Str("path", c.Path()).
-				Msg("Database query failed while counting items with search")
-			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to count items"})
+			log.Debug().Err(err).Int("userId", userID).Msg("Rejected items cursor")
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 		}
+		cursor = &decoded
+		offset = 0
+	}
 
-		rows, err = dal.DB.Query(`
-            SELECT id, name, description 
-            FROM items 
-            WHERE (name LIKE ? OR description LIKE ?) AND user_id = ?
-            ORDER BY id DESC
-            LIMIT ? OFFSET ?`,
-			"%"+search+"%", "%"+search+"%", userID, perPage, offset)
-	} else {
-		err = dal.DB.QueryRow("SELECT COUNT(*) FROM items WHERE user_id = ?",
-			userID).Scan(&totalItems)
+	var totalItems, totalPages *int
+	if params.Count {
+		var total int
+		err = dal.DB.QueryRow(query.countSQL(), query.args...).Scan(&total)
+		if err != nil && search != "" && isSearchSyntaxError(err) {
+			log.Debug().Err(err).Int("userId", userID).Str("search", search).Msg("Invalid search query")
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid search query"})
+		}
 		if err != nil {
 			fmt.Println(err)
 			log.Error().Err(err).
 				Int("userId", userID).
-				Str("query", "SELECT COUNT(*) FROM items WHERE user_id = ?").
+				Str("search", search).
+				Str("query", query.countSQL()).
 				Str("method", c.Method()).
 				Str("path", c.Path()).
 				Msg("Database query failed while counting items")
 			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to count items"})
 		}
+		pages := (total + perPage - 1) / perPage
+		totalItems, totalPages = &total, &pages
+	}
 
-		rows, err = dal.DB.Query(`
-            SELECT id, name, description 
-            FROM items 
-            WHERE user_id = ? 
-            ORDER BY id DESC 
-            LIMIT ? OFFSET ?`,
-			userID, perPage, offset)
+	if cursor != nil {
+		query.seek(cursor.Keys, cursor.Direction == cursorPrev)
 	}
 
+	// Fetch one extra row to learn whether another page follows in this direction
+	rows, err := dal.DB.Query(query.pageSQL(), query.pageArgs(perPage+1, offset)...)
+	if err != nil && search != "" && isSearchSyntaxError(err) {
+		log.Debug().Err(err).Int("userId", userID).Str("search", search).Msg("Invalid search query")
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid search query"})
+	}
 	if err != nil {
 		fmt.Println(err)
 		log.Error().Err(err).
@@ -161,12 +158,24 @@ func GetItems(c *fiber.Ctx) error {
 	}
 	defer rows.Close()
 
-	totalPages := (totalItems + perPage - 1) / perPage
-
-	var items []models.Item
+	var (
+		items []models.Item
+		keys  [][]interface{}
+	)
 	for rows.Next() {
 		var item models.Item
-		if err := rows.Scan(&item.ID, &item.Name, &item.Description); err != nil {
+		var pinned, favorite bool
+		var position sql.NullString
+		extra := []interface{}{&pinned, &favorite, &position}
+		var highlightName, highlightSnippet sql.NullString
+		if query.highlighted() {
+			extra = append(extra, &highlightName, &highlightSnippet)
+		}
+		key := make([]interface{}, query.keyCount())
+		for i := range key {
+			extra = append(extra, &key[i])
+		}
+		if err := scanItem(rows, &item, extra...); err != nil {
 			log.Error().Err(err).
 				Int("userId", userID).
 				Int("page", page).
@@ -176,7 +185,12 @@ func GetItems(c *fiber.Ctx) error {
 				Msg("Failed to scan item row from database result")
 			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to process item data"})
 		}
+		scanItemPreferences(&item, pinned, favorite, position)
+		if query.highlighted() {
+			item.Highlight = newItemHighlight(highlightName.String, highlightSnippet.String)
+		}
 		items = append(items, item)
+		keys = append(keys, key)
 	}
 
 	if err = rows.Err(); err != nil {
@@ -191,20 +205,56 @@ func GetItems(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to process items"})
 	}
 
+	hasMore := len(items) > perPage
+	if hasMore {
+		items, keys = items[:perPage], keys[:perPage]
+	}
+	if query.backward {
+		slices.Reverse(items)
+		slices.Reverse(keys)
+	}
+
+	response := models.PaginatedResponse{
+		Items:      items,
+		TotalItems: totalItems,
+		TotalPages: totalPages,
+		PerPage:    perPage,
+		Sort:       params.sortString(),
+		Scope:      params.Scope,
+		Search:     search,
+		SearchMode: params.SearchMode,
+		Filters:    params.filters(),
+	}
+	if cursor == nil {
+		response.CurrentPage = page
+	}
+
+	// Cursors continue from the first and last rows of this page
+	if query.keyCount() > 0 && len(items) > 0 {
+		hasNext, hasPrev := hasMore, page > 1
+		if cursor != nil {
+			hasNext, hasPrev = cursor.Direction == cursorPrev || hasMore, cursor.Direction == cursorNext || hasMore
+		}
+		if hasNext {
+			response.NextCursor, err = encodeCursor(itemCursor{Direction: cursorNext, Query: fingerprint, Keys: keys[len(keys)-1]})
+		}
+		if err == nil && hasPrev {
+			response.PrevCursor, err = encodeCursor(itemCursor{Direction: cursorPrev, Query: fingerprint, Keys: keys[0]})
+		}
+		if err != nil {
+			log.Error().Err(err).Int("userId", userID).Msg("Failed to encode items cursor")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to process items"})
+		}
+	}
+
 	log.Info().
 		Int("userId", userID).
-		Int("totalItems", totalItems).
 		Int("returnedItems", len(items)).
 		Int("page", page).
-		Int("totalPages", totalPages).
+		Bool("cursor", cursor != nil).
 		Msg("Items retrieved successfully")
 
-	return c.JSON(models.PaginatedResponse{
-		Items:       items,
-		TotalItems:  totalItems,
-		TotalPages:  totalPages,
-		CurrentPage: page,
-	})
+	return c.JSON(response)
 }
 
 func GetItem(c *fiber.Ctx) error {
@@ -214,6 +264,12 @@ func GetItem(c *fiber.Ctx) error {
 		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
 	}
 
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		log.Debug().Err(err).Int("userId", userID).Msg("No active organization")
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
 	id, err := c.ParamsInt("id")
 	if err != nil {
 		log.Error().Err(err).
@@ -227,12 +283,14 @@ func GetItem(c *fiber.Ctx) error {
 
 	log.Debug().Int("userId", userID).Int("id", id).Msg("Fetching single item")
 
+	accessClause, accessArgs := itemAccessClause(userID, org, AccessViewer)
+
 	var item models.Item
-	err = dal.DB.QueryRow(`
-        SELECT id, name, description 
-        FROM items 
-        WHERE id = ? AND user_id = ?`,
-		id, userID).Scan(&item.ID, &item.Name, &item.Description)
+	err = scanItem(dal.DB.QueryRow(`
+        SELECT `+itemColumns+`
+        FROM items `+itemOwnerJoin+`
+        WHERE items.id = ? AND `+accessClause,
+		append([]interface{}{id}, accessArgs...)...), &item)
 
 	if err == sql.ErrNoRows {
 		log.Debug().Int("userId", userID).Int("id", id).Msg("Item not found")
@@ -241,13 +299,33 @@ func GetItem(c *fiber.Ctx) error {
 		log.Error().Err(err).
 			Int("userId", userID).
 			Int("itemId", id).
-			Str("query", "SELECT id, name, description FROM items WHERE id = ? AND user_id = ?").
+			Str("query", "SELECT "+itemColumns+" FROM items "+itemOwnerJoin+" WHERE items.id = ? AND "+accessClause).
 			Str("method", c.Method()).
 			Str("path", c.Path()).
 			Msg("Database query failed while fetching single item")
 		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch item"})
 	}
 
+	if err := authorizeItem(c, userID, org, id, "read_item"); err != nil {
+		return err
+	}
+
+	includes, err := parseItemIncludes(c.Query("include"))
+	if err != nil {
+		return err
+	}
+
+	// The ETag covers the item itself, so embedded items are never answered with 304
+	c.Set(fiber.HeaderETag, item.ETag)
+	if len(includes) > 0 {
+		if item.Related, err = itemRelations(userID, org, id, includes); err != nil {
+			log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to fetch related items")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch related items"})
+		}
+	} else if match := c.Get(fiber.HeaderIfNoneMatch); match != "" && etagMatches(match, item.ETag) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
 	log.Info().Int("userId", userID).Int("id", id).Msg("Item retrieved successfully")
 	return c.JSON(item)
 }
@@ -259,6 +337,12 @@ func CreateItem(c *fiber.Ctx) error {
 		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
 	}
 
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		log.Debug().Err(err).Int("userId", userID).Msg("No active organization")
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
 	item := new(models.Item)
 	if err := c.BodyParser(item); err != nil {
 		log.Error().Err(err).
@@ -270,22 +354,51 @@ func CreateItem(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
 	}
 
+	// Organization viewers can only read
+	if orgRoleRank[org.Role] < orgRoleRank[OrgRoleMember] {
+		return c.Status(403).JSON(fiber.Map{"error": "Organization viewers cannot create items"})
+	}
+
+	resource := policy.Attributes{"type": "item", "organization_id": org.ID, "name": item.Name}
+	if err := authorize(c, userID, "create_item", resource); err != nil {
+		return err
+	}
+
 	log.Debug().
 		Int("userId", userID).
+		Int("organizationId", org.ID).
 		Str("name", item.Name).
 		Str("description", item.Description).
 		Msg("Creating new item")
 
-	result, err := dal.DB.Exec(`
-        INSERT INTO items (name, description, user_id) 
-        VALUES (?, ?, ?)`,
-		item.Name, item.Description, userID)
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create item"})
+	}
+	defer tx.Rollback()
+
+	attributes, err := checkedAttributes(tx, org, item.Attributes)
+	if err != nil {
+		return respondItemError(c, err)
+	}
+
+	status, err := initialItemStatus(tx, org.ID)
+	if err != nil {
+		log.Error().Err(err).Int("organizationId", org.ID).Msg("Failed to fetch workflow")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create item"})
+	}
+
+	result, err := tx.Exec(`
+        INSERT INTO items (name, description, attributes, status, due_at, remind_at, user_id, organization_id) 
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		item.Name, item.Description, attributes, status, sqliteTime(item.DueAt), sqliteTime(item.RemindAt), userID, org.ID)
 	if err != nil {
 		log.Error().Err(err).
 			Int("userId", userID).
 			Str("name", item.Name).
 			Str("description", item.Description).
-			Str("query", "INSERT INTO items (name, description, user_id) VALUES (?, ?, ?)").
+			Str("query", "INSERT INTO items (name, description, attributes, status, due_at, remind_at, user_id, organization_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)").
 			Str("method", c.Method()).
 			Str("path", c.Path()).
 			Msg("Database query failed while inserting new item")
@@ -293,7 +406,18 @@ func CreateItem(c *fiber.Ctx) error {
 	}
 
 	id, _ := result.LastInsertId()
-	item.ID = int(id)
+	created, err := queryItem(tx, int(id))
+	if err == nil {
+		err = recordItemRevision(tx, userID, created, RevisionCreate, nil)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int64("id", id).Msg("Failed to record created item")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create item"})
+	}
+	item = &created
 
 	log.Info().
 		Int("userId", userID).
@@ -301,6 +425,7 @@ func CreateItem(c *fiber.Ctx) error {
 		Str("name", item.Name).
 		Msg("Item created successfully")
 
+	c.Set(fiber.HeaderETag, item.ETag)
 	return c.JSON(item)
 }
 
@@ -311,6 +436,12 @@ func UpdateItem(c *fiber.Ctx) error {
 		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
 	}
 
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		log.Debug().Err(err).Int("userId", userID).Msg("No active organization")
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
 	id, err := c.ParamsInt("id")
 	if err != nil {
 		log.Error().Err(err).
@@ -341,18 +472,47 @@ func UpdateItem(c *fiber.Ctx) error {
 		Str("description", item.Description).
 		Msg("Updating item")
 
-	result, err := dal.DB.Exec(`
+	if err := authorizeItem(c, userID, org, id, "update_item"); err != nil {
+		return err
+	}
+
+	version, err := checkItemIfMatch(c, id)
+	if err != nil {
+		return respondItemError(c, err)
+	}
+
+	accessClause, accessArgs := itemAccessClause(userID, org, AccessEditor)
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update item"})
+	}
+	defer tx.Rollback()
+
+	// Attributes and due dates left out of the request are kept as they are; PATCH
+	// clears due dates
+	var attributes interface{}
+	if item.Attributes != nil {
+		if attributes, err = checkedAttributes(tx, org, item.Attributes); err != nil {
+			return respondItemError(c, err)
+		}
+	}
+
+	result, err := tx.Exec(`
         UPDATE items 
-        SET name = ?, description = ? 
-        WHERE id = ? AND user_id = ?`,
-		item.Name, item.Description, id, userID)
+        SET name = ?, description = ?, attributes = COALESCE(?, attributes),
+            due_at = COALESCE(?, due_at), remind_at = COALESCE(?, remind_at), version = version + 1
+        WHERE items.id = ? AND (? = 0 OR items.version = ?) AND `+accessClause,
+		append([]interface{}{item.Name, item.Description, attributes, sqliteTime(item.DueAt), sqliteTime(item.RemindAt),
+			id, version, version}, accessArgs...)...)
 	if err != nil {
 		log.Error().Err(err).
 			Int("userId", userID).
 			Int("itemId", id).
 			Str("name", item.Name).
 			Str("description", item.Description).
-			Str("query", "UPDATE items SET name = ?, description = ? WHERE id = ? AND user_id = ?").
+			Str("query", "UPDATE items SET name = ?, description = ?, attributes = COALESCE(?, attributes), due_at = COALESCE(?, due_at), remind_at = COALESCE(?, remind_at), version = version + 1 WHERE items.id = ? AND (? = 0 OR items.version = ?) AND "+accessClause).
 			Str("method", c.Method()).
 			Str("path", c.Path()).
 			Msg("Database query failed while updating item")
@@ -361,17 +521,31 @@ func UpdateItem(c *fiber.Ctx) error {
 
 	rowsAffected, _ := result.RowsAffected()
 	if rowsAffected == 0 {
-		log.Debug().Int("userId", userID).Int("id", id).Msg("Item not found for update")
-		return c.Status(404).JSON(fiber.Map{"error": "Item not found"})
+		log.Debug().Int("userId", userID).Int("id", id).Msg("Item not found, not editable or modified meanwhile")
+		tx.Rollback()
+		return itemWriteRejected(c, userID, org, id, version)
+	}
+
+	updated, err := queryItem(tx, id)
+	if err == nil {
+		err = recordItemRevision(tx, userID, updated, RevisionUpdate, nil)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("id", id).Msg("Failed to record updated item")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update item"})
 	}
+	item = &updated
 
-	item.ID = id
 	log.Info().
 		Int("userId", userID).
 		Int("id", id).
 		Str("name", item.Name).
 		Msg("Item updated successfully")
 
+	c.Set(fiber.HeaderETag, item.ETag)
 	return c.JSON(item)
 }
 
@@ -382,6 +556,12 @@ func DeleteItem(c *fiber.Ctx) error {
 		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
 	}
 
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		log.Debug().Err(err).Int("userId", userID).Msg("No active organization")
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
 	id, err := c.ParamsInt("id")
 	if err != nil {
 		log.Error().Err(err).
@@ -395,13 +575,47 @@ func DeleteItem(c *fiber.Ctx) error {
 
 	log.Debug().Int("userId", userID).Int("id", id).Msg("Deleting item")
 
-	result, err := dal.DB.Exec("DELETE FROM items WHERE id = ? AND user_id = ?",
-		id, userID)
+	if err := authorizeItem(c, userID, org, id, "delete_item"); err != nil {
+		return err
+	}
+
+	// Children stay by default; children=delete moves the whole subtree to the trash
+	var descendants []int
+	switch c.Query("children", ChildrenKeep) {
+	case ChildrenKeep:
+	case ChildrenDelete:
+		if descendants, err = checkDescendantsDeletable(c, userID, org, id); err != nil {
+			return err
+		}
+	default:
+		return c.Status(400).JSON(fiber.Map{"error": "children must be keep or delete"})
+	}
+
+	version, err := checkItemIfMatch(c, id)
+	if err != nil {
+		return respondItemError(c, err)
+	}
+
+	accessClause, accessArgs := itemAccessClause(userID, org, AccessOwner)
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to delete item"})
+	}
+	defer tx.Rollback()
+
+	// Deleting moves the item to the trash; it is removed for good by PurgeItem or
+	// once the retention period has passed
+	query := `UPDATE items
+        SET deleted_at = CURRENT_TIMESTAMP, deleted_by = ?, version = version + 1
+        WHERE items.id = ? AND (? = 0 OR items.version = ?) AND ` + accessClause
+	result, err := tx.Exec(query, append([]interface{}{userID, id, version, version}, accessArgs...)...)
 	if err != nil {
 		log.Error().Err(err).
 			Int("userId", userID).
 			Int("itemId", id).
-			Str("query", "DELETE FROM items WHERE id = ? AND user_id = ?").
+			Str("query", query).
 			Str("method", c.Method()).
 			Str("path", c.Path()).
 			Msg("Database query failed while deleting item")
@@ -410,11 +624,37 @@ func DeleteItem(c *fiber.Ctx) error {
 
 	rowsAffected, _ := result.RowsAffected()
 	if rowsAffected == 0 {
-		log.Debug().Int("userId", userID).Int("id", id).Msg("Item not found for deletion")
-		return c.Status(404).JSON(fiber.Map{"error": "Item not found"})
+		log.Debug().Int("userId", userID).Int("id", id).Msg("Item not found, not deletable or modified meanwhile")
+		tx.Rollback()
+		return itemWriteRejected(c, userID, org, id, version)
+	}
+
+	for _, deletedID := range append([]int{id}, descendants...) {
+		if deletedID != id {
+			_, err = tx.Exec(`UPDATE items
+                SET deleted_at = CURRENT_TIMESTAMP, deleted_by = ?, version = version + 1
+                WHERE items.id = ? AND `+itemLiveCondition, userID, deletedID)
+			if err != nil {
+				log.Error().Err(err).Int("itemId", deletedID).Msg("Failed to delete child item")
+				return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to delete item"})
+			}
+		}
+		deleted, err := queryItem(tx, deletedID)
+		if err == nil {
+			err = recordItemRevision(tx, userID, deleted, RevisionDelete, nil)
+		}
+		if err != nil {
+			log.Error().Err(err).Int("itemId", deletedID).Msg("Failed to record item deletion")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to delete item"})
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Error().Err(err).Msg("Failed to commit transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to delete item"})
 	}
 
-	log.Info().Int("userId", userID).Int("id", id).Msg("Item deleted successfully")
+	log.Info().Int("userId", userID).Int("id", id).Ints("children", descendants).Msg("Item moved to trash")
 	return c.SendStatus(204)
 }
 
@@ -0,0 +1,447 @@
+package logic
+
+import (
+	"crudracula/dal"
+	"crudracula/models"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Relations of an item to a linked item, as named by the API
+const (
+	RelationParentOf  = "parent_of"
+	RelationChildOf   = "child_of"
+	RelationBlocks    = "blocks"
+	RelationBlockedBy = "blocked_by"
+	RelationRelatesTo = "relates_to"
+)
+
+// Stored link types, see item_links
+const (
+	linkParent  = "parent"
+	linkBlocks  = "blocks"
+	linkRelates = "relates"
+)
+
+// What DeleteItem does with the children of an item, as set by its children parameter
+const (
+	ChildrenKeep   = "keep"
+	ChildrenDelete = "delete"
+)
+
+// maxItemLinks bounds the links of one item
+const maxItemLinks = 500
+
+// itemLinkIncludes maps the include values of GetItem to the relation of the item to
+// the embedded ones
+var itemLinkIncludes = map[string]string{
+	"parent":     RelationChildOf,
+	"children":   RelationParentOf,
+	"blocks":     RelationBlocks,
+	"blocked_by": RelationBlockedBy,
+	"related":    RelationRelatesTo,
+}
+
+// linkEdge returns how the relation of item id to other is stored
+func linkEdge(relation string, id, other int) (string, int, int, bool) {
+	switch relation {
+	case RelationParentOf:
+		return linkParent, id, other, true
+	case RelationChildOf:
+		return linkParent, other, id, true
+	case RelationBlocks:
+		return linkBlocks, id, other, true
+	case RelationBlockedBy:
+		return linkBlocks, other, id, true
+	case RelationRelatesTo:
+		return linkRelates, min(id, other), max(id, other), true
+	}
+	return "", 0, 0, false
+}
+
+// linkRelation names the relation of item id in a stored link
+func linkRelation(linkType string, sourceID, id int) string {
+	switch {
+	case linkType == linkParent && sourceID == id:
+		return RelationParentOf
+	case linkType == linkParent:
+		return RelationChildOf
+	case linkType == linkBlocks && sourceID == id:
+		return RelationBlocks
+	case linkType == linkBlocks:
+		return RelationBlockedBy
+	}
+	return RelationRelatesTo
+}
+
+// loadItemLinks lists the links of an item to live items the user can see, oldest first
+func loadItemLinks(userID int, org activeOrganization, id int) ([]models.ItemLink, error) {
+	rows, err := dal.DB.Query(`
+		SELECT l.id, l.type, l.source_id, l.target_id, l.created_by, u.email, l.created_at
+		FROM item_links l
+		LEFT JOIN users u ON u.id = l.created_by
+		WHERE l.source_id = ? OR l.target_id = ?
+		ORDER BY l.id`, id, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type storedLink struct {
+		link    models.ItemLink
+		otherID int
+	}
+	var stored []storedLink
+	var otherIDs []interface{}
+	for rows.Next() {
+		var (
+			s                  storedLink
+			linkType           string
+			sourceID, targetID int
+			creatorID          sql.NullInt64
+			creatorEmail       sql.NullString
+		)
+		if err := rows.Scan(&s.link.ID, &linkType, &sourceID, &targetID, &creatorID, &creatorEmail, &s.link.CreatedAt); err != nil {
+			return nil, err
+		}
+		s.link.Relation = linkRelation(linkType, sourceID, id)
+		s.link.CreatedAt = s.link.CreatedAt.UTC()
+		if creatorID.Valid && creatorEmail.Valid {
+			s.link.CreatedBy = &models.ItemOwner{ID: int(creatorID.Int64), Email: creatorEmail.String}
+		}
+		s.otherID = targetID
+		if targetID == id {
+			s.otherID = sourceID
+		}
+		stored = append(stored, s)
+		otherIDs = append(otherIDs, s.otherID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	links := []models.ItemLink{}
+	if len(stored) == 0 {
+		return links, nil
+	}
+
+	// Links to items in the trash or out of the user's reach are left out
+	accessClause, accessArgs := itemAccessClause(userID, org, AccessViewer)
+	itemRows, err := dal.DB.Query("SELECT "+itemColumns+" FROM items "+itemOwnerJoin+
+		" WHERE items.id IN ("+placeholders(len(otherIDs))+") AND "+accessClause,
+		append(otherIDs, accessArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer itemRows.Close()
+	visible := map[int]models.Item{}
+	for itemRows.Next() {
+		var item models.Item
+		if err := scanItem(itemRows, &item); err != nil {
+			return nil, err
+		}
+		visible[item.ID] = item
+	}
+	if err := itemRows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, s := range stored {
+		if item, ok := visible[s.otherID]; ok {
+			s.link.Item = item
+			links = append(links, s.link)
+		}
+	}
+	return links, nil
+}
+
+// parseItemIncludes reads the related items GetItem is asked to embed
+func parseItemIncludes(raw string) ([]string, error) {
+	var includes []string
+	for _, include := range strings.Split(raw, ",") {
+		if include = strings.TrimSpace(include); include == "" {
+			continue
+		}
+		if _, ok := itemLinkIncludes[include]; !ok {
+			return nil, fiber.NewError(fiber.StatusBadRequest,
+				fmt.Sprintf("Unknown include %q, expected parent, children, blocks, blocked_by or related", include))
+		}
+		includes = append(includes, include)
+	}
+	return includes, nil
+}
+
+// itemRelations embeds the related items asked for into an item
+func itemRelations(userID int, org activeOrganization, id int, includes []string) (*models.ItemRelations, error) {
+	links, err := loadItemLinks(userID, org, id)
+	if err != nil {
+		return nil, err
+	}
+
+	related := func(relation string) *[]models.Item {
+		items := []models.Item{}
+		for _, link := range links {
+			if link.Relation == relation {
+				items = append(items, link.Item)
+			}
+		}
+		return &items
+	}
+
+	relations := &models.ItemRelations{}
+	for _, include := range includes {
+		switch include {
+		case "parent":
+			if parents := *related(RelationChildOf); len(parents) > 0 {
+				relations.Parent = &parents[0]
+			}
+		case "children":
+			relations.Children = related(RelationParentOf)
+		case "blocks":
+			relations.Blocks = related(RelationBlocks)
+		case "blocked_by":
+			relations.BlockedBy = related(RelationBlockedBy)
+		case "related":
+			relations.Related = related(RelationRelatesTo)
+		}
+	}
+	return relations, nil
+}
+
+// linkCreatesCycle reports whether a link of the given type from source to target
+// would close a cycle, that is whether source can already be reached from target
+func linkCreatesCycle(tx *sql.Tx, linkType string, sourceID, targetID int) (bool, error) {
+	var cycle bool
+	err := tx.QueryRow(`
+		WITH RECURSIVE reachable(id) AS (
+			SELECT ?
+			UNION
+			SELECT l.target_id FROM item_links l JOIN reachable r ON l.source_id = r.id
+			WHERE l.type = ?
+		)
+		SELECT EXISTS (SELECT 1 FROM reachable WHERE id = ?)`, targetID, linkType, sourceID).Scan(&cycle)
+	return cycle, err
+}
+
+// GetItemLinks lists the links of an item to the items the caller can see
+func GetItemLinks(c *fiber.Ctx) error {
+	userID, id, err := readableItem(c)
+	if err != nil {
+		return err
+	}
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
+	links, err := loadItemLinks(userID, org, id)
+	if err != nil {
+		log.Error().Err(err).Int("itemId", id).Msg("Failed to fetch item links")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch links"})
+	}
+	return c.JSON(links)
+}
+
+// CreateItemLink links the item to another one. Links change both items, so the
+// caller must be able to edit both.
+func CreateItemLink(c *fiber.Ctx) error {
+	userID, id, err := editableItem(c)
+	if err != nil {
+		return err
+	}
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
+	var req models.ItemLinkRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+	}
+	linkType, sourceID, targetID, ok := linkEdge(req.Relation, id, req.ItemID)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "relation must be parent_of, child_of, blocks, blocked_by or relates_to",
+		})
+	}
+	if req.ItemID == id {
+		return c.Status(400).JSON(fiber.Map{"error": "An item cannot be linked to itself"})
+	}
+
+	level, err := itemAccessLevel(userID, org, req.ItemID)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", req.ItemID).Msg("Failed to check item access")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to check item access"})
+	}
+	switch {
+	case level == "":
+		return c.Status(404).JSON(fiber.Map{"error": "Linked item not found"})
+	case accessLevelRank[level] < accessLevelRank[AccessEditor]:
+		return c.Status(403).JSON(fiber.Map{"error": "Insufficient access to linked item"})
+	}
+	if err := authorizeItem(c, userID, org, req.ItemID, "update_item"); err != nil {
+		return err
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to link items"})
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	var linkCount int
+	err = tx.QueryRow(`SELECT
+		EXISTS (SELECT 1 FROM item_links WHERE type = ? AND source_id = ? AND target_id = ?),
+		(SELECT COUNT(*) FROM item_links WHERE source_id = ? OR target_id = ?)`,
+		linkType, sourceID, targetID, id, id).Scan(&exists, &linkCount)
+	if err != nil {
+		log.Error().Err(err).Int("itemId", id).Msg("Failed to check item links")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to link items"})
+	}
+	if exists {
+		return c.Status(409).JSON(fiber.Map{"error": "The items are already linked this way"})
+	}
+	if linkCount >= maxItemLinks {
+		return c.Status(409).JSON(fiber.Map{"error": fmt.Sprintf("An item can have at most %d links", maxItemLinks)})
+	}
+
+	if linkType == linkParent {
+		// A child has one parent. A parent in the trash gives way to the new one.
+		var liveParent bool
+		err := tx.QueryRow(`SELECT EXISTS (
+			SELECT 1 FROM item_links l JOIN items ON items.id = l.source_id
+			WHERE l.type = ? AND l.target_id = ? AND `+itemLiveCondition+`)`, linkParent, targetID).Scan(&liveParent)
+		if err != nil {
+			log.Error().Err(err).Int("itemId", targetID).Msg("Failed to check item parent")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to link items"})
+		}
+		if liveParent {
+			return c.Status(409).JSON(fiber.Map{"error": fmt.Sprintf("Item %d already has a parent", targetID)})
+		}
+		if _, err := tx.Exec("DELETE FROM item_links WHERE type = ? AND target_id = ?", linkParent, targetID); err != nil {
+			log.Error().Err(err).Int("itemId", targetID).Msg("Failed to unlink trashed parent")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to link items"})
+		}
+	}
+
+	// Hierarchies and dependencies must not loop back on themselves
+	if linkType != linkRelates {
+		cycle, err := linkCreatesCycle(tx, linkType, sourceID, targetID)
+		if err != nil {
+			log.Error().Err(err).Int("itemId", id).Msg("Failed to check for link cycles")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to link items"})
+		}
+		if cycle {
+			return c.Status(409).JSON(fiber.Map{"error": "The link would create a cycle"})
+		}
+	}
+
+	result, err := tx.Exec("INSERT INTO item_links (type, source_id, target_id, created_by) VALUES (?, ?, ?, ?)",
+		linkType, sourceID, targetID, userID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Error().Err(err).Int("itemId", id).Int("linkedItemId", req.ItemID).Msg("Failed to link items")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to link items"})
+	}
+	linkID, _ := result.LastInsertId()
+
+	log.Info().Int("userId", userID).Int("itemId", id).Int("linkedItemId", req.ItemID).
+		Str("relation", req.Relation).Msg("Items linked")
+
+	links, err := loadItemLinks(userID, org, id)
+	if err != nil {
+		log.Error().Err(err).Int("itemId", id).Msg("Failed to fetch item links")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch links"})
+	}
+	for _, link := range links {
+		if link.ID == int(linkID) {
+			return c.Status(201).JSON(link)
+		}
+	}
+	return c.SendStatus(201)
+}
+
+// DeleteItemLink removes a link of the item; editors of either item may remove it
+func DeleteItemLink(c *fiber.Ctx) error {
+	userID, id, err := editableItem(c)
+	if err != nil {
+		return err
+	}
+
+	linkID, err := c.ParamsInt("linkId")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid link ID"})
+	}
+
+	result, err := dal.DB.Exec("DELETE FROM item_links WHERE id = ? AND (source_id = ? OR target_id = ?)", linkID, id, id)
+	if err != nil {
+		log.Error().Err(err).Int("itemId", id).Int("linkId", linkID).Msg("Failed to delete item link")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to delete link"})
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Link not found"})
+	}
+
+	log.Info().Int("userId", userID).Int("itemId", id).Int("linkId", linkID).Msg("Item link deleted")
+	return c.SendStatus(204)
+}
+
+// itemDescendants lists the live items below an item in its parent/child hierarchy
+func itemDescendants(q queryer, id int) ([]int, error) {
+	rows, err := q.Query(`
+		WITH RECURSIVE descendants(id) AS (
+			SELECT l.target_id FROM item_links l WHERE l.type = ? AND l.source_id = ?
+			UNION
+			SELECT l.target_id FROM item_links l JOIN descendants d ON l.source_id = d.id
+			WHERE l.type = ?
+		)
+		SELECT items.id FROM items JOIN descendants d ON d.id = items.id
+		WHERE `+itemLiveCondition+`
+		ORDER BY items.id`, linkParent, id, linkParent)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var childID int
+		if err := rows.Scan(&childID); err != nil {
+			return nil, err
+		}
+		ids = append(ids, childID)
+	}
+	return ids, rows.Err()
+}
+
+// checkDescendantsDeletable collects the children of an item that DeleteItem moves to the
+// trash along with it and checks that the caller may delete each of them
+func checkDescendantsDeletable(c *fiber.Ctx, userID int, org activeOrganization, id int) ([]int, error) {
+	descendants, err := itemDescendants(dal.DB, id)
+	if err != nil {
+		log.Error().Err(err).Int("itemId", id).Msg("Failed to fetch child items")
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Internal server error: failed to delete item")
+	}
+	for _, childID := range descendants {
+		allowed, err := hasItemAccess(userID, org, childID, AccessOwner)
+		if err != nil {
+			log.Error().Err(err).Int("userId", userID).Int("itemId", childID).Msg("Failed to check item access")
+			return nil, fiber.NewError(fiber.StatusInternalServerError, "Internal server error: failed to check item access")
+		}
+		if !allowed {
+			return nil, fiber.NewError(fiber.StatusForbidden, fmt.Sprintf("Insufficient access to delete child item %d", childID))
+		}
+		if err := authorizeItem(c, userID, org, childID, "delete_item"); err != nil {
+			return nil, err
+		}
+	}
+	return descendants, nil
+}
@@ -0,0 +1,168 @@
+package logic
+
+import (
+	"context"
+	"crudracula/dal"
+	"crudracula/models"
+	"crudracula/notify"
+	"database/sql"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultNotificationsPerPage = 20
+	maxNotificationsPerPage     = 100
+)
+
+// mailer sends e-mail through the SMTP server set up by InitNotifications, and is nil
+// when none is configured
+var mailer notify.Notifier
+
+// InitNotifications sets up e-mail delivery when SMTP_HOST is set. Reminders are then
+// sent by e-mail as well as in the app, and organization invitations can be sent.
+func InitNotifications() {
+	email, err := notify.FromEnv()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid e-mail settings")
+	}
+	mailer = email
+	log.Info().Bool("email", mailer != nil).Msg("Notifications initialized")
+}
+
+// insertNotification stores a message as a notification the user reads in the app
+func insertNotification(ctx context.Context, tx *sql.Tx, msg notify.Message) error {
+	var itemID interface{}
+	if msg.ItemID != 0 {
+		itemID = msg.ItemID
+	}
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO notifications (user_id, kind, item_id, subject, body) VALUES (?, ?, ?, ?, ?)",
+		msg.UserID, msg.Kind, itemID, msg.Subject, msg.Body)
+	return err
+}
+
+// GetNotifications pages through the notifications of the current user, newest first.
+// unread=true leaves out those already read.
+func GetNotifications(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	page := 1
+	if p, err := strconv.Atoi(c.Query("page", "1")); err == nil && p > 1 {
+		page = p
+	}
+	perPage := defaultNotificationsPerPage
+	if raw := c.Query("per_page"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return c.Status(400).JSON(fiber.Map{"error": "per_page must be a positive number"})
+		}
+		perPage = min(n, maxNotificationsPerPage)
+	}
+
+	where := "user_id = ?"
+	if c.QueryBool("unread") {
+		where += " AND read_at IS NULL"
+	}
+
+	response := models.NotificationsResponse{
+		Notifications: []models.Notification{},
+		CurrentPage:   page,
+		PerPage:       perPage,
+	}
+	err = dal.DB.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM notifications WHERE `+where+`),
+		(SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL)`, userID, userID).
+		Scan(&response.TotalNotifications, &response.Unread)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Msg("Failed to count notifications")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to count notifications"})
+	}
+	response.TotalPages = (response.TotalNotifications + perPage - 1) / perPage
+
+	rows, err := dal.DB.Query(`
+		SELECT id, kind, item_id, subject, body, read_at, created_at
+		FROM notifications WHERE `+where+`
+		ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?`, userID, perPage, (page-1)*perPage)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Msg("Failed to fetch notifications")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch notifications"})
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			notification models.Notification
+			itemID       sql.NullInt64
+			readAt       sql.NullTime
+		)
+		err := rows.Scan(&notification.ID, &notification.Kind, &itemID, &notification.Subject, &notification.Body,
+			&readAt, &notification.CreatedAt)
+		if err != nil {
+			log.Error().Err(err).Int("userId", userID).Msg("Failed to scan notification")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch notifications"})
+		}
+		if itemID.Valid {
+			id := int(itemID.Int64)
+			notification.ItemID = &id
+		}
+		notification.ReadAt = nullTimeUTC(readAt)
+		notification.CreatedAt = notification.CreatedAt.UTC()
+		response.Notifications = append(response.Notifications, notification)
+	}
+	if err := rows.Err(); err != nil {
+		log.Error().Err(err).Int("userId", userID).Msg("Failed to iterate notifications")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch notifications"})
+	}
+
+	return c.JSON(response)
+}
+
+// MarkNotificationRead marks one notification of the current user as read
+func MarkNotificationRead(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid ID"})
+	}
+
+	result, err := dal.DB.Exec(
+		"UPDATE notifications SET read_at = COALESCE(read_at, CURRENT_TIMESTAMP) WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("notificationId", id).Msg("Failed to mark notification as read")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update notification"})
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Notification not found"})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// MarkAllNotificationsRead marks every notification of the current user as read
+func MarkAllNotificationsRead(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	result, err := dal.DB.Exec(
+		"UPDATE notifications SET read_at = CURRENT_TIMESTAMP WHERE user_id = ? AND read_at IS NULL", userID)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Msg("Failed to mark notifications as read")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update notifications"})
+	}
+	marked, _ := result.RowsAffected()
+	return c.JSON(fiber.Map{"marked": marked})
+}
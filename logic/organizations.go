@@ -0,0 +1,787 @@
+package logic
+
+import (
+	"crudracula/dal"
+	"crudracula/models"
+	"crudracula/notify"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Organization roles, from least to most privileged
+const (
+	OrgRoleViewer = "viewer"
+	OrgRoleMember = "member"
+	OrgRoleAdmin  = "admin"
+	OrgRoleOwner  = "owner"
+)
+
+var orgRoleRank = map[string]int{
+	OrgRoleViewer: 1,
+	OrgRoleMember: 2,
+	OrgRoleAdmin:  3,
+	OrgRoleOwner:  4,
+}
+
+// orgRoleItemAccess is the access level an organization role implies on every item of the organization
+var orgRoleItemAccess = map[string]string{
+	OrgRoleViewer: AccessViewer,
+	OrgRoleMember: AccessEditor,
+	OrgRoleAdmin:  AccessOwner,
+	OrgRoleOwner:  AccessOwner,
+}
+
+// invitationTTL is how long an organization invitation stays valid
+const invitationTTL = 7 * 24 * time.Hour
+
+// activeOrganization is the organization a request is scoped to (set by OrganizationMiddleware)
+type activeOrganization struct {
+	ID   int
+	Role string
+}
+
+// getActiveOrganization returns the organization resolved for the current request
+func getActiveOrganization(c *fiber.Ctx) (activeOrganization, error) {
+	id, ok := c.Locals("organizationID").(int)
+	if !ok || id == 0 {
+		return activeOrganization{}, errors.New("no active organization")
+	}
+	role, _ := c.Locals("organizationRole").(string)
+	return activeOrganization{ID: id, Role: role}, nil
+}
+
+// organizationRole returns the role of a user in an organization, or an empty string for non-members
+func organizationRole(orgID, userID int) (string, error) {
+	var role string
+	err := dal.DB.QueryRow(
+		"SELECT role FROM organization_members WHERE organization_id = ? AND user_id = ?",
+		orgID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// requireOrganizationRole loads the caller's role in the organization from the route
+// and fails unless it is at least the given role. Non-members get a 404.
+func requireOrganizationRole(c *fiber.Ctx, userID, orgID int, minRole string) (string, error) {
+	role, err := organizationRole(orgID, userID)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("organizationId", orgID).Msg("Failed to get organization role")
+		return "", fiber.NewError(fiber.StatusInternalServerError, "Database error")
+	}
+	if role == "" {
+		return "", fiber.NewError(fiber.StatusNotFound, "Organization not found")
+	}
+	if orgRoleRank[role] < orgRoleRank[minRole] {
+		return "", fiber.NewError(fiber.StatusForbidden, "Insufficient organization role")
+	}
+	return role, nil
+}
+
+// createPersonalOrganization creates the personal organization of a newly registered user
+func createPersonalOrganization(tx *sql.Tx, userID int, email string) error {
+	result, err := tx.Exec(
+		"INSERT INTO organizations (name, personal_user_id, created_by) VALUES (?, ?, ?)",
+		email, userID, userID)
+	if err != nil {
+		return err
+	}
+
+	orgID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO organization_members (organization_id, user_id, role) VALUES (?, ?, ?)",
+		orgID, userID, OrgRoleOwner)
+	return err
+}
+
+func GetOrganizations(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	rows, err := dal.DB.Query(`
+		SELECT o.id, o.name, o.personal_user_id IS NOT NULL, m.role, o.created_at, o.updated_at
+		FROM organizations o
+		JOIN organization_members m ON m.organization_id = o.id
+		WHERE m.user_id = ?
+		ORDER BY o.personal_user_id IS NULL, o.name`, userID)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Msg("Failed to fetch organizations")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	defer rows.Close()
+
+	organizations := []models.Organization{}
+	for rows.Next() {
+		var org models.Organization
+		if err := rows.Scan(&org.ID, &org.Name, &org.Personal, &org.Role, &org.CreatedAt, &org.UpdatedAt); err != nil {
+			log.Error().Err(err).Msg("Failed to scan organization")
+			return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		}
+		organizations = append(organizations, org)
+	}
+
+	return c.JSON(organizations)
+}
+
+func GetOrganization(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid organization ID"})
+	}
+
+	var org models.Organization
+	err = dal.DB.QueryRow(`
+		SELECT o.id, o.name, o.personal_user_id IS NOT NULL, m.role, o.created_at, o.updated_at
+		FROM organizations o
+		JOIN organization_members m ON m.organization_id = o.id
+		WHERE o.id = ? AND m.user_id = ?`, id, userID).
+		Scan(&org.ID, &org.Name, &org.Personal, &org.Role, &org.CreatedAt, &org.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Organization not found"})
+	} else if err != nil {
+		log.Error().Err(err).Int("id", id).Msg("Failed to fetch organization")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	return c.JSON(org)
+}
+
+func CreateOrganization(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	var req models.OrganizationRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Organization name is required"})
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO organizations (name, created_by) VALUES (?, ?)", req.Name, userID)
+	if err != nil {
+		log.Error().Err(err).Str("name", req.Name).Msg("Failed to create organization")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	orgID, err := result.LastInsertId()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get last insert ID")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO organization_members (organization_id, user_id, role) VALUES (?, ?, ?)",
+		orgID, userID, OrgRoleOwner)
+	if err != nil {
+		log.Error().Err(err).Int64("organizationId", orgID).Msg("Failed to add organization owner")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Error().Err(err).Msg("Failed to commit transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	log.Info().Int("userId", userID).Int64("organizationId", orgID).Msg("Organization created")
+
+	return c.Status(201).JSON(fiber.Map{
+		"id":   orgID,
+		"name": req.Name,
+		"role": OrgRoleOwner,
+	})
+}
+
+func UpdateOrganization(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid organization ID"})
+	}
+
+	if _, err := requireOrganizationRole(c, userID, id, OrgRoleAdmin); err != nil {
+		return err
+	}
+
+	var req models.OrganizationRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Organization name is required"})
+	}
+
+	if _, err := dal.DB.Exec("UPDATE organizations SET name = ? WHERE id = ?", req.Name, id); err != nil {
+		log.Error().Err(err).Int("id", id).Msg("Failed to update organization")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	return c.JSON(fiber.Map{
+		"id":   id,
+		"name": req.Name,
+	})
+}
+
+func DeleteOrganization(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid organization ID"})
+	}
+
+	if _, err := requireOrganizationRole(c, userID, id, OrgRoleOwner); err != nil {
+		return err
+	}
+
+	var personal bool
+	var itemCount int
+	err = dal.DB.QueryRow(`
+		SELECT personal_user_id IS NOT NULL, (SELECT COUNT(*) FROM items WHERE organization_id = ?)
+		FROM organizations WHERE id = ?`, id, id).Scan(&personal, &itemCount)
+	if err != nil {
+		log.Error().Err(err).Int("id", id).Msg("Failed to check organization")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	if personal {
+		return c.Status(400).JSON(fiber.Map{"error": "Cannot delete a personal organization"})
+	}
+	if itemCount > 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Cannot delete organization while it has items"})
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		"DELETE FROM item_tags WHERE tag_id IN (SELECT id FROM tags WHERE organization_id = ?)",
+		"DELETE FROM tags WHERE organization_id = ?",
+		"DELETE FROM item_fields WHERE organization_id = ?",
+		"DELETE FROM workflows WHERE organization_id = ?",
+		"DELETE FROM item_templates WHERE organization_id = ?",
+		"DELETE FROM organization_invitations WHERE organization_id = ?",
+		"DELETE FROM organization_members WHERE organization_id = ?",
+		"DELETE FROM organizations WHERE id = ?",
+	} {
+		if _, err = tx.Exec(query, id); err != nil {
+			log.Error().Err(err).Int("id", id).Str("query", query).Msg("Failed to delete organization")
+			return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Error().Err(err).Msg("Failed to commit transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	log.Info().Int("userId", userID).Int("organizationId", id).Msg("Organization deleted")
+	return c.SendStatus(204)
+}
+
+// SwitchOrganization issues a new token whose org_id claim selects the organization
+func SwitchOrganization(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid organization ID"})
+	}
+
+	role, err := requireOrganizationRole(c, userID, id, OrgRoleViewer)
+	if err != nil {
+		return err
+	}
+
+	token, err := GenerateOrganizationToken(userID, id)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to generate token")
+		return c.Status(500).JSON(fiber.Map{"error": "Server error"})
+	}
+
+	return c.JSON(fiber.Map{
+		"token":           token,
+		"organization_id": id,
+		"role":            role,
+	})
+}
+
+func GetOrganizationMembers(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid organization ID"})
+	}
+
+	if _, err := requireOrganizationRole(c, userID, id, OrgRoleViewer); err != nil {
+		return err
+	}
+
+	rows, err := dal.DB.Query(`
+		SELECT m.user_id, u.email, m.role, m.created_at
+		FROM organization_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.organization_id = ?
+		ORDER BY u.email`, id)
+	if err != nil {
+		log.Error().Err(err).Int("organizationId", id).Msg("Failed to fetch organization members")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	defer rows.Close()
+
+	members := []models.OrganizationMember{}
+	for rows.Next() {
+		var member models.OrganizationMember
+		if err := rows.Scan(&member.UserID, &member.Email, &member.Role, &member.CreatedAt); err != nil {
+			log.Error().Err(err).Msg("Failed to scan organization member")
+			return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		}
+		members = append(members, member)
+	}
+
+	return c.JSON(members)
+}
+
+func UpdateOrganizationMember(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid organization ID"})
+	}
+
+	memberID, err := c.ParamsInt("userId")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	callerRole, err := requireOrganizationRole(c, userID, id, OrgRoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	var req models.MemberRoleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if _, ok := orgRoleRank[req.Role]; !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "role must be one of owner, admin, member or viewer"})
+	}
+
+	currentRole, err := organizationRole(id, memberID)
+	if err != nil {
+		log.Error().Err(err).Int("organizationId", id).Int("memberId", memberID).Msg("Failed to get member role")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	if currentRole == "" {
+		return c.Status(404).JSON(fiber.Map{"error": "Member not found"})
+	}
+
+	// Only owners may grant or revoke ownership
+	if (req.Role == OrgRoleOwner || currentRole == OrgRoleOwner) && callerRole != OrgRoleOwner {
+		return c.Status(403).JSON(fiber.Map{"error": "Only owners can change ownership"})
+	}
+
+	if currentRole == OrgRoleOwner && req.Role != OrgRoleOwner {
+		if lastOwner, err := isLastOwner(id); err != nil {
+			log.Error().Err(err).Int("organizationId", id).Msg("Failed to count owners")
+			return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		} else if lastOwner {
+			return c.Status(400).JSON(fiber.Map{"error": "An organization must keep at least one owner"})
+		}
+	}
+
+	_, err = dal.DB.Exec(
+		"UPDATE organization_members SET role = ? WHERE organization_id = ? AND user_id = ?",
+		req.Role, id, memberID)
+	if err != nil {
+		log.Error().Err(err).Int("organizationId", id).Int("memberId", memberID).Msg("Failed to update member role")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	log.Info().Int("userId", userID).Int("organizationId", id).Int("memberId", memberID).
+		Str("role", req.Role).Msg("Organization member updated")
+
+	return c.JSON(fiber.Map{
+		"user_id": memberID,
+		"role":    req.Role,
+	})
+}
+
+func RemoveOrganizationMember(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid organization ID"})
+	}
+
+	memberID, err := c.ParamsInt("userId")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+
+	// Members may always leave; removing others requires admin
+	minRole := OrgRoleAdmin
+	if memberID == userID {
+		minRole = OrgRoleViewer
+	}
+	callerRole, err := requireOrganizationRole(c, userID, id, minRole)
+	if err != nil {
+		return err
+	}
+
+	currentRole, err := organizationRole(id, memberID)
+	if err != nil {
+		log.Error().Err(err).Int("organizationId", id).Int("memberId", memberID).Msg("Failed to get member role")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	if currentRole == "" {
+		return c.Status(404).JSON(fiber.Map{"error": "Member not found"})
+	}
+
+	if currentRole == OrgRoleOwner {
+		if memberID != userID && callerRole != OrgRoleOwner {
+			return c.Status(403).JSON(fiber.Map{"error": "Only owners can remove owners"})
+		}
+		if lastOwner, err := isLastOwner(id); err != nil {
+			log.Error().Err(err).Int("organizationId", id).Msg("Failed to count owners")
+			return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		} else if lastOwner {
+			return c.Status(400).JSON(fiber.Map{"error": "An organization must keep at least one owner"})
+		}
+	}
+
+	_, err = dal.DB.Exec(
+		"DELETE FROM organization_members WHERE organization_id = ? AND user_id = ?", id, memberID)
+	if err != nil {
+		log.Error().Err(err).Int("organizationId", id).Int("memberId", memberID).Msg("Failed to remove member")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	log.Info().Int("userId", userID).Int("organizationId", id).Int("memberId", memberID).Msg("Organization member removed")
+	return c.SendStatus(204)
+}
+
+// isLastOwner reports whether the organization has exactly one owner left
+func isLastOwner(orgID int) (bool, error) {
+	var owners int
+	err := dal.DB.QueryRow(
+		"SELECT COUNT(*) FROM organization_members WHERE organization_id = ? AND role = ?",
+		orgID, OrgRoleOwner).Scan(&owners)
+	return owners <= 1, err
+}
+
+func GetOrganizationInvitations(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid organization ID"})
+	}
+
+	if _, err := requireOrganizationRole(c, userID, id, OrgRoleAdmin); err != nil {
+		return err
+	}
+
+	rows, err := dal.DB.Query(`
+		SELECT id, organization_id, email, role, invited_by, expires_at, accepted_at, created_at
+		FROM organization_invitations
+		WHERE organization_id = ?
+		ORDER BY created_at DESC`, id)
+	if err != nil {
+		log.Error().Err(err).Int("organizationId", id).Msg("Failed to fetch invitations")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	defer rows.Close()
+
+	invitations := []models.OrganizationInvitation{}
+	for rows.Next() {
+		var inv models.OrganizationInvitation
+		if err := rows.Scan(&inv.ID, &inv.OrganizationID, &inv.Email, &inv.Role, &inv.InvitedBy,
+			&inv.ExpiresAt, &inv.AcceptedAt, &inv.CreatedAt); err != nil {
+			log.Error().Err(err).Msg("Failed to scan invitation")
+			return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		}
+		invitations = append(invitations, inv)
+	}
+
+	return c.JSON(invitations)
+}
+
+func CreateOrganizationInvitation(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid organization ID"})
+	}
+
+	if _, err := requireOrganizationRole(c, userID, id, OrgRoleAdmin); err != nil {
+		return err
+	}
+
+	var req models.InvitationRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	req.Email = strings.TrimSpace(strings.ToLower(req.Email))
+	if !isValidEmail(req.Email) {
+		return c.Status(400).JSON(fiber.Map{"error": "A valid email is required"})
+	}
+	if req.Role == "" {
+		req.Role = OrgRoleMember
+	}
+	if req.Role == OrgRoleOwner || orgRoleRank[req.Role] == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "role must be one of admin, member or viewer"})
+	}
+
+	var alreadyMember bool
+	err = dal.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM organization_members m
+			JOIN users u ON u.id = m.user_id
+			WHERE m.organization_id = ? AND LOWER(u.email) = ?
+		)`, id, req.Email).Scan(&alreadyMember)
+	if err != nil {
+		log.Error().Err(err).Int("organizationId", id).Msg("Failed to check existing membership")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	if alreadyMember {
+		return c.Status(409).JSON(fiber.Map{"error": "User is already a member"})
+	}
+
+	// The token only ever reaches the invitee by e-mail
+	if mailer == nil {
+		return c.Status(503).JSON(fiber.Map{"error": "E-mail delivery is not configured"})
+	}
+
+	token, err := generateResetToken()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to generate invitation token")
+		return c.Status(500).JSON(fiber.Map{"error": "Server error"})
+	}
+	expires := time.Now().Add(invitationTTL)
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	var orgName string
+	if err = tx.QueryRow("SELECT name FROM organizations WHERE id = ?", id).Scan(&orgName); err != nil {
+		log.Error().Err(err).Int("organizationId", id).Msg("Failed to fetch organization")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO organization_invitations (organization_id, email, role, token_hash, invited_by, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, id, req.Email, req.Role, hashShareToken(token), userID, expires)
+	if err != nil {
+		log.Error().Err(err).Int("organizationId", id).Str("email", req.Email).Msg("Failed to create invitation")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	invitationID, _ := result.LastInsertId()
+
+	// The invitation is only kept once it was sent, so a failed send can simply be retried
+	if err = mailer.Notify(c.UserContext(), invitationMessage(c, orgName, req.Email, req.Role, token, expires)); err != nil {
+		log.Error().Err(err).Int("organizationId", id).Str("email", req.Email).Msg("Failed to send invitation")
+		return c.Status(502).JSON(fiber.Map{"error": "Failed to send invitation"})
+	}
+	if err = tx.Commit(); err != nil {
+		log.Error().Err(err).Msg("Failed to commit transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	log.Info().Int("userId", userID).Int("organizationId", id).Str("email", req.Email).Msg("Invitation sent")
+
+	return c.Status(201).JSON(fiber.Map{
+		"id":         invitationID,
+		"email":      req.Email,
+		"role":       req.Role,
+		"expires_at": expires,
+	})
+}
+
+// invitationMessage is the e-mail carrying the token of an invitation
+func invitationMessage(c *fiber.Ctx, orgName, email, role, token string, expires time.Time) notify.Message {
+	return notify.Message{
+		Email:   email,
+		Kind:    "invitation",
+		Subject: fmt.Sprintf("You are invited to join %s", orgName),
+		Body: fmt.Sprintf("You have been invited to join %s as %s.\n\n"+
+			"To accept, sign in with this address and send your invitation token to %s:\n\n%s\n\n"+
+			"The invitation expires on %s.\n",
+			orgName, role, c.BaseURL()+"/api/invitations/accept", token, expires.UTC().Format(time.RFC1123)),
+	}
+}
+
+func RevokeOrganizationInvitation(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid organization ID"})
+	}
+
+	invitationID, err := c.ParamsInt("invitationId")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid invitation ID"})
+	}
+
+	if _, err := requireOrganizationRole(c, userID, id, OrgRoleAdmin); err != nil {
+		return err
+	}
+
+	result, err := dal.DB.Exec(
+		"DELETE FROM organization_invitations WHERE id = ? AND organization_id = ? AND accepted_at IS NULL",
+		invitationID, id)
+	if err != nil {
+		log.Error().Err(err).Int("invitationId", invitationID).Msg("Failed to revoke invitation")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Invitation not found"})
+	}
+
+	return c.SendStatus(204)
+}
+
+// AcceptOrganizationInvitation adds the current user to the inviting organization.
+// The invitation must have been sent to the user's email address.
+func AcceptOrganizationInvitation(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	var req models.AcceptInvitationRequest
+	if err := c.BodyParser(&req); err != nil || req.Token == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Invitation token is required"})
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	defer tx.Rollback()
+
+	var (
+		invitationID int
+		orgID        int
+		email        string
+		role         string
+	)
+	err = tx.QueryRow(`
+		SELECT id, organization_id, email, role FROM organization_invitations
+		WHERE token_hash = ? AND accepted_at IS NULL AND expires_at > ?`,
+		hashShareToken(req.Token), time.Now()).Scan(&invitationID, &orgID, &email, &role)
+	if err == sql.ErrNoRows {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid or expired invitation"})
+	} else if err != nil {
+		log.Error().Err(err).Msg("Failed to fetch invitation")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	var userEmail string
+	if err = tx.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&userEmail); err != nil {
+		log.Error().Err(err).Int("userId", userID).Msg("Failed to fetch user")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	if !strings.EqualFold(userEmail, email) {
+		return c.Status(403).JSON(fiber.Map{"error": "Invitation was sent to a different email address"})
+	}
+
+	_, err = tx.Exec(
+		"INSERT OR IGNORE INTO organization_members (organization_id, user_id, role) VALUES (?, ?, ?)",
+		orgID, userID, role)
+	if err != nil {
+		log.Error().Err(err).Int("organizationId", orgID).Msg("Failed to add organization member")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	_, err = tx.Exec("UPDATE organization_invitations SET accepted_at = ? WHERE id = ?", time.Now(), invitationID)
+	if err != nil {
+		log.Error().Err(err).Int("invitationId", invitationID).Msg("Failed to mark invitation accepted")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Error().Err(err).Msg("Failed to commit transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	log.Info().Int("userId", userID).Int("organizationId", orgID).Msg("Invitation accepted")
+
+	return c.JSON(fiber.Map{
+		"organization_id": orgID,
+		"role":            role,
+	})
+}
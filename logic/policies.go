@@ -0,0 +1,364 @@
+package logic
+
+import (
+	"crudracula/dal"
+	"crudracula/encoders"
+	"crudracula/models"
+	"crudracula/policy"
+	"database/sql"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// builtinPolicies are the rules declared in Go. Rules from POLICY_FILE are evaluated
+// alongside them, so a file can add deny rules that narrow what roles allow.
+var builtinPolicies = []policy.Rule{
+	{
+		Name:        "role-permissions",
+		Description: "Allow actions granted to the subject's role",
+		Effect:      policy.Allow,
+		Actions:     []string{"*"},
+		Match: func(req policy.Request) (bool, error) {
+			permissions, _ := req.Subject["permissions"].([]string)
+			for _, p := range permissions {
+				if p == req.Action {
+					return true, nil
+				}
+			}
+			return false, nil
+		},
+	},
+}
+
+// InitPolicies loads the built-in rules and any declarative rules from POLICY_FILE
+func InitPolicies() {
+	rules := append([]policy.Rule{}, builtinPolicies...)
+
+	if path := os.Getenv("POLICY_FILE"); path != "" {
+		fileRules, err := policy.LoadFile(path)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", path).Msg("Failed to load policy file")
+		}
+		rules = append(rules, fileRules...)
+	}
+
+	if err := policy.Default.SetRules(rules); err != nil {
+		log.Fatal().Err(err).Msg("Invalid policy rules")
+	}
+
+	log.Info().Int("rules", len(rules)).Msg("Policies loaded")
+}
+
+// subjectAttributes describes a user for policy evaluation
+func subjectAttributes(userID int, org *activeOrganization) (policy.Attributes, error) {
+	var (
+		email    string
+		roleID   *int
+		roleName *string
+	)
+	err := dal.DB.QueryRow(`
+		SELECT u.email, u.role_id, r.name
+		FROM users u
+		LEFT JOIN roles r ON r.id = u.role_id
+		WHERE u.id = ?`, userID).Scan(&email, &roleID, &roleName)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions, err := userPermissions(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := policy.Attributes{
+		"id":          userID,
+		"email":       email,
+		"role_id":     roleID,
+		"role":        roleName,
+		"permissions": permissions,
+	}
+	if org != nil {
+		attrs["organization_id"] = org.ID
+		attrs["organization_role"] = org.Role
+	}
+	return attrs, nil
+}
+
+// userPermissions returns the names of all permissions granted to the user's role
+func userPermissions(userID int) ([]string, error) {
+	rows, err := dal.DB.Query(`
+		SELECT p.name
+		FROM permissions p
+		JOIN role_permissions rp ON rp.permission_id = p.id
+		JOIN users u ON u.role_id = rp.role_id
+		WHERE u.id = ?
+		ORDER BY p.name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, name)
+	}
+	return permissions, rows.Err()
+}
+
+// environmentAttributes describes the circumstances of the request
+func environmentAttributes(c *fiber.Ctx) policy.Attributes {
+	now := time.Now().UTC()
+	return policy.Attributes{
+		"now":     now,
+		"hour":    now.Hour(),
+		"weekday": now.Weekday().String(),
+		"ip":      c.IP(),
+		"method":  c.Method(),
+		"path":    c.Path(),
+	}
+}
+
+// itemResourceAttributes describes a live item of the organization for policy evaluation.
+// It returns nil when the item does not exist in the organization or is in the trash.
+func itemResourceAttributes(userID int, org activeOrganization, itemID int) (policy.Attributes, error) {
+	return itemResource(userID, org, itemID, false)
+}
+
+// itemResource describes an item for policy evaluation, looking either at live items or
+// at those in the trash
+func itemResource(userID int, org activeOrganization, itemID int, trashed bool) (policy.Attributes, error) {
+	condition, levelOf := itemLiveCondition, itemAccessLevel
+	if trashed {
+		condition, levelOf = itemTrashedCondition, trashedItemAccessLevel
+	}
+
+	var (
+		ownerID    int
+		name       string
+		status     string
+		tags       string
+		attributes string
+		createdAt  time.Time
+		updatedAt  time.Time
+	)
+	err := dal.DB.QueryRow(`
+		SELECT user_id, name, status,
+			(SELECT json_group_array(name) FROM (
+				SELECT tags.name FROM item_tags JOIN tags ON tags.id = item_tags.tag_id
+				WHERE item_tags.item_id = items.id ORDER BY tags.name)),
+			attributes, created_at, updated_at
+		FROM items
+		WHERE id = ? AND organization_id = ? AND `+condition, itemID, org.ID).
+		Scan(&ownerID, &name, &status, &tags, &attributes, &createdAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	tagNames := []string{}
+	if err := encoders.Unmarshal([]byte(tags), &tagNames); err != nil {
+		return nil, err
+	}
+	attributeValues := map[string]interface{}{}
+	if err := encoders.Unmarshal([]byte(attributes), &attributeValues); err != nil {
+		return nil, err
+	}
+
+	accessLevel, err := levelOf(userID, org, itemID)
+	if err != nil {
+		return nil, err
+	}
+
+	return policy.Attributes{
+		"type":            "item",
+		"id":              itemID,
+		"owner_id":        ownerID,
+		"organization_id": org.ID,
+		"name":            name,
+		"status":          status,
+		"tags":            tagNames,
+		"attributes":      attributeValues,
+		"created_at":      createdAt,
+		"updated_at":      updatedAt,
+		"access_level":    accessLevel,
+		"trashed":         trashed,
+	}, nil
+}
+
+// roleResourceAttributes describes a role for policy evaluation
+func roleResourceAttributes(roleID int) (policy.Attributes, error) {
+	var name string
+	err := dal.DB.QueryRow("SELECT name FROM roles WHERE id = ?", roleID).Scan(&name)
+	if err == sql.ErrNoRows {
+		return policy.Attributes{"type": "role", "id": roleID}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return policy.Attributes{"type": "role", "id": roleID, "name": name}, nil
+}
+
+// evaluatePolicy decides an action on a resource for the current user
+func evaluatePolicy(c *fiber.Ctx, userID int, action string, resource policy.Attributes) (policy.Decision, error) {
+	var org *activeOrganization
+	if active, err := getActiveOrganization(c); err == nil {
+		org = &active
+	}
+
+	subject, err := subjectAttributes(userID, org)
+	if err != nil {
+		return policy.Decision{}, err
+	}
+
+	return policy.Default.Evaluate(policy.Request{
+		Subject:     subject,
+		Action:      action,
+		Resource:    resource,
+		Environment: environmentAttributes(c),
+	}), nil
+}
+
+// authorize evaluates the policy engine for the current user and returns a 403 error
+// when the action is denied
+func authorize(c *fiber.Ctx, userID int, action string, resource policy.Attributes) error {
+	decision, err := evaluatePolicy(c, userID, action, resource)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Str("action", action).Msg("Failed to load policy subject")
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to check user permissions")
+	}
+	if !decision.Allowed {
+		log.Debug().Int("userId", userID).Str("action", action).Str("rule", decision.Rule).
+			Str("reason", decision.Reason).Msg("Policy denied action")
+		return fiber.NewError(fiber.StatusForbidden, "Permission denied: "+decision.Reason)
+	}
+	return nil
+}
+
+// authorizeItem evaluates the policy engine for an action on a live item of the active
+// organization, returning a 404 error when the item does not exist there
+func authorizeItem(c *fiber.Ctx, userID int, org activeOrganization, itemID int, action string) error {
+	return authorizeItemResource(c, userID, org, itemID, action, false)
+}
+
+// authorizeTrashedItem is authorizeItem for items in the trash
+func authorizeTrashedItem(c *fiber.Ctx, userID int, org activeOrganization, itemID int, action string) error {
+	return authorizeItemResource(c, userID, org, itemID, action, true)
+}
+
+func authorizeItemResource(c *fiber.Ctx, userID int, org activeOrganization, itemID int, action string, trashed bool) error {
+	resource, err := itemResource(userID, org, itemID, trashed)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", itemID).Msg("Failed to load policy resource")
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to check user permissions")
+	}
+	if resource == nil {
+		return fiber.NewError(fiber.StatusNotFound, "Item not found")
+	}
+	return authorize(c, userID, action, resource)
+}
+
+// ExplainPermission evaluates a policy request without performing it and reports
+// how every rule responded
+func ExplainPermission(c *fiber.Ctx) error {
+	callerID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	var req models.PolicyExplainRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if req.Action == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Action is required"})
+	}
+
+	userID := callerID
+	if req.UserID != nil {
+		userID = *req.UserID
+	}
+
+	// Resolve the organization the subject would be acting in
+	var org activeOrganization
+	if req.OrganizationID != nil {
+		org.ID = *req.OrganizationID
+	} else {
+		err = dal.DB.QueryRow("SELECT id FROM organizations WHERE personal_user_id = ?", userID).Scan(&org.ID)
+		if err != nil && err != sql.ErrNoRows {
+			log.Error().Err(err).Int("userId", userID).Msg("Failed to get personal organization")
+			return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		}
+	}
+	// manage_roles is not scoped to an organization, so only organizations the caller
+	// belongs to can be looked into
+	if _, err := requireOrganizationRole(c, callerID, org.ID, OrgRoleViewer); err != nil {
+		return err
+	}
+	if org.Role, err = organizationRole(org.ID, userID); err != nil {
+		log.Error().Err(err).Int("userId", userID).Msg("Failed to get organization role")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	subject, err := subjectAttributes(userID, &org)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+	} else if err != nil {
+		log.Error().Err(err).Int("userId", userID).Msg("Failed to load policy subject")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	// Load stored attributes for known resource types, letting the request fill in the rest
+	resource := policy.Attributes{}
+	resourceType, _ := req.Resource["type"].(string)
+	resourceID, hasID := req.Resource["id"].(float64)
+	if hasID {
+		var stored policy.Attributes
+		switch resourceType {
+		case "item":
+			stored, err = itemResourceAttributes(userID, org, int(resourceID))
+		case "role":
+			stored, err = roleResourceAttributes(int(resourceID))
+		}
+		if err != nil {
+			log.Error().Err(err).Str("type", resourceType).Int("id", int(resourceID)).Msg("Failed to load policy resource")
+			return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		}
+		if stored == nil && resourceType == "item" {
+			return c.Status(404).JSON(fiber.Map{"error": "Item not found"})
+		}
+		for k, v := range stored {
+			resource[k] = v
+		}
+	}
+	for k, v := range req.Resource {
+		if _, ok := resource[k]; !ok {
+			resource[k] = v
+		}
+	}
+
+	request := policy.Request{
+		Subject:     subject,
+		Action:      req.Action,
+		Resource:    resource,
+		Environment: environmentAttributes(c),
+	}
+	decision := policy.Default.Evaluate(request)
+
+	log.Info().Int("callerId", callerID).Int("userId", userID).Str("action", req.Action).
+		Bool("allowed", decision.Allowed).Str("rule", decision.Rule).Msg("Policy explained")
+
+	return c.JSON(fiber.Map{
+		"allowed":     decision.Allowed,
+		"rule":        decision.Rule,
+		"reason":      decision.Reason,
+		"evaluations": decision.Evaluations,
+		"request":     request,
+	})
+}
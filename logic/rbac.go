@@ -0,0 +1,444 @@
+package logic
+
+import (
+	"crudracula/dal"
+	"crudracula/encoders"
+	"crudracula/models"
+	"crudracula/policy"
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// rbacDocumentVersion is the version written by ExportRoles and accepted by ApplyRoles
+const rbacDocumentVersion = 1
+
+const (
+	// adminRoleName is the role seeded with every permission; documents never change it
+	adminRoleName = "admin"
+	// defaultRoleName is the role given to new users at signup; it is never pruned
+	defaultRoleName = "user"
+)
+
+// storedRole is a role as it currently exists in the database
+type storedRole struct {
+	ID          int
+	Description string
+	Permissions map[string]bool
+	UserCount   int
+}
+
+// isYAMLContentType reports whether a Content-Type header names a YAML document
+func isYAMLContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return true
+	}
+	return false
+}
+
+// loadRoles reads every role with its permission names and the number of users holding it
+func loadRoles() (map[string]*storedRole, error) {
+	rows, err := dal.DB.Query(`
+		SELECT r.id, r.name, COALESCE(r.description, ''),
+			(SELECT COUNT(*) FROM users u WHERE u.role_id = r.id)
+		FROM roles r`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := map[string]*storedRole{}
+	byID := map[int]*storedRole{}
+	for rows.Next() {
+		var (
+			name string
+			role = &storedRole{Permissions: map[string]bool{}}
+		)
+		if err := rows.Scan(&role.ID, &name, &role.Description, &role.UserCount); err != nil {
+			return nil, err
+		}
+		roles[name] = role
+		byID[role.ID] = role
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	permRows, err := dal.DB.Query(`
+		SELECT rp.role_id, p.name
+		FROM role_permissions rp
+		JOIN permissions p ON p.id = rp.permission_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer permRows.Close()
+
+	for permRows.Next() {
+		var (
+			roleID int
+			name   string
+		)
+		if err := permRows.Scan(&roleID, &name); err != nil {
+			return nil, err
+		}
+		if role, ok := byID[roleID]; ok {
+			role.Permissions[name] = true
+		}
+	}
+	return roles, permRows.Err()
+}
+
+// loadPermissionIDs maps every permission name to its ID
+func loadPermissionIDs() (map[string]int, error) {
+	rows, err := dal.DB.Query("SELECT id, name FROM permissions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := map[string]int{}
+	for rows.Next() {
+		var (
+			id   int
+			name string
+		)
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		ids[name] = id
+	}
+	return ids, rows.Err()
+}
+
+// sortedKeys returns the keys of a set in alphabetical order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validateRBACDocument checks a document against the known permissions
+func validateRBACDocument(doc models.RBACDocument, permissionIDs map[string]int) error {
+	if doc.Version != 0 && doc.Version != rbacDocumentVersion {
+		return fmt.Errorf("unsupported document version %d", doc.Version)
+	}
+
+	seen := map[string]bool{}
+	for i, role := range doc.Roles {
+		name := strings.TrimSpace(role.Name)
+		if name == "" {
+			return fmt.Errorf("role %d: name is required", i+1)
+		}
+		if seen[name] {
+			return fmt.Errorf("role %q is defined more than once", name)
+		}
+		seen[name] = true
+
+		for _, perm := range role.Permissions {
+			if _, ok := permissionIDs[perm]; !ok {
+				return fmt.Errorf("role %q: unknown permission %q", name, perm)
+			}
+		}
+	}
+	return nil
+}
+
+// planRoles compares a document with the stored roles and lists the changes needed
+// to make the database match it. Roles missing from the document are only deleted
+// when prune is set.
+func planRoles(doc models.RBACDocument, current map[string]*storedRole, prune bool) models.RBACPlan {
+	plan := models.RBACPlan{Changes: []models.RoleChange{}, Summary: map[string]int{}}
+	add := func(change models.RoleChange) {
+		plan.Changes = append(plan.Changes, change)
+		plan.Summary[change.Action]++
+	}
+
+	declared := map[string]bool{}
+	for _, def := range doc.Roles {
+		name := strings.TrimSpace(def.Name)
+		declared[name] = true
+
+		wanted := map[string]bool{}
+		for _, perm := range def.Permissions {
+			wanted[perm] = true
+		}
+
+		if name == adminRoleName {
+			add(models.RoleChange{Action: "skip", Role: name, Reason: "The admin role always has every permission"})
+			continue
+		}
+
+		existing, ok := current[name]
+		if !ok {
+			description := def.Description
+			add(models.RoleChange{
+				Action:           "create",
+				Role:             name,
+				Description:      &description,
+				AddedPermissions: sortedKeys(wanted),
+			})
+			continue
+		}
+
+		change := models.RoleChange{Action: "update", Role: name}
+		if def.Description != existing.Description {
+			description := def.Description
+			change.Description = &description
+		}
+		for _, perm := range sortedKeys(wanted) {
+			if !existing.Permissions[perm] {
+				change.AddedPermissions = append(change.AddedPermissions, perm)
+			}
+		}
+		for _, perm := range sortedKeys(existing.Permissions) {
+			if !wanted[perm] {
+				change.RemovedPermissions = append(change.RemovedPermissions, perm)
+			}
+		}
+		if change.Description == nil && len(change.AddedPermissions) == 0 && len(change.RemovedPermissions) == 0 {
+			change.Action = "unchanged"
+		}
+		add(change)
+	}
+
+	if !prune {
+		return plan
+	}
+
+	undeclared := make([]string, 0)
+	for name := range current {
+		if !declared[name] {
+			undeclared = append(undeclared, name)
+		}
+	}
+	sort.Strings(undeclared)
+
+	for _, name := range undeclared {
+		role := current[name]
+		switch {
+		case name == adminRoleName:
+			add(models.RoleChange{Action: "skip", Role: name, Reason: "The admin role cannot be deleted"})
+		case name == defaultRoleName:
+			add(models.RoleChange{Action: "skip", Role: name, Reason: "New users are given this role at signup"})
+		case role.UserCount > 0:
+			add(models.RoleChange{
+				Action: "skip",
+				Role:   name,
+				Reason: fmt.Sprintf("Role is assigned to %d user(s)", role.UserCount),
+			})
+		default:
+			add(models.RoleChange{Action: "delete", Role: name, RemovedPermissions: sortedKeys(role.Permissions)})
+		}
+	}
+	return plan
+}
+
+// authorizeRolePlan checks every change of a plan with the policy engine as the single
+// role request making it would be, so that policies on specific roles still apply
+func authorizeRolePlan(c *fiber.Ctx, userID int, plan models.RBACPlan, current map[string]*storedRole) error {
+	for _, change := range plan.Changes {
+		var err error
+		switch change.Action {
+		case "create":
+			err = authorize(c, userID, "manage_roles",
+				policy.Attributes{"type": "role", "name": change.Role, "permissions": change.AddedPermissions})
+		case "update", "delete":
+			err = authorizeRole(c, userID, current[change.Role].ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyRolePlan performs the create, update and delete steps of a plan in one transaction
+func applyRolePlan(plan models.RBACPlan, current map[string]*storedRole, permissionIDs map[string]int) error {
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, change := range plan.Changes {
+		switch change.Action {
+		case "create":
+			result, err := tx.Exec("INSERT INTO roles (name, description) VALUES (?, ?)", change.Role, *change.Description)
+			if err != nil {
+				return fmt.Errorf("create role %q: %w", change.Role, err)
+			}
+			roleID, err := result.LastInsertId()
+			if err != nil {
+				return err
+			}
+			for _, perm := range change.AddedPermissions {
+				if _, err := tx.Exec("INSERT INTO role_permissions (role_id, permission_id) VALUES (?, ?)",
+					roleID, permissionIDs[perm]); err != nil {
+					return fmt.Errorf("grant %s to %q: %w", perm, change.Role, err)
+				}
+			}
+
+		case "update":
+			roleID := current[change.Role].ID
+			if change.Description != nil {
+				if _, err := tx.Exec("UPDATE roles SET description = ? WHERE id = ?", *change.Description, roleID); err != nil {
+					return fmt.Errorf("update role %q: %w", change.Role, err)
+				}
+			}
+			for _, perm := range change.AddedPermissions {
+				if _, err := tx.Exec("INSERT OR IGNORE INTO role_permissions (role_id, permission_id) VALUES (?, ?)",
+					roleID, permissionIDs[perm]); err != nil {
+					return fmt.Errorf("grant %s to %q: %w", perm, change.Role, err)
+				}
+			}
+			for _, perm := range change.RemovedPermissions {
+				if _, err := tx.Exec("DELETE FROM role_permissions WHERE role_id = ? AND permission_id = ?",
+					roleID, permissionIDs[perm]); err != nil {
+					return fmt.Errorf("revoke %s from %q: %w", perm, change.Role, err)
+				}
+			}
+
+		case "delete":
+			roleID := current[change.Role].ID
+			for _, stmt := range []string{
+				"DELETE FROM role_permissions WHERE role_id = ?",
+				"DELETE FROM item_shares WHERE role_id = ?",
+				"DELETE FROM roles WHERE id = ?",
+			} {
+				if _, err := tx.Exec(stmt, roleID); err != nil {
+					return fmt.Errorf("delete role %q: %w", change.Role, err)
+				}
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ExportRoles returns every role with its permission names as a JSON or YAML document
+// that ApplyRoles accepts
+func ExportRoles(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	if err := authorize(c, userID, "manage_roles", policy.Attributes{"type": "role"}); err != nil {
+		return err
+	}
+
+	format := c.Query("format", "json")
+	if format != "json" && format != "yaml" {
+		return c.Status(400).JSON(fiber.Map{"error": "Format must be json or yaml"})
+	}
+
+	current, err := loadRoles()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load roles for export")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	names := make([]string, 0, len(current))
+	for name := range current {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	doc := models.RBACDocument{Version: rbacDocumentVersion, Roles: make([]models.RoleDefinition, 0, len(names))}
+	for _, name := range names {
+		doc.Roles = append(doc.Roles, models.RoleDefinition{
+			Name:        name,
+			Description: current[name].Description,
+			Permissions: sortedKeys(current[name].Permissions),
+		})
+	}
+
+	if format == "yaml" {
+		out, err := yaml.Marshal(doc)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to encode roles as YAML")
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to export roles"})
+		}
+		c.Set(fiber.HeaderContentType, "application/yaml")
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="roles.yaml"`)
+		return c.Send(out)
+	}
+
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="roles.json"`)
+	return c.JSON(doc)
+}
+
+// ApplyRoles makes the stored roles match a JSON or YAML document. With mode=plan
+// (the default) it only reports the changes; mode=apply performs them atomically.
+// Roles missing from the document are deleted only with prune=true.
+func ApplyRoles(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	if err := authorize(c, userID, "manage_roles", policy.Attributes{"type": "role"}); err != nil {
+		return err
+	}
+
+	mode := c.Query("mode", "plan")
+	if mode != "plan" && mode != "apply" {
+		return c.Status(400).JSON(fiber.Map{"error": "Mode must be plan or apply"})
+	}
+	prune := c.QueryBool("prune", false)
+
+	var doc models.RBACDocument
+	if isYAMLContentType(c.Get(fiber.HeaderContentType)) {
+		err = yaml.Unmarshal(c.Body(), &doc)
+	} else {
+		err = encoders.Unmarshal(c.Body(), &doc)
+	}
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid role document: " + err.Error()})
+	}
+
+	permissionIDs, err := loadPermissionIDs()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load permissions")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+	if err := validateRBACDocument(doc, permissionIDs); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	current, err := loadRoles()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load roles")
+		return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+	}
+
+	plan := planRoles(doc, current, prune)
+	if mode == "plan" {
+		return c.JSON(plan)
+	}
+
+	if err := authorizeRolePlan(c, userID, plan, current); err != nil {
+		return err
+	}
+	if err := applyRolePlan(plan, current, permissionIDs); err != nil {
+		log.Error().Err(err).Int("userId", userID).Msg("Failed to apply role document")
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to apply roles"})
+	}
+	plan.Applied = true
+
+	log.Info().Int("userId", userID).Bool("prune", prune).Interface("summary", plan.Summary).Msg("Role document applied")
+	return c.JSON(plan)
+}
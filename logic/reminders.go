@@ -0,0 +1,260 @@
+package logic
+
+import (
+	"context"
+	"crudracula/dal"
+	"crudracula/notify"
+	"crudracula/policy"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// defaultReminderInterval applies when REMINDER_INTERVAL is not set
+	defaultReminderInterval = "1m"
+
+	// reminderBatchSize is how many due reminders are read at a time
+	reminderBatchSize = 100
+
+	// reminderRetryDelay is how long a claimed reminder waits for its e-mail before it
+	// is sent again, leaving the server that claimed it time to send it
+	reminderRetryDelay = 5 * time.Minute
+
+	// reminderRetryWindow is how long after its claim the e-mail of a reminder is retried
+	reminderRetryWindow = 24 * time.Hour
+)
+
+// Due date filters of GET /api/items
+const (
+	DueOverdue = "overdue"
+	DueToday   = "today"
+	DueWeek    = "week"
+)
+
+// dueReminder is an item whose reminder is due, with its owner
+type dueReminder struct {
+	ItemID   int
+	Name     string
+	DueAt    *time.Time
+	UserID   int
+	Email    string
+	remindAt string // As stored, identifying the reminder in item_reminders
+}
+
+// StartReminderScheduler delivers item reminders once their remind_at has passed,
+// checking every REMINDER_INTERVAL ("1m" by default, "0" to disable). Reminders are
+// delivered in the app and, when SMTP_HOST is set, by e-mail. Reminders that came due
+// while the server was down, and e-mails that could not be sent, are delivered when it
+// starts.
+func StartReminderScheduler() {
+	raw := os.Getenv("REMINDER_INTERVAL")
+	if raw == "" {
+		raw = defaultReminderInterval
+	}
+	if raw == "0" {
+		log.Info().Msg("Reminders disabled")
+		return
+	}
+	interval, err := policy.ParseDuration(raw)
+	if err != nil || interval <= 0 {
+		log.Fatal().Str("value", raw).Msg("Invalid REMINDER_INTERVAL")
+	}
+
+	fire := func() {
+		fired, err := fireDueReminders(context.Background(), time.Now())
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to fire reminders")
+		}
+		if fired > 0 {
+			log.Info().Int("reminders", fired).Msg("Fired item reminders")
+		}
+	}
+
+	log.Info().Str("interval", raw).Bool("email", mailer != nil).Msg("Reminder scheduler started")
+	go func() {
+		fire()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			fire()
+		}
+	}()
+}
+
+// fireDueReminders delivers the reminders due at now and returns how many fired. Each
+// reminder is claimed in item_reminders in one transaction with its notification in the
+// app, so it fires once per remind_at even across restarts or with several servers
+// sharing the database. Its e-mail is sent after the claim, which is then marked
+// delivered; e-mails still pending after reminderRetryDelay are sent again by later runs,
+// the first of them at startup.
+func fireDueReminders(ctx context.Context, now time.Time) (int, error) {
+	if err := redeliverReminders(ctx, now); err != nil {
+		return 0, err
+	}
+
+	cutoff := now.UTC().Format(sqliteTimeLayout)
+	fired := 0
+	for {
+		reminders, err := loadDueReminders(cutoff)
+		if err != nil {
+			return fired, err
+		}
+
+		for _, reminder := range reminders {
+			claimed, err := claimReminder(ctx, reminder, cutoff)
+			if err != nil {
+				return fired, err
+			}
+			if !claimed {
+				continue
+			}
+			fired++
+			if mailer != nil {
+				deliverReminder(ctx, reminder)
+			}
+		}
+
+		if len(reminders) < reminderBatchSize {
+			return fired, nil
+		}
+	}
+}
+
+// dueReminderColumns are the columns read by scanDueReminders, from items joined by
+// itemOwnerJoin
+const dueReminderColumns = `items.id, items.name, items.due_at, items.user_id,
+	COALESCE(owner.email, ''), CAST(items.remind_at AS TEXT)`
+
+// loadDueReminders lists unclaimed reminders of live items that are due at cutoff
+func loadDueReminders(cutoff string) ([]dueReminder, error) {
+	rows, err := dal.DB.Query(`
+		SELECT `+dueReminderColumns+`
+		FROM items `+itemOwnerJoin+`
+		WHERE items.remind_at <= ? AND `+itemLiveCondition+`
+		AND NOT EXISTS (
+			SELECT 1 FROM item_reminders r WHERE r.item_id = items.id AND r.remind_at = items.remind_at)
+		ORDER BY items.remind_at, items.id
+		LIMIT ?`, cutoff, reminderBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	return scanDueReminders(rows)
+}
+
+// scanDueReminders reads dueReminderColumns and closes the rows
+func scanDueReminders(rows *sql.Rows) ([]dueReminder, error) {
+	defer rows.Close()
+
+	var reminders []dueReminder
+	for rows.Next() {
+		var (
+			reminder dueReminder
+			dueAt    sql.NullTime
+		)
+		if err := rows.Scan(&reminder.ItemID, &reminder.Name, &dueAt, &reminder.UserID, &reminder.Email,
+			&reminder.remindAt); err != nil {
+			return nil, err
+		}
+		reminder.DueAt = nullTimeUTC(dueAt)
+		reminders = append(reminders, reminder)
+	}
+	return reminders, rows.Err()
+}
+
+// claimReminder records that a reminder fired and notifies its owner in the app. It
+// reports false when another run claimed it first or the item changed meanwhile. The
+// claim is left pending until the reminder was e-mailed, if e-mail is configured.
+func claimReminder(ctx context.Context, reminder dueReminder, cutoff string) (bool, error) {
+	tx, err := dal.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT OR IGNORE INTO item_reminders (item_id, remind_at, delivered_at)
+		SELECT items.id, items.remind_at, CASE WHEN ? THEN CURRENT_TIMESTAMP END FROM items
+		WHERE items.id = ? AND items.remind_at = ? AND items.remind_at <= ? AND `+itemLiveCondition,
+		mailer == nil, reminder.ItemID, reminder.remindAt, cutoff)
+	if err != nil {
+		return false, err
+	}
+	if claimed, err := result.RowsAffected(); err != nil || claimed != 1 {
+		return false, err
+	}
+
+	if err := insertNotification(ctx, tx, reminderMessage(reminder)); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// deliverReminder e-mails a claimed reminder and marks it delivered once it was sent.
+// A failure is logged, leaving the claim pending for redeliverReminders.
+func deliverReminder(ctx context.Context, reminder dueReminder) {
+	if err := mailer.Notify(ctx, reminderMessage(reminder)); err != nil {
+		log.Error().Err(err).Int("itemId", reminder.ItemID).Int("userId", reminder.UserID).
+			Msg("Failed to e-mail item reminder")
+		return
+	}
+	_, err := dal.DB.ExecContext(ctx,
+		"UPDATE item_reminders SET delivered_at = CURRENT_TIMESTAMP WHERE item_id = ? AND remind_at = ?",
+		reminder.ItemID, reminder.remindAt)
+	if err != nil {
+		log.Error().Err(err).Int("itemId", reminder.ItemID).Msg("Failed to mark item reminder delivered")
+	}
+}
+
+// redeliverReminders e-mails the claimed reminders still pending reminderRetryDelay after
+// their claim, because sending them failed or the server stopped before it could, for
+// up to reminderRetryWindow. Reminders of items changed or trashed since are left out.
+func redeliverReminders(ctx context.Context, now time.Time) error {
+	if mailer == nil {
+		return nil
+	}
+
+	rows, err := dal.DB.QueryContext(ctx, `
+		SELECT `+dueReminderColumns+`
+		FROM item_reminders r
+		JOIN items ON items.id = r.item_id AND items.remind_at = r.remind_at `+itemOwnerJoin+`
+		WHERE r.delivered_at IS NULL AND r.fired_at <= ? AND r.fired_at > ? AND `+itemLiveCondition+`
+		ORDER BY r.fired_at`,
+		now.Add(-reminderRetryDelay).UTC().Format(sqliteTimeLayout),
+		now.Add(-reminderRetryWindow).UTC().Format(sqliteTimeLayout))
+	if err != nil {
+		return err
+	}
+	reminders, err := scanDueReminders(rows)
+	if err != nil {
+		return err
+	}
+
+	for _, reminder := range reminders {
+		deliverReminder(ctx, reminder)
+	}
+	if len(reminders) > 0 {
+		log.Info().Int("reminders", len(reminders)).Msg("Retried item reminder e-mails")
+	}
+	return nil
+}
+
+func reminderMessage(reminder dueReminder) notify.Message {
+	var body strings.Builder
+	fmt.Fprintf(&body, "This is your reminder about %q (item #%d).\n", reminder.Name, reminder.ItemID)
+	if reminder.DueAt != nil {
+		fmt.Fprintf(&body, "It is due %s.\n", reminder.DueAt.Format("Mon, 02 Jan 2006 15:04 MST"))
+	}
+	return notify.Message{
+		UserID:  reminder.UserID,
+		Email:   reminder.Email,
+		Kind:    "reminder",
+		ItemID:  reminder.ItemID,
+		Subject: "Reminder: " + reminder.Name,
+		Body:    body.String(),
+	}
+}
@@ -0,0 +1,336 @@
+package logic
+
+import (
+	"crudracula/dal"
+	"crudracula/encoders"
+	"crudracula/models"
+	"database/sql"
+	"reflect"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	RevisionCreate  = "create"
+	RevisionUpdate  = "update"
+	RevisionDelete  = "delete"
+	RevisionRestore = "restore"
+)
+
+// itemRevisionColumns are the columns read by scanItemRevision
+const itemRevisionColumns = `r.id, r.item_id, r.revision, r.action, r.restored_from, r.snapshot,
+	r.user_id, author.email, r.created_at
+	FROM item_revisions r
+	LEFT JOIN users author ON author.id = r.user_id`
+
+// itemSnapshot captures the content of an item for its history
+func itemSnapshot(item models.Item) models.ItemSnapshot {
+	tags := append([]string{}, item.Tags...)
+	return models.ItemSnapshot{Name: item.Name, Description: item.Description, Tags: &tags, Attributes: item.Attributes,
+		Status: item.Status, DueAt: item.DueAt, RemindAt: item.RemindAt}
+}
+
+// recordItemRevision appends the given state of an item to its history. It must run in
+// the transaction that changed the item, after the change.
+func recordItemRevision(tx *sql.Tx, userID int, item models.Item, action string, restoredFrom *int) error {
+	snapshot, err := encoders.Marshal(itemSnapshot(item))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO item_revisions (item_id, revision, action, snapshot, restored_from, user_id)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		item.ID, item.Version, action, string(snapshot), restoredFrom, userID)
+	return err
+}
+
+func scanItemRevision(row rowScanner, rev *models.ItemRevision) error {
+	var (
+		snapshot    string
+		authorID    sql.NullInt64
+		authorEmail sql.NullString
+	)
+	err := row.Scan(&rev.ID, &rev.ItemID, &rev.Revision, &rev.Action, &rev.RestoredFrom, &snapshot,
+		&authorID, &authorEmail, &rev.CreatedAt)
+	if err != nil {
+		return err
+	}
+	rev.CreatedAt = rev.CreatedAt.UTC()
+	if authorID.Valid && authorEmail.Valid {
+		rev.Author = &models.ItemOwner{ID: int(authorID.Int64), Email: authorEmail.String}
+	}
+	return encoders.Unmarshal([]byte(snapshot), &rev.Snapshot)
+}
+
+// loadItemRevision reads one revision of an item
+func loadItemRevision(itemID, revision int) (models.ItemRevision, error) {
+	var rev models.ItemRevision
+	err := scanItemRevision(dal.DB.QueryRow("SELECT "+itemRevisionColumns+
+		" WHERE r.item_id = ? AND r.revision = ?", itemID, revision), &rev)
+	return rev, err
+}
+
+// snapshotFields flattens a snapshot into its JSON members for comparison
+func snapshotFields(snapshot models.ItemSnapshot) (map[string]interface{}, error) {
+	encoded, err := encoders.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	err = encoders.Unmarshal(encoded, &fields)
+	return fields, err
+}
+
+// diffSnapshots lists the fields that differ between two snapshots, in field order
+func diffSnapshots(from, to models.ItemSnapshot) ([]models.FieldChange, error) {
+	fromFields, err := snapshotFields(from)
+	if err != nil {
+		return nil, err
+	}
+	toFields, err := snapshotFields(to)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for name := range fromFields {
+		names[name] = true
+	}
+	for name := range toFields {
+		names[name] = true
+	}
+
+	changes := []models.FieldChange{}
+	for _, name := range sortedKeys(names) {
+		if !reflect.DeepEqual(fromFields[name], toFields[name]) {
+			changes = append(changes, models.FieldChange{Field: name, From: fromFields[name], To: toFields[name]})
+		}
+	}
+	return changes, nil
+}
+
+// readableItem resolves the caller and checks read access to the item in the route
+func readableItem(c *fiber.Ctx) (int, int, error) {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return 0, 0, fiber.NewError(fiber.StatusUnauthorized, "Unauthorized")
+	}
+
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return 0, 0, fiber.NewError(fiber.StatusForbidden, "No active organization")
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return 0, 0, fiber.NewError(fiber.StatusBadRequest, "Invalid ID")
+	}
+
+	visible, err := hasItemAccess(userID, org, id, AccessViewer)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to check item access")
+		return 0, 0, fiber.NewError(fiber.StatusInternalServerError, "Internal server error: failed to check item access")
+	}
+	if !visible {
+		return 0, 0, fiber.NewError(fiber.StatusNotFound, "Item not found")
+	}
+
+	if err := authorizeItem(c, userID, org, id, "read_item"); err != nil {
+		return 0, 0, err
+	}
+	return userID, id, nil
+}
+
+// GetItemRevisions lists an item's history, newest first
+func GetItemRevisions(c *fiber.Ctx) error {
+	userID, id, err := readableItem(c)
+	if err != nil {
+		return err
+	}
+
+	rows, err := dal.DB.Query("SELECT "+itemRevisionColumns+
+		" WHERE r.item_id = ? ORDER BY r.revision DESC", id)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to fetch item revisions")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch revisions"})
+	}
+	defer rows.Close()
+
+	revisions := []models.ItemRevision{}
+	for rows.Next() {
+		var rev models.ItemRevision
+		if err := scanItemRevision(rows, &rev); err != nil {
+			log.Error().Err(err).Int("itemId", id).Msg("Failed to scan item revision")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch revisions"})
+		}
+		revisions = append(revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		log.Error().Err(err).Int("itemId", id).Msg("Failed to iterate item revisions")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch revisions"})
+	}
+
+	return c.JSON(revisions)
+}
+
+// GetItemRevision returns a single revision of an item
+func GetItemRevision(c *fiber.Ctx) error {
+	_, id, err := readableItem(c)
+	if err != nil {
+		return err
+	}
+
+	revision, err := c.ParamsInt("rev")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid revision"})
+	}
+
+	rev, err := loadItemRevision(id, revision)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Revision not found"})
+	} else if err != nil {
+		log.Error().Err(err).Int("itemId", id).Int("revision", revision).Msg("Failed to fetch item revision")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch revision"})
+	}
+
+	return c.JSON(rev)
+}
+
+// DiffItemRevisions compares two revisions field by field. "to" defaults to the latest
+// revision and "from" to the one before "to".
+func DiffItemRevisions(c *fiber.Ctx) error {
+	_, id, err := readableItem(c)
+	if err != nil {
+		return err
+	}
+
+	to := c.QueryInt("to", 0)
+	if to == 0 {
+		err = dal.DB.QueryRow("SELECT COALESCE(MAX(revision), 0) FROM item_revisions WHERE item_id = ?", id).Scan(&to)
+		if err != nil {
+			log.Error().Err(err).Int("itemId", id).Msg("Failed to find latest item revision")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch revisions"})
+		}
+	}
+	from := c.QueryInt("from", to-1)
+
+	revisions := make([]models.ItemRevision, 2)
+	for i, revision := range []int{from, to} {
+		revisions[i], err = loadItemRevision(id, revision)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Revision not found"})
+		} else if err != nil {
+			log.Error().Err(err).Int("itemId", id).Int("revision", revision).Msg("Failed to fetch item revision")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch revision"})
+		}
+	}
+
+	changes, err := diffSnapshots(revisions[0].Snapshot, revisions[1].Snapshot)
+	if err != nil {
+		log.Error().Err(err).Int("itemId", id).Msg("Failed to diff item revisions")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to compare revisions"})
+	}
+
+	return c.JSON(models.ItemRevisionDiff{ItemID: id, From: from, To: to, Changes: changes})
+}
+
+// RestoreItemRevision sets an item's content back to a revision. The restore is
+// recorded as a new revision; history is never rewritten.
+func RestoreItemRevision(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid ID"})
+	}
+	revision, err := c.ParamsInt("rev")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid revision"})
+	}
+
+	if err := authorizeItem(c, userID, org, id, "update_item"); err != nil {
+		return err
+	}
+
+	version, err := checkItemIfMatch(c, id)
+	if err != nil {
+		return respondItemError(c, err)
+	}
+
+	rev, err := loadItemRevision(id, revision)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Revision not found"})
+	} else if err != nil {
+		log.Error().Err(err).Int("itemId", id).Int("revision", revision).Msg("Failed to fetch item revision")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to restore revision"})
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to restore revision"})
+	}
+	defer tx.Rollback()
+
+	// Revisions recorded before items had custom fields leave the current attributes alone
+	var attributes interface{}
+	if rev.Snapshot.Attributes != nil {
+		if attributes, err = checkedAttributes(tx, org, rev.Snapshot.Attributes); err != nil {
+			return respondItemError(c, err)
+		}
+	}
+
+	accessClause, accessArgs := itemAccessClause(userID, org, AccessEditor)
+	result, err := tx.Exec(`
+		UPDATE items
+		SET name = ?, description = ?, attributes = COALESCE(?, attributes), version = version + 1
+		WHERE items.id = ? AND (? = 0 OR items.version = ?) AND `+accessClause,
+		append([]interface{}{rev.Snapshot.Name, rev.Snapshot.Description, attributes, id, version, version}, accessArgs...)...)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to restore item revision")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to restore revision"})
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		tx.Rollback()
+		return itemWriteRejected(c, userID, org, id, version)
+	}
+
+	// Revisions recorded before items had tags leave the current tags alone
+	if rev.Snapshot.Tags != nil {
+		_, err = setItemTags(tx, userID, org, id, *rev.Snapshot.Tags)
+	}
+	var restored models.Item
+	if err == nil {
+		restored, err = queryItem(tx, id)
+	}
+	if err == nil {
+		err = recordItemRevision(tx, userID, restored, RevisionRestore, &revision)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to record restored revision")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to restore revision"})
+	}
+
+	log.Info().Int("userId", userID).Int("itemId", id).Int("revision", revision).
+		Int("version", restored.Version).Msg("Item revision restored")
+
+	c.Set(fiber.HeaderETag, restored.ETag)
+	return c.JSON(restored)
+}
@@ -3,6 +3,7 @@ package logic
 import (
 	"crudracula/dal"
 	"crudracula/models"
+	"crudracula/policy"
 	"database/sql"
 	"fmt"
 
@@ -17,6 +18,15 @@ func GetRolesPage(c *fiber.Ctx) error {
 }
 
 func GetRoles(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	if err := authorize(c, userID, "manage_roles", policy.Attributes{"type": "role"}); err != nil {
+		return err
+	}
+
 	rows, err := dal.DB.Query(`
 		SELECT r.id, r.name, r.description
 		FROM roles r
@@ -68,11 +78,20 @@ func GetRoles(c *fiber.Ctx) error {
 }
 
 func GetRole(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
 	id, err := c.ParamsInt("id")
 	if err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid role ID"})
 	}
 
+	if err := authorizeRole(c, userID, id); err != nil {
+		return err
+	}
+
 	var role models.Role
 	err = dal.DB.QueryRow(`
 		SELECT id, name, description
@@ -115,6 +134,11 @@ func GetRole(c *fiber.Ctx) error {
 }
 
 func CreateRole(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
 	var roleRequest models.RoleRequest
 	if err := c.BodyParser(&roleRequest); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
@@ -124,6 +148,11 @@ func CreateRole(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Role name is required"})
 	}
 
+	resource := policy.Attributes{"type": "role", "name": roleRequest.Name, "permissions": roleRequest.Permissions}
+	if err := authorize(c, userID, "manage_roles", resource); err != nil {
+		return err
+	}
+
 	// Start transaction
 	tx, err := dal.DB.Begin()
 	if err != nil {
@@ -177,11 +206,20 @@ func CreateRole(c *fiber.Ctx) error {
 }
 
 func UpdateRole(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
 	id, err := c.ParamsInt("id")
 	if err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid role ID"})
 	}
 
+	if err := authorizeRole(c, userID, id); err != nil {
+		return err
+	}
+
 	// Don't allow updating the admin role
 	if id == 1 {
 		return c.Status(403).JSON(fiber.Map{"error": "Cannot modify admin role"})
@@ -261,11 +299,20 @@ func UpdateRole(c *fiber.Ctx) error {
 }
 
 func DeleteRole(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
 	id, err := c.ParamsInt("id")
 	if err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid role ID"})
 	}
 
+	if err := authorizeRole(c, userID, id); err != nil {
+		return err
+	}
+
 	// Don't allow deleting the admin role
 	if id == 1 {
 		return c.Status(403).JSON(fiber.Map{"error": "Cannot delete admin role"})
@@ -377,6 +424,184 @@ func CheckPermission(c *fiber.Ctx) error {
 	return c.SendStatus(200)
 }
 
+// authorizeRole evaluates the policy engine for managing a specific role
+func authorizeRole(c *fiber.Ctx, userID, roleID int) error {
+	resource, err := roleResourceAttributes(roleID)
+	if err != nil {
+		log.Error().Err(err).Int("roleId", roleID).Msg("Failed to load policy resource")
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to check user permissions")
+	}
+	return authorize(c, userID, "manage_roles", resource)
+}
+
+// maxPermissionChecks bounds the number of permissions checked in one request
+const maxPermissionChecks = 50
+
+// itemPermissionAccess is the item access level each item permission needs on a specific item
+var itemPermissionAccess = map[string]string{
+	"read_item":         AccessViewer,
+	"update_item":       AccessEditor,
+	"delete_item":       AccessOwner,
+	"share_item":        AccessOwner,
+	"comment_item":      AccessViewer,
+	"moderate_comments": AccessViewer,
+}
+
+// permissionResource is the policy resource the handlers authorize a permission against
+// when it is not checked for a specific resource
+func permissionResource(permName string, org activeOrganization) policy.Attributes {
+	if permName == "manage_roles" {
+		return policy.Attributes{"type": "role"}
+	}
+	return policy.Attributes{"type": "item", "organization_id": org.ID}
+}
+
+// CheckPermissions reports which of the requested permissions the caller holds in the
+// active organization, optionally for a specific resource, using the same role check as
+// RequirePermission followed by the organization role, item access and policy checks
+func CheckPermissions(c *fiber.Ctx) error {
+	userID, err := GetUserIDFromToken(c)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	var req models.PermissionCheckRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if len(req.Permissions) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "At least one permission is required"})
+	}
+	if len(req.Permissions) > maxPermissionChecks {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("At most %d permissions can be checked at once", maxPermissionChecks)})
+	}
+
+	// Permissions are checked within the active organization, as the handlers do
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
+	// Load the resource once for all checks
+	var resource policy.Attributes
+	if req.Resource != nil {
+		if req.Resource.Type != "item" {
+			return c.Status(400).JSON(fiber.Map{"error": "Only item resources are supported"})
+		}
+		resource, err = itemResourceAttributes(userID, org, req.Resource.ID)
+		if err != nil {
+			log.Error().Err(err).Int("userId", userID).Int("itemId", req.Resource.ID).Msg("Failed to load policy resource")
+			return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		}
+		if resource == nil || resource["access_level"] == "" {
+			return c.Status(404).JSON(fiber.Map{"error": "Item not found"})
+		}
+	}
+
+	results := make(map[string]models.PermissionCheckResult, len(req.Permissions))
+	for _, permName := range req.Permissions {
+		if _, done := results[permName]; done {
+			continue
+		}
+
+		check, err := CheckRolePermission(userID, permName)
+		if err != nil {
+			log.Error().Err(err).Int("userId", userID).Str("permission", permName).Msg("Failed to check permission")
+			return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		}
+		if !check.Allowed {
+			results[permName] = models.PermissionCheckResult{Reason: check.Reason}
+			continue
+		}
+
+		// Organization viewers can only read
+		if permName == "create_item" && orgRoleRank[org.Role] < orgRoleRank[OrgRoleMember] {
+			results[permName] = models.PermissionCheckResult{Reason: "Organization viewers cannot create items"}
+			continue
+		}
+
+		if resource != nil {
+			if required, ok := itemPermissionAccess[permName]; ok {
+				level, _ := resource["access_level"].(string)
+				if accessLevelRank[level] < accessLevelRank[required] {
+					results[permName] = models.PermissionCheckResult{
+						Reason: fmt.Sprintf("Item access %q is below the required %q", level, required),
+					}
+					continue
+				}
+			}
+		}
+
+		policyResource := resource
+		if policyResource == nil {
+			policyResource = permissionResource(permName, org)
+		}
+		decision, err := evaluatePolicy(c, userID, permName, policyResource)
+		if err != nil {
+			log.Error().Err(err).Int("userId", userID).Str("permission", permName).Msg("Failed to evaluate policy")
+			return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		}
+		if !decision.Allowed {
+			results[permName] = models.PermissionCheckResult{Reason: "Policy " + decision.Reason}
+			continue
+		}
+
+		results[permName] = models.PermissionCheckResult{Allowed: true, Reason: check.Reason}
+	}
+
+	return c.JSON(fiber.Map{
+		"results":  results,
+		"resource": req.Resource,
+	})
+}
+
+// RolePermissionCheck is the outcome of checking a permission against a user's role
+type RolePermissionCheck struct {
+	Allowed bool
+	NoRole  bool // The user has no role assigned at all
+	Reason  string
+}
+
+// CheckRolePermission decides whether the user's role grants a permission. It backs
+// the RequirePermission middleware and the bulk permission check endpoint.
+func CheckRolePermission(userID int, permissionName string) (RolePermissionCheck, error) {
+	var roleID *int
+	var roleName *string
+	err := dal.DB.QueryRow(`
+		SELECT u.role_id, r.name
+		FROM users u
+		LEFT JOIN roles r ON r.id = u.role_id
+		WHERE u.id = ?`, userID).Scan(&roleID, &roleName)
+	if err != nil {
+		return RolePermissionCheck{}, err
+	}
+
+	if roleID == nil || roleName == nil {
+		return RolePermissionCheck{NoRole: true, Reason: "No role assigned to user"}, nil
+	}
+
+	var known, granted bool
+	err = dal.DB.QueryRow(`
+		SELECT
+			EXISTS(SELECT 1 FROM permissions WHERE name = ?),
+			EXISTS(
+				SELECT 1 FROM role_permissions rp
+				JOIN permissions p ON rp.permission_id = p.id
+				WHERE rp.role_id = ? AND p.name = ?
+			)`, permissionName, *roleID, permissionName).Scan(&known, &granted)
+	if err != nil {
+		return RolePermissionCheck{}, err
+	}
+
+	switch {
+	case !known:
+		return RolePermissionCheck{Reason: fmt.Sprintf("Unknown permission %q", permissionName)}, nil
+	case !granted:
+		return RolePermissionCheck{Reason: fmt.Sprintf("Role %q does not grant %s", *roleName, permissionName)}, nil
+	}
+	return RolePermissionCheck{Allowed: true, Reason: fmt.Sprintf("Granted by role %q", *roleName)}, nil
+}
+
 // Helper function to check if a user has a specific permission
 func hasPermission(userID int, permissionName string) (bool, error) {
 	var exists bool
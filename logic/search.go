@@ -0,0 +1,108 @@
+package logic
+
+import (
+	"crudracula/dal"
+	"crudracula/models"
+	"html"
+	"strings"
+)
+
+const (
+	// SearchSimple matches every word of the query, each as a prefix
+	SearchSimple = "simple"
+	// SearchAdvanced passes the query to FTS5, allowing "phrases", prefix*, AND, OR and NOT
+	SearchAdvanced = "advanced"
+)
+
+// Markers placed around matches by highlight() and snippet(); they are replaced with
+// <mark> tags after the surrounding text has been escaped
+const (
+	matchStart = "\x02"
+	matchEnd   = "\x03"
+)
+
+// itemSearch is the part of an items query contributed by a search term
+type itemSearch struct {
+	Join    string        // Joined after FROM items
+	Where   string        // Condition restricting the results to matches
+	Args    []interface{} // Arguments of Where
+	Columns string        // Extra selected columns, empty or highlight and snippet
+	OrderBy string        // Relevance ordering, empty without FTS5
+}
+
+// searchWords splits a query into words, dropping empty ones
+func searchWords(search string) []string {
+	return strings.Fields(search)
+}
+
+// ftsSimpleQuery quotes every word of a query so FTS5 operators in user input are taken
+// literally, and matches each as a prefix
+func ftsSimpleQuery(search string) string {
+	words := searchWords(search)
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"*`
+	}
+	return strings.Join(words, " ")
+}
+
+// likePattern escapes LIKE wildcards in s and wraps it for a substring match.
+// It must be used with ESCAPE '\'.
+func likePattern(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `%`, `\%`)
+	s = strings.ReplaceAll(s, `_`, `\_`)
+	return "%" + s + "%"
+}
+
+// newItemSearch builds the query parts for a search. With FTS5 the matches are ranked
+// with name matches weighted above description matches; without it every word must
+// appear in the name or description.
+func newItemSearch(search, mode string) itemSearch {
+	if dal.FTS5 {
+		query := search
+		if mode != SearchAdvanced {
+			query = ftsSimpleQuery(search)
+		}
+		return itemSearch{
+			Join:  "JOIN items_fts ON items_fts.rowid = items.id",
+			Where: "items_fts MATCH ?",
+			Args:  []interface{}{query},
+			Columns: `highlight(items_fts, 0, '` + matchStart + `', '` + matchEnd + `'),
+				snippet(items_fts, 1, '` + matchStart + `', '` + matchEnd + `', '…', 16)`,
+			OrderBy: "bm25(items_fts, 10.0, 1.0)",
+		}
+	}
+
+	var (
+		where []string
+		args  []interface{}
+	)
+	for _, word := range searchWords(search) {
+		pattern := likePattern(word)
+		where = append(where, `(items.name LIKE ? ESCAPE '\' OR items.description LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern)
+	}
+	if len(where) == 0 {
+		where = append(where, "1 = 1")
+	}
+	return itemSearch{Where: strings.Join(where, " AND "), Args: args}
+}
+
+// isSearchSyntaxError reports whether a query failed because of an invalid FTS5 query
+func isSearchSyntaxError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "fts5:") || strings.Contains(msg, "no such column") ||
+		strings.Contains(msg, "unterminated string")
+}
+
+// highlightHTML escapes text marked by highlight() or snippet() and wraps matches in <mark>
+func highlightHTML(marked string) string {
+	escaped := html.EscapeString(marked)
+	escaped = strings.ReplaceAll(escaped, matchStart, "<mark>")
+	return strings.ReplaceAll(escaped, matchEnd, "</mark>")
+}
+
+// newItemHighlight converts the highlight and snippet columns of a search result
+func newItemHighlight(name, snippet string) *models.ItemHighlight {
+	return &models.ItemHighlight{Name: highlightHTML(name), Snippet: highlightHTML(snippet)}
+}
@@ -0,0 +1,480 @@
+package logic
+
+import (
+	"crudracula/dal"
+	"crudracula/models"
+	"crudracula/policy"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// shareTokenBytes is the entropy of share link tokens
+	shareTokenBytes = 32
+
+	// maxShareLinkViews bounds the view limit of a share link
+	maxShareLinkViews = 1000000
+
+	// Share link passwords are hashed with bcrypt, which reads at most 72 bytes
+	minSharePasswordLength = 6
+	maxSharePasswordLength = 72
+
+	// sharePasswordAttempts wrong passwords within sharePasswordWindow lock a share
+	// link until the window has passed
+	sharePasswordAttempts = 10
+	sharePasswordWindow   = 15 * time.Minute
+
+	defaultShareViewsPerPage = 20
+	maxShareViewsPerPage     = 100
+)
+
+// Outcomes of the attempts to use a share link, as recorded in its access log
+const (
+	ShareViewed           = "viewed"
+	ShareRevoked          = "revoked"
+	ShareExpired          = "expired"
+	ShareViewLimit        = "view_limit"
+	ShareItemUnavailable  = "item_unavailable"
+	SharePasswordRequired = "password_required"
+	ShareWrongPassword    = "wrong_password"
+	ShareThrottled        = "throttled"
+)
+
+const shareLinkColumns = `l.id, l.item_id, l.password_hash IS NOT NULL, l.expires_at, l.max_views, l.view_count,
+	l.created_by, u.email, l.created_at, l.revoked_at
+	FROM share_links l
+	LEFT JOIN users u ON u.id = l.created_by`
+
+func scanShareLink(row rowScanner, link *models.ShareLink) error {
+	var (
+		expiresAt, revokedAt sql.NullTime
+		maxViews             sql.NullInt64
+		creatorID            sql.NullInt64
+		creatorEmail         sql.NullString
+	)
+	err := row.Scan(&link.ID, &link.ItemID, &link.HasPassword, &expiresAt, &maxViews, &link.ViewCount,
+		&creatorID, &creatorEmail, &link.CreatedAt, &revokedAt)
+	if err != nil {
+		return err
+	}
+	link.CreatedAt = link.CreatedAt.UTC()
+	link.ExpiresAt, link.RevokedAt = nullTimeUTC(expiresAt), nullTimeUTC(revokedAt)
+	link.MaxViews = nil
+	if maxViews.Valid {
+		n := int(maxViews.Int64)
+		link.MaxViews = &n
+	}
+	if creatorID.Valid && creatorEmail.Valid {
+		link.CreatedBy = &models.ItemOwner{ID: int(creatorID.Int64), Email: creatorEmail.String}
+	}
+	link.Active = link.RevokedAt == nil &&
+		(link.ExpiresAt == nil || link.ExpiresAt.After(time.Now())) &&
+		(link.MaxViews == nil || link.ViewCount < *link.MaxViews)
+	return nil
+}
+
+// hashShareToken is how share link tokens are looked up
+func hashShareToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// shareableItem authenticates the management of the share links of an item and returns
+// the user, organization and item. Share links take the same access as sharing.
+func shareableItem(c *fiber.Ctx) (int, activeOrganization, int, error) {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return 0, activeOrganization{}, 0, fiber.NewError(fiber.StatusUnauthorized, "Unauthorized")
+	}
+
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return 0, org, 0, fiber.NewError(fiber.StatusForbidden, "No active organization")
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return 0, org, 0, fiber.NewError(fiber.StatusBadRequest, "Invalid ID")
+	}
+
+	level, err := itemAccessLevel(userID, org, id)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to check item access")
+		return 0, org, 0, fiber.NewError(fiber.StatusInternalServerError, "Internal server error: failed to check item access")
+	}
+	switch {
+	case level == "":
+		return 0, org, 0, fiber.NewError(fiber.StatusNotFound, "Item not found")
+	case accessLevelRank[level] < accessLevelRank[itemPermissionAccess["share_item"]]:
+		return 0, org, 0, fiber.NewError(fiber.StatusForbidden, "Insufficient access to item")
+	}
+
+	if err := authorizeItem(c, userID, org, id, "share_item"); err != nil {
+		return 0, org, 0, err
+	}
+	return userID, org, id, nil
+}
+
+// shareLinkParam reads the share link in the route, which must belong to the item
+func shareLinkParam(c *fiber.Ctx, itemID int) (models.ShareLink, error) {
+	var link models.ShareLink
+	linkID, err := c.ParamsInt("linkId")
+	if err != nil {
+		return link, fiber.NewError(fiber.StatusBadRequest, "Invalid share link ID")
+	}
+	err = scanShareLink(dal.DB.QueryRow("SELECT "+shareLinkColumns+" WHERE l.id = ? AND l.item_id = ?", linkID, itemID), &link)
+	if err == sql.ErrNoRows {
+		return link, fiber.NewError(fiber.StatusNotFound, "Share link not found")
+	} else if err != nil {
+		log.Error().Err(err).Int("itemId", itemID).Int("linkId", linkID).Msg("Failed to fetch share link")
+		return link, fiber.NewError(fiber.StatusInternalServerError, "Internal server error: failed to fetch share link")
+	}
+	return link, nil
+}
+
+// GetShareLinks lists the share links of an item, newest first
+func GetShareLinks(c *fiber.Ctx) error {
+	_, _, id, err := shareableItem(c)
+	if err != nil {
+		return err
+	}
+
+	rows, err := dal.DB.Query("SELECT "+shareLinkColumns+" WHERE l.item_id = ? ORDER BY l.id DESC", id)
+	if err != nil {
+		log.Error().Err(err).Int("itemId", id).Msg("Failed to fetch share links")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch share links"})
+	}
+	defer rows.Close()
+
+	links := []models.ShareLink{}
+	for rows.Next() {
+		var link models.ShareLink
+		if err := scanShareLink(rows, &link); err != nil {
+			log.Error().Err(err).Int("itemId", id).Msg("Failed to scan share link")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch share links"})
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		log.Error().Err(err).Int("itemId", id).Msg("Failed to iterate share links")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch share links"})
+	}
+	return c.JSON(links)
+}
+
+// CreateShareLink creates a share link for an item. The response holds the only copy
+// of its token and URL.
+func CreateShareLink(c *fiber.Ctx) error {
+	userID, _, id, err := shareableItem(c)
+	if err != nil {
+		return err
+	}
+
+	var req models.ShareLinkRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+	}
+
+	expiresAt := req.ExpiresAt
+	if req.ExpiresIn != "" {
+		if expiresAt != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Set either expires_at or expires_in"})
+		}
+		duration, err := policy.ParseDuration(req.ExpiresIn)
+		if err != nil || duration <= 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "expires_in must be a positive duration such as 7d or 12h"})
+		}
+		expires := time.Now().Add(duration)
+		expiresAt = &expires
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return c.Status(400).JSON(fiber.Map{"error": "expires_at must be in the future"})
+	}
+	if req.MaxViews != nil && (*req.MaxViews < 1 || *req.MaxViews > maxShareLinkViews) {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("max_views must be between 1 and %d", maxShareLinkViews)})
+	}
+
+	var passwordHash interface{}
+	if req.Password != "" {
+		if utf8.RuneCountInString(req.Password) < minSharePasswordLength || len(req.Password) > maxSharePasswordLength {
+			return c.Status(400).JSON(fiber.Map{
+				"error": fmt.Sprintf("Passwords must have at least %d characters and at most %d bytes",
+					minSharePasswordLength, maxSharePasswordLength),
+			})
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to hash share link password")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create share link"})
+		}
+		passwordHash = string(hash)
+	}
+
+	raw := make([]byte, shareTokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		log.Error().Err(err).Msg("Failed to generate share link token")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create share link"})
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	var maxViews interface{}
+	if req.MaxViews != nil {
+		maxViews = *req.MaxViews
+	}
+	result, err := dal.DB.Exec(`
+		INSERT INTO share_links (item_id, token_hash, password_hash, expires_at, max_views, created_by)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		id, hashShareToken(token), passwordHash, sqliteTime(expiresAt), maxViews, userID)
+	if err != nil {
+		log.Error().Err(err).Int("itemId", id).Msg("Failed to create share link")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create share link"})
+	}
+	linkID, _ := result.LastInsertId()
+
+	var link models.ShareLink
+	if err := scanShareLink(dal.DB.QueryRow("SELECT "+shareLinkColumns+" WHERE l.id = ?", linkID), &link); err != nil {
+		log.Error().Err(err).Int64("linkId", linkID).Msg("Failed to fetch share link")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch share link"})
+	}
+	link.Token = token
+	link.URL = c.BaseURL() + "/s/" + token
+
+	log.Info().Int("userId", userID).Int("itemId", id).Int64("linkId", linkID).
+		Bool("password", link.HasPassword).Msg("Share link created")
+	return c.Status(201).JSON(link)
+}
+
+// RevokeShareLink turns a share link off for good
+func RevokeShareLink(c *fiber.Ctx) error {
+	userID, _, id, err := shareableItem(c)
+	if err != nil {
+		return err
+	}
+	link, err := shareLinkParam(c, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = dal.DB.Exec("UPDATE share_links SET revoked_at = COALESCE(revoked_at, CURRENT_TIMESTAMP) WHERE id = ?", link.ID)
+	if err != nil {
+		log.Error().Err(err).Int("linkId", link.ID).Msg("Failed to revoke share link")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to revoke share link"})
+	}
+
+	log.Info().Int("userId", userID).Int("itemId", id).Int("linkId", link.ID).Msg("Share link revoked")
+	return c.SendStatus(204)
+}
+
+// GetShareLinkViews pages through the access log of a share link, newest first
+func GetShareLinkViews(c *fiber.Ctx) error {
+	_, _, id, err := shareableItem(c)
+	if err != nil {
+		return err
+	}
+	link, err := shareLinkParam(c, id)
+	if err != nil {
+		return err
+	}
+
+	page := 1
+	if p, err := strconv.Atoi(c.Query("page", "1")); err == nil && p > 1 {
+		page = p
+	}
+	perPage := defaultShareViewsPerPage
+	if raw := c.Query("per_page"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return c.Status(400).JSON(fiber.Map{"error": "per_page must be a positive number"})
+		}
+		perPage = min(n, maxShareViewsPerPage)
+	}
+
+	response := models.ShareLinkViewsResponse{Views: []models.ShareLinkView{}, CurrentPage: page, PerPage: perPage}
+	err = dal.DB.QueryRow("SELECT COUNT(*) FROM share_link_views WHERE share_link_id = ?", link.ID).Scan(&response.TotalViews)
+	if err != nil {
+		log.Error().Err(err).Int("linkId", link.ID).Msg("Failed to count share link views")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to count views"})
+	}
+	response.TotalPages = (response.TotalViews + perPage - 1) / perPage
+
+	rows, err := dal.DB.Query(`
+		SELECT id, outcome, ip, user_agent, created_at FROM share_link_views
+		WHERE share_link_id = ? ORDER BY id DESC LIMIT ? OFFSET ?`, link.ID, perPage, (page-1)*perPage)
+	if err != nil {
+		log.Error().Err(err).Int("linkId", link.ID).Msg("Failed to fetch share link views")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch views"})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var view models.ShareLinkView
+		if err := rows.Scan(&view.ID, &view.Outcome, &view.IP, &view.UserAgent, &view.CreatedAt); err != nil {
+			log.Error().Err(err).Int("linkId", link.ID).Msg("Failed to scan share link view")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch views"})
+		}
+		view.CreatedAt = view.CreatedAt.UTC()
+		response.Views = append(response.Views, view)
+	}
+	if err := rows.Err(); err != nil {
+		log.Error().Err(err).Int("linkId", link.ID).Msg("Failed to iterate share link views")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch views"})
+	}
+	return c.JSON(response)
+}
+
+// logShareView records an attempt to use a share link
+func logShareView(c *fiber.Ctx, linkID int, outcome string) {
+	userAgent := c.Get(fiber.HeaderUserAgent)
+	if runes := []rune(userAgent); len(runes) > 255 {
+		userAgent = string(runes[:255])
+	}
+	_, err := dal.DB.Exec("INSERT INTO share_link_views (share_link_id, outcome, ip, user_agent) VALUES (?, ?, ?, ?)",
+		linkID, outcome, c.IP(), userAgent)
+	if err != nil {
+		log.Error().Err(err).Int("linkId", linkID).Str("outcome", outcome).Msg("Failed to log share link view")
+	}
+}
+
+// respondShared answers a share link request with the share page or, when the client
+// asks for JSON, with the item or an error
+func respondShared(c *fiber.Ctx, status int, item *models.SharedItem, message string, passwordRequired bool) error {
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Set("X-Robots-Tag", "noindex, nofollow")
+	c.Set("Referrer-Policy", "no-referrer")
+
+	if c.Accepts(fiber.MIMETextHTML, fiber.MIMEApplicationJSON) == fiber.MIMEApplicationJSON {
+		if item != nil {
+			return c.Status(status).JSON(item)
+		}
+		body := fiber.Map{"error": message}
+		if passwordRequired {
+			body["password_required"] = true
+		}
+		return c.Status(status).JSON(body)
+	}
+
+	title := "Shared item - Crudracula"
+	if item != nil {
+		title = item.Name + " - Crudracula"
+	}
+	return c.Status(status).Render("share", fiber.Map{
+		"title":            title,
+		"item":             item,
+		"error":            message,
+		"passwordRequired": passwordRequired,
+	})
+}
+
+// ViewSharedItem shows the item of a share link to anyone who has the link, without
+// authentication. Links with a password take it in the X-Share-Password header or as
+// the password field of a POST, as sent by the share page. Every use of a link, whether
+// or not it is let through, is recorded in its access log.
+func ViewSharedItem(c *fiber.Ctx) error {
+	var (
+		linkID, itemID, viewCount int
+		passwordHash              sql.NullString
+		expiresAt, revokedAt      sql.NullTime
+		maxViews                  sql.NullInt64
+		itemLive                  bool
+	)
+	err := dal.DB.QueryRow(`
+		SELECT l.id, l.item_id, l.password_hash, l.expires_at, l.max_views, l.view_count, l.revoked_at,
+			items.deleted_at IS NULL
+		FROM share_links l JOIN items ON items.id = l.item_id
+		WHERE l.token_hash = ?`, hashShareToken(c.Params("token"))).
+		Scan(&linkID, &itemID, &passwordHash, &expiresAt, &maxViews, &viewCount, &revokedAt, &itemLive)
+	if err == sql.ErrNoRows {
+		return respondShared(c, 404, nil, "This link does not exist.", false)
+	} else if err != nil {
+		log.Error().Err(err).Msg("Failed to fetch share link")
+		return respondShared(c, 500, nil, "Something went wrong, please try again later.", false)
+	}
+
+	switch {
+	case revokedAt.Valid:
+		logShareView(c, linkID, ShareRevoked)
+		return respondShared(c, 410, nil, "This link has been turned off.", false)
+	case expiresAt.Valid && !expiresAt.Time.After(time.Now()):
+		logShareView(c, linkID, ShareExpired)
+		return respondShared(c, 410, nil, "This link has expired.", false)
+	case !itemLive:
+		logShareView(c, linkID, ShareItemUnavailable)
+		return respondShared(c, 404, nil, "The shared item is no longer available.", false)
+	case maxViews.Valid && int64(viewCount) >= maxViews.Int64:
+		logShareView(c, linkID, ShareViewLimit)
+		return respondShared(c, 410, nil, "This link has been viewed as often as it may be.", false)
+	}
+
+	if passwordHash.Valid {
+		password := c.Get("X-Share-Password")
+		if password == "" && c.Method() == fiber.MethodPost {
+			password = c.FormValue("password")
+		}
+		if password == "" {
+			logShareView(c, linkID, SharePasswordRequired)
+			return respondShared(c, 401, nil, "This link is protected with a password.", true)
+		}
+
+		var failures int
+		err := dal.DB.QueryRow(`SELECT COUNT(*) FROM share_link_views
+			WHERE share_link_id = ? AND outcome = ? AND created_at > ?`,
+			linkID, ShareWrongPassword, time.Now().UTC().Add(-sharePasswordWindow).Format(sqliteTimeLayout)).Scan(&failures)
+		if err != nil {
+			log.Error().Err(err).Int("linkId", linkID).Msg("Failed to count share link password failures")
+			return respondShared(c, 500, nil, "Something went wrong, please try again later.", false)
+		}
+		if failures >= sharePasswordAttempts {
+			logShareView(c, linkID, ShareThrottled)
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(sharePasswordWindow.Seconds())))
+			return respondShared(c, 429, nil, "Too many wrong passwords, please try again later.", false)
+		}
+
+		if bcrypt.CompareHashAndPassword([]byte(passwordHash.String), []byte(password)) != nil {
+			logShareView(c, linkID, ShareWrongPassword)
+			return respondShared(c, 401, nil, "Wrong password.", true)
+		}
+	}
+
+	// Views are counted atomically so concurrent requests cannot exceed the limit
+	result, err := dal.DB.Exec(`
+		UPDATE share_links SET view_count = view_count + 1
+		WHERE id = ? AND revoked_at IS NULL AND (max_views IS NULL OR view_count < max_views)`, linkID)
+	if err != nil {
+		log.Error().Err(err).Int("linkId", linkID).Msg("Failed to count share link view")
+		return respondShared(c, 500, nil, "Something went wrong, please try again later.", false)
+	}
+	if counted, _ := result.RowsAffected(); counted == 0 {
+		logShareView(c, linkID, ShareViewLimit)
+		return respondShared(c, 410, nil, "This link has been viewed as often as it may be.", false)
+	}
+
+	item, err := loadItem(itemID)
+	if err != nil {
+		log.Error().Err(err).Int("itemId", itemID).Msg("Failed to fetch shared item")
+		return respondShared(c, 500, nil, "Something went wrong, please try again later.", false)
+	}
+	logShareView(c, linkID, ShareViewed)
+
+	log.Info().Int("linkId", linkID).Int("itemId", itemID).Str("ip", c.IP()).Msg("Shared item viewed")
+	return respondShared(c, 200, &models.SharedItem{
+		Name:        item.Name,
+		Description: item.Description,
+		Status:      item.Status,
+		Tags:        item.Tags,
+		Attributes:  item.Attributes,
+		DueAt:       item.DueAt,
+		CreatedAt:   item.CreatedAt,
+		UpdatedAt:   item.UpdatedAt,
+	}, "", false)
+}
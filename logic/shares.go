@@ -0,0 +1,442 @@
+package logic
+
+import (
+	"crudracula/dal"
+	"crudracula/models"
+	"database/sql"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Item access levels, from least to most privileged
+const (
+	AccessViewer = "viewer"
+	AccessEditor = "editor"
+	AccessOwner  = "owner"
+)
+
+var accessLevelRank = map[string]int{
+	AccessViewer: 1,
+	AccessEditor: 2,
+	AccessOwner:  3,
+}
+
+// accessLevelsAtLeast returns every access level that satisfies the given minimum level
+func accessLevelsAtLeast(level string) []string {
+	var levels []string
+	for name, rank := range accessLevelRank {
+		if rank >= accessLevelRank[level] {
+			levels = append(levels, name)
+		}
+	}
+	return levels
+}
+
+// placeholders returns n comma separated SQL placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// itemShareGrantClause matches share grants on the current items row given to the
+// user either directly or through their role
+const itemShareGrantClause = `EXISTS (
+		SELECT 1 FROM item_shares s
+		WHERE s.item_id = items.id
+		AND s.access_level IN (%s)
+		AND (s.user_id = ? OR s.role_id = (SELECT role_id FROM users WHERE id = ?))
+	)`
+
+// Conditions separating live items from those moved to the trash
+const (
+	itemLiveCondition    = "items.deleted_at IS NULL"
+	itemTrashedCondition = "items.deleted_at IS NOT NULL"
+)
+
+// itemAccessClause returns a WHERE fragment restricting the items table to live rows of the
+// active organization the user can access with at least the given level, either through
+// their organization role, as the creator, or through a share grant
+func itemAccessClause(userID int, org activeOrganization, level string) (string, []interface{}) {
+	clause, args := itemGrantClause(userID, org, level)
+	return "(" + clause + " AND " + itemLiveCondition + ")", args
+}
+
+// trashedItemAccessClause is itemAccessClause for items in the trash
+func trashedItemAccessClause(userID int, org activeOrganization, level string) (string, []interface{}) {
+	clause, args := itemGrantClause(userID, org, level)
+	return "(" + clause + " AND " + itemTrashedCondition + ")", args
+}
+
+// itemGrantClause matches rows the user can access with at least the given level,
+// whether or not they are in the trash
+func itemGrantClause(userID int, org activeOrganization, level string) (string, []interface{}) {
+	if accessLevelRank[orgRoleItemAccess[org.Role]] >= accessLevelRank[level] {
+		return "(items.organization_id = ?)", []interface{}{org.ID}
+	}
+
+	levels := accessLevelsAtLeast(level)
+	args := []interface{}{org.ID, userID}
+	for _, l := range levels {
+		args = append(args, l)
+	}
+	args = append(args, userID, userID)
+
+	clause := "(items.organization_id = ? AND (items.user_id = ? OR " +
+		strings.Replace(itemShareGrantClause, "%s", placeholders(len(levels)), 1) + "))"
+	return clause, args
+}
+
+// itemSharedWithClause returns a WHERE fragment restricting the items table to live rows of
+// the active organization created by someone else and shared with the user
+func itemSharedWithClause(userID int, org activeOrganization) (string, []interface{}) {
+	levels := accessLevelsAtLeast(AccessViewer)
+	args := []interface{}{org.ID, userID}
+	for _, l := range levels {
+		args = append(args, l)
+	}
+	args = append(args, userID, userID)
+
+	clause := "(items.organization_id = ? AND items.user_id <> ? AND " + itemLiveCondition + " AND " +
+		strings.Replace(itemShareGrantClause, "%s", placeholders(len(levels)), 1) + ")"
+	return clause, args
+}
+
+// itemAccessLevel returns the effective access level of a user on a live item of the
+// active organization, or an empty string when the user has no access at all
+func itemAccessLevel(userID int, org activeOrganization, itemID int) (string, error) {
+	return accessLevelWhere(userID, org, itemID, itemLiveCondition)
+}
+
+// trashedItemAccessLevel is itemAccessLevel for items in the trash
+func trashedItemAccessLevel(userID int, org activeOrganization, itemID int) (string, error) {
+	return accessLevelWhere(userID, org, itemID, itemTrashedCondition)
+}
+
+// accessLevelWhere resolves the access level on an item matching the given condition
+func accessLevelWhere(userID int, org activeOrganization, itemID int, condition string) (string, error) {
+	var ownerID int
+	err := dal.DB.QueryRow("SELECT user_id FROM items WHERE id = ? AND organization_id = ? AND "+condition,
+		itemID, org.ID).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if ownerID == userID {
+		return AccessOwner, nil
+	}
+
+	rows, err := dal.DB.Query(`
+		SELECT s.access_level FROM item_shares s
+		WHERE s.item_id = ?
+		AND (s.user_id = ? OR s.role_id = (SELECT role_id FROM users WHERE id = ?))`,
+		itemID, userID, userID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	level := orgRoleItemAccess[org.Role]
+	for rows.Next() {
+		var l string
+		if err := rows.Scan(&l); err != nil {
+			return "", err
+		}
+		if accessLevelRank[l] > accessLevelRank[level] {
+			level = l
+		}
+	}
+	return level, rows.Err()
+}
+
+// hasItemAccess reports whether the user can access the item with at least the given level
+func hasItemAccess(userID int, org activeOrganization, itemID int, level string) (bool, error) {
+	current, err := itemAccessLevel(userID, org, itemID)
+	if err != nil {
+		return false, err
+	}
+	return current != "" && accessLevelRank[current] >= accessLevelRank[level], nil
+}
+
+// itemAccessDenied responds with 404 when the user cannot see the item at all and
+// 403 when they can see it but lack the required access level
+func itemAccessDenied(c *fiber.Ctx, userID int, org activeOrganization, itemID int) error {
+	level, err := itemAccessLevel(userID, org, itemID)
+	if err != nil {
+		log.Error().Err(err).
+			Int("userId", userID).
+			Int("itemId", itemID).
+			Str("method", c.Method()).
+			Str("path", c.Path()).
+			Msg("Failed to resolve item access level")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to check item access"})
+	}
+	if level == "" {
+		return c.Status(404).JSON(fiber.Map{"error": "Item not found"})
+	}
+	return c.Status(403).JSON(fiber.Map{"error": "Insufficient access to item"})
+}
+
+func GetItemShares(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid ID"})
+	}
+
+	allowed, err := hasItemAccess(userID, org, id, AccessOwner)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to check item access")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to check item access"})
+	}
+	if !allowed {
+		return itemAccessDenied(c, userID, org, id)
+	}
+
+	if err := authorizeItem(c, userID, org, id, "share_item"); err != nil {
+		return err
+	}
+
+	rows, err := dal.DB.Query(`
+		SELECT s.id, s.item_id, s.user_id, u.email, s.role_id, r.name, s.access_level, s.created_by, s.created_at
+		FROM item_shares s
+		LEFT JOIN users u ON u.id = s.user_id
+		LEFT JOIN roles r ON r.id = s.role_id
+		WHERE s.item_id = ?
+		ORDER BY s.id`, id)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to fetch item shares")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch shares"})
+	}
+	defer rows.Close()
+
+	shares := []models.ItemShare{}
+	for rows.Next() {
+		var share models.ItemShare
+		if err := rows.Scan(&share.ID, &share.ItemID, &share.UserID, &share.UserEmail, &share.RoleID,
+			&share.RoleName, &share.AccessLevel, &share.CreatedBy, &share.CreatedAt); err != nil {
+			log.Error().Err(err).Int("itemId", id).Msg("Failed to scan item share")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to process shares"})
+		}
+		shares = append(shares, share)
+	}
+
+	return c.JSON(shares)
+}
+
+func AddItemShare(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid ID"})
+	}
+
+	var req models.ShareRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+	}
+
+	if _, ok := accessLevelRank[req.AccessLevel]; !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "access_level must be one of viewer, editor or owner"})
+	}
+
+	targets := 0
+	if req.Email != "" {
+		targets++
+	}
+	if req.UserID != nil {
+		targets++
+	}
+	if req.RoleID != nil {
+		targets++
+	}
+	if targets != 1 {
+		return c.Status(400).JSON(fiber.Map{"error": "Exactly one of email, user_id or role_id is required"})
+	}
+
+	allowed, err := hasItemAccess(userID, org, id, AccessOwner)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to check item access")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to check item access"})
+	}
+	if !allowed {
+		return itemAccessDenied(c, userID, org, id)
+	}
+
+	if err := authorizeItem(c, userID, org, id, "share_item"); err != nil {
+		return err
+	}
+
+	// Resolve the grantee
+	if req.Email != "" {
+		var targetID int
+		err = dal.DB.QueryRow("SELECT id FROM users WHERE email = ?", req.Email).Scan(&targetID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+		} else if err != nil {
+			log.Error().Err(err).Str("email", req.Email).Msg("Failed to look up share target")
+			return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		}
+		req.UserID = &targetID
+	}
+
+	// Shares are keyed by item and grantee, so sharing again changes the access level
+	var column string
+	var target int
+	if req.UserID != nil {
+		var exists bool
+		if err := dal.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", *req.UserID).Scan(&exists); err != nil {
+			log.Error().Err(err).Int("targetUserId", *req.UserID).Msg("Failed to look up share target")
+			return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		}
+		if !exists {
+			return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+		}
+
+		// Grants only reach members of the item's organization
+		role, err := organizationRole(org.ID, *req.UserID)
+		if err != nil {
+			log.Error().Err(err).Int("targetUserId", *req.UserID).Msg("Failed to check organization membership")
+			return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		}
+		if role == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "User is not a member of this organization"})
+		}
+
+		var ownerID int
+		if err := dal.DB.QueryRow("SELECT user_id FROM items WHERE id = ?", id).Scan(&ownerID); err != nil {
+			log.Error().Err(err).Int("itemId", id).Msg("Failed to fetch item owner")
+			return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		}
+		if ownerID == *req.UserID {
+			return c.Status(400).JSON(fiber.Map{"error": "Item is already owned by this user"})
+		}
+
+		column, target = "user_id", *req.UserID
+	} else {
+		var exists bool
+		if err := dal.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM roles WHERE id = ?)", *req.RoleID).Scan(&exists); err != nil {
+			log.Error().Err(err).Int("roleId", *req.RoleID).Msg("Failed to look up share target")
+			return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		}
+		if !exists {
+			return c.Status(404).JSON(fiber.Map{"error": "Role not found"})
+		}
+
+		column, target = "role_id", *req.RoleID
+	}
+
+	var (
+		shareID int64
+		existed bool
+	)
+	err = dal.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM item_shares WHERE item_id = ? AND "+column+" = ?)",
+		id, target).Scan(&existed)
+	if err == nil {
+		err = dal.DB.QueryRow(`
+			INSERT INTO item_shares (item_id, `+column+`, access_level, created_by)
+			VALUES (?, ?, ?, ?)
+			ON CONFLICT(item_id, `+column+`) DO UPDATE SET access_level = excluded.access_level
+			RETURNING id`,
+			id, target, req.AccessLevel, userID).Scan(&shareID)
+	}
+	if err != nil {
+		log.Error().Err(err).
+			Int("userId", userID).
+			Int("itemId", id).
+			Str("accessLevel", req.AccessLevel).
+			Str("method", c.Method()).
+			Str("path", c.Path()).
+			Msg("Database query failed while sharing item")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to share item"})
+	}
+
+	log.Info().
+		Int("userId", userID).
+		Int("itemId", id).
+		Str("accessLevel", req.AccessLevel).
+		Msg("Item shared successfully")
+
+	status := fiber.StatusCreated
+	if existed {
+		status = fiber.StatusOK
+	}
+	return c.Status(status).JSON(fiber.Map{
+		"id":           shareID,
+		"item_id":      id,
+		"user_id":      req.UserID,
+		"role_id":      req.RoleID,
+		"access_level": req.AccessLevel,
+	})
+}
+
+func RemoveItemShare(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid ID"})
+	}
+
+	shareID, err := c.ParamsInt("shareId")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid share ID"})
+	}
+
+	allowed, err := hasItemAccess(userID, org, id, AccessOwner)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to check item access")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to check item access"})
+	}
+	if !allowed {
+		return itemAccessDenied(c, userID, org, id)
+	}
+
+	if err := authorizeItem(c, userID, org, id, "share_item"); err != nil {
+		return err
+	}
+
+	result, err := dal.DB.Exec("DELETE FROM item_shares WHERE id = ? AND item_id = ?", shareID, id)
+	if err != nil {
+		log.Error().Err(err).Int("itemId", id).Int("shareId", shareID).Msg("Failed to remove item share")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to remove share"})
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Share not found"})
+	}
+
+	log.Info().Int("userId", userID).Int("itemId", id).Int("shareId", shareID).Msg("Item share removed")
+	return c.SendStatus(204)
+}
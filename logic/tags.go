@@ -0,0 +1,508 @@
+package logic
+
+import (
+	"crudracula/dal"
+	"crudracula/models"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// maxTagNameLength matches the VARCHAR(50) of tags.name
+const maxTagNameLength = 50
+
+// Tag filter modes of GET /api/items
+const (
+	TagMatchAny = "any"
+	TagMatchAll = "all"
+)
+
+// normalizeTagName collapses whitespace in a tag name and checks that it can be stored
+// and used in the comma-separated tags filter
+func normalizeTagName(name string) (string, error) {
+	name = strings.Join(strings.Fields(name), " ")
+	switch {
+	case name == "":
+		return "", fiber.NewError(fiber.StatusBadRequest, "Tag names must not be empty")
+	case len(name) > maxTagNameLength:
+		return "", fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Tag names must be at most %d characters", maxTagNameLength))
+	case strings.Contains(name, ","):
+		return "", fiber.NewError(fiber.StatusBadRequest, "Tag names cannot contain commas")
+	}
+	return name, nil
+}
+
+// normalizeTagNames normalizes tag names, dropping names that differ only by case
+func normalizeTagNames(names []string) ([]string, error) {
+	seen := map[string]bool{}
+	normalized := make([]string, 0, len(names))
+	for _, name := range names {
+		name, err := normalizeTagName(name)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[strings.ToLower(name)] {
+			seen[strings.ToLower(name)] = true
+			normalized = append(normalized, name)
+		}
+	}
+	return normalized, nil
+}
+
+// ensureTags returns the IDs of the named tags of the organization, creating missing ones
+func ensureTags(tx *sql.Tx, userID int, org activeOrganization, names []string) ([]int, error) {
+	ids := make([]int, 0, len(names))
+	for _, name := range names {
+		_, err := tx.Exec("INSERT OR IGNORE INTO tags (organization_id, name, created_by) VALUES (?, ?, ?)",
+			org.ID, name, userID)
+		if err != nil {
+			return nil, err
+		}
+		var id int
+		if err := tx.QueryRow("SELECT id FROM tags WHERE organization_id = ? AND name = ?", org.ID, name).Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// addItemTags tags an item and reports whether any tag was new to it
+func addItemTags(tx *sql.Tx, itemID int, tagIDs []int) (bool, error) {
+	changed := false
+	for _, tagID := range tagIDs {
+		result, err := tx.Exec("INSERT OR IGNORE INTO item_tags (item_id, tag_id) VALUES (?, ?)", itemID, tagID)
+		if err != nil {
+			return false, err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// setItemTags replaces the tags of an item and reports whether they changed
+func setItemTags(tx *sql.Tx, userID int, org activeOrganization, itemID int, names []string) (bool, error) {
+	tagIDs, err := ensureTags(tx, userID, org, names)
+	if err != nil {
+		return false, err
+	}
+
+	args := []interface{}{itemID}
+	for _, id := range tagIDs {
+		args = append(args, id)
+	}
+	query := "DELETE FROM item_tags WHERE item_id = ?"
+	if len(tagIDs) > 0 {
+		query += " AND tag_id NOT IN (" + placeholders(len(tagIDs)) + ")"
+	}
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	removed, _ := result.RowsAffected()
+
+	added, err := addItemTags(tx, itemID, tagIDs)
+	return added || removed > 0, err
+}
+
+// touchItems bumps the version of live items changed on their behalf, by a tag rename
+// or merge or the deletion of a custom field, and records the change in their history
+func touchItems(tx *sql.Tx, userID int, itemIDs []int) error {
+	for _, id := range itemIDs {
+		result, err := tx.Exec("UPDATE items SET version = version + 1 WHERE items.id = ? AND "+itemLiveCondition, id)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+		item, err := queryItem(tx, id)
+		if err == nil {
+			err = recordItemRevision(tx, userID, item, RevisionUpdate, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// taggedItemIDs lists the items carrying a tag
+func taggedItemIDs(tx *sql.Tx, tagID int) ([]int, error) {
+	rows, err := tx.Query("SELECT item_id FROM item_tags WHERE tag_id = ?", tagID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// changeItemTags runs a change to the tags of the item in the route and responds with
+// the item. The version is bumped and a revision recorded only when the tags changed.
+func changeItemTags(c *fiber.Ctx, change func(tx *sql.Tx, userID int, org activeOrganization, id int) (bool, error)) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid ID"})
+	}
+
+	if err := authorizeItem(c, userID, org, id, "update_item"); err != nil {
+		return err
+	}
+
+	version, err := checkItemIfMatch(c, id)
+	if err != nil {
+		return respondItemError(c, err)
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update tags"})
+	}
+	defer tx.Rollback()
+
+	accessClause, accessArgs := itemAccessClause(userID, org, AccessEditor)
+	result, err := tx.Exec(`
+		UPDATE items SET version = version + 1
+		WHERE items.id = ? AND (? = 0 OR items.version = ?) AND `+accessClause,
+		append([]interface{}{id, version, version}, accessArgs...)...)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to update item for tags")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update tags"})
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		tx.Rollback()
+		return itemWriteRejected(c, userID, org, id, version)
+	}
+
+	changed, err := change(tx, userID, org, id)
+	if _, ok := err.(*fiber.Error); ok {
+		return err
+	} else if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to change item tags")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update tags"})
+	}
+
+	// Nothing changed, so the version stays as it was
+	if !changed {
+		tx.Rollback()
+		item, err := loadItem(id)
+		if err != nil {
+			log.Error().Err(err).Int("itemId", id).Msg("Failed to load item")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update tags"})
+		}
+		c.Set(fiber.HeaderETag, item.ETag)
+		return c.JSON(item)
+	}
+
+	updated, err := queryItem(tx, id)
+	if err == nil {
+		err = recordItemRevision(tx, userID, updated, RevisionUpdate, nil)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to record item tags")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update tags"})
+	}
+
+	log.Info().Int("userId", userID).Int("itemId", id).Strs("tags", updated.Tags).Msg("Item tags updated")
+
+	c.Set(fiber.HeaderETag, updated.ETag)
+	return c.JSON(updated)
+}
+
+// AddItemTags adds tags to an item, creating tags the organization does not have yet
+func AddItemTags(c *fiber.Ctx) error {
+	var req models.ItemTagsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+	}
+	names, err := normalizeTagNames(req.Tags)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "tags must not be empty"})
+	}
+
+	return changeItemTags(c, func(tx *sql.Tx, userID int, org activeOrganization, id int) (bool, error) {
+		tagIDs, err := ensureTags(tx, userID, org, names)
+		if err != nil {
+			return false, err
+		}
+		return addItemTags(tx, id, tagIDs)
+	})
+}
+
+// SetItemTags replaces all tags of an item; an empty list removes them
+func SetItemTags(c *fiber.Ctx) error {
+	var req models.ItemTagsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+	}
+	names, err := normalizeTagNames(req.Tags)
+	if err != nil {
+		return err
+	}
+
+	return changeItemTags(c, func(tx *sql.Tx, userID int, org activeOrganization, id int) (bool, error) {
+		return setItemTags(tx, userID, org, id, names)
+	})
+}
+
+// RemoveItemTag removes one tag, by name, from an item
+func RemoveItemTag(c *fiber.Ctx) error {
+	name, err := url.PathUnescape(c.Params("tag"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid tag"})
+	}
+
+	return changeItemTags(c, func(tx *sql.Tx, userID int, org activeOrganization, id int) (bool, error) {
+		result, err := tx.Exec(`
+			DELETE FROM item_tags
+			WHERE item_id = ? AND tag_id = (SELECT id FROM tags WHERE organization_id = ? AND name = ?)`,
+			id, org.ID, strings.TrimSpace(name))
+		if err != nil {
+			return false, err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return false, fiber.NewError(fiber.StatusNotFound, "The item does not have this tag")
+		}
+		return true, nil
+	})
+}
+
+// queryTags lists tags of the active organization matching a condition on the tags
+// table, counting the live items the user can see that carry each one
+func queryTags(userID int, org activeOrganization, where string, args ...interface{}) ([]models.Tag, error) {
+	accessClause, accessArgs := itemAccessClause(userID, org, AccessViewer)
+	rows, err := dal.DB.Query(`
+		SELECT tags.id, tags.name, tags.created_at, (
+			SELECT COUNT(*) FROM item_tags JOIN items ON items.id = item_tags.item_id
+			WHERE item_tags.tag_id = tags.id AND `+accessClause+`
+		)
+		FROM tags
+		WHERE tags.organization_id = ? AND `+where+`
+		ORDER BY tags.name`,
+		append(append(accessArgs, org.ID), args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []models.Tag{}
+	for rows.Next() {
+		var tag models.Tag
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.CreatedAt, &tag.Count); err != nil {
+			return nil, err
+		}
+		tag.CreatedAt = tag.CreatedAt.UTC()
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// GetTags lists the tags of the active organization with item counts
+func GetTags(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
+	tags, err := queryTags(userID, org, "1 = 1")
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("organizationId", org.ID).Msg("Failed to fetch tags")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch tags"})
+	}
+	return c.JSON(tags)
+}
+
+// tagAdmin resolves the caller and the tag in the route for a rename or merge, which
+// change items across the organization and are reserved to its admins
+func tagAdmin(c *fiber.Ctx) (int, activeOrganization, int, error) {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return 0, activeOrganization{}, 0, fiber.NewError(fiber.StatusUnauthorized, "Unauthorized")
+	}
+
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return 0, org, 0, fiber.NewError(fiber.StatusForbidden, "No active organization")
+	}
+	if orgRoleRank[org.Role] < orgRoleRank[OrgRoleAdmin] {
+		return 0, org, 0, fiber.NewError(fiber.StatusForbidden, "Only organization admins can rename or merge tags")
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return 0, org, 0, fiber.NewError(fiber.StatusBadRequest, "Invalid tag ID")
+	}
+	if err := checkTagExists(org, id); err != nil {
+		return 0, org, 0, err
+	}
+	return userID, org, id, nil
+}
+
+// checkTagExists fails with 404 unless the tag belongs to the organization
+func checkTagExists(org activeOrganization, id int) error {
+	var exists bool
+	err := dal.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM tags WHERE id = ? AND organization_id = ?)", id, org.ID).Scan(&exists)
+	if err != nil {
+		log.Error().Err(err).Int("tagId", id).Msg("Failed to check tag")
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal server error: failed to fetch tag")
+	}
+	if !exists {
+		return fiber.NewError(fiber.StatusNotFound, "Tag not found")
+	}
+	return nil
+}
+
+// respondTag responds with a tag after a rename or merge
+func respondTag(c *fiber.Ctx, userID int, org activeOrganization, id int) error {
+	tags, err := queryTags(userID, org, "tags.id = ?", id)
+	if err != nil || len(tags) == 0 {
+		log.Error().Err(err).Int("tagId", id).Msg("Failed to load tag")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch tag"})
+	}
+	return c.JSON(tags[0])
+}
+
+// RenameTag renames a tag on every item that carries it
+func RenameTag(c *fiber.Ctx) error {
+	userID, org, id, err := tagAdmin(c)
+	if err != nil {
+		return err
+	}
+
+	var req models.RenameTagRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+	}
+	name, err := normalizeTagName(req.Name)
+	if err != nil {
+		return err
+	}
+
+	var conflict bool
+	err = dal.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM tags WHERE organization_id = ? AND name = ? AND id <> ?)",
+		org.ID, name, id).Scan(&conflict)
+	if err != nil {
+		log.Error().Err(err).Int("tagId", id).Msg("Failed to check tag name")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to rename tag"})
+	}
+	if conflict {
+		return c.Status(409).JSON(fiber.Map{"error": fmt.Sprintf("A tag named %q already exists, merge the tags instead", name)})
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to rename tag"})
+	}
+	defer tx.Rollback()
+
+	itemIDs, err := taggedItemIDs(tx, id)
+	if err == nil {
+		_, err = tx.Exec("UPDATE tags SET name = ? WHERE id = ?", name, id)
+	}
+	if err == nil {
+		err = touchItems(tx, userID, itemIDs)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("tagId", id).Msg("Failed to rename tag")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to rename tag"})
+	}
+
+	log.Info().Int("userId", userID).Int("tagId", id).Str("name", name).Int("items", len(itemIDs)).Msg("Tag renamed")
+	return respondTag(c, userID, org, id)
+}
+
+// MergeTag moves every item of a tag to another tag and deletes it
+func MergeTag(c *fiber.Ctx) error {
+	userID, org, id, err := tagAdmin(c)
+	if err != nil {
+		return err
+	}
+
+	var req models.MergeTagRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+	}
+	if req.Into == id {
+		return c.Status(400).JSON(fiber.Map{"error": "A tag cannot be merged into itself"})
+	}
+	if err := checkTagExists(org, req.Into); err != nil {
+		return err
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to merge tags"})
+	}
+	defer tx.Rollback()
+
+	itemIDs, err := taggedItemIDs(tx, id)
+	if err == nil {
+		_, err = tx.Exec(`
+			INSERT OR IGNORE INTO item_tags (item_id, tag_id, created_at)
+			SELECT item_id, ?, created_at FROM item_tags WHERE tag_id = ?`, req.Into, id)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM item_tags WHERE tag_id = ?", id)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM tags WHERE id = ?", id)
+	}
+	if err == nil {
+		err = touchItems(tx, userID, itemIDs)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("tagId", id).Int("into", req.Into).Msg("Failed to merge tags")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to merge tags"})
+	}
+
+	log.Info().Int("userId", userID).Int("tagId", id).Int("into", req.Into).Int("items", len(itemIDs)).Msg("Tags merged")
+	return respondTag(c, userID, org, req.Into)
+}
@@ -0,0 +1,647 @@
+package logic
+
+import (
+	"crudracula/dal"
+	"crudracula/encoders"
+	"crudracula/models"
+	"crudracula/policy"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// maxTemplateNameLength matches the VARCHAR(255) of item_templates.name and item_name
+const maxTemplateNameLength = 255
+
+// templatePlaceholderPattern matches placeholders such as {{user.email}}, {{date}} and
+// {{date+7d}}; time placeholders may be offset by a duration
+var templatePlaceholderPattern = regexp.MustCompile(`\{\{\s*([a-z][a-z0-9_.]*)\s*(?:([+-])\s*([0-9.]+[a-z]+)\s*)?\}\}`)
+
+// templateTimeLayouts are the built-in time placeholders
+var templateTimeLayouts = map[string]string{
+	"date":     "2006-01-02",
+	"time":     "15:04",
+	"datetime": time.RFC3339,
+	"weekday":  "Monday",
+}
+
+const itemTemplateColumns = `t.id, t.name, t.shared, t.item_name, t.description, t.tags, t.attributes,
+	t.due_in, t.remind_in, t.user_id, u.email, t.created_at, t.updated_at
+	FROM item_templates t
+	LEFT JOIN users u ON u.id = t.user_id`
+
+// itemTemplateVisibility limits templates to the shared ones of the organization and
+// the user's own
+const itemTemplateVisibility = "t.organization_id = ? AND (t.shared OR t.user_id = ?)"
+
+func scanItemTemplate(row rowScanner, template *models.ItemTemplate) error {
+	var (
+		tags, attributes string
+		creatorEmail     sql.NullString
+		creatorID        int
+	)
+	err := row.Scan(&template.ID, &template.Name, &template.Shared, &template.ItemName, &template.Description,
+		&tags, &attributes, &template.DueIn, &template.RemindIn, &creatorID, &creatorEmail,
+		&template.CreatedAt, &template.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	template.CreatedAt, template.UpdatedAt = template.CreatedAt.UTC(), template.UpdatedAt.UTC()
+	if creatorEmail.Valid {
+		template.CreatedBy = &models.ItemOwner{ID: creatorID, Email: creatorEmail.String}
+	}
+	template.Tags, template.Attributes = []string{}, map[string]interface{}{}
+	if err := encoders.Unmarshal([]byte(tags), &template.Tags); err != nil {
+		return err
+	}
+	return encoders.Unmarshal([]byte(attributes), &template.Attributes)
+}
+
+// loadItemTemplate returns a template the user can see in the organization
+func loadItemTemplate(userID int, org activeOrganization, id int) (models.ItemTemplate, error) {
+	var template models.ItemTemplate
+	err := scanItemTemplate(dal.DB.QueryRow("SELECT "+itemTemplateColumns+" WHERE t.id = ? AND "+itemTemplateVisibility,
+		id, org.ID, userID), &template)
+	return template, err
+}
+
+// templateUser authenticates a template request. Organization viewers can list and read
+// templates but neither write nor use them, as they cannot create items.
+func templateUser(c *fiber.Ctx, write bool) (int, activeOrganization, error) {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return 0, activeOrganization{}, fiber.NewError(fiber.StatusUnauthorized, "Unauthorized")
+	}
+
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return 0, org, fiber.NewError(fiber.StatusForbidden, "No active organization")
+	}
+	if write && orgRoleRank[org.Role] < orgRoleRank[OrgRoleMember] {
+		return 0, org, fiber.NewError(fiber.StatusForbidden, "Organization viewers cannot use templates")
+	}
+	return userID, org, nil
+}
+
+// templateParam reads the template in the route, which the user must be able to see
+func templateParam(c *fiber.Ctx, userID int, org activeOrganization) (models.ItemTemplate, error) {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return models.ItemTemplate{}, fiber.NewError(fiber.StatusBadRequest, "Invalid template ID")
+	}
+	template, err := loadItemTemplate(userID, org, id)
+	if err == sql.ErrNoRows {
+		return template, fiber.NewError(fiber.StatusNotFound, "Template not found")
+	} else if err != nil {
+		log.Error().Err(err).Int("templateId", id).Msg("Failed to fetch template")
+		return template, fiber.NewError(fiber.StatusInternalServerError, "Internal server error: failed to fetch template")
+	}
+	return template, nil
+}
+
+// checkTemplateManager allows changes to a template to its creator and, for shared
+// templates, to organization admins
+func checkTemplateManager(userID int, org activeOrganization, template models.ItemTemplate) error {
+	if template.CreatedBy != nil && template.CreatedBy.ID == userID {
+		return nil
+	}
+	if template.Shared && orgRoleRank[org.Role] >= orgRoleRank[OrgRoleAdmin] {
+		return nil
+	}
+	return fiber.NewError(fiber.StatusForbidden, "Only the creator of a template or an organization admin can change it")
+}
+
+// validateTemplateOffset checks a due_in or remind_in duration
+func validateTemplateOffset(name, offset string) error {
+	if offset == "" {
+		return nil
+	}
+	d, err := policy.ParseDuration(offset)
+	if err != nil || d < 0 {
+		return fiber.NewError(fiber.StatusBadRequest, name+" must be a duration such as 7d or 12h")
+	}
+	return nil
+}
+
+// validateItemTemplate checks a template request. Attributes are only checked against
+// the custom fields when items are made from the template, as placeholders may fill them.
+func validateItemTemplate(req models.ItemTemplateRequest) (models.ItemTemplate, error) {
+	template := models.ItemTemplate{
+		Name:        strings.TrimSpace(req.Name),
+		Shared:      req.Shared,
+		ItemName:    strings.TrimSpace(req.ItemName),
+		Description: req.Description,
+		Attributes:  req.Attributes,
+		DueIn:       strings.TrimSpace(req.DueIn),
+		RemindIn:    strings.TrimSpace(req.RemindIn),
+	}
+	switch {
+	case template.Name == "":
+		return template, fiber.NewError(fiber.StatusBadRequest, "Template name is required")
+	case template.ItemName == "":
+		return template, fiber.NewError(fiber.StatusBadRequest, "Item name is required")
+	case utf8.RuneCountInString(template.Name) > maxTemplateNameLength || utf8.RuneCountInString(template.ItemName) > maxTemplateNameLength:
+		return template, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Names must be at most %d characters", maxTemplateNameLength))
+	}
+	if err := validateTemplateOffset("due_in", template.DueIn); err != nil {
+		return template, err
+	}
+	if err := validateTemplateOffset("remind_in", template.RemindIn); err != nil {
+		return template, err
+	}
+
+	tags, err := normalizeTagNames(req.Tags)
+	if err != nil {
+		return template, err
+	}
+	template.Tags = tags
+	if template.Attributes == nil {
+		template.Attributes = map[string]interface{}{}
+	}
+	return template, nil
+}
+
+// templateColumns serializes the tags and attributes of a template for storage
+func templateColumns(template models.ItemTemplate) (string, string, error) {
+	tags, err := encoders.Marshal(template.Tags)
+	if err != nil {
+		return "", "", err
+	}
+	attributes, err := encoders.Marshal(template.Attributes)
+	return string(tags), string(attributes), err
+}
+
+// templateExpander fills the placeholders of a template and collects those it cannot fill
+type templateExpander struct {
+	now        time.Time
+	email      string
+	values     map[string]string
+	unresolved map[string]bool
+}
+
+func (e *templateExpander) expand(text string) string {
+	return templatePlaceholderPattern.ReplaceAllStringFunc(text, func(placeholder string) string {
+		match := templatePlaceholderPattern.FindStringSubmatch(placeholder)
+		name, sign, offset := match[1], match[2], match[3]
+
+		if layout, ok := templateTimeLayouts[name]; ok {
+			at := e.now
+			if offset != "" {
+				d, err := policy.ParseDuration(offset)
+				if err != nil {
+					e.unresolved[placeholder] = true
+					return placeholder
+				}
+				if sign == "-" {
+					d = -d
+				}
+				at = at.Add(d)
+			}
+			return at.Format(layout)
+		}
+
+		if offset == "" {
+			if name == "user.email" {
+				return e.email
+			}
+			if value, ok := e.values[name]; ok {
+				return value
+			}
+		}
+		e.unresolved[placeholder] = true
+		return placeholder
+	})
+}
+
+// instantiate makes the item a template describes
+func (e *templateExpander) instantiate(template models.ItemTemplate) (models.Item, error) {
+	item := models.Item{
+		Name:        e.expand(template.ItemName),
+		Description: e.expand(template.Description),
+		Attributes:  make(map[string]interface{}, len(template.Attributes)),
+	}
+	for _, tag := range template.Tags {
+		item.Tags = append(item.Tags, e.expand(tag))
+	}
+	for name, value := range template.Attributes {
+		if text, ok := value.(string); ok {
+			value = e.expand(text)
+			// An attribute that is a placeholder alone keeps numbers and booleans as such
+			if templatePlaceholderPattern.FindString(text) == strings.TrimSpace(text) {
+				var scalar interface{}
+				if encoders.Unmarshal([]byte(value.(string)), &scalar) == nil {
+					switch scalar.(type) {
+					case float64, bool:
+						value = scalar
+					}
+				}
+			}
+		}
+		item.Attributes[name] = value
+	}
+
+	if len(e.unresolved) > 0 {
+		unresolved := make([]string, 0, len(e.unresolved))
+		for placeholder := range e.unresolved {
+			unresolved = append(unresolved, placeholder)
+		}
+		sort.Strings(unresolved)
+		return item, &unresolvedPlaceholdersError{Placeholders: unresolved}
+	}
+
+	tags, err := normalizeTagNames(item.Tags)
+	if err != nil {
+		return item, err
+	}
+	item.Tags = tags
+
+	for _, offset := range []struct {
+		duration string
+		at       **time.Time
+	}{{template.DueIn, &item.DueAt}, {template.RemindIn, &item.RemindAt}} {
+		if offset.duration == "" {
+			continue
+		}
+		d, err := policy.ParseDuration(offset.duration)
+		if err != nil {
+			return item, err
+		}
+		at := e.now.Add(d).UTC().Truncate(time.Second)
+		*offset.at = &at
+	}
+	return item, nil
+}
+
+// unresolvedPlaceholdersError lists the placeholders of a template that neither are
+// built in nor were given values
+type unresolvedPlaceholdersError struct {
+	Placeholders []string
+}
+
+func (e *unresolvedPlaceholdersError) Error() string {
+	return "unresolved placeholders: " + strings.Join(e.Placeholders, ", ")
+}
+
+// insertItem creates an item of the organization owned by the user, with the initial
+// status of the workflow, and records it in the item's history. Tags must be normalized.
+func insertItem(tx *sql.Tx, userID int, org activeOrganization, item models.Item) (models.Item, error) {
+	attributes, err := checkedAttributes(tx, org, item.Attributes)
+	if err != nil {
+		return item, err
+	}
+	status, err := initialItemStatus(tx, org.ID)
+	if err != nil {
+		return item, err
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO items (name, description, attributes, status, due_at, remind_at, user_id, organization_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		item.Name, item.Description, attributes, status, sqliteTime(item.DueAt), sqliteTime(item.RemindAt), userID, org.ID)
+	if err != nil {
+		return item, err
+	}
+	id, _ := result.LastInsertId()
+	if _, err := setItemTags(tx, userID, org, int(id), item.Tags); err != nil {
+		return item, err
+	}
+
+	created, err := queryItem(tx, int(id))
+	if err != nil {
+		return item, err
+	}
+	return created, recordItemRevision(tx, userID, created, RevisionCreate, nil)
+}
+
+// createItemFrom creates an item made from another item or a template, after the checks
+// of CreateItem, and responds with it
+func createItemFrom(c *fiber.Ctx, userID int, org activeOrganization, item models.Item) error {
+	if orgRoleRank[org.Role] < orgRoleRank[OrgRoleMember] {
+		return c.Status(403).JSON(fiber.Map{"error": "Organization viewers cannot create items"})
+	}
+	resource := policy.Attributes{"type": "item", "organization_id": org.ID, "name": item.Name}
+	if err := authorize(c, userID, "create_item", resource); err != nil {
+		return err
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create item"})
+	}
+	defer tx.Rollback()
+
+	created, err := insertItem(tx, userID, org, item)
+	if err == nil {
+		err = tx.Commit()
+	}
+	var invalid *invalidAttributesError
+	if errors.As(err, &invalid) {
+		return respondItemError(c, err)
+	} else if err != nil {
+		log.Error().Err(err).Int("userId", userID).Str("name", item.Name).Msg("Failed to create item")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create item"})
+	}
+
+	log.Info().Int("userId", userID).Int("id", created.ID).Str("name", created.Name).Msg("Item created successfully")
+	c.Set(fiber.HeaderETag, created.ETag)
+	return c.Status(201).JSON(created)
+}
+
+// DuplicateItem creates a copy of an item the user can see, owned by the user. Name,
+// description, tags, attributes and due date are copied, as is the reminder when it is
+// still ahead; the copy starts in the initial status of the workflow, without the links,
+// comments, attachments, shares or history of the original.
+func DuplicateItem(c *fiber.Ctx) error {
+	userID, org, id, err := visibleItem(c)
+	if err != nil {
+		return err
+	}
+	if err := authorizeItem(c, userID, org, id, "read_item"); err != nil {
+		return err
+	}
+
+	var req models.DuplicateItemRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+	}
+
+	original, err := loadItem(id)
+	if err != nil {
+		log.Error().Err(err).Int("itemId", id).Msg("Failed to fetch item to duplicate")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to duplicate item"})
+	}
+
+	copied := models.Item{
+		Name:        original.Name + " (copy)",
+		Description: original.Description,
+		Tags:        original.Tags,
+		Attributes:  original.Attributes,
+		DueAt:       original.DueAt,
+	}
+	if req.Name != nil {
+		copied.Name = *req.Name
+	}
+	if original.RemindAt != nil && original.RemindAt.After(time.Now()) {
+		copied.RemindAt = original.RemindAt
+	}
+
+	log.Debug().Int("userId", userID).Int("itemId", id).Str("name", copied.Name).Msg("Duplicating item")
+	return createItemFrom(c, userID, org, copied)
+}
+
+// GetItemTemplates lists the templates the user can use: their own and those shared
+// with the organization
+func GetItemTemplates(c *fiber.Ctx) error {
+	userID, org, err := templateUser(c, false)
+	if err != nil {
+		return err
+	}
+
+	rows, err := dal.DB.Query("SELECT "+itemTemplateColumns+" WHERE "+itemTemplateVisibility+" ORDER BY t.name, t.id",
+		org.ID, userID)
+	if err != nil {
+		log.Error().Err(err).Int("organizationId", org.ID).Msg("Failed to fetch templates")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch templates"})
+	}
+	defer rows.Close()
+
+	templates := []models.ItemTemplate{}
+	for rows.Next() {
+		var template models.ItemTemplate
+		if err := scanItemTemplate(rows, &template); err != nil {
+			log.Error().Err(err).Msg("Failed to scan template")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch templates"})
+		}
+		templates = append(templates, template)
+	}
+	if err := rows.Err(); err != nil {
+		log.Error().Err(err).Msg("Failed to iterate templates")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch templates"})
+	}
+	return c.JSON(templates)
+}
+
+// GetItemTemplate returns a template
+func GetItemTemplate(c *fiber.Ctx) error {
+	userID, org, err := templateUser(c, false)
+	if err != nil {
+		return err
+	}
+	template, err := templateParam(c, userID, org)
+	if err != nil {
+		return err
+	}
+	return c.JSON(template)
+}
+
+// CreateItemTemplate saves a personal or shared template. With item_id, the item fields
+// left out of the request are taken from that item.
+func CreateItemTemplate(c *fiber.Ctx) error {
+	userID, org, err := templateUser(c, true)
+	if err != nil {
+		return err
+	}
+
+	var req models.ItemTemplateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+	}
+	if req.ItemID != 0 {
+		visible, err := hasItemAccess(userID, org, req.ItemID, AccessViewer)
+		if err != nil {
+			log.Error().Err(err).Int("userId", userID).Int("itemId", req.ItemID).Msg("Failed to check item access")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to check item access"})
+		}
+		if !visible {
+			return c.Status(404).JSON(fiber.Map{"error": "Item not found"})
+		}
+		if err := authorizeItem(c, userID, org, req.ItemID, "read_item"); err != nil {
+			return err
+		}
+		item, err := loadItem(req.ItemID)
+		if err != nil {
+			log.Error().Err(err).Int("itemId", req.ItemID).Msg("Failed to fetch template item")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create template"})
+		}
+		if req.ItemName == "" {
+			req.ItemName = item.Name
+		}
+		if req.Description == "" {
+			req.Description = item.Description
+		}
+		if req.Tags == nil {
+			req.Tags = item.Tags
+		}
+		if req.Attributes == nil {
+			req.Attributes = item.Attributes
+		}
+	}
+
+	template, err := validateItemTemplate(req)
+	if err != nil {
+		return err
+	}
+	tags, attributes, err := templateColumns(template)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create template"})
+	}
+
+	result, err := dal.DB.Exec(`
+		INSERT INTO item_templates (organization_id, user_id, name, shared, item_name, description, tags, attributes, due_in, remind_in)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		org.ID, userID, template.Name, template.Shared, template.ItemName, template.Description, tags, attributes,
+		template.DueIn, template.RemindIn)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Str("name", template.Name).Msg("Failed to create template")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create template"})
+	}
+
+	id, _ := result.LastInsertId()
+	created, err := loadItemTemplate(userID, org, int(id))
+	if err != nil {
+		log.Error().Err(err).Int64("templateId", id).Msg("Failed to load created template")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create template"})
+	}
+
+	log.Info().Int("userId", userID).Int("organizationId", org.ID).Int("templateId", created.ID).
+		Bool("shared", created.Shared).Msg("Template created")
+	return c.Status(201).JSON(created)
+}
+
+// UpdateItemTemplate replaces a template
+func UpdateItemTemplate(c *fiber.Ctx) error {
+	userID, org, err := templateUser(c, true)
+	if err != nil {
+		return err
+	}
+	current, err := templateParam(c, userID, org)
+	if err != nil {
+		return err
+	}
+	if err := checkTemplateManager(userID, org, current); err != nil {
+		return err
+	}
+
+	var req models.ItemTemplateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+	}
+	if req.ItemID != 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "item_id can only be given when creating a template"})
+	}
+	template, err := validateItemTemplate(req)
+	if err != nil {
+		return err
+	}
+	tags, attributes, err := templateColumns(template)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update template"})
+	}
+
+	_, err = dal.DB.Exec(`
+		UPDATE item_templates
+		SET name = ?, shared = ?, item_name = ?, description = ?, tags = ?, attributes = ?, due_in = ?, remind_in = ?,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?`,
+		template.Name, template.Shared, template.ItemName, template.Description, tags, attributes,
+		template.DueIn, template.RemindIn, current.ID)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("templateId", current.ID).Msg("Failed to update template")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update template"})
+	}
+
+	// An admin who makes someone else's template personal can no longer see it
+	var updated models.ItemTemplate
+	err = scanItemTemplate(dal.DB.QueryRow("SELECT "+itemTemplateColumns+" WHERE t.id = ?", current.ID), &updated)
+	if err != nil {
+		log.Error().Err(err).Int("templateId", current.ID).Msg("Failed to load updated template")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update template"})
+	}
+
+	log.Info().Int("userId", userID).Int("templateId", updated.ID).Msg("Template updated")
+	return c.JSON(updated)
+}
+
+// DeleteItemTemplate removes a template; items made from it are not affected
+func DeleteItemTemplate(c *fiber.Ctx) error {
+	userID, org, err := templateUser(c, true)
+	if err != nil {
+		return err
+	}
+	template, err := templateParam(c, userID, org)
+	if err != nil {
+		return err
+	}
+	if err := checkTemplateManager(userID, org, template); err != nil {
+		return err
+	}
+
+	if _, err := dal.DB.Exec("DELETE FROM item_templates WHERE id = ?", template.ID); err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("templateId", template.ID).Msg("Failed to delete template")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to delete template"})
+	}
+
+	log.Info().Int("userId", userID).Int("templateId", template.ID).Msg("Template deleted")
+	return c.SendStatus(204)
+}
+
+// CreateItemFromTemplate creates an item from a template, filling its placeholders.
+// {{date}}, {{time}}, {{datetime}} and {{weekday}} give the current time, optionally
+// offset as in {{date+7d}}, and {{user.email}} the email of the user; any other
+// placeholder takes its value from the request, and is rejected when none is given.
+func CreateItemFromTemplate(c *fiber.Ctx) error {
+	userID, org, err := templateUser(c, true)
+	if err != nil {
+		return err
+	}
+	template, err := templateParam(c, userID, org)
+	if err != nil {
+		return err
+	}
+
+	var req models.TemplateItemRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+	}
+	location := time.UTC
+	if req.TZ != "" {
+		if location, err = time.LoadLocation(req.TZ); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "tz must be an IANA time zone name"})
+		}
+	}
+
+	var email string
+	if err := dal.DB.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email); err != nil {
+		log.Error().Err(err).Int("userId", userID).Msg("Failed to fetch user email")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to create item"})
+	}
+
+	expander := &templateExpander{now: time.Now().In(location), email: email, values: req.Values, unresolved: map[string]bool{}}
+	item, err := expander.instantiate(template)
+	var unresolved *unresolvedPlaceholdersError
+	if errors.As(err, &unresolved) {
+		return c.Status(422).JSON(fiber.Map{
+			"error":        "Template placeholders without a value",
+			"placeholders": unresolved.Placeholders,
+		})
+	} else if err != nil {
+		return err
+	}
+
+	log.Debug().Int("userId", userID).Int("templateId", template.ID).Str("name", item.Name).Msg("Creating item from template")
+	return createItemFrom(c, userID, org, item)
+}
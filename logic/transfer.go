@@ -0,0 +1,666 @@
+package logic
+
+import (
+	"bufio"
+	"bytes"
+	"crudracula/dal"
+	"crudracula/encoders"
+	"crudracula/models"
+	"crudracula/policy"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// exportContentTypes are the export formats and the content type each is served with
+var exportContentTypes = map[string]string{
+	"csv":   "text/csv; charset=utf-8",
+	"jsonl": "application/x-ndjson",
+	"json":  fiber.MIMEApplicationJSON,
+}
+
+// itemCSVHeader are the columns of a CSV export
+var itemCSVHeader = []string{"id", "name", "description", "status", "due_at", "remind_at", "owner", "tags", "attributes", "version", "created_at", "updated_at"}
+
+// exportFlushEvery is how many items are written between flushes of the response stream
+const exportFlushEvery = 100
+
+// csvTime formats an optional time for CSV, leaving the cell empty when it is not set
+func csvTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func itemCSVRecord(item models.Item) []string {
+	owner := ""
+	if item.Owner != nil {
+		owner = item.Owner.Email
+	}
+	attributes, _ := encoders.Marshal(item.Attributes)
+	return []string{strconv.Itoa(item.ID), item.Name, item.Description, item.Status,
+		csvTime(item.DueAt), csvTime(item.RemindAt), owner, strings.Join(item.Tags, ","),
+		string(attributes), strconv.Itoa(item.Version),
+		item.CreatedAt.Format(time.RFC3339), item.UpdatedAt.Format(time.RFC3339)}
+}
+
+// writeItemExport streams the items of rows in the given format. hasRow tells whether
+// rows is already positioned on the first item.
+func writeItemExport(w *bufio.Writer, format string, rows *sql.Rows, hasRow bool) error {
+	var csvWriter *csv.Writer
+	switch format {
+	case "csv":
+		csvWriter = csv.NewWriter(w)
+		if err := csvWriter.Write(itemCSVHeader); err != nil {
+			return err
+		}
+	case "json":
+		w.WriteByte('[')
+	}
+
+	for n := 0; hasRow; n++ {
+		var item models.Item
+		if err := scanItem(rows, &item); err != nil {
+			return err
+		}
+
+		if csvWriter != nil {
+			if err := csvWriter.Write(itemCSVRecord(item)); err != nil {
+				return err
+			}
+		} else {
+			encoded, err := encoders.Marshal(item)
+			if err != nil {
+				return err
+			}
+			if format == "json" && n > 0 {
+				w.WriteByte(',')
+			}
+			w.Write(encoded)
+			if format == "jsonl" {
+				w.WriteByte('\n')
+			}
+		}
+
+		// Flushing sends a chunk to the client and fails once it has gone away
+		if (n+1)%exportFlushEvery == 0 {
+			if csvWriter != nil {
+				csvWriter.Flush()
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+		hasRow = rows.Next()
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if csvWriter != nil {
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return err
+		}
+	}
+	if format == "json" {
+		w.WriteByte(']')
+	}
+	return w.Flush()
+}
+
+// ExportItems streams every item matching the listing options of GetItems as CSV, JSON
+// Lines or a JSON array. Paging options are ignored.
+func ExportItems(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		log.Debug().Err(err).Int("userId", userID).Msg("No active organization")
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
+	format := c.Query("format", "csv")
+	contentType, known := exportContentTypes[format]
+	if !known {
+		return c.Status(400).JSON(fiber.Map{"error": "format must be csv, jsonl or json"})
+	}
+
+	params, err := parseItemListParams(c)
+	if err != nil {
+		return err
+	}
+
+	if err := authorize(c, userID, "read_item", policy.Attributes{"type": "item", "organization_id": org.ID}); err != nil {
+		return err
+	}
+
+	// Exports need only the items themselves, not highlights or cursor keys
+	query := newItemQuery(userID, org, params)
+	query.columns = []string{itemColumns}
+
+	rows, err := dal.DB.Query(query.listSQL(), query.args...)
+	if err != nil && params.Search != "" && isSearchSyntaxError(err) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid search query"})
+	}
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Str("query", query.listSQL()).Msg("Database query failed while exporting items")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to export items"})
+	}
+
+	// Step to the first row so errors are still reported with a status code
+	hasRow := rows.Next()
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		if params.Search != "" && isSearchSyntaxError(err) {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid search query"})
+		}
+		log.Error().Err(err).Int("userId", userID).Msg("Failed to read exported items")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to export items"})
+	}
+
+	log.Info().Int("userId", userID).Str("format", format).Str("search", params.Search).Msg("Exporting items")
+
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderContentDisposition,
+		fmt.Sprintf(`attachment; filename="items-%s.%s"`, time.Now().UTC().Format("20060102"), format))
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer rows.Close()
+		if err := writeItemExport(w, format, rows, hasRow); err != nil {
+			log.Warn().Err(err).Int("userId", userID).Str("format", format).Msg("Item export stopped early")
+		}
+	})
+	return nil
+}
+
+const (
+	// importBatchSize is how many rows are checked and then written in one transaction
+	importBatchSize = 200
+
+	// maxImportErrors bounds the rejected rows listed in an import report
+	maxImportErrors = 100
+
+	// maxImportSize bounds an uploaded import file
+	maxImportSize = 100 << 20
+)
+
+// itemImportFields are the item fields an import row can set or be matched on
+var itemImportFields = []string{"id", "name", "description", "attributes", "version"}
+
+// importRow is one record of an import file, mapped to item fields
+type importRow struct {
+	Line   int
+	Fields map[string]string // Only the fields present in the record
+}
+
+// importRowError rejects one row without stopping the import
+type importRowError struct {
+	Field   string
+	Message string
+}
+
+func (e *importRowError) Error() string {
+	return e.Message
+}
+
+// importReader yields the rows of an import file and io.EOF after the last one. Errors
+// other than importRowError end the import.
+type importReader interface {
+	Next() (importRow, error)
+}
+
+// csvImportReader reads rows of a CSV file with a header row
+type csvImportReader struct {
+	r       *csv.Reader
+	columns map[string]int // Column index of each mapped item field
+}
+
+func newCSVImportReader(src io.Reader, mapping map[string]string, explicit map[string]bool) (*csvImportReader, error) {
+	r := csv.NewReader(src)
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "The file must start with a header row")
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		for _, field := range itemImportFields {
+			if _, taken := columns[field]; !taken && strings.EqualFold(name, mapping[field]) {
+				columns[field] = i
+			}
+		}
+	}
+	for field := range explicit {
+		if _, found := columns[field]; !found {
+			return nil, fiber.NewError(fiber.StatusBadRequest,
+				fmt.Sprintf("Column %q mapped to %s is not in the header", mapping[field], field))
+		}
+	}
+
+	return &csvImportReader{r: r, columns: columns}, nil
+}
+
+func (r *csvImportReader) Next() (importRow, error) {
+	record, err := r.r.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return importRow{Line: parseErr.StartLine}, fiber.NewError(fiber.StatusBadRequest, parseErr.Err.Error())
+		}
+		return importRow{}, err
+	}
+
+	line, _ := r.r.FieldPos(0)
+	row := importRow{Line: line, Fields: map[string]string{}}
+	for field, i := range r.columns {
+		if i < len(record) {
+			row.Fields[field] = record[i]
+		}
+	}
+	return row, nil
+}
+
+// jsonlImportReader reads rows of a JSON Lines file, one object per line
+type jsonlImportReader struct {
+	r       *bufio.Reader
+	line    int
+	mapping map[string]string
+}
+
+func (r *jsonlImportReader) Next() (importRow, error) {
+	for {
+		raw, err := r.r.ReadBytes('\n')
+		if len(raw) == 0 && err != nil {
+			return importRow{}, err
+		}
+		r.line++
+		if len(bytes.TrimSpace(raw)) == 0 {
+			continue
+		}
+
+		row := importRow{Line: r.line, Fields: map[string]string{}}
+		var record map[string]interface{}
+		if err := encoders.Unmarshal(raw, &record); err != nil {
+			return row, &importRowError{Message: "Each line must be a JSON object"}
+		}
+		for _, field := range itemImportFields {
+			value, present := record[r.mapping[field]]
+			if !present {
+				continue
+			}
+			switch v := value.(type) {
+			case nil:
+				row.Fields[field] = ""
+			case string:
+				row.Fields[field] = v
+			case float64:
+				row.Fields[field] = strconv.FormatFloat(v, 'f', -1, 64)
+			case map[string]interface{}:
+				encoded, err := encoders.Marshal(v)
+				if err != nil {
+					return row, err
+				}
+				row.Fields[field] = string(encoded)
+			default:
+				return row, &importRowError{Field: field, Message: r.mapping[field] + " must be a string or a number"}
+			}
+		}
+		return row, nil
+	}
+}
+
+// importTarget finds the live item of the organization a row is matched to by key,
+// returning 0 when there is none and the row creates an item
+func importTarget(org activeOrganization, key, value string) (int, error) {
+	if key == "" || value == "" {
+		return 0, nil
+	}
+
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	if key == "id" {
+		id, convErr := strconv.Atoi(value)
+		if convErr != nil {
+			return 0, &importRowError{Field: "id", Message: "id must be a number"}
+		}
+		rows, err = dal.DB.Query("SELECT id FROM items WHERE id = ? AND organization_id = ? AND "+itemLiveCondition,
+			id, org.ID)
+	} else {
+		rows, err = dal.DB.Query("SELECT id FROM items WHERE name = ? AND organization_id = ? AND "+itemLiveCondition+
+			" ORDER BY id LIMIT 2", value, org.ID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	switch len(ids) {
+	case 0:
+		return 0, nil
+	case 1:
+		return ids[0], nil
+	default:
+		return 0, fiber.NewError(fiber.StatusConflict, fmt.Sprintf("Several items are named %q", value))
+	}
+}
+
+// importOperation turns a row into the bulk operation it stands for
+func importOperation(org activeOrganization, row importRow, key string) (models.BulkItemOperation, error) {
+	op := models.BulkItemOperation{Op: "create"}
+	if name, present := row.Fields["name"]; present {
+		op.Name = &name
+	}
+	if description, present := row.Fields["description"]; present {
+		op.Description = &description
+	}
+	// Attributes come as a JSON object, in a CSV cell as text
+	if attributes := row.Fields["attributes"]; attributes != "" {
+		if err := encoders.Unmarshal([]byte(attributes), &op.Attributes); err != nil || op.Attributes == nil {
+			return op, &importRowError{Field: "attributes", Message: "attributes must be a JSON object"}
+		}
+	}
+
+	// A version makes an update conditional, as in a bulk operation
+	if version := row.Fields["version"]; version != "" {
+		var err error
+		if op.Version, err = strconv.Atoi(version); err != nil {
+			return op, &importRowError{Field: "version", Message: "version must be a number"}
+		}
+	}
+
+	id, err := importTarget(org, key, row.Fields[key])
+	if err != nil {
+		return op, err
+	}
+	if id != 0 {
+		op.Op, op.ID = "update", id
+	}
+	return op, nil
+}
+
+// parseImportMapping reads the mapping of item fields to source columns or members.
+// Fields that are not mapped keep their own name. It also returns the fields that were
+// mapped explicitly.
+func parseImportMapping(raw string) (map[string]string, map[string]bool, error) {
+	mapping := map[string]string{}
+	for _, field := range itemImportFields {
+		mapping[field] = field
+	}
+	explicit := map[string]bool{}
+	if raw == "" {
+		return mapping, explicit, nil
+	}
+
+	var given map[string]string
+	if err := encoders.Unmarshal([]byte(raw), &given); err != nil {
+		return nil, nil, fiber.NewError(fiber.StatusBadRequest, "mapping must be a JSON object of field names to column names")
+	}
+	for field, source := range given {
+		if _, known := mapping[field]; !known {
+			return nil, nil, fiber.NewError(fiber.StatusBadRequest,
+				fmt.Sprintf("Unknown field %q in mapping, expected one of %s", field, strings.Join(itemImportFields, ", ")))
+		}
+		if source == "" {
+			return nil, nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("The column mapped to %s must not be empty", field))
+		}
+		mapping[field], explicit[field] = source, true
+	}
+	return mapping, explicit, nil
+}
+
+// plannedImport is a checked row waiting to be written
+type plannedImport struct {
+	line int
+	op   models.BulkItemOperation
+}
+
+// ImportItems creates or updates items from an uploaded CSV or JSON Lines file. The file
+// is read row by row; rows are checked like bulk operations and written in batches, and
+// rejected rows are listed in the report without stopping the import.
+func ImportItems(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		log.Debug().Err(err).Int("userId", userID).Msg("No active organization")
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
+	tooLarge := "Import files must not be larger than 100MB"
+	if err := checkUploadLength(c, maxImportSize, tooLarge); err != nil {
+		return err
+	}
+	upload, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "A file must be uploaded in the file field"})
+	}
+	if upload.Size > maxImportSize {
+		return c.Status(413).JSON(fiber.Map{"error": tooLarge})
+	}
+
+	format := c.FormValue("format")
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(upload.Filename)) {
+		case ".csv":
+			format = "csv"
+		case ".jsonl", ".ndjson":
+			format = "jsonl"
+		}
+	}
+	if format != "csv" && format != "jsonl" {
+		return c.Status(400).JSON(fiber.Map{"error": "format must be csv or jsonl"})
+	}
+
+	key := c.FormValue("key")
+	if key != "" && key != "id" && key != "name" {
+		return c.Status(400).JSON(fiber.Map{"error": "key must be id or name"})
+	}
+
+	dryRun := false
+	if raw := c.FormValue("dry_run"); raw != "" {
+		if dryRun, err = strconv.ParseBool(raw); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "dry_run must be true or false"})
+		}
+	}
+
+	mapping, explicit, err := parseImportMapping(c.FormValue("mapping"))
+	if err != nil {
+		return err
+	}
+
+	file, err := upload.Open()
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Msg("Failed to open uploaded import file")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to read file"})
+	}
+	defer file.Close()
+
+	var reader importReader
+	if format == "csv" {
+		if reader, err = newCSVImportReader(file, mapping, explicit); err != nil {
+			return err
+		}
+	} else {
+		reader = &jsonlImportReader{r: bufio.NewReader(file), mapping: mapping}
+	}
+
+	report := models.ImportReport{DryRun: dryRun, Format: format, Key: key, Errors: []models.ImportError{}}
+	reject := func(line int, err error) {
+		importErr := models.ImportError{Line: line, Status: fiber.StatusInternalServerError,
+			Error: "Internal server error: failed to import row"}
+		var rowErr *importRowError
+		var fiberErr *fiber.Error
+		switch {
+		case errors.As(err, &rowErr):
+			importErr.Field, importErr.Status, importErr.Error = rowErr.Field, fiber.StatusBadRequest, rowErr.Message
+		case errors.As(err, &fiberErr):
+			importErr.Status, importErr.Error = fiberErr.Code, fiberErr.Message
+		default:
+			log.Error().Err(err).Int("userId", userID).Int("line", line).Msg("Failed to import row")
+		}
+		report.Failed++
+		if len(report.Errors) < maxImportErrors {
+			report.Errors = append(report.Errors, importErr)
+		} else {
+			report.ErrorsTruncated = true
+		}
+	}
+
+	// Rows are checked against committed items, then written together. A row whose key
+	// repeats one of the batch is only checked once the batch is written.
+	var batch []plannedImport
+	pendingKeys := map[string]bool{}
+
+	// Nothing a dry run writes is kept, so it remembers the items it created by key: a
+	// later row with the same key is counted as the update it would be
+	dryRunCreated := map[string]int{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		tx, err := dal.DB.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		for _, planned := range batch {
+			if _, err := tx.Exec("SAVEPOINT import_row"); err != nil {
+				return err
+			}
+			if item, _, err := executeBulkOperation(tx, userID, org, planned.op); err != nil {
+				reject(planned.line, err)
+				if _, err := tx.Exec("ROLLBACK TO import_row"); err != nil {
+					return err
+				}
+			} else if planned.op.Op == "create" {
+				report.Created++
+				if dryRun && key == "id" {
+					dryRunCreated[strconv.Itoa(item.ID)] = item.ID
+				} else if dryRun && key == "name" {
+					dryRunCreated[item.Name] = item.ID
+				}
+			} else {
+				report.Updated++
+			}
+			if _, err := tx.Exec("RELEASE import_row"); err != nil {
+				return err
+			}
+		}
+
+		batch, pendingKeys = batch[:0], map[string]bool{}
+		if dryRun {
+			return tx.Rollback()
+		}
+		return tx.Commit()
+	}
+
+	roleChecks := map[string]RolePermissionCheck{}
+	for {
+		row, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		var rowErr *importRowError
+		if err != nil && !errors.As(err, &rowErr) {
+			// The rest of the file cannot be read
+			reject(row.Line, err)
+			break
+		}
+		report.Rows++
+		if err != nil {
+			reject(row.Line, err)
+			continue
+		}
+
+		if keyValue := row.Fields[key]; key != "" && keyValue != "" {
+			if pendingKeys[keyValue] {
+				if err := flush(); err != nil {
+					log.Error().Err(err).Int("userId", userID).Msg("Failed to write imported items")
+					return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to import items"})
+				}
+			}
+			pendingKeys[keyValue] = true
+		}
+
+		op, err := importOperation(org, row, key)
+		if id := dryRunCreated[row.Fields[key]]; err == nil && op.Op == "create" && id != 0 {
+			// The item was created by the dry run, so the update is only validated
+			op.Op, op.ID = "update", id
+			if err = validateBulkOperation(op); err == nil {
+				report.Updated++
+				continue
+			}
+		} else if err == nil {
+			err = checkBulkOperation(c, userID, org, op, roleChecks)
+		}
+		if err != nil {
+			reject(row.Line, err)
+			continue
+		}
+
+		batch = append(batch, plannedImport{line: row.Line, op: op})
+		if len(batch) >= importBatchSize {
+			if err := flush(); err != nil {
+				log.Error().Err(err).Int("userId", userID).Msg("Failed to write imported items")
+				return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to import items"})
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		log.Error().Err(err).Int("userId", userID).Msg("Failed to write imported items")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to import items"})
+	}
+
+	// Rows rejected while writing a batch come after those rejected when read
+	sort.SliceStable(report.Errors, func(i, j int) bool { return report.Errors[i].Line < report.Errors[j].Line })
+
+	log.Info().
+		Int("userId", userID).
+		Str("format", format).
+		Bool("dryRun", dryRun).
+		Int("rows", report.Rows).
+		Int("created", report.Created).
+		Int("updated", report.Updated).
+		Int("failed", report.Failed).
+		Msg("Items imported")
+
+	return c.JSON(report)
+}
@@ -0,0 +1,389 @@
+package logic
+
+import (
+	"context"
+	"crudracula/dal"
+	"crudracula/models"
+	"crudracula/policy"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// defaultTrashRetention applies when TRASH_RETENTION is not set
+	defaultTrashRetention = "30d"
+
+	// trashPurgeInterval is how often expired items are looked for
+	trashPurgeInterval = time.Hour
+)
+
+// trashedItemColumns follow itemColumns when reading items in the trash
+const trashedItemColumns = `, items.deleted_at, items.deleted_by, deleter.email`
+
+// trashedItemJoin joins the user who moved each item to the trash
+const trashedItemJoin = "LEFT JOIN users deleter ON deleter.id = items.deleted_by"
+
+// trashRetention returns how long items stay in the trash, as set by TRASH_RETENTION
+// ("30d", "12h", ...). Zero means items are never purged automatically.
+func trashRetention() (string, time.Duration, error) {
+	raw := os.Getenv("TRASH_RETENTION")
+	if raw == "" {
+		raw = defaultTrashRetention
+	}
+	if raw == "0" {
+		return "", 0, nil
+	}
+	retention, err := policy.ParseDuration(raw)
+	if err != nil || retention < 0 {
+		return "", 0, fmt.Errorf("invalid TRASH_RETENTION %q", raw)
+	}
+	return raw, retention, nil
+}
+
+// purgeItems removes items and everything recorded about them for good. Foreign keys
+// are not enforced, so dependent rows are deleted explicitly. Stored attachment content
+// is left for removeUnusedBlobs once the transaction has committed.
+func purgeItems(tx *sql.Tx, ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	_, err := tx.Exec("DELETE FROM comment_mentions WHERE comment_id IN (SELECT id FROM comments WHERE item_id IN ("+
+		placeholders(len(ids))+"))", args...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM share_link_views WHERE share_link_id IN (SELECT id FROM share_links WHERE item_id IN ("+
+		placeholders(len(ids))+"))", args...)
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"item_shares", "item_revisions", "item_tags", "attachments", "comments", "item_transitions",
+		"item_reminders", "notifications", "share_links", "item_preferences"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE item_id IN ("+placeholders(len(ids))+")", args...); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("DELETE FROM item_links WHERE source_id IN ("+placeholders(len(ids))+") OR target_id IN ("+
+		placeholders(len(ids))+")", append(args, args...)...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM items WHERE id IN ("+placeholders(len(ids))+")", args...)
+	return err
+}
+
+// purgeExpiredTrash permanently deletes the items that were moved to the trash before
+// the retention period and returns how many there were
+func purgeExpiredTrash(retention time.Duration) (int, error) {
+	cutoff := time.Now().UTC().Add(-retention).Format(sqliteTimeLayout)
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id FROM items WHERE deleted_at IS NOT NULL AND deleted_at <= ?", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if err := purgeItems(tx, ids); err != nil {
+		return 0, err
+	}
+	return len(ids), tx.Commit()
+}
+
+// StartTrashPurger permanently deletes items once they have been in the trash for
+// longer than TRASH_RETENTION, checking at startup and then every hour
+func StartTrashPurger() {
+	raw, retention, err := trashRetention()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid trash retention")
+	}
+	if retention == 0 {
+		log.Info().Msg("Trash purging disabled")
+		return
+	}
+
+	purge := func() {
+		purged, err := purgeExpiredTrash(retention)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to purge trash")
+			return
+		}
+		if purged > 0 {
+			log.Info().Int("items", purged).Str("retention", raw).Msg("Purged expired items from trash")
+			removeUnusedBlobs(context.Background())
+		}
+	}
+
+	log.Info().Str("retention", raw).Msg("Trash purger started")
+	go func() {
+		purge()
+		ticker := time.NewTicker(trashPurgeInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			purge()
+		}
+	}()
+}
+
+// trashedItemRejected explains why a write to an item in the trash changed no rows
+func trashedItemRejected(c *fiber.Ctx, userID int, org activeOrganization, id, version int) error {
+	level, err := trashedItemAccessLevel(userID, org, id)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to resolve item access level")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to check item access"})
+	}
+	if level == "" {
+		return c.Status(404).JSON(fiber.Map{"error": "Item not found in trash"})
+	}
+	if version != 0 {
+		if current, err := loadItem(id); err == nil && current.Version != version {
+			return respondItemError(c, &errPreconditionFailed{Current: current})
+		}
+	}
+	return c.Status(403).JSON(fiber.Map{"error": "Insufficient access to item"})
+}
+
+// GetTrash lists the items in the trash the user could delete, most recently deleted first
+func GetTrash(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		log.Debug().Err(err).Int("userId", userID).Msg("No active organization")
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
+	page := 1
+	if p, err := strconv.Atoi(c.Query("page", "1")); err == nil && p > 1 {
+		page = p
+	}
+	perPage := defaultItemsPerPage
+	if raw := c.Query("per_page"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return c.Status(400).JSON(fiber.Map{"error": "per_page must be a positive number"})
+		}
+		perPage = min(n, maxItemsPerPage)
+	}
+
+	if err := authorize(c, userID, "read_item", policy.Attributes{"type": "item", "organization_id": org.ID}); err != nil {
+		return err
+	}
+
+	accessClause, accessArgs := trashedItemAccessClause(userID, org, AccessOwner)
+
+	var total int
+	if err := dal.DB.QueryRow("SELECT COUNT(*) FROM items WHERE "+accessClause, accessArgs...).Scan(&total); err != nil {
+		log.Error().Err(err).Int("userId", userID).Msg("Failed to count items in trash")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to count items"})
+	}
+
+	rows, err := dal.DB.Query("SELECT "+itemColumns+trashedItemColumns+
+		" FROM items "+itemOwnerJoin+" "+trashedItemJoin+
+		" WHERE "+accessClause+
+		" ORDER BY items.deleted_at DESC, items.id DESC LIMIT ? OFFSET ?",
+		append(accessArgs, perPage, (page-1)*perPage)...)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Msg("Failed to fetch items in trash")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch items"})
+	}
+	defer rows.Close()
+
+	items := []models.Item{}
+	for rows.Next() {
+		var (
+			item         models.Item
+			deletedAt    sql.NullTime
+			deletedBy    sql.NullInt64
+			deletedEmail sql.NullString
+		)
+		if err := scanItem(rows, &item, &deletedAt, &deletedBy, &deletedEmail); err != nil {
+			log.Error().Err(err).Int("userId", userID).Msg("Failed to scan item in trash")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch items"})
+		}
+		if deletedAt.Valid {
+			at := deletedAt.Time.UTC()
+			item.DeletedAt = &at
+		}
+		if deletedBy.Valid && deletedEmail.Valid {
+			item.DeletedBy = &models.ItemOwner{ID: int(deletedBy.Int64), Email: deletedEmail.String}
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		log.Error().Err(err).Int("userId", userID).Msg("Failed to iterate items in trash")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch items"})
+	}
+
+	retention, _, _ := trashRetention()
+	return c.JSON(models.TrashResponse{
+		Items:       items,
+		TotalItems:  total,
+		TotalPages:  (total + perPage - 1) / perPage,
+		CurrentPage: page,
+		PerPage:     perPage,
+		Retention:   retention,
+	})
+}
+
+// RestoreTrashedItem takes an item out of the trash
+func RestoreTrashedItem(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid ID"})
+	}
+
+	if err := authorizeTrashedItem(c, userID, org, id, "delete_item"); err != nil {
+		return err
+	}
+
+	version, err := checkItemIfMatch(c, id)
+	if err != nil {
+		return respondItemError(c, err)
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to restore item"})
+	}
+	defer tx.Rollback()
+
+	accessClause, accessArgs := trashedItemAccessClause(userID, org, AccessOwner)
+	result, err := tx.Exec(`
+		UPDATE items
+		SET deleted_at = NULL, deleted_by = NULL, version = version + 1
+		WHERE items.id = ? AND (? = 0 OR items.version = ?) AND `+accessClause,
+		append([]interface{}{id, version, version}, accessArgs...)...)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to restore item from trash")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to restore item"})
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		tx.Rollback()
+		return trashedItemRejected(c, userID, org, id, version)
+	}
+
+	restored, err := queryItem(tx, id)
+	if err == nil {
+		err = recordItemRevision(tx, userID, restored, RevisionRestore, nil)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to record restored item")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to restore item"})
+	}
+
+	log.Info().Int("userId", userID).Int("itemId", id).Msg("Item restored from trash")
+
+	c.Set(fiber.HeaderETag, restored.ETag)
+	return c.JSON(restored)
+}
+
+// PurgeItem permanently deletes an item from the trash, along with its history and grants
+func PurgeItem(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid ID"})
+	}
+
+	if err := authorizeTrashedItem(c, userID, org, id, "delete_item"); err != nil {
+		return err
+	}
+
+	version, err := checkItemIfMatch(c, id)
+	if err != nil {
+		return respondItemError(c, err)
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to delete item"})
+	}
+	defer tx.Rollback()
+
+	// The item must still be in the trash, at the expected version
+	accessClause, accessArgs := trashedItemAccessClause(userID, org, AccessOwner)
+	var found int
+	err = tx.QueryRow("SELECT COUNT(*) FROM items WHERE items.id = ? AND (? = 0 OR items.version = ?) AND "+accessClause,
+		append([]interface{}{id, version, version}, accessArgs...)...).Scan(&found)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to check item in trash")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to delete item"})
+	}
+	if found == 0 {
+		tx.Rollback()
+		return trashedItemRejected(c, userID, org, id, version)
+	}
+
+	if err = purgeItems(tx, []int{id}); err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to purge item")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to delete item"})
+	}
+
+	log.Info().Int("userId", userID).Int("itemId", id).Msg("Item permanently deleted")
+	removeUnusedBlobs(c.UserContext())
+	return c.SendStatus(204)
+}
@@ -0,0 +1,586 @@
+package logic
+
+import (
+	"crudracula/dal"
+	"crudracula/encoders"
+	"crudracula/models"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// maxWorkflowStates and maxWorkflowTransitions bound the size of a workflow
+	maxWorkflowStates      = 50
+	maxWorkflowTransitions = 200
+
+	// maxTransitionCommentLength bounds the comment recorded with a transition
+	maxTransitionCommentLength = 1000
+)
+
+// workflowNamePattern matches state and transition names, which fit VARCHAR(50)
+var workflowNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+// defaultWorkflow applies to organizations that have not configured their own. Its
+// initial state matches the default of items.status.
+func defaultWorkflow() models.Workflow {
+	return models.Workflow{
+		Initial: "open",
+		States: []models.WorkflowState{
+			{Name: "open", Label: "Open"},
+			{Name: "in_progress", Label: "In progress"},
+			{Name: "done", Label: "Done"},
+		},
+		Transitions: []models.WorkflowTransition{
+			{Name: "start", Label: "Start", From: []string{"open"}, To: "in_progress", Permission: "update_item"},
+			{Name: "stop", Label: "Stop", From: []string{"in_progress"}, To: "open", Permission: "update_item"},
+			{Name: "complete", Label: "Complete", From: []string{"open", "in_progress"}, To: "done", Permission: "update_item"},
+			{Name: "reopen", Label: "Reopen", From: []string{"done"}, To: "open", Permission: "update_item"},
+		},
+	}
+}
+
+// loadWorkflow returns the workflow of an organization
+func loadWorkflow(q rowQuerier, orgID int) (models.Workflow, error) {
+	var (
+		definition string
+		updatedAt  time.Time
+	)
+	err := q.QueryRow("SELECT definition, updated_at FROM workflows WHERE organization_id = ?", orgID).
+		Scan(&definition, &updatedAt)
+	if err == sql.ErrNoRows {
+		return defaultWorkflow(), nil
+	} else if err != nil {
+		return models.Workflow{}, err
+	}
+
+	var workflow models.Workflow
+	if err := encoders.Unmarshal([]byte(definition), &workflow); err != nil {
+		return workflow, err
+	}
+	updatedAt = updatedAt.UTC()
+	workflow.UpdatedAt = &updatedAt
+	return workflow, nil
+}
+
+// initialItemStatus is the status new items of an organization start in
+func initialItemStatus(q rowQuerier, orgID int) (string, error) {
+	workflow, err := loadWorkflow(q, orgID)
+	return workflow.Initial, err
+}
+
+func workflowHasState(workflow models.Workflow, name string) bool {
+	for _, state := range workflow.States {
+		if state.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func transitionStartsFrom(transition models.WorkflowTransition, status string) bool {
+	for _, from := range transition.From {
+		if from == status {
+			return true
+		}
+	}
+	return false
+}
+
+// validateWorkflow checks a workflow and fills in default labels and permissions
+func validateWorkflow(workflow *models.Workflow) error {
+	if len(workflow.States) == 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "A workflow needs at least one state")
+	}
+	if len(workflow.States) > maxWorkflowStates {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("A workflow can have at most %d states", maxWorkflowStates))
+	}
+	if len(workflow.Transitions) > maxWorkflowTransitions {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("A workflow can have at most %d transitions", maxWorkflowTransitions))
+	}
+
+	states := map[string]bool{}
+	for i := range workflow.States {
+		state := &workflow.States[i]
+		if !workflowNamePattern.MatchString(state.Name) {
+			return fiber.NewError(fiber.StatusBadRequest,
+				fmt.Sprintf("State name %q must start with a lowercase letter and contain only lowercase letters, digits and underscores", state.Name))
+		}
+		if states[state.Name] {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("State %q is listed twice", state.Name))
+		}
+		states[state.Name] = true
+		if state.Label = strings.TrimSpace(state.Label); state.Label == "" {
+			state.Label = state.Name
+		}
+	}
+
+	if workflow.Initial == "" {
+		workflow.Initial = workflow.States[0].Name
+	} else if !states[workflow.Initial] {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Initial state %q is not a state of the workflow", workflow.Initial))
+	}
+
+	permissions, err := permissionNames()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load permissions")
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal server error: failed to check permissions")
+	}
+
+	transitions := map[string]bool{}
+	for i := range workflow.Transitions {
+		transition := &workflow.Transitions[i]
+		if !workflowNamePattern.MatchString(transition.Name) {
+			return fiber.NewError(fiber.StatusBadRequest,
+				fmt.Sprintf("Transition name %q must start with a lowercase letter and contain only lowercase letters, digits and underscores", transition.Name))
+		}
+		if transitions[transition.Name] {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Transition %q is listed twice", transition.Name))
+		}
+		transitions[transition.Name] = true
+		if transition.Label = strings.TrimSpace(transition.Label); transition.Label == "" {
+			transition.Label = transition.Name
+		}
+
+		if !states[transition.To] {
+			return fiber.NewError(fiber.StatusBadRequest,
+				fmt.Sprintf("Transition %q leads to %q, which is not a state of the workflow", transition.Name, transition.To))
+		}
+		if len(transition.From) == 0 {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Transition %q needs at least one state to start from", transition.Name))
+		}
+		for _, from := range transition.From {
+			if !states[from] {
+				return fiber.NewError(fiber.StatusBadRequest,
+					fmt.Sprintf("Transition %q starts from %q, which is not a state of the workflow", transition.Name, from))
+			}
+			if from == transition.To {
+				return fiber.NewError(fiber.StatusBadRequest,
+					fmt.Sprintf("Transition %q cannot lead from %q to itself", transition.Name, from))
+			}
+		}
+
+		if transition.Permission == "" {
+			transition.Permission = "update_item"
+		} else if !permissions[transition.Permission] {
+			return fiber.NewError(fiber.StatusBadRequest,
+				fmt.Sprintf("Transition %q requires unknown permission %q", transition.Name, transition.Permission))
+		}
+	}
+	return nil
+}
+
+// permissionNames lists the permissions that exist
+func permissionNames() (map[string]bool, error) {
+	rows, err := dal.DB.Query("SELECT name FROM permissions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names[name] = true
+	}
+	return names, rows.Err()
+}
+
+// GetWorkflow returns the workflow of the active organization
+func GetWorkflow(c *fiber.Ctx) error {
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
+	workflow, err := loadWorkflow(dal.DB, org.ID)
+	if err != nil {
+		log.Error().Err(err).Int("organizationId", org.ID).Msg("Failed to fetch workflow")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch workflow"})
+	}
+	return c.JSON(workflow)
+}
+
+// UpdateWorkflow replaces the workflow of the active organization. Items in states the
+// new workflow drops must be moved with "migrate", which records the move in their
+// history and gives live items a new version.
+func UpdateWorkflow(c *fiber.Ctx) error {
+	userID, err := getUserIDFromToken(c)
+	if err != nil {
+		log.Debug().Err(err).Msg("Authentication failed")
+		return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+	if orgRoleRank[org.Role] < orgRoleRank[OrgRoleAdmin] {
+		return c.Status(403).JSON(fiber.Map{"error": "Only organization admins can change the workflow"})
+	}
+
+	var req models.WorkflowUpdateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+	}
+	workflow := req.Workflow
+	workflow.UpdatedAt = nil
+	if err := validateWorkflow(&workflow); err != nil {
+		return err
+	}
+	for from, to := range req.Migrate {
+		if workflowHasState(workflow, from) {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("State %q is kept, so its items cannot be migrated", from)})
+		}
+		if !workflowHasState(workflow, to) {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Items of %q cannot be migrated to %q, which is not a state of the workflow", from, to)})
+		}
+	}
+
+	definition, err := encoders.Marshal(workflow)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update workflow"})
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update workflow"})
+	}
+	defer tx.Rollback()
+
+	// Every status in use must survive or be migrated
+	rows, err := tx.Query("SELECT status, COUNT(*) FROM items WHERE organization_id = ? GROUP BY status", org.ID)
+	if err != nil {
+		log.Error().Err(err).Int("organizationId", org.ID).Msg("Failed to count item statuses")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update workflow"})
+	}
+	var unmapped []string
+	var migrated []string
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			rows.Close()
+			log.Error().Err(err).Msg("Failed to scan item status")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update workflow"})
+		}
+		switch {
+		case workflowHasState(workflow, status):
+		case req.Migrate[status] != "":
+			migrated = append(migrated, status)
+		default:
+			unmapped = append(unmapped, fmt.Sprintf("%s (%d items)", status, count))
+		}
+	}
+	rows.Close()
+	if len(unmapped) > 0 {
+		sort.Strings(unmapped)
+		return c.Status(409).JSON(fiber.Map{
+			"error": "Items are in states the workflow no longer has, map them to new states with migrate: " +
+				strings.Join(unmapped, ", "),
+		})
+	}
+
+	for _, from := range migrated {
+		if err := migrateItemStatus(tx, userID, org.ID, from, req.Migrate[from]); err != nil {
+			log.Error().Err(err).Int("organizationId", org.ID).Str("from", from).Msg("Failed to migrate item statuses")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update workflow"})
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO workflows (organization_id, definition, updated_by) VALUES (?, ?, ?)
+		ON CONFLICT (organization_id) DO UPDATE
+		SET definition = excluded.definition, updated_by = excluded.updated_by, updated_at = CURRENT_TIMESTAMP`,
+		org.ID, string(definition), userID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Error().Err(err).Int("organizationId", org.ID).Msg("Failed to update workflow")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to update workflow"})
+	}
+
+	updated, err := loadWorkflow(dal.DB, org.ID)
+	if err != nil {
+		log.Error().Err(err).Int("organizationId", org.ID).Msg("Failed to fetch workflow")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch workflow"})
+	}
+
+	log.Info().Int("userId", userID).Int("organizationId", org.ID).Int("states", len(updated.States)).
+		Strs("migrated", migrated).Msg("Workflow updated")
+	return c.JSON(updated)
+}
+
+// migrateItemStatus moves the items of an organization from a removed state
+func migrateItemStatus(tx *sql.Tx, userID, orgID int, from, to string) error {
+	rows, err := tx.Query("SELECT id FROM items WHERE organization_id = ? AND status = ?", orgID, from)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if _, err := tx.Exec("UPDATE items SET status = ? WHERE id = ?", to, id); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO item_transitions (item_id, from_status, to_status, comment, user_id)
+			VALUES (?, ?, ?, 'Workflow changed', ?)`, id, from, to, userID)
+		if err != nil {
+			return err
+		}
+	}
+	return touchItems(tx, userID, ids)
+}
+
+// transitionAccess is the item access a transition needs, which follows its permission
+func transitionAccess(transition models.WorkflowTransition) string {
+	if level, ok := itemPermissionAccess[transition.Permission]; ok {
+		return level
+	}
+	return AccessEditor
+}
+
+// authorizeTransition checks that the caller may perform a transition on an item
+func authorizeTransition(c *fiber.Ctx, userID int, org activeOrganization, id int, transition models.WorkflowTransition) error {
+	allowed, err := hasItemAccess(userID, org, id, transitionAccess(transition))
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to check item access")
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal server error: failed to check item access")
+	}
+	if !allowed {
+		return fiber.NewError(fiber.StatusForbidden, "Insufficient access to item")
+	}
+	return authorizeItem(c, userID, org, id, transition.Permission)
+}
+
+// chooseTransition finds the transition a request asks for from the item's status
+func chooseTransition(c *fiber.Ctx, userID int, org activeOrganization, id int, workflow models.Workflow,
+	status string, req models.TransitionRequest) (models.WorkflowTransition, error) {
+	if req.Transition != "" {
+		for _, transition := range workflow.Transitions {
+			if transition.Name != req.Transition {
+				continue
+			}
+			if req.To != "" && req.To != transition.To {
+				return transition, fiber.NewError(fiber.StatusBadRequest,
+					fmt.Sprintf("Transition %q leads to %q, not %q", transition.Name, transition.To, req.To))
+			}
+			if !transitionStartsFrom(transition, status) {
+				return transition, fiber.NewError(fiber.StatusConflict,
+					fmt.Sprintf("Transition %q cannot be performed from status %q", transition.Name, status))
+			}
+			return transition, authorizeTransition(c, userID, org, id, transition)
+		}
+		return models.WorkflowTransition{}, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Unknown transition %q", req.Transition))
+	}
+
+	// Any transition leading to the requested state will do, if the caller may use it
+	var denied error
+	for _, transition := range workflow.Transitions {
+		if transition.To != req.To || !transitionStartsFrom(transition, status) {
+			continue
+		}
+		if denied = authorizeTransition(c, userID, org, id, transition); denied == nil {
+			return transition, nil
+		}
+	}
+	if denied != nil {
+		return models.WorkflowTransition{}, denied
+	}
+	if !workflowHasState(workflow, req.To) {
+		return models.WorkflowTransition{}, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Unknown state %q", req.To))
+	}
+	return models.WorkflowTransition{}, fiber.NewError(fiber.StatusConflict,
+		fmt.Sprintf("No transition leads from %q to %q", status, req.To))
+}
+
+// TransitionItem moves an item to another state of the workflow, by naming either the
+// transition or the target state, and records the move in its status history
+func TransitionItem(c *fiber.Ctx) error {
+	userID, org, id, err := visibleItem(c)
+	if err != nil {
+		return err
+	}
+
+	var req models.TransitionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+	}
+	if req.Transition == "" && req.To == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "transition or to is required"})
+	}
+	req.Comment = strings.TrimSpace(req.Comment)
+	if utf8.RuneCountInString(req.Comment) > maxTransitionCommentLength {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Transition comments must not be longer than %d characters", maxTransitionCommentLength)})
+	}
+
+	workflow, err := loadWorkflow(dal.DB, org.ID)
+	if err != nil {
+		log.Error().Err(err).Int("organizationId", org.ID).Msg("Failed to fetch workflow")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to change status"})
+	}
+	current, err := loadItem(id)
+	if err != nil {
+		log.Error().Err(err).Int("itemId", id).Msg("Failed to fetch item")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to change status"})
+	}
+
+	transition, err := chooseTransition(c, userID, org, id, workflow, current.Status, req)
+	if err != nil {
+		return err
+	}
+
+	version, err := checkItemIfMatch(c, id)
+	if err != nil {
+		return respondItemError(c, err)
+	}
+
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start transaction")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to change status"})
+	}
+	defer tx.Rollback()
+
+	accessClause, accessArgs := itemAccessClause(userID, org, transitionAccess(transition))
+	result, err := tx.Exec(`
+		UPDATE items SET status = ?, version = version + 1
+		WHERE items.id = ? AND items.status = ? AND (? = 0 OR items.version = ?) AND `+accessClause,
+		append([]interface{}{transition.To, id, current.Status, version, version}, accessArgs...)...)
+	if err != nil {
+		log.Error().Err(err).Int("userId", userID).Int("itemId", id).Msg("Failed to change item status")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to change status"})
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		tx.Rollback()
+		if latest, err := loadItem(id); err == nil && latest.Status != current.Status && version == 0 {
+			return c.Status(409).JSON(fiber.Map{"error": fmt.Sprintf("The item's status changed to %q meanwhile", latest.Status)})
+		}
+		return itemWriteRejected(c, userID, org, id, version)
+	}
+
+	_, err = tx.Exec(`INSERT INTO item_transitions (item_id, transition, from_status, to_status, comment, user_id)
+		VALUES (?, ?, ?, ?, ?, ?)`, id, transition.Name, current.Status, transition.To, req.Comment, userID)
+	if err != nil {
+		log.Error().Err(err).Int("itemId", id).Msg("Failed to record item transition")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to change status"})
+	}
+
+	item, err := queryItem(tx, id)
+	if err == nil {
+		err = recordItemRevision(tx, userID, item, RevisionUpdate, nil)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Error().Err(err).Int("itemId", id).Msg("Failed to change item status")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to change status"})
+	}
+
+	log.Info().Int("userId", userID).Int("itemId", id).Str("transition", transition.Name).
+		Str("from", current.Status).Str("to", transition.To).Msg("Item status changed")
+	c.Set(fiber.HeaderETag, item.ETag)
+	return c.JSON(item)
+}
+
+// GetItemTransitions reports an item's status, the transitions the caller could
+// perform from it and its status history
+func GetItemTransitions(c *fiber.Ctx) error {
+	userID, id, err := readableItem(c)
+	if err != nil {
+		return err
+	}
+	org, err := getActiveOrganization(c)
+	if err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": "No active organization"})
+	}
+
+	workflow, err := loadWorkflow(dal.DB, org.ID)
+	if err != nil {
+		log.Error().Err(err).Int("organizationId", org.ID).Msg("Failed to fetch workflow")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch transitions"})
+	}
+	item, err := loadItem(id)
+	if err != nil {
+		log.Error().Err(err).Int("itemId", id).Msg("Failed to fetch item")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch transitions"})
+	}
+
+	response := models.ItemTransitions{
+		Status:    item.Status,
+		Available: []models.WorkflowTransition{},
+		History:   []models.ItemTransition{},
+	}
+	for _, transition := range workflow.Transitions {
+		if !transitionStartsFrom(transition, item.Status) {
+			continue
+		}
+		if err := authorizeTransition(c, userID, org, id, transition); err == nil {
+			response.Available = append(response.Available, transition)
+		} else if fiberErr, ok := err.(*fiber.Error); !ok || fiberErr.Code >= 500 {
+			return err
+		}
+	}
+
+	rows, err := dal.DB.Query(`
+		SELECT t.id, t.item_id, COALESCE(t.transition, ''), t.from_status, t.to_status, t.comment,
+			t.user_id, u.email, t.created_at
+		FROM item_transitions t
+		LEFT JOIN users u ON u.id = t.user_id
+		WHERE t.item_id = ?
+		ORDER BY t.id DESC`, id)
+	if err != nil {
+		log.Error().Err(err).Int("itemId", id).Msg("Failed to fetch item transitions")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch transitions"})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			entry     models.ItemTransition
+			userIDCol sql.NullInt64
+			email     sql.NullString
+		)
+		err := rows.Scan(&entry.ID, &entry.ItemID, &entry.Transition, &entry.From, &entry.To, &entry.Comment,
+			&userIDCol, &email, &entry.CreatedAt)
+		if err != nil {
+			log.Error().Err(err).Int("itemId", id).Msg("Failed to scan item transition")
+			return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch transitions"})
+		}
+		entry.CreatedAt = entry.CreatedAt.UTC()
+		if userIDCol.Valid && email.Valid {
+			entry.User = &models.ItemOwner{ID: int(userIDCol.Int64), Email: email.String}
+		}
+		response.History = append(response.History, entry)
+	}
+	if err := rows.Err(); err != nil {
+		log.Error().Err(err).Int("itemId", id).Msg("Failed to iterate item transitions")
+		return c.Status(500).JSON(fiber.Map{"error": "Internal server error: failed to fetch transitions"})
+	}
+
+	return c.JSON(response)
+}
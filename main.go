@@ -28,6 +28,36 @@ func main() {
 	defer dal.DB.Close()
 	log.Info().Msg("Database initialized successfully")
 
+	// Initialize authorization policies
+	logic.InitPolicies()
+
+	// Permanently delete items that stayed in the trash past the retention period
+	logic.StartTrashPurger()
+
+	// Configure blob storage for item attachments
+	logic.InitAttachments()
+
+	// Configure e-mail delivery of notifications and invitations
+	logic.InitNotifications()
+
+	// Deliver item reminders as they come due
+	logic.StartReminderScheduler()
+
+	app := newApp()
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "3000"
+	}
+
+	log.Info().Str("port", port).Msg("Server starting...")
+	if err := app.Listen(":" + port); err != nil {
+		log.Fatal().Err(err).Msg("Server failed to start")
+	}
+}
+
+// newApp configures the server with its middleware and routes
+func newApp() *fiber.App {
 	// Set Views Engine with proper configuration
 	engine := html.New("./views", ".html")
 	engine.Reload(true) // Enable reloading in development
@@ -40,13 +70,19 @@ func main() {
 		// Add proper JSON settings
 		JSONEncoder: encoders.Marshal,
 		JSONDecoder: encoders.Unmarshal,
+		// Bodies are streamed and multipart forms parsed on demand, so that uploads are
+		// spooled to disk; the limit is enforced by middlewares.BodyLimit
+		BodyLimit:                    fiber.DefaultBodyLimit,
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
 	})
 
 	// Enable CORS with specific configuration
 	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowMethods: "GET,POST,PUT,DELETE,OPTIONS",
-		AllowHeaders: "Origin, Content-Type, Accept, Authorization",
+		AllowOrigins:  "*",
+		AllowMethods:  "GET,POST,PUT,PATCH,DELETE,OPTIONS",
+		AllowHeaders:  "Origin, Content-Type, Accept, Authorization, X-Organization-ID, If-Match, If-None-Match, Range, If-Range, X-Share-Password",
+		ExposeHeaders: "ETag, Content-Range, Content-Disposition, Accept-Ranges",
 	}))
 
 	// Add request ID middleware first
@@ -55,8 +91,15 @@ func main() {
 	// Add request logging middleware
 	app.Use(requestLogger)
 
+	// Reject oversized bodies of every route but uploads, which check their own size
+	app.Use(middlewares.BodyLimit(fiber.DefaultBodyLimit))
+
 	// Enable Gzip Compression with proper settings
 	app.Use(compress.New(compress.Config{
+		// Partial content must be sent as stored
+		Next: func(c *fiber.Ctx) bool {
+			return c.Get(fiber.HeaderRange) != ""
+		},
 		Level: compress.LevelBestSpeed,
 	}))
 
@@ -84,6 +127,10 @@ func main() {
 	app.Get("/signup", logic.GetSignUpPage)
 	app.Get("/reset-password", logic.GetResetPasswordPage)
 
+	// Share links; anyone with the token may view the shared item
+	app.Get("/s/:token", logic.ViewSharedItem)
+	app.Post("/s/:token", logic.ViewSharedItem)
+
 	// Admin pages (protected by middleware)
 	adminPages := app.Group("/admin")
 	adminPages.Use(middlewares.AuthMiddleware)
@@ -100,18 +147,137 @@ func main() {
 	api := app.Group("/api")
 	api.Use(middlewares.AuthMiddleware)
 
-	// CRUD endpoints (protected by middleware)
+	// Organization endpoints (membership is checked per organization)
+	organizations := api.Group("/organizations")
+	organizations.Get("/", logic.GetOrganizations)
+	organizations.Post("/", logic.CreateOrganization)
+	organizations.Get("/:id", logic.GetOrganization)
+	organizations.Put("/:id", logic.UpdateOrganization)
+	organizations.Delete("/:id", logic.DeleteOrganization)
+	organizations.Post("/:id/switch", logic.SwitchOrganization)
+	organizations.Get("/:id/members", logic.GetOrganizationMembers)
+	organizations.Put("/:id/members/:userId", logic.UpdateOrganizationMember)
+	organizations.Delete("/:id/members/:userId", logic.RemoveOrganizationMember)
+	organizations.Get("/:id/invitations", logic.GetOrganizationInvitations)
+	organizations.Post("/:id/invitations", logic.CreateOrganizationInvitation)
+	organizations.Delete("/:id/invitations/:invitationId", logic.RevokeOrganizationInvitation)
+	api.Post("/invitations/accept", logic.AcceptOrganizationInvitation)
+
+	// CRUD endpoints (protected by middleware and scoped to the active organization)
 	items := api.Group("/items")
+	items.Use(middlewares.OrganizationMiddleware)
 	items.Get("/", middlewares.RequirePermission("read_item"), logic.GetItems)
+
+	// Batches check each operation's permission themselves
+	items.Post("/bulk", logic.BulkItems)
+	items.Get("/export", middlewares.RequirePermission("read_item"), logic.ExportItems)
+	items.Post("/import", logic.ImportItems)
+
+	// Trash (before /:id so "trash" is not taken for an item ID)
+	items.Get("/trash", middlewares.RequirePermission("read_item"), logic.GetTrash)
+	items.Post("/trash/:id/restore", middlewares.RequirePermission("delete_item"), logic.RestoreTrashedItem)
+	items.Delete("/trash/:id", middlewares.RequirePermission("delete_item"), logic.PurgeItem)
+
 	items.Get("/:id", middlewares.RequirePermission("read_item"), logic.GetItem)
 	items.Post("/", middlewares.RequirePermission("create_item"), logic.CreateItem)
+	items.Post("/:id/duplicate", middlewares.RequirePermission("create_item"), logic.DuplicateItem)
 	items.Put("/:id", middlewares.RequirePermission("update_item"), logic.UpdateItem)
+	items.Patch("/:id", middlewares.RequirePermission("update_item"), logic.PatchItem)
 	items.Delete("/:id", middlewares.RequirePermission("delete_item"), logic.DeleteItem)
 
+	// Item history
+	items.Get("/:id/revisions", middlewares.RequirePermission("read_item"), logic.GetItemRevisions)
+	items.Get("/:id/revisions/diff", middlewares.RequirePermission("read_item"), logic.DiffItemRevisions)
+	items.Get("/:id/revisions/:rev", middlewares.RequirePermission("read_item"), logic.GetItemRevision)
+	items.Post("/:id/revisions/:rev/restore", middlewares.RequirePermission("update_item"), logic.RestoreItemRevision)
+
+	// Item sharing endpoints
+	items.Get("/:id/shares", middlewares.RequirePermission("share_item"), logic.GetItemShares)
+	items.Post("/:id/shares", middlewares.RequirePermission("share_item"), logic.AddItemShare)
+	items.Delete("/:id/shares/:shareId", middlewares.RequirePermission("share_item"), logic.RemoveItemShare)
+
+	// Item tags
+	items.Post("/:id/tags", middlewares.RequirePermission("update_item"), logic.AddItemTags)
+	items.Put("/:id/tags", middlewares.RequirePermission("update_item"), logic.SetItemTags)
+	items.Delete("/:id/tags/:tag", middlewares.RequirePermission("update_item"), logic.RemoveItemTag)
+
+	// Item attachments
+	items.Get("/:id/attachments", middlewares.RequirePermission("read_item"), logic.GetItemAttachments)
+	items.Post("/:id/attachments", middlewares.RequirePermission("update_item"), logic.UploadItemAttachment)
+	items.Get("/:id/attachments/:attachmentId", middlewares.RequirePermission("read_item"), logic.DownloadItemAttachment)
+	items.Delete("/:id/attachments/:attachmentId", middlewares.RequirePermission("update_item"), logic.DeleteItemAttachment)
+
+	// Item comments; deleting checks comment_item or moderate_comments itself
+	items.Get("/:id/comments", middlewares.RequirePermission("read_item"), logic.GetItemComments)
+	items.Post("/:id/comments", middlewares.RequirePermission("comment_item"), logic.CreateItemComment)
+	items.Get("/:id/comments/:commentId", middlewares.RequirePermission("read_item"), logic.GetItemComment)
+	items.Get("/:id/comments/:commentId/replies", middlewares.RequirePermission("read_item"), logic.GetCommentReplies)
+	items.Put("/:id/comments/:commentId", middlewares.RequirePermission("comment_item"), logic.UpdateItemComment)
+	items.Delete("/:id/comments/:commentId", logic.DeleteItemComment)
+
+	// Item links; linking takes edit access to both items
+	items.Get("/:id/links", middlewares.RequirePermission("read_item"), logic.GetItemLinks)
+	items.Post("/:id/links", middlewares.RequirePermission("update_item"), logic.CreateItemLink)
+	items.Delete("/:id/links/:linkId", middlewares.RequirePermission("update_item"), logic.DeleteItemLink)
+
+	// Item share links
+	items.Get("/:id/share-links", middlewares.RequirePermission("share_item"), logic.GetShareLinks)
+	items.Post("/:id/share-links", middlewares.RequirePermission("share_item"), logic.CreateShareLink)
+	items.Delete("/:id/share-links/:linkId", middlewares.RequirePermission("share_item"), logic.RevokeShareLink)
+	items.Get("/:id/share-links/:linkId/views", middlewares.RequirePermission("share_item"), logic.GetShareLinkViews)
+
+	// The current user's pins, favorites and manual order
+	items.Get("/:id/preferences", middlewares.RequirePermission("read_item"), logic.GetItemPreferences)
+	items.Put("/:id/pin", middlewares.RequirePermission("read_item"), logic.PinItem)
+	items.Delete("/:id/pin", middlewares.RequirePermission("read_item"), logic.UnpinItem)
+	items.Put("/:id/favorite", middlewares.RequirePermission("read_item"), logic.FavoriteItem)
+	items.Delete("/:id/favorite", middlewares.RequirePermission("read_item"), logic.UnfavoriteItem)
+	items.Put("/:id/position", middlewares.RequirePermission("read_item"), logic.MoveItem)
+	items.Delete("/:id/position", middlewares.RequirePermission("read_item"), logic.ClearItemPosition)
+
+	// Item status; each transition checks the permission the workflow assigns to it
+	items.Get("/:id/transitions", middlewares.RequirePermission("read_item"), logic.GetItemTransitions)
+	items.Post("/:id/transitions", logic.TransitionItem)
+
+	// Organization tags; renames and merges are further limited to organization admins
+	tags := api.Group("/tags")
+	tags.Use(middlewares.OrganizationMiddleware)
+	tags.Get("/", middlewares.RequirePermission("read_item"), logic.GetTags)
+	tags.Put("/:id", middlewares.RequirePermission("update_item"), logic.RenameTag)
+	tags.Post("/:id/merge", middlewares.RequirePermission("update_item"), logic.MergeTag)
+
+	// Item templates; personal ones are only seen by their creator, and shared ones can
+	// be changed by their creator and organization admins
+	templates := api.Group("/templates")
+	templates.Use(middlewares.OrganizationMiddleware)
+	templates.Get("/", middlewares.RequirePermission("read_item"), logic.GetItemTemplates)
+	templates.Post("/", middlewares.RequirePermission("create_item"), logic.CreateItemTemplate)
+	templates.Get("/:id", middlewares.RequirePermission("read_item"), logic.GetItemTemplate)
+	templates.Put("/:id", middlewares.RequirePermission("create_item"), logic.UpdateItemTemplate)
+	templates.Delete("/:id", middlewares.RequirePermission("create_item"), logic.DeleteItemTemplate)
+	templates.Post("/:id/items", middlewares.RequirePermission("create_item"), logic.CreateItemFromTemplate)
+
+	// Custom item fields; changing them is further limited to organization admins
+	fields := api.Group("/fields")
+	fields.Use(middlewares.OrganizationMiddleware)
+	fields.Get("/", middlewares.RequirePermission("read_item"), logic.GetItemFields)
+	fields.Get("/schema", middlewares.RequirePermission("read_item"), logic.GetItemFieldSchema)
+	fields.Post("/", middlewares.RequirePermission("update_item"), logic.CreateItemField)
+	fields.Put("/:id", middlewares.RequirePermission("update_item"), logic.UpdateItemField)
+	fields.Delete("/:id", middlewares.RequirePermission("update_item"), logic.DeleteItemField)
+
+	// Status workflow; changing it is further limited to organization admins
+	workflow := api.Group("/workflow")
+	workflow.Use(middlewares.OrganizationMiddleware)
+	workflow.Get("/", middlewares.RequirePermission("read_item"), logic.GetWorkflow)
+	workflow.Put("/", middlewares.RequirePermission("update_item"), logic.UpdateWorkflow)
+
 	// Role management endpoints (protected + require manage_roles permission)
 	roles := api.Group("/roles")
 	roles.Use(middlewares.RequirePermission("manage_roles"))
 	roles.Get("/", logic.GetRoles)
+	roles.Get("/export", logic.ExportRoles)
+	roles.Post("/apply", logic.ApplyRoles)
 	roles.Get("/:id", logic.GetRole)
 	roles.Post("/", logic.CreateRole)
 	roles.Put("/:id", logic.UpdateRole)
@@ -119,19 +285,20 @@ func main() {
 
 	// Permission endpoints
 	permissions := api.Group("/permissions")
-	permissions.Use(middlewares.RequirePermission("manage_roles"))
-	permissions.Get("/", logic.GetPermissions)
-	permissions.Get("/check/:permission", logic.CheckPermission)
+	permissions.Get("/", middlewares.RequirePermission("manage_roles"), logic.GetPermissions)
+	permissions.Get("/check/:permission", middlewares.RequirePermission("manage_roles"), logic.CheckPermission)
+	permissions.Post("/explain", middlewares.RequirePermission("manage_roles"), logic.ExplainPermission)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "3000"
-	}
+	// Any authenticated user may check their own permissions
+	permissions.Post("/check", middlewares.OrganizationMiddleware, logic.CheckPermissions)
 
-	log.Info().Str("port", port).Msg("Server starting...")
-	if err := app.Listen(":" + port); err != nil {
-		log.Fatal().Err(err).Msg("Server failed to start")
-	}
+	// Notifications of the current user, such as item reminders
+	notifications := api.Group("/notifications")
+	notifications.Get("/", logic.GetNotifications)
+	notifications.Post("/read", logic.MarkAllNotificationsRead)
+	notifications.Post("/:id/read", logic.MarkNotificationRead)
+
+	return app
 }
 
 func requestLogger(c *fiber.Ctx) error {
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crudracula/dal"
+	"crudracula/logic"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// testApp serves the full route table against a fresh database in a temporary directory
+var testApp *fiber.App
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "crudracula-test")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+
+	dal.InitDB()
+	logic.InitPolicies()
+	logic.InitAttachments()
+	testApp = newApp()
+
+	code := m.Run()
+	dal.DB.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// apiRequest sends a request to the test app and returns the status and body
+func apiRequest(t *testing.T, method, path, token string, headers map[string]string, body string) (int, []byte) {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != "" {
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	}
+	if token != "" {
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := testApp.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: reading body: %v", method, path, err)
+	}
+	return resp.StatusCode, data
+}
+
+// mustRequest is apiRequest for calls that must succeed, decoding the response into out
+func mustRequest(t *testing.T, method, path, token string, headers map[string]string, body string, out interface{}) {
+	t.Helper()
+	status, data := apiRequest(t, method, path, token, headers, body)
+	if status < 200 || status > 299 {
+		t.Fatalf("%s %s: status %d: %s", method, path, status, data)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("%s %s: decoding %s: %v", method, path, data, err)
+		}
+	}
+}
+
+// emailCounter keeps the addresses of uniqueEmail apart within a run
+var emailCounter atomic.Int64
+
+// uniqueEmail returns an address for a user of the test that no other test or run of the
+// test against the same database has signed up with, as -count reruns tests in the process
+func uniqueEmail(t *testing.T, user string) string {
+	name := strings.ToLower(strings.NewReplacer("/", ".", " ", "_").Replace(t.Name()))
+	return fmt.Sprintf("%s+%s.%d@example.test", user, name, emailCounter.Add(1))
+}
+
+// signupUser registers a user with the admin role, so that global permissions never
+// hide what organization checks do, and returns a token for them
+func signupUser(t *testing.T, email string) string {
+	t.Helper()
+	credentials := fmt.Sprintf(`{"email": %q, "password": "password123"}`, email)
+	mustRequest(t, http.MethodPost, "/api/signup", "", nil, credentials, nil)
+	_, err := dal.DB.Exec("UPDATE users SET role_id = (SELECT id FROM roles WHERE name = 'admin') WHERE email = ?", email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var login struct {
+		Token string `json:"token"`
+	}
+	mustRequest(t, http.MethodPost, "/api/login", "", nil, credentials, &login)
+	return login.Token
+}
+
+// personalOrganization returns the ID of the personal organization of a user
+func personalOrganization(t *testing.T, email string) int {
+	t.Helper()
+	var id int
+	err := dal.DB.QueryRow("SELECT o.id FROM organizations o JOIN users u ON u.id = o.personal_user_id WHERE u.email = ?",
+		email).Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// createTestItem creates an item in the active organization of the token and returns its ID
+func createTestItem(t *testing.T, token string, headers map[string]string, name string) int {
+	t.Helper()
+	var item struct {
+		ID int `json:"id"`
+	}
+	mustRequest(t, http.MethodPost, "/api/items", token, headers, fmt.Sprintf(`{"name": %q}`, name), &item)
+	return item.ID
+}
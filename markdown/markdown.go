@@ -0,0 +1,381 @@
+// Package markdown renders the Markdown subset used in comments to HTML that is safe to
+// embed in a page. Raw HTML in the source is escaped rather than passed through, links
+// are limited to http, https and mailto URLs, and only the following is recognized:
+// paragraphs (single line breaks are kept), ATX headings, block quotes, bulleted and
+// numbered lists, fenced code blocks, thematic breaks, `code`, **strong**, *emphasis*,
+// ~~strikethrough~~, [links](https://example.com), bare http(s) URLs, backslash escapes
+// and @mentions of email addresses.
+package markdown
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MentionFunc resolves the email address of an @mention to a user ID. Mentions it does
+// not resolve are rendered as plain text.
+type MentionFunc func(email string) (int, bool)
+
+var (
+	headingPattern  = regexp.MustCompile(`^(#{1,6})[ \t]+(.*?)[ \t#]*$`)
+	bulletPattern   = regexp.MustCompile(`^[ \t]{0,3}[-*+][ \t]+(.*)$`)
+	orderedPattern  = regexp.MustCompile(`^[ \t]{0,3}(\d{1,9})[.)][ \t]+(.*)$`)
+	quotePattern    = regexp.MustCompile(`^[ \t]{0,3}>[ \t]?(.*)$`)
+	fencePattern    = regexp.MustCompile("^[ \t]{0,3}(```+|~~~+)[ \t]*([^`\\s]*)")
+	thematicPattern = regexp.MustCompile(`^[ \t]{0,3}((\*[ \t]*){3,}|(-[ \t]*){3,}|(_[ \t]*){3,})$`)
+	emailPattern    = regexp.MustCompile(`^[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`)
+	languagePattern = regexp.MustCompile(`^[A-Za-z0-9_+\-]+$`)
+)
+
+// Render converts Markdown source to sanitized HTML. mention may be nil, in which case
+// no mentions are resolved.
+func Render(source string, mention MentionFunc) string {
+	r := renderer{mention: mention}
+	lines := strings.Split(strings.ReplaceAll(strings.ReplaceAll(source, "\r\n", "\n"), "\r", "\n"), "\n")
+	r.blocks(lines)
+	return strings.TrimSuffix(r.out.String(), "\n")
+}
+
+type renderer struct {
+	out     strings.Builder
+	mention MentionFunc
+}
+
+// blocks renders a sequence of lines as block elements
+func (r *renderer) blocks(lines []string) {
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) > 0 {
+			r.out.WriteString("<p>")
+			for i, line := range paragraph {
+				if i > 0 {
+					r.out.WriteString("<br>\n")
+				}
+				r.out.WriteString(r.inline(strings.TrimSpace(line), false))
+			}
+			r.out.WriteString("</p>\n")
+			paragraph = nil
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			flush()
+
+		case fencePattern.MatchString(line):
+			flush()
+			match := fencePattern.FindStringSubmatch(line)
+			fence := match[1]
+			var code []string
+			for i++; i < len(lines); i++ {
+				if strings.HasPrefix(strings.TrimSpace(lines[i]), fence) && strings.Trim(strings.TrimSpace(lines[i]), fence[:1]) == "" {
+					break
+				}
+				code = append(code, lines[i])
+			}
+			r.out.WriteString("<pre><code")
+			if language := match[2]; languagePattern.MatchString(language) {
+				r.out.WriteString(` class="language-` + html.EscapeString(language) + `"`)
+			}
+			r.out.WriteString(">")
+			for _, line := range code {
+				r.out.WriteString(html.EscapeString(line) + "\n")
+			}
+			r.out.WriteString("</code></pre>\n")
+
+		case thematicPattern.MatchString(line):
+			flush()
+			r.out.WriteString("<hr>\n")
+
+		case headingPattern.MatchString(line):
+			flush()
+			match := headingPattern.FindStringSubmatch(line)
+			level := strconv.Itoa(len(match[1]))
+			r.out.WriteString("<h" + level + ">" + r.inline(match[2], false) + "</h" + level + ">\n")
+
+		case quotePattern.MatchString(line):
+			flush()
+			var quoted []string
+			for ; i < len(lines) && quotePattern.MatchString(lines[i]); i++ {
+				quoted = append(quoted, quotePattern.FindStringSubmatch(lines[i])[1])
+			}
+			i--
+			r.out.WriteString("<blockquote>\n")
+			r.blocks(quoted)
+			r.out.WriteString("</blockquote>\n")
+
+		case bulletPattern.MatchString(line), orderedPattern.MatchString(line):
+			flush()
+			i = r.list(lines, i) - 1
+
+		default:
+			paragraph = append(paragraph, line)
+		}
+	}
+	flush()
+}
+
+// list renders the list starting at lines[start] and returns the index of the first
+// line after it. Indented lines continue the previous entry.
+func (r *renderer) list(lines []string, start int) int {
+	pattern, tag := bulletPattern, "ul"
+	open := "<ul>\n"
+	if match := orderedPattern.FindStringSubmatch(lines[start]); match != nil {
+		pattern, tag = orderedPattern, "ol"
+		open = "<ol>\n"
+		if n, _ := strconv.Atoi(match[1]); n != 1 {
+			open = `<ol start="` + strconv.Itoa(n) + `">` + "\n"
+		}
+	}
+
+	var entries [][]string
+	i := start
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if match := pattern.FindStringSubmatch(line); match != nil {
+			entries = append(entries, []string{match[len(match)-1]})
+		} else if strings.TrimSpace(line) != "" && (line[0] == ' ' || line[0] == '\t') {
+			entries[len(entries)-1] = append(entries[len(entries)-1], strings.TrimSpace(line))
+		} else {
+			break
+		}
+	}
+
+	r.out.WriteString(open)
+	for _, entry := range entries {
+		r.out.WriteString("<li>")
+		for j, line := range entry {
+			if j > 0 {
+				r.out.WriteString("<br>\n")
+			}
+			r.out.WriteString(r.inline(line, false))
+		}
+		r.out.WriteString("</li>\n")
+	}
+	r.out.WriteString("</" + tag + ">\n")
+	return i
+}
+
+// inline renders the inline elements of a line. Inside link text, links are not
+// recognized again.
+func (r *renderer) inline(s string, inLink bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && isASCIIPunct(s[i+1]):
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '`':
+			run := countRun(s[i:], '`')
+			fence := s[i : i+run]
+			if end := strings.Index(s[i+run:], fence); end >= 0 {
+				code := s[i+run : i+run+end]
+				if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' {
+					code = code[1 : len(code)-1]
+				}
+				b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i += run + end + run
+				continue
+			}
+			b.WriteString(fence)
+			i += run
+			continue
+
+		case c == '[' && !inLink:
+			if text, href, n, ok := parseLink(s[i:]); ok {
+				b.WriteString(`<a href="` + html.EscapeString(href) + `" rel="nofollow noopener noreferrer">` +
+					r.inline(text, true) + "</a>")
+				i += n
+				continue
+			}
+
+		case (c == 'h' || c == 'H') && !inLink && atWordStart(s, i):
+			if href, n := autolink(s[i:]); n > 0 {
+				b.WriteString(`<a href="` + html.EscapeString(href) + `" rel="nofollow noopener noreferrer">` +
+					html.EscapeString(href) + "</a>")
+				i += n
+				continue
+			}
+
+		case c == '@' && atWordStart(s, i):
+			if email := emailPattern.FindString(s[i+1:]); email != "" {
+				email = strings.TrimRight(email, ".")
+				if r.mention != nil {
+					if userID, ok := r.mention(email); ok {
+						b.WriteString(`<span class="mention" data-user-id="` + strconv.Itoa(userID) + `">@` +
+							html.EscapeString(email) + "</span>")
+						i += 1 + len(email)
+						continue
+					}
+				}
+				b.WriteString("@" + html.EscapeString(email))
+				i += 1 + len(email)
+				continue
+			}
+
+		case c == '*' || c == '~':
+			if out, n := r.emphasis(s[i:], inLink); n > 0 {
+				b.WriteString(out)
+				i += n
+				continue
+			}
+			// A run that opens nothing is literal as a whole
+			run := countRun(s[i:], c)
+			b.WriteString(s[i : i+run])
+			i += run
+			continue
+		}
+
+		_, size := utf8.DecodeRuneInString(s[i:])
+		b.WriteString(html.EscapeString(s[i : i+size]))
+		i += size
+	}
+	return b.String()
+}
+
+// emphasis renders **strong**, *em* or ~~del~~ at the start of s and returns how many
+// bytes it consumed, or 0 when s does not start one
+func (r *renderer) emphasis(s string, inLink bool) (string, int) {
+	for _, delim := range []struct{ marker, tag string }{{"**", "strong"}, {"~~", "del"}, {"*", "em"}} {
+		if !strings.HasPrefix(s, delim.marker) {
+			continue
+		}
+		rest := s[len(delim.marker):]
+		if first, _ := utf8.DecodeRuneInString(rest); rest == "" || unicode.IsSpace(first) {
+			return "", 0
+		}
+		for from := 0; from < len(rest); {
+			end := strings.Index(rest[from:], delim.marker)
+			if end < 0 {
+				break
+			}
+			end += from
+			if escaped(rest, end) {
+				from = end + 1
+				continue
+			}
+			// A single * must not close on the first half of a **
+			if delim.marker == "*" && end+1 < len(rest) && rest[end+1] == '*' {
+				from = end + 2
+				continue
+			}
+			if last, _ := utf8.DecodeLastRuneInString(rest[:end]); end == 0 || unicode.IsSpace(last) {
+				from = end + len(delim.marker)
+				continue
+			}
+			return "<" + delim.tag + ">" + r.inline(rest[:end], inLink) + "</" + delim.tag + ">",
+				len(delim.marker) + end + len(delim.marker)
+		}
+		return "", 0
+	}
+	return "", 0
+}
+
+// parseLink reads [text](url) at the start of s. Only http, https and mailto URLs are
+// accepted.
+func parseLink(s string) (text, href string, n int, ok bool) {
+	depth := 0
+	closeText := -1
+	for i := 1; i < len(s) && closeText < 0; i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			depth++
+		case ']':
+			if depth == 0 {
+				closeText = i
+			}
+			depth--
+		}
+	}
+	if closeText <= 1 || closeText+1 >= len(s) || s[closeText+1] != '(' {
+		return "", "", 0, false
+	}
+	closeURL := strings.IndexByte(s[closeText+2:], ')')
+	if closeURL < 0 {
+		return "", "", 0, false
+	}
+	href = strings.TrimSpace(s[closeText+2 : closeText+2+closeURL])
+	href = strings.TrimSuffix(strings.TrimPrefix(href, "<"), ">")
+	if !safeURL(href) {
+		return "", "", 0, false
+	}
+	return s[1:closeText], href, closeText + 2 + closeURL + 1, true
+}
+
+// autolink reads a bare http(s) URL at the start of s, leaving out trailing punctuation
+func autolink(s string) (string, int) {
+	lower := strings.ToLower(s)
+	if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") {
+		return "", 0
+	}
+	end := strings.IndexFunc(s, func(r rune) bool { return unicode.IsSpace(r) || r == '<' || r == '>' || r == '"' })
+	if end < 0 {
+		end = len(s)
+	}
+	candidate := strings.TrimRight(s[:end], ".,:;!?'*~")
+	for strings.HasSuffix(candidate, ")") && strings.Count(candidate, "(") < strings.Count(candidate, ")") {
+		candidate = candidate[:len(candidate)-1]
+	}
+	if !safeURL(candidate) {
+		return "", 0
+	}
+	return candidate, len(candidate)
+}
+
+// safeURL accepts absolute http and https URLs with a host, and mailto URLs
+func safeURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return u.Host != ""
+	case "mailto":
+		return u.Opaque != ""
+	}
+	return false
+}
+
+// atWordStart reports whether s[i] does not continue a word, so that "a@b" and
+// "xhttp://" are not taken for a mention or link
+func atWordStart(s string, i int) bool {
+	if i == 0 {
+		return true
+	}
+	prev, _ := utf8.DecodeLastRuneInString(s[:i])
+	return !unicode.IsLetter(prev) && !unicode.IsDigit(prev) && prev != '_' && prev != '@' && prev != '.'
+}
+
+// escaped reports whether s[i] is preceded by an odd number of backslashes
+func escaped(s string, i int) bool {
+	n := 0
+	for i-n > 0 && s[i-n-1] == '\\' {
+		n++
+	}
+	return n%2 == 1
+}
+
+func countRun(s string, c byte) int {
+	n := 0
+	for n < len(s) && s[n] == c {
+		n++
+	}
+	return n
+}
+
+func isASCIIPunct(c byte) bool {
+	return c < utf8.RuneSelf && unicode.IsPunct(rune(c)) || strings.IndexByte("$+<=>^`|~", c) >= 0
+}
@@ -27,15 +27,16 @@ func AuthMiddleware(c *fiber.Ctx) error {
 		tokenString = auth[7:]
 	}
 
-	// Use the VerifyToken function from logic package
-	userID, err := logic.VerifyToken(tokenString)
+	// Use the ParseToken function from logic package
+	claims, err := logic.ParseToken(tokenString)
 	if err != nil {
 		log.Error().Err(err).Str("token", tokenString).Msg("Invalid token")
 		return c.Status(401).JSON(fiber.Map{"error": "User not authenticated"})
 	}
 
-	// Store user ID in context
-	c.Locals("userID", userID)
+	// Store user ID and the organization selected in the token in context
+	c.Locals("userID", claims.UserID)
+	c.Locals("tokenOrganizationID", claims.OrganizationID)
 	return c.Next()
 }
 
@@ -0,0 +1,43 @@
+package middlewares
+
+import (
+	"io"
+	"regexp"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// uploadPath matches the routes taking multipart uploads larger than the body limit,
+// whose handlers check the declared size of the upload themselves
+var uploadPath = regexp.MustCompile(`^/api/items/(import|\d+/attachments)/?$`)
+
+// BodyLimit rejects request bodies over limit bytes with 413. Request bodies are streamed
+// so that uploads can be spooled to disk, which lets them past the server's own limit;
+// every other route is held to it here. Bodies of unknown length are read up to the limit.
+func BodyLimit(limit int) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Method() == fiber.MethodPost && uploadPath.MatchString(c.Path()) {
+			return c.Next()
+		}
+
+		// The rest of a rejected body is never read, so the connection cannot be reused
+		tooLarge := fiber.NewError(fiber.StatusRequestEntityTooLarge, "Request body too large")
+		length := c.Request().Header.ContentLength()
+		if length > limit {
+			c.Context().SetConnectionClose()
+			return tooLarge
+		}
+		if stream := c.Context().RequestBodyStream(); length < 0 && stream != nil {
+			body, err := io.ReadAll(io.LimitReader(stream, int64(limit)+1))
+			if err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, "Failed to read request body")
+			}
+			if len(body) > limit {
+				c.Context().SetConnectionClose()
+				return tooLarge
+			}
+			c.Request().SetBody(body)
+		}
+		return c.Next()
+	}
+}
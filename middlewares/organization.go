@@ -0,0 +1,58 @@
+package middlewares
+
+import (
+	"crudracula/dal"
+	"database/sql"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// OrganizationMiddleware resolves the active organization for the request. The
+// X-Organization-ID header takes precedence over the token's org_id claim, and
+// the user's personal organization is used when neither is present.
+func OrganizationMiddleware(c *fiber.Ctx) error {
+	// Get user ID from context (set by AuthMiddleware)
+	userID, ok := c.Locals("userID").(int)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "User not authenticated")
+	}
+
+	orgID := 0
+	if header := c.Get("X-Organization-ID"); header != "" {
+		id, err := strconv.Atoi(header)
+		if err != nil || id < 1 {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid X-Organization-ID header")
+		}
+		orgID = id
+	} else if claimID, ok := c.Locals("tokenOrganizationID").(int); ok && claimID > 0 {
+		orgID = claimID
+	}
+
+	if orgID == 0 {
+		err := dal.DB.QueryRow("SELECT id FROM organizations WHERE personal_user_id = ?", userID).Scan(&orgID)
+		if err == sql.ErrNoRows {
+			return fiber.NewError(fiber.StatusForbidden, "No active organization")
+		} else if err != nil {
+			log.Error().Err(err).Int("userID", userID).Msg("Failed to get personal organization")
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to resolve organization")
+		}
+	}
+
+	// The user must be a member of the active organization
+	var role string
+	err := dal.DB.QueryRow(
+		"SELECT role FROM organization_members WHERE organization_id = ? AND user_id = ?",
+		orgID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return fiber.NewError(fiber.StatusForbidden, "Not a member of this organization")
+	} else if err != nil {
+		log.Error().Err(err).Int("userID", userID).Int("organizationID", orgID).Msg("Failed to get organization membership")
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to resolve organization")
+	}
+
+	c.Locals("organizationID", orgID)
+	c.Locals("organizationRole", role)
+	return c.Next()
+}
@@ -2,6 +2,7 @@ package middlewares
 
 import (
 	"crudracula/dal"
+	"crudracula/logic"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/rs/zerolog/log"
@@ -17,32 +18,17 @@ func RequirePermission(permissionName string) fiber.Handler {
 		}
 
 		// Check if user has the permission through their role
-		var roleID *int
-		err := dal.DB.QueryRow("SELECT role_id FROM users WHERE id = ?", userID).Scan(&roleID)
+		check, err := logic.CheckRolePermission(userID, permissionName)
 		if err != nil {
-			log.Error().Err(err).Int("userID", userID).Msg("Failed to get user role")
+			log.Error().Err(err).Int("userID", userID).Str("permission", permissionName).Msg("Failed to check permission")
 			return fiber.NewError(fiber.StatusInternalServerError, "Failed to check user permissions")
 		}
 
-		if roleID == nil {
+		if check.NoRole {
 			return fiber.NewError(fiber.StatusForbidden, "No role assigned to user")
 		}
 
-		var hasPermission bool
-		query := `
-			SELECT EXISTS(
-				SELECT 1 FROM role_permissions rp
-				JOIN permissions p ON rp.permission_id = p.id
-				WHERE rp.role_id = ? AND p.name = ?
-			)
-		`
-		err = dal.DB.QueryRow(query, roleID, permissionName).Scan(&hasPermission)
-		if err != nil {
-			log.Error().Err(err).Int("userID", userID).Str("permission", permissionName).Msg("Failed to check permission")
-			return fiber.NewError(fiber.StatusInternalServerError, "Failed to check user permissions")
-		}
-
-		if !hasPermission {
+		if !check.Allowed {
 			return fiber.NewError(fiber.StatusForbidden, "Permission denied")
 		}
 
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// Attachment is a file uploaded to an item. SHA256 is the hex digest of the content,
+// which is stored once however many attachments share it.
+type Attachment struct {
+	ID          int        `json:"id"`
+	ItemID      int        `json:"item_id"`
+	Filename    string     `json:"filename"`
+	ContentType string     `json:"content_type"`
+	Size        int64      `json:"size"`
+	SHA256      string     `json:"sha256"`
+	UploadedBy  *ItemOwner `json:"uploaded_by,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
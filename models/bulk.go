@@ -0,0 +1,39 @@
+package models
+
+// BulkItemRequest is a batch of item operations run in one transaction
+type BulkItemRequest struct {
+	Mode       string              `json:"mode"` // atomic (default) or best_effort
+	Operations []BulkItemOperation `json:"operations"`
+}
+
+// BulkItemOperation creates, updates or deletes one item. Updates change only the
+// fields given. Version, when set, must match the item's current version like If-Match.
+type BulkItemOperation struct {
+	Op          string                 `json:"op"`
+	ID          int                    `json:"id,omitempty"`
+	Name        *string                `json:"name,omitempty"`
+	Description *string                `json:"description,omitempty"`
+	Attributes  map[string]interface{} `json:"attributes,omitempty"` // Replaces all attributes when set
+	Version     int                    `json:"version,omitempty"`
+}
+
+// BulkItemResult is the outcome of one operation, with the HTTP status it would have had
+// as a single request
+type BulkItemResult struct {
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	Status int    `json:"status"`
+	ID     int    `json:"id,omitempty"`
+	Item   *Item  `json:"item,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BulkItemResponse reports every operation of a batch and whether it was committed
+type BulkItemResponse struct {
+	Mode      string           `json:"mode"`
+	Committed bool             `json:"committed"`
+	Succeeded int              `json:"succeeded"`
+	Failed    int              `json:"failed"`
+	Errors    []int            `json:"errors"` // Indices of the failed operations
+	Results   []BulkItemResult `json:"results"`
+}
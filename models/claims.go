@@ -5,7 +5,8 @@ import (
 )
 
 type Claims struct {
-	UserID int `json:"user_id"`
+	UserID         int `json:"user_id"`
+	OrganizationID int `json:"org_id,omitempty"` // Active organization selected by the user
 	jwt.RegisteredClaims
 }
 
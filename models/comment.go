@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// Comment is a remark on an item. Replies carry the ID of the comment that starts their
+// thread in ParentID. A deleted comment that still has replies is kept without its
+// content so that the thread stays in place.
+type Comment struct {
+	ID         int         `json:"id"`
+	ItemID     int         `json:"item_id"`
+	ParentID   *int        `json:"parent_id"`
+	Author     *ItemOwner  `json:"author,omitempty"`
+	Body       string      `json:"body"` // Markdown source
+	HTML       string      `json:"html"` // Rendered and sanitized body
+	Mentions   []ItemOwner `json:"mentions"`
+	ReplyCount int         `json:"reply_count"`
+	Deleted    bool        `json:"deleted,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+	EditedAt   *time.Time  `json:"edited_at,omitempty"`
+}
+
+// CommentRequest creates or edits a comment. ParentID is only read on creation.
+type CommentRequest struct {
+	Body     string `json:"body"`
+	ParentID *int   `json:"parent_id"`
+}
+
+// CommentsResponse is a page of the comments on an item, or of the replies to one,
+// oldest first
+type CommentsResponse struct {
+	Comments      []Comment `json:"comments"`
+	TotalComments int       `json:"totalComments"`
+	TotalPages    int       `json:"totalPages"`
+	CurrentPage   int       `json:"currentPage"`
+	PerPage       int       `json:"perPage"`
+}
@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// ItemField defines a custom attribute items of an organization may carry. For string
+// and url fields Min and Max bound the length, for number and integer fields the value.
+type ItemField struct {
+	ID          int           `json:"id"`
+	Name        string        `json:"name"`
+	Type        string        `json:"type"` // string, number, integer, boolean, date or url
+	Description string        `json:"description"`
+	Required    bool          `json:"required"`
+	Enum        []interface{} `json:"enum,omitempty"`
+	Min         *float64      `json:"min,omitempty"`
+	Max         *float64      `json:"max,omitempty"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+}
+
+// ItemFieldRequest creates or redefines a custom field. Names cannot change.
+type ItemFieldRequest struct {
+	Name        string        `json:"name"`
+	Type        string        `json:"type"`
+	Description string        `json:"description"`
+	Required    bool          `json:"required"`
+	Enum        []interface{} `json:"enum"`
+	Min         *float64      `json:"min"`
+	Max         *float64      `json:"max"`
+}
+
+// FieldError explains why one field of a request is invalid
+type FieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
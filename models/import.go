@@ -0,0 +1,25 @@
+package models
+
+// ImportReport summarizes an item import. With DryRun nothing was written and the counts
+// are what the import would have done.
+type ImportReport struct {
+	DryRun  bool          `json:"dry_run"`
+	Format  string        `json:"format"`
+	Key     string        `json:"key,omitempty"` // Field rows are matched to existing items by
+	Rows    int           `json:"rows"`
+	Created int           `json:"created"`
+	Updated int           `json:"updated"`
+	Failed  int           `json:"failed"`
+	Errors  []ImportError `json:"errors"`
+
+	// ErrorsTruncated is set when more rows failed than are listed in Errors
+	ErrorsTruncated bool `json:"errors_truncated,omitempty"`
+}
+
+// ImportError explains why a row of an import file was rejected
+type ImportError struct {
+	Line   int    `json:"line"` // Line of the file the row starts on
+	Field  string `json:"field,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
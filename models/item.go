@@ -1,7 +1,38 @@
 package models
 
+import "time"
+
 type Item struct {
-	ID          int    `json:"id"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
+	ID          int                    `json:"id"`
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Owner       *ItemOwner             `json:"owner,omitempty"`
+	Tags        []string               `json:"tags"`
+	Attributes  map[string]interface{} `json:"attributes"` // Custom fields, see ItemField
+	Status      string                 `json:"status"`     // A state of the organization's Workflow
+	DueAt       *time.Time             `json:"due_at"`
+	RemindAt    *time.Time             `json:"remind_at"` // When the owner is notified about the item
+	Version     int                    `json:"version"`
+	ETag        string                 `json:"etag"`
+	CreatedAt   time.Time              `json:"created_at"`
+	UpdatedAt   time.Time              `json:"updated_at"`
+	Highlight   *ItemHighlight         `json:"highlight,omitempty"`   // Set on full-text search results
+	Related     *ItemRelations         `json:"related,omitempty"`     // Set when GetItem is asked to include them
+	Preferences *ItemPreferences       `json:"preferences,omitempty"` // The user's own marks, set on listings
+
+	// Set on items in the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy *ItemOwner `json:"deleted_by,omitempty"`
+}
+
+// ItemOwner summarizes the user who created an item
+type ItemOwner struct {
+	ID    int    `json:"id"`
+	Email string `json:"email"`
+}
+
+// ItemHighlight holds HTML-escaped text of a search result with matches wrapped in <mark>
+type ItemHighlight struct {
+	Name    string `json:"name"`
+	Snippet string `json:"snippet"`
 }
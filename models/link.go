@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// ItemLink relates an item to another one. Relation tells how the item the link is
+// listed for relates to Item: parent_of, child_of, blocks, blocked_by or relates_to.
+type ItemLink struct {
+	ID        int        `json:"id"`
+	Relation  string     `json:"relation"`
+	Item      Item       `json:"item"`
+	CreatedBy *ItemOwner `json:"created_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// ItemLinkRequest links the item in the route to another item
+type ItemLinkRequest struct {
+	Relation string `json:"relation"`
+	ItemID   int    `json:"item_id"`
+}
+
+// ItemRelations embeds the items related to an item, as asked for with include. Lists
+// that were not asked for are left out.
+type ItemRelations struct {
+	Parent    *Item   `json:"parent,omitempty"`
+	Children  *[]Item `json:"children,omitempty"`
+	Blocks    *[]Item `json:"blocks,omitempty"`
+	BlockedBy *[]Item `json:"blocked_by,omitempty"`
+	Related   *[]Item `json:"related,omitempty"`
+}
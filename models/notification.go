@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// Notification is a message shown to a user in the app, such as an item reminder
+type Notification struct {
+	ID        int        `json:"id"`
+	Kind      string     `json:"kind"`
+	ItemID    *int       `json:"item_id,omitempty"`
+	Subject   string     `json:"subject"`
+	Body      string     `json:"body"`
+	ReadAt    *time.Time `json:"read_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// NotificationsResponse is a page of a user's notifications, newest first
+type NotificationsResponse struct {
+	Notifications      []Notification `json:"notifications"`
+	TotalNotifications int            `json:"totalNotifications"`
+	Unread             int            `json:"unread"` // Unread notifications in total, on any page
+	TotalPages         int            `json:"totalPages"`
+	CurrentPage        int            `json:"currentPage"`
+	PerPage            int            `json:"perPage"`
+}
@@ -2,7 +2,37 @@ package models
 
 type PaginatedResponse struct {
 	Items       []Item `json:"items"`
-	TotalItems  int    `json:"totalItems"`
-	TotalPages  int    `json:"totalPages"`
-	CurrentPage int    `json:"currentPage"`
+	TotalItems  *int   `json:"totalItems,omitempty"`  // Omitted with count=false
+	TotalPages  *int   `json:"totalPages,omitempty"`  // Omitted with count=false
+	CurrentPage int    `json:"currentPage,omitempty"` // Omitted when paging by cursor
+
+	// Opaque cursors for the pages after and before this one
+	NextCursor string `json:"nextCursor,omitempty"`
+	PrevCursor string `json:"prevCursor,omitempty"`
+
+	// The effective listing options, after defaults and limits were applied
+	PerPage    int          `json:"perPage"`
+	Sort       string       `json:"sort"`
+	Scope      string       `json:"scope"`
+	Search     string       `json:"search,omitempty"`
+	SearchMode string       `json:"searchMode"`
+	Filters    *ItemFilters `json:"filters,omitempty"`
+}
+
+// ItemFilters echoes the date, status, due, tag, preference and custom field filters applied to an items listing
+type ItemFilters struct {
+	CreatedAfter  string   `json:"createdAfter,omitempty"`
+	CreatedBefore string   `json:"createdBefore,omitempty"`
+	UpdatedAfter  string   `json:"updatedAfter,omitempty"`
+	UpdatedBefore string   `json:"updatedBefore,omitempty"`
+	Status        []string `json:"status,omitempty"`
+	Due           string   `json:"due,omitempty"`
+	TZ            string   `json:"tz,omitempty"`
+	Tags          []string `json:"tags,omitempty"`
+	TagMatch      string   `json:"tagMatch,omitempty"`
+	Pinned        *bool    `json:"pinned,omitempty"`
+	Favorite      *bool    `json:"favorite,omitempty"`
+
+	// Attributes maps custom field parameters without the attr. prefix to their values
+	Attributes map[string][]string `json:"attributes,omitempty"`
 }
@@ -0,0 +1,10 @@
+package models
+
+// PolicyExplainRequest asks how the policy engine would decide an action.
+// UserID defaults to the caller and OrganizationID to the user's personal organization.
+type PolicyExplainRequest struct {
+	UserID         *int                   `json:"user_id"`
+	OrganizationID *int                   `json:"organization_id"`
+	Action         string                 `json:"action"`
+	Resource       map[string]interface{} `json:"resource"`
+}
@@ -0,0 +1,17 @@
+package models
+
+// ItemPreferences are the marks a user puts on an item for themselves: pinned items can
+// be kept on top, favorites filtered for, and Position orders items by hand. Positions
+// are opaque keys that sort as strings; items without one were never placed.
+type ItemPreferences struct {
+	Pinned   bool    `json:"pinned"`
+	Favorite bool    `json:"favorite"`
+	Position *string `json:"position"`
+}
+
+// ItemPositionRequest places an item right before or after another item in the user's
+// manual order, or first when neither is given
+type ItemPositionRequest struct {
+	BeforeID int `json:"before_id"`
+	AfterID  int `json:"after_id"`
+}
@@ -0,0 +1,48 @@
+package models
+
+import "time"
+
+// ItemSnapshot is the content of an item recorded by a revision
+type ItemSnapshot struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Tags        *[]string `json:"tags,omitempty"` // Not recorded by revisions from before tags existed
+
+	// Attributes is nil for revisions from before items had custom fields
+	Attributes map[string]interface{} `json:"attributes"`
+
+	// Status and the schedule are recorded for reference; restoring a revision does not
+	// change them
+	Status   string     `json:"status,omitempty"`
+	DueAt    *time.Time `json:"due_at,omitempty"`
+	RemindAt *time.Time `json:"remind_at,omitempty"`
+}
+
+// ItemRevision is one entry of an item's history. Revision numbers match the item's
+// version after the change. Moving an item to the trash is recorded as a delete, and
+// taking it out again as a restore without restored_from.
+type ItemRevision struct {
+	ID           int          `json:"id"`
+	ItemID       int          `json:"item_id"`
+	Revision     int          `json:"revision"`
+	Action       string       `json:"action"` // create, update, delete or restore
+	RestoredFrom *int         `json:"restored_from,omitempty"`
+	Snapshot     ItemSnapshot `json:"snapshot"`
+	Author       *ItemOwner   `json:"author,omitempty"`
+	CreatedAt    time.Time    `json:"created_at"`
+}
+
+// FieldChange is a field that differs between two revisions
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// ItemRevisionDiff lists the fields changed between two revisions
+type ItemRevisionDiff struct {
+	ItemID  int           `json:"item_id"`
+	From    int           `json:"from"`
+	To      int           `json:"to"`
+	Changes []FieldChange `json:"changes"`
+}
@@ -45,3 +45,52 @@ type PermissionCheck struct {
 	UserID         int    `json:"user_id"`
 	PermissionName string `json:"permission_name"`
 }
+
+// PermissionCheckRequest asks which of several permissions the caller holds,
+// optionally for a specific resource
+type PermissionCheckRequest struct {
+	Permissions []string                 `json:"permissions"`
+	Resource    *PermissionCheckResource `json:"resource"`
+}
+
+type PermissionCheckResource struct {
+	Type string `json:"type"` // Only "item" is supported
+	ID   int    `json:"id"`
+}
+
+// PermissionCheckResult is the outcome of a single permission check
+type PermissionCheckResult struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason"`
+}
+
+// RBACDocument is the declarative form of all roles and their permissions,
+// suitable for keeping in version control
+type RBACDocument struct {
+	Version int              `json:"version" yaml:"version"`
+	Roles   []RoleDefinition `json:"roles" yaml:"roles"`
+}
+
+// RoleDefinition describes a role by name with the names of its permissions
+type RoleDefinition struct {
+	Name        string   `json:"name" yaml:"name"`
+	Description string   `json:"description" yaml:"description"`
+	Permissions []string `json:"permissions" yaml:"permissions"`
+}
+
+// RoleChange is one step of an RBAC plan
+type RoleChange struct {
+	Action             string   `json:"action"` // create, update, delete, unchanged or skip
+	Role               string   `json:"role"`
+	Description        *string  `json:"description,omitempty"` // New description when it changes
+	AddedPermissions   []string `json:"added_permissions,omitempty"`
+	RemovedPermissions []string `json:"removed_permissions,omitempty"`
+	Reason             string   `json:"reason,omitempty"` // Why a change was skipped
+}
+
+// RBACPlan lists the changes needed to make the database match an RBACDocument
+type RBACPlan struct {
+	Changes []RoleChange   `json:"changes"`
+	Summary map[string]int `json:"summary"`
+	Applied bool           `json:"applied"`
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// ItemShare grants a user or a role access to an item owned by someone else
+type ItemShare struct {
+	ID          int       `json:"id"`
+	ItemID      int       `json:"item_id"`
+	UserID      *int      `json:"user_id,omitempty"`
+	UserEmail   *string   `json:"user_email,omitempty"`
+	RoleID      *int      `json:"role_id,omitempty"`
+	RoleName    *string   `json:"role_name,omitempty"`
+	AccessLevel string    `json:"access_level"` // viewer, editor or owner
+	CreatedBy   int       `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ShareRequest is used for granting access to an item.
+// Exactly one of Email, UserID or RoleID must be set.
+type ShareRequest struct {
+	Email       string `json:"email"`
+	UserID      *int   `json:"user_id"`
+	RoleID      *int   `json:"role_id"`
+	AccessLevel string `json:"access_level"`
+}
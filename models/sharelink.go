@@ -0,0 +1,59 @@
+package models
+
+import "time"
+
+// ShareLink gives anyone with its URL read-only access to an item, without an account.
+// Only a hash of the token is stored, so the URL is returned once, on creation.
+type ShareLink struct {
+	ID          int        `json:"id"`
+	ItemID      int        `json:"item_id"`
+	Token       string     `json:"token,omitempty"`
+	URL         string     `json:"url,omitempty"`
+	HasPassword bool       `json:"has_password"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	MaxViews    *int       `json:"max_views"`
+	ViewCount   int        `json:"view_count"`
+	Active      bool       `json:"active"` // Neither revoked, expired nor used up
+	CreatedBy   *ItemOwner `json:"created_by,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+}
+
+// ShareLinkRequest creates a share link. ExpiresIn ("7d", "12h") is an alternative to
+// ExpiresAt.
+type ShareLinkRequest struct {
+	ExpiresAt *time.Time `json:"expires_at"`
+	ExpiresIn string     `json:"expires_in"`
+	Password  string     `json:"password"`
+	MaxViews  *int       `json:"max_views"`
+}
+
+// ShareLinkView is an entry of the access log of a share link
+type ShareLinkView struct {
+	ID        int       `json:"id"`
+	Outcome   string    `json:"outcome"` // viewed, or why access was refused
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ShareLinkViewsResponse is a page of the access log of a share link, newest first
+type ShareLinkViewsResponse struct {
+	Views       []ShareLinkView `json:"views"`
+	TotalViews  int             `json:"totalViews"`
+	TotalPages  int             `json:"totalPages"`
+	CurrentPage int             `json:"currentPage"`
+	PerPage     int             `json:"perPage"`
+}
+
+// SharedItem is what a share link shows of an item
+type SharedItem struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Status      string                 `json:"status"`
+	Tags        []string               `json:"tags"`
+	Attributes  map[string]interface{} `json:"attributes"`
+	DueAt       *time.Time             `json:"due_at"`
+	CreatedAt   time.Time              `json:"created_at"`
+	UpdatedAt   time.Time              `json:"updated_at"`
+}
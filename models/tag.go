@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// Tag labels items of an organization. Count is the number of items carrying it that
+// the current user can see.
+type Tag struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Count     int       `json:"count"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ItemTagsRequest lists tag names to add to an item or to replace its tags with
+type ItemTagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+type RenameTagRequest struct {
+	Name string `json:"name"`
+}
+
+// MergeTagRequest names the tag that takes over the items of the merged one
+type MergeTagRequest struct {
+	Into int `json:"into"`
+}
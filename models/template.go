@@ -0,0 +1,48 @@
+package models
+
+import "time"
+
+// ItemTemplate is a blueprint for new items. Personal templates are seen by their
+// creator only, shared ones by the whole organization. The item name, description, tags
+// and text attributes may contain placeholders such as {{date}} or {{user.email}}.
+type ItemTemplate struct {
+	ID          int                    `json:"id"`
+	Name        string                 `json:"name"`
+	Shared      bool                   `json:"shared"`
+	ItemName    string                 `json:"item_name"`
+	Description string                 `json:"description"`
+	Tags        []string               `json:"tags"`
+	Attributes  map[string]interface{} `json:"attributes"`
+	DueIn       string                 `json:"due_in"`    // Due date of new items relative to their creation, e.g. "7d"
+	RemindIn    string                 `json:"remind_in"` // Reminder of new items relative to their creation
+	CreatedBy   *ItemOwner             `json:"created_by,omitempty"`
+	CreatedAt   time.Time              `json:"created_at"`
+	UpdatedAt   time.Time              `json:"updated_at"`
+}
+
+// ItemTemplateRequest creates or replaces a template. On creation, ItemID fills the
+// item fields left out of the request from an existing item.
+type ItemTemplateRequest struct {
+	Name        string                 `json:"name"`
+	Shared      bool                   `json:"shared"`
+	ItemID      int                    `json:"item_id"`
+	ItemName    string                 `json:"item_name"`
+	Description string                 `json:"description"`
+	Tags        []string               `json:"tags"`
+	Attributes  map[string]interface{} `json:"attributes"`
+	DueIn       string                 `json:"due_in"`
+	RemindIn    string                 `json:"remind_in"`
+}
+
+// TemplateItemRequest creates an item from a template. Values fill the placeholders
+// that are not built in, and TZ is the time zone of date placeholders (UTC by default).
+type TemplateItemRequest struct {
+	Values map[string]string `json:"values"`
+	TZ     string            `json:"tz"`
+}
+
+// DuplicateItemRequest names the copy of an item; it defaults to the name of the
+// original followed by "(copy)"
+type DuplicateItemRequest struct {
+	Name *string `json:"name"`
+}
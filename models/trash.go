@@ -0,0 +1,11 @@
+package models
+
+// TrashResponse is a page of the items in the trash, most recently deleted first
+type TrashResponse struct {
+	Items       []Item `json:"items"`
+	TotalItems  int    `json:"totalItems"`
+	TotalPages  int    `json:"totalPages"`
+	CurrentPage int    `json:"currentPage"`
+	PerPage     int    `json:"perPage"`
+	Retention   string `json:"retention,omitempty"` // How long items stay in the trash; empty when never purged
+}
@@ -0,0 +1,62 @@
+package models
+
+import "time"
+
+// Workflow is the state machine an organization's items move through. New items start
+// in Initial and change state only through Transitions.
+type Workflow struct {
+	Initial     string               `json:"initial"`
+	States      []WorkflowState      `json:"states"`
+	Transitions []WorkflowTransition `json:"transitions"`
+	UpdatedAt   *time.Time           `json:"updated_at,omitempty"` // Omitted for the built-in default
+}
+
+type WorkflowState struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+}
+
+// WorkflowTransition moves an item from any of the From states to To. Only users
+// granted Permission may perform it.
+type WorkflowTransition struct {
+	Name       string   `json:"name"`
+	Label      string   `json:"label"`
+	From       []string `json:"from"`
+	To         string   `json:"to"`
+	Permission string   `json:"permission"`
+}
+
+// WorkflowUpdateRequest replaces a workflow. Migrate maps states that are removed to
+// the state their items move to.
+type WorkflowUpdateRequest struct {
+	Workflow
+	Migrate map[string]string `json:"migrate"`
+}
+
+// TransitionRequest names the transition to perform, or the state to move to
+type TransitionRequest struct {
+	Transition string `json:"transition"`
+	To         string `json:"to"`
+	Comment    string `json:"comment"`
+}
+
+// ItemTransition is one entry of an item's status history. Transition is empty when
+// the item was moved because its state was removed from the workflow.
+type ItemTransition struct {
+	ID         int        `json:"id"`
+	ItemID     int        `json:"item_id"`
+	Transition string     `json:"transition,omitempty"`
+	From       string     `json:"from"`
+	To         string     `json:"to"`
+	Comment    string     `json:"comment,omitempty"`
+	User       *ItemOwner `json:"user,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// ItemTransitions reports an item's status, the transitions the caller may perform from
+// it and its status history, most recent first
+type ItemTransitions struct {
+	Status    string               `json:"status"`
+	Available []WorkflowTransition `json:"available"`
+	History   []ItemTransition     `json:"history"`
+}
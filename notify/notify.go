@@ -0,0 +1,67 @@
+// Package notify delivers messages to users, such as the reminders of items, through
+// channels like e-mail. Messages are addressed by user ID and e-mail address so each
+// channel can use whichever it needs.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Message is a notification for one user
+type Message struct {
+	UserID  int
+	Email   string
+	Kind    string // What the message is about, e.g. "reminder"
+	ItemID  int    // The item the message is about, if any
+	Subject string
+	Body    string // Plain text
+}
+
+// Notifier is a delivery channel
+type Notifier interface {
+	Notify(ctx context.Context, msg Message) error
+}
+
+// Multi delivers a message through several channels. A failing channel does not keep
+// the message from the others; their errors are joined.
+type Multi []Notifier
+
+func (m Multi) Notify(ctx context.Context, msg Message) error {
+	var errs []error
+	for _, notifier := range m {
+		if err := notifier.Notify(ctx, msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FromEnv configures e-mail delivery through the SMTP server at SMTP_HOST and SMTP_PORT
+// (587 by default), authenticating with SMTP_USERNAME and SMTP_PASSWORD when set and
+// sending from SMTP_FROM. It returns nil when SMTP_HOST is not set.
+func FromEnv() (Notifier, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil, nil
+	}
+
+	config := SMTPConfig{
+		Host:     host,
+		Port:     587,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+	}
+	if raw := os.Getenv("SMTP_PORT"); raw != "" {
+		port, err := strconv.Atoi(raw)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid SMTP_PORT %q", raw)
+		}
+		config.Port = port
+	}
+	return NewSMTP(config)
+}
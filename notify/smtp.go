@@ -0,0 +1,86 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTPConfig locates an SMTP server and the sender of the messages
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string // No authentication when empty
+	Password string
+	From     string
+}
+
+// SMTP sends messages as plain text e-mail
+type SMTP struct {
+	addr string
+	auth smtp.Auth
+	from mail.Address
+}
+
+// NewSMTP checks the configuration of an SMTP notifier. Credentials are only sent over
+// TLS or to localhost.
+func NewSMTP(config SMTPConfig) (*SMTP, error) {
+	if config.Host == "" {
+		return nil, errors.New("SMTP host is required")
+	}
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP sender %q", config.From)
+	}
+
+	s := &SMTP{addr: net.JoinHostPort(config.Host, strconv.Itoa(config.Port)), from: *from}
+	if config.Username != "" {
+		s.auth = smtp.PlainAuth("", config.Username, config.Password, config.Host)
+	}
+	return s, nil
+}
+
+// Notify sends a message to the user's e-mail address. The context is not consulted
+// once the connection is made, as net/smtp does not support cancellation.
+func (s *SMTP) Notify(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	to, err := mail.ParseAddress(msg.Email)
+	if err != nil {
+		return fmt.Errorf("invalid recipient %q", msg.Email)
+	}
+
+	var buf bytes.Buffer
+	header := func(name, value string) {
+		buf.WriteString(name + ": " + value + "\r\n")
+	}
+	header("From", s.from.String())
+	header("To", to.String())
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "8bit")
+	buf.WriteString("\r\n")
+
+	// Bare line feeds are not allowed in SMTP data
+	body := strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n")
+	buf.WriteString(body)
+	if !strings.HasSuffix(body, "\r\n") {
+		buf.WriteString("\r\n")
+	}
+
+	if err := smtp.SendMail(s.addr, s.auth, s.from.Address, []string{to.Address}, buf.Bytes()); err != nil {
+		return fmt.Errorf("sending mail to %s: %w", to.Address, err)
+	}
+	return nil
+}
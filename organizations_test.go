@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crudracula/dal"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// itemRoute is an item route with {item}, {trashed} and sub-resource placeholders
+type itemRoute struct {
+	method string
+	path   string
+	body   string
+}
+
+// itemRoutes lists every route under /api/items that addresses a single item
+var itemRoutes = []itemRoute{
+	{http.MethodGet, "/api/items/{item}", ""},
+	{http.MethodPost, "/api/items/{item}/duplicate", "{}"},
+	{http.MethodPut, "/api/items/{item}", `{"name": "taken over", "description": ""}`},
+	{http.MethodPatch, "/api/items/{item}", ""},
+	{http.MethodDelete, "/api/items/{item}", ""},
+	{http.MethodPost, "/api/items/trash/{trashed}/restore", ""},
+	{http.MethodDelete, "/api/items/trash/{trashed}", ""},
+	{http.MethodGet, "/api/items/{item}/revisions", ""},
+	{http.MethodGet, "/api/items/{item}/revisions/diff?from=1&to=1", ""},
+	{http.MethodGet, "/api/items/{item}/revisions/1", ""},
+	{http.MethodPost, "/api/items/{item}/revisions/1/restore", ""},
+	{http.MethodGet, "/api/items/{item}/shares", ""},
+	{http.MethodPost, "/api/items/{item}/shares", `{"role_id": {role}, "access_level": "editor"}`},
+	{http.MethodDelete, "/api/items/{item}/shares/{share}", ""},
+	{http.MethodPost, "/api/items/{item}/tags", `{"tags": ["taken"]}`},
+	{http.MethodPut, "/api/items/{item}/tags", `{"tags": []}`},
+	{http.MethodDelete, "/api/items/{item}/tags/secret", ""},
+	{http.MethodGet, "/api/items/{item}/attachments", ""},
+	{http.MethodPost, "/api/items/{item}/attachments", ""},
+	{http.MethodGet, "/api/items/{item}/attachments/1", ""},
+	{http.MethodDelete, "/api/items/{item}/attachments/1", ""},
+	{http.MethodGet, "/api/items/{item}/comments", ""},
+	{http.MethodPost, "/api/items/{item}/comments", `{"body": "taken over"}`},
+	{http.MethodGet, "/api/items/{item}/comments/{comment}", ""},
+	{http.MethodGet, "/api/items/{item}/comments/{comment}/replies", ""},
+	{http.MethodPut, "/api/items/{item}/comments/{comment}", `{"body": "taken over"}`},
+	{http.MethodDelete, "/api/items/{item}/comments/{comment}", ""},
+	{http.MethodGet, "/api/items/{item}/links", ""},
+	{http.MethodPost, "/api/items/{item}/links", `{"relation": "relates_to", "item_id": {own}}`},
+	{http.MethodDelete, "/api/items/{item}/links/{link}", ""},
+	{http.MethodGet, "/api/items/{item}/share-links", ""},
+	{http.MethodPost, "/api/items/{item}/share-links", "{}"},
+	{http.MethodDelete, "/api/items/{item}/share-links/{shareLink}", ""},
+	{http.MethodGet, "/api/items/{item}/share-links/{shareLink}/views", ""},
+	{http.MethodGet, "/api/items/{item}/preferences", ""},
+	{http.MethodPut, "/api/items/{item}/pin", ""},
+	{http.MethodDelete, "/api/items/{item}/pin", ""},
+	{http.MethodPut, "/api/items/{item}/favorite", ""},
+	{http.MethodDelete, "/api/items/{item}/favorite", ""},
+	{http.MethodPut, "/api/items/{item}/position", ""},
+	{http.MethodDelete, "/api/items/{item}/position", ""},
+	{http.MethodGet, "/api/items/{item}/transitions", ""},
+	{http.MethodPost, "/api/items/{item}/transitions", `{"to": "closed"}`},
+}
+
+// collectionRoutes lists the routes under /api/items that address the organization
+var collectionRoutes = []itemRoute{
+	{http.MethodGet, "/api/items", ""},
+	{http.MethodPost, "/api/items", `{"name": "planted"}`},
+	{http.MethodPost, "/api/items/bulk", `{"operations": [{"op": "delete", "id": {item}}]}`},
+	{http.MethodGet, "/api/items/export?format=json", ""},
+	{http.MethodPost, "/api/items/import?format=json", `[{"id": {item}, "name": "taken over"}]`},
+	{http.MethodGet, "/api/items/trash", ""},
+}
+
+// TestItemRoutesStayWithinOrganization checks that no item route reads or changes an
+// item of an organization the caller is not a member of, whether the caller names that
+// organization in X-Organization-ID or addresses its item from their own organization
+func TestItemRoutesStayWithinOrganization(t *testing.T) {
+	const secret = "Tenant secret plan"
+	aliceEmail := uniqueEmail(t, "alice")
+	alice := signupUser(t, aliceEmail)
+	mallory := signupUser(t, uniqueEmail(t, "mallory"))
+	aliceOrg := personalOrganization(t, aliceEmail)
+
+	item := createTestItem(t, alice, nil, secret)
+	other := createTestItem(t, alice, nil, secret+" (other)")
+	trashed := createTestItem(t, alice, nil, secret+" (trashed)")
+	mustRequest(t, http.MethodDelete, "/api/items/"+strconv.Itoa(trashed), alice, nil, "", nil)
+	mustRequest(t, http.MethodPost, fmt.Sprintf("/api/items/%d/tags", item), alice, nil, `{"tags": ["secret"]}`, nil)
+
+	var comment, link, shareLink, share struct {
+		ID int `json:"id"`
+	}
+	mustRequest(t, http.MethodPost, fmt.Sprintf("/api/items/%d/comments", item), alice, nil, `{"body": "`+secret+`"}`, &comment)
+	mustRequest(t, http.MethodPost, fmt.Sprintf("/api/items/%d/links", item), alice, nil,
+		fmt.Sprintf(`{"relation": "relates_to", "item_id": %d}`, other), &link)
+	mustRequest(t, http.MethodPost, fmt.Sprintf("/api/items/%d/share-links", item), alice, nil, "{}", &shareLink)
+	var role int
+	if err := dal.DB.QueryRow("SELECT id FROM roles WHERE name = 'user'").Scan(&role); err != nil {
+		t.Fatal(err)
+	}
+	mustRequest(t, http.MethodPost, fmt.Sprintf("/api/items/%d/shares", item), alice, nil,
+		fmt.Sprintf(`{"role_id": %d, "access_level": "viewer"}`, role), &share)
+
+	own := createTestItem(t, mallory, nil, "Mallory's item")
+	fill := strings.NewReplacer(
+		"{item}", strconv.Itoa(item),
+		"{trashed}", strconv.Itoa(trashed),
+		"{comment}", strconv.Itoa(comment.ID),
+		"{link}", strconv.Itoa(link.ID),
+		"{shareLink}", strconv.Itoa(shareLink.ID),
+		"{share}", strconv.Itoa(share.ID),
+		"{role}", strconv.Itoa(role),
+		"{own}", strconv.Itoa(own),
+	)
+
+	for _, route := range append(append([]itemRoute{}, itemRoutes...), collectionRoutes...) {
+		path, body := fill.Replace(route.path), fill.Replace(route.body)
+		headers := map[string]string{"X-Organization-ID": strconv.Itoa(aliceOrg)}
+		if route.method == http.MethodPatch {
+			headers["Content-Type"] = "application/merge-patch+json"
+			body = `{"name": "taken over"}`
+		}
+
+		t.Run("foreign organization "+route.method+" "+route.path, func(t *testing.T) {
+			status, data := apiRequest(t, route.method, path, mallory, headers, body)
+			if status != http.StatusForbidden {
+				t.Errorf("status %d, want 403: %s", status, data)
+			}
+			if strings.Contains(string(data), secret) {
+				t.Errorf("response leaks the item: %s", data)
+			}
+		})
+	}
+
+	for _, route := range itemRoutes {
+		path, body := fill.Replace(route.path), fill.Replace(route.body)
+		var headers map[string]string
+		if route.method == http.MethodPatch {
+			headers = map[string]string{"Content-Type": "application/merge-patch+json"}
+			body = `{"name": "taken over"}`
+		}
+
+		t.Run("foreign item "+route.method+" "+route.path, func(t *testing.T) {
+			status, data := apiRequest(t, route.method, path, mallory, headers, body)
+			if status != http.StatusNotFound {
+				t.Errorf("status %d, want 404: %s", status, data)
+			}
+			if strings.Contains(string(data), secret) {
+				t.Errorf("response leaks the item: %s", data)
+			}
+		})
+	}
+
+	// Listings of Mallory's own organization never include Alice's items
+	for _, path := range []string{"/api/items", "/api/items?search=Tenant", "/api/items/trash", "/api/items/export?format=json"} {
+		_, data := apiRequest(t, http.MethodGet, path, mallory, nil, "")
+		if strings.Contains(string(data), secret) {
+			t.Errorf("GET %s leaks an item of another organization: %s", path, data)
+		}
+	}
+
+	// Nothing of Alice's was changed along the way
+	var current struct {
+		Name    string   `json:"name"`
+		Version int      `json:"version"`
+		Tags    []string `json:"tags"`
+	}
+	mustRequest(t, http.MethodGet, "/api/items/"+strconv.Itoa(item), alice, nil, "", &current)
+	if current.Name != secret || current.Version != 2 || len(current.Tags) != 1 {
+		t.Errorf("item changed by another organization: %+v", current)
+	}
+	status, _ := apiRequest(t, http.MethodGet, "/api/items/trash", alice, nil, "")
+	var trashCount, commentCount, shareCount int
+	dal.DB.QueryRow("SELECT COUNT(*) FROM items WHERE id = ? AND deleted_at IS NOT NULL", trashed).Scan(&trashCount)
+	dal.DB.QueryRow("SELECT COUNT(*) FROM comments WHERE item_id = ? AND body = ?", item, secret).Scan(&commentCount)
+	dal.DB.QueryRow("SELECT COUNT(*) FROM item_shares WHERE item_id = ? AND access_level = 'viewer'", item).Scan(&shareCount)
+	if status != http.StatusOK || trashCount != 1 || commentCount != 1 || shareCount != 1 {
+		t.Errorf("items changed by another organization: trash %d, comments %d, shares %d", trashCount, commentCount, shareCount)
+	}
+}
+
+// TestExplainPermissionRequiresMembership checks that the policy explainer does not
+// describe items of organizations the caller is not a member of
+func TestExplainPermissionRequiresMembership(t *testing.T) {
+	const secret = "Explained secret"
+	aliceEmail := uniqueEmail(t, "alice")
+	alice := signupUser(t, aliceEmail)
+	mallory := signupUser(t, uniqueEmail(t, "mallory"))
+	aliceOrg := personalOrganization(t, aliceEmail)
+	item := createTestItem(t, alice, nil, secret)
+
+	body := fmt.Sprintf(`{"action": "read_item", "organization_id": %d, "resource": {"type": "item", "id": %d}}`, aliceOrg, item)
+	status, data := apiRequest(t, http.MethodPost, "/api/permissions/explain", mallory, nil, body)
+	if status != http.StatusNotFound || strings.Contains(string(data), secret) {
+		t.Errorf("status %d, want 404 without the item: %s", status, data)
+	}
+
+	status, data = apiRequest(t, http.MethodPost, "/api/permissions/explain", alice, nil, body)
+	if status != http.StatusOK || !strings.Contains(string(data), secret) {
+		t.Errorf("status %d, want 200 with the item: %s", status, data)
+	}
+}
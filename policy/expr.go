@@ -0,0 +1,725 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The condition language is a small expression syntax evaluated against a Request:
+//
+//	subject.role == "editor" && resource.owner_id == subject.id
+//	env.now - resource.created_at <= duration("7d")
+//	action in ["update_item", "delete_item"] && !(resource.status == "archived")
+//
+// Identifiers resolve against subject, resource, env and action. Missing attributes
+// evaluate to null. Supported operators are || && ! == != < <= > >= in + - and
+// parentheses; literals are numbers, strings, true, false, null and [lists].
+// Functions: duration(s), time(s), len(x), lower(s), has(x).
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(src) {
+		ch := rune(src[i])
+		switch {
+		case unicode.IsSpace(ch):
+			i++
+		case unicode.IsDigit(ch):
+			start := i
+			for i < len(src) && (unicode.IsDigit(rune(src[i])) || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{tokNumber, src[start:i], start})
+		case ch == '"' || ch == '\'':
+			start := i
+			i++
+			var sb strings.Builder
+			for i < len(src) && rune(src[i]) != ch {
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+				}
+				sb.WriteByte(src[i])
+				i++
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			i++
+			tokens = append(tokens, token{tokString, sb.String(), start})
+		case unicode.IsLetter(ch) || ch == '_':
+			start := i
+			for i < len(src) && (unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i])) || src[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, token{tokIdent, src[start:i], start})
+		default:
+			if i+1 < len(src) {
+				two := src[i : i+2]
+				switch two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					tokens = append(tokens, token{tokOp, two, i})
+					i += 2
+					continue
+				}
+			}
+			if strings.ContainsRune("<>!+-().,[]", ch) {
+				tokens = append(tokens, token{tokOp, string(ch), i})
+				i++
+				continue
+			}
+			return nil, fmt.Errorf("unexpected character %q at %d", ch, i)
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(src)}), nil
+}
+
+// node is a compiled expression
+type node interface {
+	eval(req Request) (interface{}, error)
+}
+
+type literalNode struct{ value interface{} }
+
+type pathNode struct{ path []string }
+
+type listNode struct{ items []node }
+
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+type callNode struct {
+	name string
+	args []node
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// compile parses a condition expression
+func compile(src string) (node, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at %d", p.peek().text, p.peek().pos)
+	}
+	return n, nil
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isOp(ops ...string) bool {
+	t := p.peek()
+	if t.kind != tokOp && !(t.kind == tokIdent && t.text == "in") {
+		return false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.isOp(op) {
+		return fmt.Errorf("expected %q at %d", op, p.peek().pos)
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{"||", left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{"&&", left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.isOp("!") {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{"!", operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	if p.isOp("==", "!=", "<", "<=", ">", ">=", "in") {
+		op := p.next().text
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return &binaryNode{op, left, right}, nil
+	}
+	return left, nil
+}
+
+func (p *parser) parseAdditive() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("+", "-") {
+		op := p.next().text
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op, left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.isOp("-") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{"-", operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at %d", t.text, t.pos)
+		}
+		return &literalNode{f}, nil
+	case tokString:
+		return &literalNode{t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return &literalNode{true}, nil
+		case "false":
+			return &literalNode{false}, nil
+		case "null":
+			return &literalNode{nil}, nil
+		}
+		if p.isOp("(") {
+			p.next()
+			var args []node
+			for !p.isOp(")") {
+				arg, err := p.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, arg)
+				if !p.isOp(",") {
+					break
+				}
+				p.next()
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			if _, ok := functions[t.text]; !ok {
+				return nil, fmt.Errorf("unknown function %q at %d", t.text, t.pos)
+			}
+			return &callNode{t.text, args}, nil
+		}
+		path := []string{t.text}
+		for p.isOp(".") {
+			p.next()
+			part := p.next()
+			if part.kind != tokIdent {
+				return nil, fmt.Errorf("expected attribute name at %d", part.pos)
+			}
+			path = append(path, part.text)
+		}
+		switch path[0] {
+		case "subject", "resource", "env", "action":
+		default:
+			return nil, fmt.Errorf("unknown identifier %q at %d", path[0], t.pos)
+		}
+		return &pathNode{path}, nil
+	case tokOp:
+		switch t.text {
+		case "(":
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		case "[":
+			list := &listNode{}
+			for !p.isOp("]") {
+				item, err := p.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				list.items = append(list.items, item)
+				if !p.isOp(",") {
+					break
+				}
+				p.next()
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			return list, nil
+		}
+	}
+	if t.kind == tokEOF {
+		return nil, errors.New("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+func (n *literalNode) eval(req Request) (interface{}, error) { return n.value, nil }
+
+func (n *pathNode) eval(req Request) (interface{}, error) {
+	var current interface{}
+	switch n.path[0] {
+	case "subject":
+		current = req.Subject
+	case "resource":
+		current = req.Resource
+	case "env":
+		current = req.Environment
+	case "action":
+		current = req.Action
+	}
+	for _, part := range n.path[1:] {
+		attrs, ok := current.(Attributes)
+		if !ok {
+			if m, isMap := current.(map[string]interface{}); isMap {
+				attrs = m
+			} else {
+				return nil, nil
+			}
+		}
+		current = attrs[part]
+	}
+	return normalize(current), nil
+}
+
+func (n *listNode) eval(req Request) (interface{}, error) {
+	values := make([]interface{}, 0, len(n.items))
+	for _, item := range n.items {
+		v, err := item.eval(req)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func (n *unaryNode) eval(req Request) (interface{}, error) {
+	v, err := n.operand.eval(req)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "!":
+		return !truthy(v), nil
+	case "-":
+		switch x := v.(type) {
+		case float64:
+			return -x, nil
+		case time.Duration:
+			return -x, nil
+		}
+		return nil, fmt.Errorf("cannot negate %T", v)
+	}
+	return nil, fmt.Errorf("unknown operator %q", n.op)
+}
+
+func (n *binaryNode) eval(req Request) (interface{}, error) {
+	left, err := n.left.eval(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Short-circuit boolean operators
+	switch n.op {
+	case "&&":
+		if !truthy(left) {
+			return false, nil
+		}
+		right, err := n.right.eval(req)
+		return truthy(right), err
+	case "||":
+		if truthy(left) {
+			return true, nil
+		}
+		right, err := n.right.eval(req)
+		return truthy(right), err
+	}
+
+	right, err := n.right.eval(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "<", "<=", ">", ">=":
+		if left == nil || right == nil {
+			return false, nil
+		}
+		cmp, err := compare(left, right)
+		if err != nil {
+			return nil, err
+		}
+		switch n.op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		default:
+			return cmp >= 0, nil
+		}
+	case "in":
+		switch container := right.(type) {
+		case []interface{}:
+			for _, v := range container {
+				if equal(left, v) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case string:
+			s, ok := left.(string)
+			return ok && strings.Contains(container, s), nil
+		case nil:
+			return false, nil
+		}
+		return nil, fmt.Errorf("cannot use in with %T", right)
+	case "+":
+		return add(left, right)
+	case "-":
+		return subtract(left, right)
+	}
+	return nil, fmt.Errorf("unknown operator %q", n.op)
+}
+
+func (n *callNode) eval(req Request) (interface{}, error) {
+	args := make([]interface{}, 0, len(n.args))
+	for _, arg := range n.args {
+		v, err := arg.eval(req)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	return functions[n.name](args)
+}
+
+var functions = map[string]func(args []interface{}) (interface{}, error){
+	"duration": func(args []interface{}) (interface{}, error) {
+		s, err := stringArg("duration", args)
+		if err != nil {
+			return nil, err
+		}
+		return ParseDuration(s)
+	},
+	"time": func(args []interface{}) (interface{}, error) {
+		s, err := stringArg("time", args)
+		if err != nil {
+			return nil, err
+		}
+		return time.Parse(time.RFC3339, s)
+	},
+	"lower": func(args []interface{}) (interface{}, error) {
+		s, err := stringArg("lower", args)
+		if err != nil {
+			return nil, err
+		}
+		return strings.ToLower(s), nil
+	},
+	"len": func(args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, errors.New("len expects one argument")
+		}
+		switch v := args[0].(type) {
+		case string:
+			return float64(len(v)), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case nil:
+			return float64(0), nil
+		}
+		return nil, fmt.Errorf("len of %T", args[0])
+	},
+	"has": func(args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, errors.New("has expects one argument")
+		}
+		return args[0] != nil, nil
+	},
+}
+
+func stringArg(name string, args []interface{}) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("%s expects one argument", name)
+	}
+	s, ok := args[0].(string)
+	if !ok {
+		return "", fmt.Errorf("%s expects a string", name)
+	}
+	return s, nil
+}
+
+// ParseDuration parses a Go duration string, additionally accepting a "d" suffix for days
+func ParseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// normalize converts attribute values into the types understood by the evaluator
+func normalize(v interface{}) interface{} {
+	switch x := v.(type) {
+	case int:
+		return float64(x)
+	case int64:
+		return float64(x)
+	case *int:
+		if x == nil {
+			return nil
+		}
+		return float64(*x)
+	case *string:
+		if x == nil {
+			return nil
+		}
+		return *x
+	case *time.Time:
+		if x == nil {
+			return nil
+		}
+		return *x
+	case []string:
+		values := make([]interface{}, len(x))
+		for i, s := range x {
+			values[i] = s
+		}
+		return values
+	case []int:
+		values := make([]interface{}, len(x))
+		for i, n := range x {
+			values[i] = float64(n)
+		}
+		return values
+	}
+	return v
+}
+
+func truthy(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	case float64:
+		return x != 0
+	case string:
+		return x != ""
+	case []interface{}:
+		return len(x) > 0
+	}
+	return true
+}
+
+func equal(a, b interface{}) bool {
+	a, b = normalize(a), normalize(b)
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if ta, ok := a.(time.Time); ok {
+		tb, ok := b.(time.Time)
+		return ok && ta.Equal(tb)
+	}
+	if la, ok := a.([]interface{}); ok {
+		lb, ok := b.([]interface{})
+		if !ok || len(la) != len(lb) {
+			return false
+		}
+		for i := range la {
+			if !equal(la[i], lb[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	// Objects and other values that == would panic on are compared deeply
+	return reflect.DeepEqual(a, b)
+}
+
+func compare(a, b interface{}) (int, error) {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			return sign(x - y), nil
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), nil
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			return x.Compare(y), nil
+		}
+	case time.Duration:
+		if y, ok := b.(time.Duration); ok {
+			return sign(float64(x - y)), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %T with %T", a, b)
+}
+
+func sign(f float64) int {
+	switch {
+	case f < 0:
+		return -1
+	case f > 0:
+		return 1
+	}
+	return 0
+}
+
+func add(a, b interface{}) (interface{}, error) {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			return x + y, nil
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return x + y, nil
+		}
+	case time.Time:
+		if y, ok := b.(time.Duration); ok {
+			return x.Add(y), nil
+		}
+	case time.Duration:
+		switch y := b.(type) {
+		case time.Duration:
+			return x + y, nil
+		case time.Time:
+			return y.Add(x), nil
+		}
+	}
+	return nil, fmt.Errorf("cannot add %T and %T", a, b)
+}
+
+func subtract(a, b interface{}) (interface{}, error) {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			return x - y, nil
+		}
+	case time.Time:
+		switch y := b.(type) {
+		case time.Time:
+			return x.Sub(y), nil
+		case time.Duration:
+			return x.Add(-y), nil
+		}
+	case time.Duration:
+		if y, ok := b.(time.Duration); ok {
+			return x - y, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot subtract %T from %T", b, a)
+}
@@ -0,0 +1,220 @@
+package policy
+
+import (
+	"crudracula/encoders"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Attributes is a bag of named values describing a subject, resource or environment
+type Attributes map[string]interface{}
+
+// Request is a single authorization question: may Subject perform Action on Resource?
+type Request struct {
+	Subject     Attributes `json:"subject"`
+	Action      string     `json:"action"`
+	Resource    Attributes `json:"resource"`
+	Environment Attributes `json:"environment"`
+}
+
+type Effect string
+
+const (
+	Allow Effect = "allow"
+	Deny  Effect = "deny"
+)
+
+// Condition decides whether a Go-declared rule applies to a request
+type Condition func(req Request) (bool, error)
+
+// Rule allows or denies a set of actions when its condition holds. Conditions are
+// either Go functions (Match) or expressions in the condition language (Condition).
+type Rule struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Effect      Effect    `json:"effect"`
+	Actions     []string  `json:"actions"`             // Action names, "*" or a prefix such as "item*"
+	Condition   string    `json:"condition,omitempty"` // Empty means the rule always applies
+	Match       Condition `json:"-"`
+
+	compiled node
+}
+
+// RuleEvaluation records how a single rule responded to a request
+type RuleEvaluation struct {
+	Rule       string `json:"rule"`
+	Effect     Effect `json:"effect"`
+	Applicable bool   `json:"applicable"` // The rule covers the requested action
+	Matched    bool   `json:"matched"`    // The rule's condition held
+	Error      string `json:"error,omitempty"`
+}
+
+// Decision is the outcome of evaluating a request, with the rule that decided it
+type Decision struct {
+	Allowed     bool             `json:"allowed"`
+	Rule        string           `json:"rule,omitempty"`
+	Reason      string           `json:"reason"`
+	Evaluations []RuleEvaluation `json:"evaluations"`
+}
+
+// Engine evaluates requests against an ordered rule set. Any matching deny rule wins;
+// otherwise a matching allow rule grants access; otherwise access is denied.
+type Engine struct {
+	mu    sync.RWMutex
+	rules []Rule
+}
+
+// Default is the engine used by the application handlers
+var Default = &Engine{}
+
+// NewEngine validates and compiles the given rules
+func NewEngine(rules ...Rule) (*Engine, error) {
+	e := &Engine{}
+	if err := e.SetRules(rules); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// SetRules validates, compiles and replaces the engine's rules
+func (e *Engine) SetRules(rules []Rule) error {
+	compiled := make([]Rule, 0, len(rules))
+	seen := map[string]bool{}
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return fmt.Errorf("rule without a name")
+		}
+		if seen[rule.Name] {
+			return fmt.Errorf("duplicate rule %q", rule.Name)
+		}
+		seen[rule.Name] = true
+
+		if rule.Effect != Allow && rule.Effect != Deny {
+			return fmt.Errorf("rule %q: effect must be allow or deny", rule.Name)
+		}
+		if len(rule.Actions) == 0 {
+			return fmt.Errorf("rule %q: at least one action is required", rule.Name)
+		}
+		if rule.Condition != "" {
+			n, err := compile(rule.Condition)
+			if err != nil {
+				return fmt.Errorf("rule %q: %w", rule.Name, err)
+			}
+			rule.compiled = n
+		}
+		compiled = append(compiled, rule)
+	}
+
+	e.mu.Lock()
+	e.rules = compiled
+	e.mu.Unlock()
+	return nil
+}
+
+// Rules returns a copy of the engine's rules
+func (e *Engine) Rules() []Rule {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return append([]Rule(nil), e.rules...)
+}
+
+// Evaluate decides a request and explains the decision
+func (e *Engine) Evaluate(req Request) Decision {
+	e.mu.RLock()
+	rules := e.rules
+	e.mu.RUnlock()
+
+	decision := Decision{Evaluations: make([]RuleEvaluation, 0, len(rules))}
+	var allowedBy, deniedBy string
+
+	for _, rule := range rules {
+		eval := RuleEvaluation{Rule: rule.Name, Effect: rule.Effect}
+		if !rule.covers(req.Action) {
+			decision.Evaluations = append(decision.Evaluations, eval)
+			continue
+		}
+		eval.Applicable = true
+
+		matched, err := rule.matches(req)
+		if err != nil {
+			eval.Error = err.Error()
+			// Fail closed: a broken deny rule still denies, a broken allow rule never allows
+			matched = rule.Effect == Deny
+		}
+		eval.Matched = matched
+		decision.Evaluations = append(decision.Evaluations, eval)
+
+		if !matched {
+			continue
+		}
+		if rule.Effect == Deny && deniedBy == "" {
+			deniedBy = rule.Name
+		}
+		if rule.Effect == Allow && allowedBy == "" {
+			allowedBy = rule.Name
+		}
+	}
+
+	switch {
+	case deniedBy != "":
+		decision.Rule = deniedBy
+		decision.Reason = fmt.Sprintf("denied by rule %q", deniedBy)
+	case allowedBy != "":
+		decision.Allowed = true
+		decision.Rule = allowedBy
+		decision.Reason = fmt.Sprintf("allowed by rule %q", allowedBy)
+	default:
+		decision.Reason = "no rule allows this action"
+	}
+	return decision
+}
+
+func (r Rule) covers(action string) bool {
+	for _, a := range r.Actions {
+		if a == "*" || a == action {
+			return true
+		}
+		if strings.HasSuffix(a, "*") && strings.HasPrefix(action, strings.TrimSuffix(a, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rule) matches(req Request) (bool, error) {
+	if r.Match != nil {
+		ok, err := r.Match(req)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	if r.compiled != nil {
+		v, err := r.compiled.eval(req)
+		if err != nil {
+			return false, err
+		}
+		return truthy(v), nil
+	}
+	return true, nil
+}
+
+// policyFile is the on-disk format of declarative rules
+type policyFile struct {
+	Rules []Rule `json:"rules"`
+}
+
+// LoadFile reads declarative rules from a JSON file
+func LoadFile(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file policyFile
+	if err := encoders.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return file.Rules, nil
+}
@@ -0,0 +1,71 @@
+// Package storage keeps blobs, such as the files attached to items, on local disk or in
+// an S3-compatible object store. Keys are slash-separated paths chosen by the caller.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// ErrNotFound is returned when a blob does not exist
+var ErrNotFound = errors.New("blob not found")
+
+// Store is a blob storage backend
+type Store interface {
+	// Put stores size bytes read from body under key, replacing any blob stored there
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+
+	// Open reads length bytes of a blob starting at offset; a negative length reads to
+	// the end
+	Open(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+
+	// Delete removes a blob; deleting a missing blob is not an error
+	Delete(ctx context.Context, key string) error
+}
+
+// FromEnv configures the store selected by STORAGE_DRIVER. "local", the default, keeps
+// blobs under STORAGE_PATH (./attachments by default). "s3" keeps them in S3_BUCKET,
+// signed with S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY for S3_REGION. S3_ENDPOINT
+// points it at another S3-compatible service, which is then addressed path-style
+// unless S3_PATH_STYLE is false.
+func FromEnv() (Store, error) {
+	switch driver := os.Getenv("STORAGE_DRIVER"); driver {
+	case "", "local":
+		root := os.Getenv("STORAGE_PATH")
+		if root == "" {
+			root = "./attachments"
+		}
+		return NewLocal(root)
+
+	case "s3":
+		config := S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			PathStyle:       os.Getenv("S3_ENDPOINT") != "",
+		}
+		if raw := os.Getenv("S3_PATH_STYLE"); raw != "" {
+			pathStyle, err := strconv.ParseBool(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid S3_PATH_STYLE %q", raw)
+			}
+			config.PathStyle = pathStyle
+		}
+		return NewS3(config)
+
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_DRIVER %q, expected local or s3", driver)
+	}
+}
+
+// readCloser closes a reader that only reads part of a file
+type readCloser struct {
+	io.Reader
+	io.Closer
+}